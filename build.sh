@@ -7,6 +7,8 @@ versionflags="-X github.com/m-lab/msak/pkg/version.Version=$VERSION"
 
 COMMIT=$(git log -1 --format=%h)
 versionflags="${versionflags} -X github.com/m-lab/go/prometheusx.GitShortCommit=${COMMIT}"
+versionflags="${versionflags} -X github.com/m-lab/msak/pkg/version.GitCommit=$(git log -1 --format=%H)"
+versionflags="${versionflags} -X github.com/m-lab/msak/pkg/version.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
 
 go build -v \
     -tags netgo \
@@ -1,8 +1,10 @@
-// Package main implements a bare-bones minimal MSAK throughput1 client.
+// Package main implements a bare-bones minimal MSAK throughput1 client. It
+// runs a download by default, or an upload with -direction=upload.
 package main
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
@@ -14,6 +16,7 @@ import (
 	"net/url"
 	"path"
 	"runtime"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -28,6 +31,20 @@ const (
 	locateURL     = "https://locate.measurementlab.net/v2/nearest/"
 )
 
+// Binary message sizes used by the upload sender.
+//
+// Find the authoritative values in:
+// * github.com/m-lab/msak/pkg/throughput1/spec/spec.go
+const (
+	// minMessageSize is the initial size of binary messages.
+	minMessageSize = 1 << 10
+	// maxScaledMessageSize is the maximum size of binary messages.
+	maxScaledMessageSize = 1 << 20
+	// scalingFraction sets the threshold for scaling binary messages: the
+	// size doubles while it is at most 1/scalingFraction of the bytes sent.
+	scalingFraction = 16
+)
+
 var (
 	flagCC          = flag.String("cc", "bbr", "Congestion control algorithm to use")
 	flagDuration    = flag.Duration("duration", 5*time.Second, "Length of the last stream")
@@ -38,7 +55,9 @@ var (
 	flagMID         = flag.String("server.mid", uuid.NewString(), "Measurement ID to use")
 	flagScheme      = flag.String("locate.scheme", "wss", "Websocket scheme (wss or ws)")
 	flagLocateURL   = flag.String("locate.url", locateURL, "The base url for the Locate API")
+	flagLocateKey   = flag.String("locate.api-key", "", "API key for the Locate API")
 	flagStreams     = flag.Int("streams", 1, "The number of concurrent streams to create")
+	flagDirection   = flag.String("direction", "download", "Test direction (download or upload)")
 )
 
 // WireMeasurement is a wrapper for Measurement structs that contains
@@ -133,13 +152,24 @@ func prepareHeaders(ctx context.Context, s *url.URL) (string, http.Header) {
 	return s.String(), headers
 }
 
+// directionLabel returns the test direction, capitalized for logging.
+func directionLabel() string {
+	return strings.ToUpper((*flagDirection)[:1]) + (*flagDirection)[1:]
+}
+
 // formatMessage reports a WireMeasurement in a human readable format.
 func formatMessage(prefix string, stream int, m WireMeasurement) {
+	// The server sends bytes during downloads and receives them during
+	// uploads.
+	transferred := m.TCPInfo["BytesAcked"]
+	if *flagDirection == "upload" {
+		transferred = m.TCPInfo["BytesReceived"]
+	}
 	log.Printf("%s #%d rate: %0.2f Mbps, rtt %5.2fms, elapsed %0.4fs, application r/w: %d/%d, network r/w: %d/%d kernel* r/w: %d/%d\n",
 		prefix, stream,
-		8*float64(m.TCPInfo["BytesAcked"])/(float64(m.ElapsedTime)), // to mbps.
-		float64(m.TCPInfo["RTT"])/1000.0,                            // to ms.
-		float64(m.ElapsedTime)/1000000.0,                            // to sec.
+		8*float64(transferred)/(float64(m.ElapsedTime)), // to mbps.
+		float64(m.TCPInfo["RTT"])/1000.0,                // to ms.
+		float64(m.ElapsedTime)/1000000.0,                // to sec.
 		m.Application.BytesReceived, m.Application.BytesSent,
 		m.Network.BytesReceived, m.Network.BytesSent,
 		m.TCPInfo["BytesReceived"], m.TCPInfo["BytesAcked"],
@@ -153,6 +183,11 @@ func locateGetServers(ctx context.Context, userAgent, locate string) ([]Target,
 		return nil, err
 	}
 	u.Path = path.Join(u.Path, locate)
+	if *flagLocateKey != "" {
+		q := u.Query()
+		q.Set("key", *flagLocateKey)
+		u.RawQuery = q.Encode()
+	}
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
 	if err != nil {
 		return nil, err
@@ -179,14 +214,18 @@ func locateGetServers(ctx context.Context, userAgent, locate string) ([]Target,
 	return reply.Results, err
 }
 
-// getDownloadServer find a single server from given flags or Locate API.
-func getDownloadServer(ctx context.Context) (*url.URL, error) {
+// getServer find a single server from given flags or Locate API.
+func getServer(ctx context.Context) (*url.URL, error) {
 	// Use explicit server if provided.
 	if *flagServerURL != "" {
 		u, err := url.Parse(*flagServerURL)
 		if err != nil {
 			return nil, err
 		}
+		// Target the requested direction on the same server.
+		if base := path.Base(u.Path); base == "download" || base == "upload" {
+			u.Path = path.Join(path.Dir(u.Path), *flagDirection)
+		}
 		q := u.Query()
 		q.Set("mid", *flagMID)
 		u.RawQuery = q.Encode()
@@ -200,7 +239,7 @@ func getDownloadServer(ctx context.Context) (*url.URL, error) {
 	}
 	// Just use the first result.
 	for i := range targets {
-		srvurl := targets[i].URLs[*flagScheme+":///throughput/v1/download"]
+		srvurl := targets[i].URLs[*flagScheme+":///throughput/v1/"+*flagDirection]
 		// Get server url.
 		return url.Parse(srvurl)
 	}
@@ -221,7 +260,7 @@ type sharedResults struct {
 	lastStopTime     time.Time
 }
 
-func (s *sharedResults) download(ctx context.Context, u string, headers http.Header, wg *sync.WaitGroup, streamCount int, stream int) {
+func (s *sharedResults) run(ctx context.Context, u string, headers http.Header, wg *sync.WaitGroup, streamCount int, stream int) {
 	// Connect to server.
 	conn, _, err := localDialer.DialContext(ctx, u, headers)
 	if err != nil {
@@ -264,6 +303,21 @@ func (s *sharedResults) download(ctx context.Context, u string, headers http.Hea
 	conn.SetWriteDeadline(deadline)
 	conn.SetReadDeadline(deadline)
 
+	// During uploads, binary messages are sent while the server's
+	// measurements are received below.
+	if *flagDirection == "upload" {
+		senderDone := make(chan struct{})
+		go func() {
+			defer close(senderDone)
+			s.upload(ctx, conn)
+		}()
+		// Stop the sender once the receive loop is over.
+		defer func() {
+			conn.Close()
+			<-senderDone
+		}()
+	}
+
 outer:
 	// Receive text & binary messages from conn until the context expires or conn closes.
 	for {
@@ -293,7 +347,9 @@ outer:
 					log.Println("error", err)
 					return
 				}
-				s.bytesTotal.Add(int64(len(data)))
+				if *flagDirection == "download" {
+					s.bytesTotal.Add(int64(len(data)))
+				}
 
 				var m WireMeasurement
 				if err := json.Unmarshal(data, &m); err != nil {
@@ -308,11 +364,12 @@ outer:
 				switch {
 				case streamCount == 1:
 					// Use server metrics for single stream tests.
-					formatMessage("Download server", 1, m)
+					formatMessage(directionLabel()+" server", 1, m)
 				case streamCount > 1 && stream == 0:
 					// Only do this for one stream.
 					elapsed := time.Since(s.firstStartTime)
-					log.Printf("Download stream #1 rate: %0.2f Mbps, MinRTT %5.2fms, elapsed %0.4fs, application r/w: %d/%d\n",
+					log.Printf("%s stream #1 rate: %0.2f Mbps, MinRTT %5.2fms, elapsed %0.4fs, application r/w: %d/%d\n",
+						directionLabel(),
 						8*float64(s.bytesTotal.Load())/1e6/elapsed.Seconds(), // as mbps.
 						float64(s.minRTT.Load())/1000.0,                      // as ms.
 						elapsed.Seconds(), 0, s.bytesTotal.Load())
@@ -322,9 +379,58 @@ outer:
 	}
 }
 
+// upload sends binary messages on conn until ctx is done, the byte limit is
+// reached or the server closes the connection. As in the reference sender,
+// messages start at minMessageSize bytes and double in size while they are at
+// most 1/scalingFraction of the bytes sent so far, up to maxScaledMessageSize.
+func (s *sharedResults) upload(ctx context.Context, conn *websocket.Conn) {
+	size := minMessageSize
+	message, err := newMessage(size)
+	if err != nil {
+		log.Println("error", err)
+		return
+	}
+	sent := 0
+	for ctx.Err() == nil {
+		if err := conn.WritePreparedMessage(message); err != nil {
+			// The server closes the connection at the end of the test.
+			return
+		}
+		sent += size
+		s.bytesTotal.Add(int64(size))
+		if *flagByteLimit > 0 && sent >= *flagByteLimit {
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+				time.Now().Add(time.Second))
+			return
+		}
+		if size < maxScaledMessageSize && size <= sent/scalingFraction {
+			size *= 2
+			if message, err = newMessage(size); err != nil {
+				log.Println("error", err)
+				return
+			}
+		}
+	}
+}
+
+// newMessage returns a binary message of the given size filled with random
+// bytes. Preparing it once avoids framing it again on every write.
+func newMessage(size int) (*websocket.PreparedMessage, error) {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		return nil, err
+	}
+	return websocket.NewPreparedMessage(websocket.BinaryMessage, data)
+}
+
 func main() {
 	flag.Parse()
 
+	if *flagDirection != "download" && *flagDirection != "upload" {
+		log.Fatal("Invalid configuration: the direction must be download or upload.")
+	}
+
 	if *flagStreams < 1 || *flagStreams > 4 {
 		log.Fatal("Invalid configuration: the number of streams must be between 1 and 4.")
 	}
@@ -332,7 +438,7 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), *flagMaxDuration)
 	defer cancel()
 
-	srv, err := getDownloadServer(ctx)
+	srv, err := getServer(ctx)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -344,7 +450,7 @@ func main() {
 	wg := &sync.WaitGroup{}
 	for i := 0; i < *flagStreams; i++ {
 		wg.Add(1)
-		go s.download(ctx, u, headers, wg, *flagStreams, i)
+		go s.run(ctx, u, headers, wg, *flagStreams, i)
 	}
 	wg.Wait()
 
@@ -352,7 +458,8 @@ func main() {
 	// Average over all connections.
 	elapsedTotal := s.lastStopTime.Sub(s.firstStartTime)
 	bytesTotal := s.bytesTotal.Load()
-	log.Printf("Download total average:  %0.2f Mbps, MinRTT %5.2fms, elapsed %0.4fs, application r/w: %d/%d\n",
+	log.Printf("%s total average:  %0.2f Mbps, MinRTT %5.2fms, elapsed %0.4fs, application r/w: %d/%d\n",
+		directionLabel(),
 		8*float64(bytesTotal)/1e6/elapsedTotal.Seconds(), // as mbps.
 		float64(s.minRTT.Load())/1000.0,                  // as ms.
 		elapsedTotal.Seconds(), 0, bytesTotal)
@@ -361,7 +468,8 @@ func main() {
 	elapsedAvg := s.firstStopTime.Sub(s.firstStartTime)
 	bytesAvg := s.bytesAtFirstStop.Load() // like msak-client, bytes during first-start to first-stop.
 	if *flagStreams > 1 {
-		log.Printf("Download first average:  %0.2f Mbps, MinRTT %5.2fms, elapsed %0.4fs, application r/w: %d/%d\n",
+		log.Printf("%s first average:  %0.2f Mbps, MinRTT %5.2fms, elapsed %0.4fs, application r/w: %d/%d\n",
+			directionLabel(),
 			8*float64(bytesAvg)/1e6/elapsedAvg.Seconds(), // as mbps.
 			float64(s.minRTT.Load())/1000.0,              // as ms.
 			elapsedAvg.Seconds(), 0, bytesAvg)
@@ -372,7 +480,8 @@ func main() {
 	elapsedPeak := s.firstStopTime.Sub(s.lastStartTime)
 	bytesPeak := s.bytesAtFirstStop.Load() - s.bytesAtLastStart.Load() // bytes during of peak period.
 	if *flagStreams > 1 && bytesPeak > 0 && elapsedPeak > 0 {
-		log.Printf("Download center average: %0.2f Mbps, MinRTT %5.2fms, elapsed %0.4fs, application r/w: %d/%d\n",
+		log.Printf("%s center average: %0.2f Mbps, MinRTT %5.2fms, elapsed %0.4fs, application r/w: %d/%d\n",
+			directionLabel(),
 			8*float64(bytesPeak)/1e6/elapsedPeak.Seconds(), // as mbps.
 			float64(s.minRTT.Load())/1000.0,                // as ms.
 			elapsedPeak.Seconds(), 0, bytesPeak)
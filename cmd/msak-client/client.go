@@ -2,39 +2,93 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/m-lab/go/flagx"
 	"github.com/m-lab/msak/pkg/client"
 	"github.com/m-lab/msak/pkg/version"
 )
 
 const clientName = "msak-client-go"
 
-var clientVersion = version.Version
+// diagnoseLength is the duration of each subtest in diagnose mode.
+const diagnoseLength = 2 * time.Second
+
+var clientVersion = version.Get().Version
 
 var (
 	flagServer    = flag.String("server", "", "Server address")
 	flagStreams   = flag.Int("streams", client.DefaultStreams, "Number of streams")
 	flagCC        = flag.String("cc", "bbr", "Congestion control algorithm to use")
 	flagDelay     = flag.Duration("delay", 0, "Delay between each stream")
-	flagDuration  = flag.Duration("duration", client.DefaultLength, "Length of the last stream")
+	flagDuration  = flag.Duration("duration", client.DefaultLength, "Length of the last stream (0 = until -bytes are transferred or the server's maximum runtime)")
 	flagScheme    = flag.String("scheme", client.DefaultScheme, "Websocket scheme (wss or ws)")
 	flagMID       = flag.String("mid", uuid.NewString(), "Measurement ID to use")
 	flagNoVerify  = flag.Bool("no-verify", false, "Skip TLS certificate verification")
 	flagDebug     = flag.Bool("debug", false, "Enable debug logging")
 	flagByteLimit = flag.Int("bytes", 0, "Byte limit to request to the server")
+	flagInterval  = flag.Duration("measure-interval", 0, "Average interval between measurements (0 for server default)")
+	flagRate      = flag.Int64("target-rate", 0, "Target sending rate in bits per second (0 to saturate the link)")
+	flagCBOR      = flag.Bool("cbor", false, "Request CBOR-encoded measurements")
+	flagNoCF      = flag.Bool("no-counterflow", false, "Ask the server not to send measurements during uploads, except for the final one")
+	flagInfluxURL = flag.String("influxdb-url", "", "InfluxDB write URL to export measurements to")
+	flagInfluxTok = flag.String("influxdb-token", "", "InfluxDB authentication token")
+	flagSpoolDir  = flag.String("influxdb-spool-dir", "", "Directory to keep measurements that cannot be written to InfluxDB in, until a later run writes them")
+	flagNetCtx    = flag.Bool("report-network-context", false, "Send interface type, VPN and MTU information as metadata")
 	flagUpload    = flag.Bool("upload", true, "Whether to run upload test")
 	flagDownload  = flag.Bool("download", true, "Whether to run download test")
+	flagLocateKey = flag.String("locate.api-key", "", "API key for the Locate API")
+	flagDiagnose  = flag.Bool("diagnose", false, "Run a short test and write a diagnostics bundle to attach to bug reports")
+	flagDiagOut   = flag.String("diagnose.output", "msak-diagnostics.json", "File to write the diagnostics bundle to")
+	flagCapture   = flag.String("capture-dir", "", "Directory to record the WebSocket messages of every stream to, for replay with msak-replay")
+
+	flagLocateHeaders = flagx.KeyValueArray{}
+	flagEmit          = flagx.StringArray{}
 )
 
+func init() {
+	flag.Var(&flagLocateHeaders, "locate.header",
+		"Additional header to send to the Locate API, as name=value (can be repeated)")
+	flag.Var(&flagEmit, "emit",
+		"Output to produce: human, json (JSON lines on stdout) or json:<file> (can be repeated). Default: human")
+}
+
+// newEmitter returns the Emitter producing the output described by an -emit
+// value, and the file it writes to, if any.
+func newEmitter(value string, debug bool) (client.Emitter, *os.File, error) {
+	kind, path, _ := strings.Cut(value, ":")
+	switch {
+	case kind == "human" && path == "":
+		return client.HumanReadable{Debug: debug}, nil, nil
+	case kind == "json" && path == "":
+		return &client.JSON{Writer: os.Stdout}, nil, nil
+	case kind == "json":
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &client.JSON{Writer: f}, f, nil
+	}
+	return nil, nil, fmt.Errorf("unknown output %q", value)
+}
+
 func main() {
 	flag.Parse()
 
 	// For a given number of streams, there will be streams-1 delays. This makes
 	// sure that all the streams can at least start with the current configuration.
-	if float64(*flagStreams-1)*flagDelay.Seconds() >= flagDuration.Seconds() {
+	if *flagDuration != 0 &&
+		float64(*flagStreams-1)*flagDelay.Seconds() >= flagDuration.Seconds() {
 		log.Fatal("Invalid configuration: please check streams, delay and duration and make sure they make sense.")
 	}
 
@@ -43,28 +97,97 @@ func main() {
 	}
 
 	config := client.Config{
-		Server:            *flagServer,
-		Scheme:            *flagScheme,
-		NumStreams:        *flagStreams,
-		CongestionControl: *flagCC,
-		Delay:             *flagDelay,
-		Length:            *flagDuration,
-		MeasurementID:     *flagMID,
-		Emitter: client.HumanReadable{
-			Debug: *flagDebug,
-		},
-		NoVerify:  *flagNoVerify,
-		ByteLimit: *flagByteLimit,
+		Server:               *flagServer,
+		Scheme:               *flagScheme,
+		NumStreams:           *flagStreams,
+		CongestionControl:    *flagCC,
+		Delay:                *flagDelay,
+		Length:               *flagDuration,
+		MeasurementID:        *flagMID,
+		NoVerify:             *flagNoVerify,
+		ByteLimit:            *flagByteLimit,
+		MeasureInterval:      *flagInterval,
+		TargetRate:           *flagRate,
+		NoCounterflow:        *flagNoCF,
+		PreferCBOR:           *flagCBOR,
+		ReportNetworkContext: *flagNetCtx,
+		LocateAPIKey:         *flagLocateKey,
+		CollectDiagnostics:   *flagDiagnose,
+		CaptureDir:           *flagCapture,
+	}
+	if *flagDiagnose {
+		config.Length = diagnoseLength
+	}
+	for name, values := range flagLocateHeaders.Get() {
+		if config.LocateHeaders == nil {
+			config.LocateHeaders = http.Header{}
+		}
+		for _, v := range values {
+			config.LocateHeaders.Add(name, v)
+		}
+	}
+
+	// Every requested output is produced at the same time.
+	outputs := []string(flagEmit)
+	if len(outputs) == 0 {
+		outputs = []string{"human"}
+	}
+	var emitters client.MultiEmitter
+	for _, output := range outputs {
+		e, f, err := newEmitter(output, *flagDebug || *flagDiagnose)
+		if err != nil {
+			log.Fatalf("Invalid configuration: %v", err)
+		}
+		if f != nil {
+			defer f.Close()
+		}
+		emitters = append(emitters, e)
+	}
+	if *flagInfluxURL != "" {
+		emitters = append(emitters, &client.InfluxDB{
+			Endpoint: *flagInfluxURL,
+			Token:    *flagInfluxTok,
+			SpoolDir: *flagSpoolDir,
+			OnWriteError: func(err error) {
+				log.Printf("failed to write to InfluxDB: %v", err)
+			},
+		})
+	}
+	config.Emitter = emitters
+
+	if err := config.Validate(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
 	}
 
 	cl := client.New(clientName, clientVersion, config)
 
-	if *flagDownload {
+	// On SIGINT, abort the test in progress and skip the remaining ones.
+	var interrupted atomic.Bool
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt)
+	go func() {
+		<-sigCh
+		interrupted.Store(true)
+		cl.Abort()
+	}()
+
+	if *flagDownload && !interrupted.Load() {
 		cl.Download(context.Background())
 	}
-	if *flagUpload {
+	if *flagUpload && !interrupted.Load() {
 		cl.Upload(context.Background())
 	}
 
 	cl.PrintSummary()
+
+	if *flagDiagnose {
+		b, err := json.MarshalIndent(cl.Diagnostics(), "", "  ")
+		if err != nil {
+			log.Fatalf("cannot marshal diagnostics: %v", err)
+		}
+		if err := os.WriteFile(*flagDiagOut, b, 0644); err != nil {
+			log.Fatalf("cannot write diagnostics: %v", err)
+		}
+		log.Printf("Diagnostics written to %s", *flagDiagOut)
+	}
 }
@@ -0,0 +1,173 @@
+// msak-diff compares two sets of archived throughput1 results, e.g. from a
+// canary and a production deployment, to support safe rollouts of protocol
+// or kernel changes.
+//
+// Results are grouped by direction and congestion control algorithm. For
+// each group and metric, it prints the sample sizes, the median and tail
+// percentiles of both sets and the result of a two-sample Kolmogorov-Smirnov
+// test. A low p-value means the two distributions likely differ.
+//
+// Usage:
+//
+//	msak-diff -a ./canary-data -b ./production-data
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/m-lab/msak/pkg/throughput1/model"
+)
+
+var (
+	flagA = flag.String("a", "", "Directory containing the first set of throughput1 results")
+	flagB = flag.String("b", "", "Directory containing the second set of throughput1 results")
+)
+
+// metrics are the per-stream values compared between the two sets.
+var metrics = []struct {
+	name  string
+	value func(r *model.Throughput1Result) (float64, bool)
+}{
+	{name: "goodput_mbps", value: goodput},
+	{name: "min_rtt_ms", value: minRTT},
+}
+
+// sample holds the values of each metric for a group of results.
+type sample map[string][]float64
+
+func main() {
+	flag.Parse()
+	if *flagA == "" || *flagB == "" {
+		log.Fatal("both -a and -b must be provided")
+	}
+	a, err := load(*flagA)
+	if err != nil {
+		log.Fatalf("cannot load results from %s: %v", *flagA, err)
+	}
+	b, err := load(*flagB)
+	if err != nil {
+		log.Fatalf("cannot load results from %s: %v", *flagB, err)
+	}
+
+	groups := map[string]struct{}{}
+	for k := range a {
+		groups[k] = struct{}{}
+	}
+	for k := range b {
+		groups[k] = struct{}{}
+	}
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "group\tmetric\tn(a)\tn(b)\tp50(a)\tp50(b)\tp90(a)\tp90(b)\tp99(a)\tp99(b)\tks-D\tp-value")
+	for _, k := range keys {
+		for _, m := range metrics {
+			xa := sortedCopy(a[k][m.name])
+			xb := sortedCopy(b[k][m.name])
+			d, p := ksTest(xa, xb)
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%.2f\t%.2f\t%.2f\t%.2f\t%.2f\t%.2f\t%.3f\t%.4f\n",
+				k, m.name, len(xa), len(xb),
+				quantile(xa, 0.5), quantile(xb, 0.5),
+				quantile(xa, 0.9), quantile(xb, 0.9),
+				quantile(xa, 0.99), quantile(xb, 0.99), d, p)
+		}
+	}
+	w.Flush()
+}
+
+// load reads all the throughput1 results under dir and returns the metric
+// samples grouped by direction and congestion control algorithm.
+func load(dir string) (map[string]sample, error) {
+	groups := map[string]sample{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasPrefix(d.Name(), "throughput1-") ||
+			!strings.HasSuffix(d.Name(), ".json") {
+			return nil
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var r model.Throughput1Result
+		if err := json.Unmarshal(b, &r); err != nil {
+			log.Printf("skipping %s: %v", path, err)
+			return nil
+		}
+		// Results that failed validation would skew the comparison.
+		if len(r.ValidationFlags) > 0 {
+			return nil
+		}
+		key := groupKey(&r)
+		if groups[key] == nil {
+			groups[key] = sample{}
+		}
+		for _, m := range metrics {
+			if v, ok := m.value(&r); ok {
+				groups[key][m.name] = append(groups[key][m.name], v)
+			}
+		}
+		return nil
+	})
+	return groups, err
+}
+
+// groupKey returns the direction/cc group of a result.
+func groupKey(r *model.Throughput1Result) string {
+	cc := r.ActualCC
+	if cc == "" {
+		cc = r.CCAlgorithm
+	}
+	if cc == "" {
+		cc = "unknown"
+	}
+	return r.Direction + "/" + cc
+}
+
+// lastServerMeasurement returns the last measurement taken by the server.
+func lastServerMeasurement(r *model.Throughput1Result) (model.Measurement, bool) {
+	if len(r.ServerMeasurements) == 0 {
+		return model.Measurement{}, false
+	}
+	return r.ServerMeasurements[len(r.ServerMeasurements)-1], true
+}
+
+// goodput returns the stream's application-level goodput in Mb/s, as
+// observed by the server.
+func goodput(r *model.Throughput1Result) (float64, bool) {
+	m, ok := lastServerMeasurement(r)
+	if !ok || m.ElapsedTime <= 0 {
+		return 0, false
+	}
+	bytes := m.Application.BytesSent
+	if r.Direction == string(model.DirectionUpload) {
+		bytes = m.Application.BytesReceived
+	}
+	// Bits per microsecond are megabits per second.
+	return float64(bytes) * 8 / float64(m.ElapsedTime), true
+}
+
+// minRTT returns the stream's minimum RTT in milliseconds, from the server's
+// TCP_INFO.
+func minRTT(r *model.Throughput1Result) (float64, bool) {
+	m, ok := lastServerMeasurement(r)
+	if !ok || m.TCPInfo == nil || m.TCPInfo.MinRTT == 0 {
+		return 0, false
+	}
+	return float64(m.TCPInfo.MinRTT) / 1000, true
+}
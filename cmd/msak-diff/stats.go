@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// quantile returns the q-th quantile of the sorted sample xs, using linear
+// interpolation between the closest ranks. It returns NaN if xs is empty.
+func quantile(xs []float64, q float64) float64 {
+	if len(xs) == 0 {
+		return math.NaN()
+	}
+	pos := q * float64(len(xs)-1)
+	lo := int(math.Floor(pos))
+	hi := int(math.Ceil(pos))
+	return xs[lo] + (xs[hi]-xs[lo])*(pos-float64(lo))
+}
+
+// ksTest runs a two-sample Kolmogorov-Smirnov test on the sorted samples a and
+// b. It returns the KS statistic D, i.e. the maximum distance between the two
+// empirical distribution functions, and the asymptotic p-value of the null
+// hypothesis that both samples come from the same distribution.
+func ksTest(a, b []float64) (float64, float64) {
+	if len(a) == 0 || len(b) == 0 {
+		return math.NaN(), math.NaN()
+	}
+	var d float64
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		x := math.Min(a[i], b[j])
+		for i < len(a) && a[i] <= x {
+			i++
+		}
+		for j < len(b) && b[j] <= x {
+			j++
+		}
+		diff := math.Abs(float64(i)/float64(len(a)) - float64(j)/float64(len(b)))
+		if diff > d {
+			d = diff
+		}
+	}
+	n := float64(len(a)) * float64(len(b)) / float64(len(a)+len(b))
+	sqrtN := math.Sqrt(n)
+	return d, kolmogorovQ((sqrtN + 0.12 + 0.11/sqrtN) * d)
+}
+
+// kolmogorovQ is the complementary cumulative distribution function of the
+// Kolmogorov distribution.
+func kolmogorovQ(lambda float64) float64 {
+	if lambda < 1e-3 {
+		return 1
+	}
+	var sum float64
+	sign := 1.0
+	for k := 1; k <= 100; k++ {
+		term := sign * math.Exp(-2*float64(k*k)*lambda*lambda)
+		sum += term
+		if math.Abs(term) < 1e-10 {
+			break
+		}
+		sign = -sign
+	}
+	return math.Max(0, math.Min(1, 2*sum))
+}
+
+// sortedCopy returns a sorted copy of xs.
+func sortedCopy(xs []float64) []float64 {
+	c := append([]float64(nil), xs...)
+	sort.Float64s(c)
+	return c
+}
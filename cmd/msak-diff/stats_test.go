@@ -0,0 +1,138 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// approxEqual reports whether a and b are within tol of each other, or both
+// NaN.
+func approxEqual(a, b, tol float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+	return math.Abs(a-b) <= tol
+}
+
+func Test_quantile(t *testing.T) {
+	tests := []struct {
+		name string
+		xs   []float64
+		q    float64
+		want float64
+	}{
+		{name: "empty", xs: nil, q: 0.5, want: math.NaN()},
+		{name: "single", xs: []float64{3}, q: 0.9, want: 3},
+		{name: "min", xs: []float64{1, 2, 3, 4}, q: 0, want: 1},
+		{name: "max", xs: []float64{1, 2, 3, 4}, q: 1, want: 4},
+		{name: "median-odd", xs: []float64{1, 2, 10}, q: 0.5, want: 2},
+		{name: "median-even", xs: []float64{1, 2, 3, 4}, q: 0.5, want: 2.5},
+		{name: "interpolated", xs: []float64{0, 10, 20, 30, 40}, q: 0.9, want: 36},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := quantile(tt.xs, tt.q); !approxEqual(got, tt.want, 1e-9) {
+				t.Errorf("quantile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_ksTest(t *testing.T) {
+	tests := []struct {
+		name  string
+		a, b  []float64
+		wantD float64
+		wantP float64
+	}{
+		{
+			name:  "empty",
+			a:     nil,
+			b:     []float64{1},
+			wantD: math.NaN(),
+			wantP: math.NaN(),
+		},
+		{
+			name:  "identical",
+			a:     []float64{1, 2, 3, 4},
+			b:     []float64{1, 2, 3, 4},
+			wantD: 0,
+			wantP: 1,
+		},
+		{
+			name:  "disjoint",
+			a:     []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
+			b:     []float64{11, 12, 13, 14, 15, 16, 17, 18, 19, 20},
+			wantD: 1,
+			// lambda = (sqrt(5) + 0.12 + 0.11/sqrt(5)) * 1.
+			wantP: kolmogorovQ(math.Sqrt(5) + 0.12 + 0.11/math.Sqrt(5)),
+		},
+		{
+			name:  "shifted",
+			a:     []float64{1, 2, 3, 4},
+			b:     []float64{3, 4, 5, 6},
+			wantD: 0.5,
+			wantP: kolmogorovQ((math.Sqrt(2) + 0.12 + 0.11/math.Sqrt(2)) * 0.5),
+		},
+		{
+			name:  "ties",
+			a:     []float64{1, 1, 2, 2},
+			b:     []float64{1, 2, 2, 2},
+			wantD: 0.25,
+			wantP: kolmogorovQ((math.Sqrt(2) + 0.12 + 0.11/math.Sqrt(2)) * 0.25),
+		},
+		{
+			name:  "different-sizes",
+			a:     []float64{1, 2},
+			b:     []float64{1, 2, 3, 4},
+			wantD: 0.5,
+			wantP: kolmogorovQ((math.Sqrt(4.0/3) + 0.12 + 0.11/math.Sqrt(4.0/3)) * 0.5),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, p := ksTest(tt.a, tt.b)
+			if !approxEqual(d, tt.wantD, 1e-9) || !approxEqual(p, tt.wantP, 1e-9) {
+				t.Errorf("ksTest() = %v, %v, want %v, %v", d, p, tt.wantD, tt.wantP)
+			}
+			// The test is symmetric.
+			d, p = ksTest(tt.b, tt.a)
+			if !approxEqual(d, tt.wantD, 1e-9) || !approxEqual(p, tt.wantP, 1e-9) {
+				t.Errorf("ksTest(b, a) = %v, %v, want %v, %v", d, p, tt.wantD,
+					tt.wantP)
+			}
+		})
+	}
+}
+
+func Test_kolmogorovQ(t *testing.T) {
+	// Reference values of the Kolmogorov distribution's complementary CDF.
+	tests := []struct {
+		lambda float64
+		want   float64
+	}{
+		{lambda: 0, want: 1},
+		{lambda: 0.5, want: 0.963945},
+		{lambda: 1, want: 0.269999},
+		{lambda: 1.36, want: 0.049486},
+		{lambda: 1.63, want: 0.009846},
+		{lambda: 3, want: 0},
+	}
+	for _, tt := range tests {
+		if got := kolmogorovQ(tt.lambda); !approxEqual(got, tt.want, 1e-5) {
+			t.Errorf("kolmogorovQ(%v) = %v, want %v", tt.lambda, got, tt.want)
+		}
+	}
+}
+
+func Test_sortedCopy(t *testing.T) {
+	xs := []float64{3, 1, 2}
+	got := sortedCopy(xs)
+	if want := []float64{1, 2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sortedCopy() = %v, want %v", got, want)
+	}
+	if want := []float64{3, 1, 2}; !reflect.DeepEqual(xs, want) {
+		t.Errorf("sortedCopy() modified its input: %v", xs)
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"runtime"
 	"time"
 
 	"github.com/m-lab/go/flagx"
@@ -18,6 +19,7 @@ import (
 	v2 "github.com/m-lab/locate/api/v2"
 	"github.com/m-lab/msak/pkg/latency1/model"
 	"github.com/m-lab/msak/pkg/latency1/spec"
+	"github.com/m-lab/msak/pkg/version"
 )
 
 var (
@@ -31,13 +33,26 @@ func init() {
 }
 
 func getTargetsFromLocate() []v2.Target {
-	locateV2 := locate.NewClient("msak-latency")
+	locateV2 := locate.NewClient(clientName)
 	targets, err := locateV2.Nearest(context.Background(), spec.ServiceName)
 	rtx.Must(err, "cannot get server list from locate")
 	return targets
 }
 
+const clientName = "msak-latency"
+
+// addClientInfo adds the client's name, OS and version to the querystring of
+// the provided authorization URL.
+func addClientInfo(authorizeURL *url.URL) {
+	q := authorizeURL.Query()
+	q.Set(spec.ClientNameParameterName, clientName)
+	q.Set(spec.ClientOSParameterName, runtime.GOOS)
+	q.Set(spec.ClientVersionParameterName, version.Get().Version)
+	authorizeURL.RawQuery = q.Encode()
+}
+
 func tryConnect(authorizeURL *url.URL) ([]byte, error) {
+	addClientInfo(authorizeURL)
 	resp, err := http.Get(authorizeURL.String())
 	if err != nil {
 		return nil, err
@@ -0,0 +1,143 @@
+// msak-replay replays a throughput1 recording, made with the capture mode of
+// msak-client or msak-server, against a third-party implementation and
+// validates the messages it sends against the recorded ones.
+//
+// A recording made by a client is replayed against a server:
+//
+//	msak-replay -recording download-0-20240104T174101.json \
+//	  -server 'ws://localhost:8080/throughput/v1/download?mid=test&streams=1'
+//
+// A recording made by a server is replayed to the first client connecting
+// to -listen, on any path:
+//
+//	msak-replay -recording ./captures/<uuid>.json -listen :8081
+//
+// The exit status is 1 if the validation fails.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/m-lab/msak/pkg/throughput1/capture"
+)
+
+var (
+	flagRecording = flag.String("recording", "", "Recording to replay")
+	flagServer    = flag.String("server", "", "URL of the server to replay a client recording against")
+	flagListen    = flag.String("listen", ":8081", "Address to accept a client on when replaying a server recording")
+	flagOutput    = flag.String("output", "", "File to write the recording of the replayed session to")
+	flagTimeout   = flag.Duration("timeout", time.Minute, "Maximum duration of the replayed session")
+)
+
+func main() {
+	flag.Parse()
+	if *flagRecording == "" {
+		log.Fatal("-recording must be provided")
+	}
+	ref, err := capture.ReadFile(*flagRecording)
+	if err != nil {
+		log.Fatalf("cannot read recording: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *flagTimeout)
+	defer cancel()
+	var actual *capture.Recording
+	switch ref.Role {
+	case capture.RoleClient:
+		if *flagServer == "" {
+			log.Fatal("-server must be provided to replay a client recording")
+		}
+		actual, err = replayClient(ctx, ref, *flagServer)
+	case capture.RoleServer:
+		actual, err = replayServer(ctx, ref, *flagListen)
+	default:
+		log.Fatalf("unknown role in recording: %q", ref.Role)
+	}
+	if err != nil {
+		log.Fatalf("replay failed: %v", err)
+	}
+
+	if *flagOutput != "" {
+		if err := actual.WriteFile(*flagOutput); err != nil {
+			log.Fatalf("cannot write recording: %v", err)
+		}
+	}
+	errs := capture.Validate(ref, actual)
+	for _, err := range errs {
+		fmt.Println(err)
+	}
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+	fmt.Printf("OK: %d messages exchanged\n", len(actual.Events))
+}
+
+// replayClient connects to serverURL as a client and replays ref.
+func replayClient(ctx context.Context, ref *capture.Recording,
+	serverURL string) (*capture.Recording, error) {
+	dialer := websocket.Dialer{
+		Subprotocols:     []string{ref.Subprotocol},
+		HandshakeTimeout: 10 * time.Second,
+	}
+	conn, _, err := dialer.DialContext(ctx, serverURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return capture.Replay(ctx, conn, ref)
+}
+
+// replayServer accepts a single WebSocket client on addr and replays ref.
+func replayServer(ctx context.Context, ref *capture.Recording,
+	addr string) (*capture.Recording, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Waiting for a client on %s", l.Addr())
+
+	type result struct {
+		rec *capture.Recording
+		err error
+	}
+	done := make(chan result, 1)
+	upgrader := websocket.Upgrader{
+		Subprotocols: []string{ref.Subprotocol},
+		CheckOrigin:  func(*http.Request) bool { return true },
+	}
+	var accepted atomic.Bool
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if !accepted.CompareAndSwap(false, true) {
+				rw.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			conn, err := upgrader.Upgrade(rw, req, nil)
+			if err != nil {
+				accepted.Store(false)
+				return
+			}
+			defer conn.Close()
+			rec, err := capture.Replay(ctx, conn, ref)
+			done <- result{rec, err}
+		}),
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	select {
+	case r := <-done:
+		return r.rec, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/m-lab/go/flagx"
+	"github.com/m-lab/msak/internal/latency1"
+	"github.com/m-lab/msak/internal/netx"
+	"github.com/m-lab/msak/internal/protocol"
+	latency1spec "github.com/m-lab/msak/pkg/latency1/spec"
+)
+
+var (
+	flagLatencyEndpoint = flag.String("latency_addr", ":1053", "Listen address/port for UDP latency tests")
+	flagLatencyTTL      = flag.Duration("latency_ttl",
+		latency1spec.DefaultSessionCacheTTL, "Session cache's TTL")
+	flagLatency1Enable = flag.Bool("latency1.enable", true,
+		"Enable the latency1 subsystem")
+	flagLatency1Addr = flag.String("latency1.addr", "",
+		"Dedicated listen address/port for the cleartext latency1 HTTP endpoints. If empty, they are served on -ws_addr")
+	flagLatency1TLSAddr = flag.String("latency1.tls-addr", "",
+		"Dedicated listen address/port for the TLS latency1 HTTP endpoints. If empty, they are served on -wss_addr")
+	flagLatencyIssueMID = flag.Bool("latency_issue_mid", false,
+		"Enable the latency1 mid issuance endpoint for anonymous clients. Ignored if -token.verify is set")
+	flagLatencyMaxPacketSize = flag.Int("latency_max_packet_size",
+		latency1spec.DefaultMaxPacketSize, "Maximum size of UDP latency packets")
+	flagLatencyShards = flag.Int("latency1.shards", 1,
+		"Number of shards of the latency1 sessions cache, and of goroutines reading UDP packets")
+	flagLatencyEchoNonce = flag.Bool("latency1.echo-nonce", false,
+		"Add a random nonce to every latency1 ping and archive the replies that do not echo it as mismatches")
+	latencyClientNames = flagx.StringArray{}
+	latencyClientOSes  = flagx.StringArray{}
+)
+
+func init() {
+	flag.Var(&latencyClientNames, "latency1.client-names",
+		"Client names used as the client_name label of latency1 metrics, others are reported as \"other\". If empty, only msak-latency is used")
+	flag.Var(&latencyClientOSes, "latency1.client-oses",
+		"Client operating systems used as the client_os label of latency1 metrics, others are reported as \"other\". If empty, common GOOS values are used")
+	protocol.Register(&latency1Protocol{})
+}
+
+// latency1Protocol serves the latency1 protocol: its HTTP endpoints and its
+// UDP socket.
+type latency1Protocol struct {
+	handler     *latency1.Handler
+	udpListener *net.UDPConn
+}
+
+// Name returns "latency1".
+func (p *latency1Protocol) Name() string {
+	return "latency1"
+}
+
+// Datatype returns "latency1".
+func (p *latency1Protocol) Datatype() string {
+	return "latency1"
+}
+
+// Enabled returns the value of -latency1.enable.
+func (p *latency1Protocol) Enabled() bool {
+	return *flagLatency1Enable
+}
+
+// Addrs returns the values of -latency1.addr and -latency1.tls-addr.
+func (p *latency1Protocol) Addrs() (string, string) {
+	return *flagLatency1Addr, *flagLatency1TLSAddr
+}
+
+// Validate checks the consistency of the latency1 flags.
+func (p *latency1Protocol) Validate(env protocol.Env) error {
+	if *flagLatencyShards < 1 {
+		return errors.New("-latency1.shards must be at least 1")
+	}
+	return nil
+}
+
+// Start creates the latency1 handler, starts reading packets from its UDP
+// socket and returns its routes.
+func (p *latency1Protocol) Start(env protocol.Env) ([]protocol.Route, error) {
+	h := latency1.NewShardedHandler(env.DataDir, *flagLatencyTTL,
+		*flagLatencyShards)
+	h.SetMaxPacketSize(*flagLatencyMaxPacketSize)
+	h.SetTokenMachine(env.TokenMachine)
+	h.SetAdvertisedServer(env.AdvertisedHost)
+	h.SetEchoVerification(*flagLatencyEchoNonce)
+	names, oses := latency1spec.DefaultClientNames, latency1spec.DefaultClientOSes
+	if len(latencyClientNames) > 0 {
+		names = latencyClientNames
+	}
+	if len(latencyClientOSes) > 0 {
+		oses = latencyClientOSes
+	}
+	h.SetClientLabels(names, oses)
+	routes := []protocol.Route{
+		{Path: latency1spec.AuthorizeV1, Handler: http.HandlerFunc(h.Authorize),
+			Authorized: true, StartsTest: true},
+		{Path: latency1spec.ResultV1, Handler: http.HandlerFunc(h.Result),
+			Authorized: true},
+	}
+	if *flagLatencyIssueMID && !env.TokenVerify {
+		routes = append(routes, protocol.Route{Path: latency1spec.IssueV1,
+			Handler: http.HandlerFunc(h.Issue), StartsTest: true})
+	}
+
+	// Start a UDP server for latency measurements, unless systemd passed
+	// its socket.
+	udpListener, err := env.Sockets.UDPConn("latency1-udp")
+	if err != nil {
+		return nil, fmt.Errorf("cannot use activated latency UDP socket: %w", err)
+	}
+	if udpListener != nil {
+		if err := netx.CheckFamily(udpListener, env.IPFamily); err != nil {
+			return nil, fmt.Errorf("activated latency UDP socket does not match -ip-family: %w", err)
+		}
+	} else {
+		network, _ := netx.ListenNetwork("udp", env.IPFamily)
+		addr, err := net.ResolveUDPAddr(network, *flagLatencyEndpoint)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve latency endpoint address: %w", err)
+		}
+		udpListener, err = net.ListenUDP(network, addr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot start latency UDP server: %w", err)
+		}
+	}
+	p.handler = h
+	p.udpListener = udpListener
+
+	go h.ProcessPacketLoop(udpListener)
+	env.Health.Register("latency1-udp", h.CheckUDP)
+	return routes, nil
+}
+
+// Drain drains the latency1 handler.
+func (p *latency1Protocol) Drain(ctx context.Context) error {
+	return p.handler.Drain(ctx)
+}
+
+// Close closes the UDP socket.
+func (p *latency1Protocol) Close() error {
+	return p.udpListener.Close()
+}
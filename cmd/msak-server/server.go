@@ -3,9 +3,16 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"flag"
+	"fmt"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/charmbracelet/log"
@@ -14,23 +21,62 @@ import (
 	"github.com/m-lab/go/flagx"
 	"github.com/m-lab/go/prometheusx"
 	"github.com/m-lab/go/rtx"
-	"github.com/m-lab/msak/internal/handler"
-	"github.com/m-lab/msak/internal/latency1"
+	"github.com/m-lab/msak/internal/activation"
+	"github.com/m-lab/msak/internal/admin"
+	"github.com/m-lab/msak/internal/certs"
+	"github.com/m-lab/msak/internal/config"
+	"github.com/m-lab/msak/internal/cors"
 	"github.com/m-lab/msak/internal/netx"
-	latency1spec "github.com/m-lab/msak/pkg/latency1/spec"
-	"github.com/m-lab/msak/pkg/throughput1/spec"
+	"github.com/m-lab/msak/internal/protocol"
+	"github.com/m-lab/msak/internal/ratelimit"
+	"github.com/m-lab/msak/internal/stats"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 var (
-	flagCertFile          = flag.String("cert", "", "The file with server certificates in PEM format.")
-	flagKeyFile           = flag.String("key", "", "The file with server key in PEM format.")
+	flagConfig = flag.String("config", "",
+		"YAML file setting any of the other flags by name. Flags set on the command line or in the environment take precedence")
+	flagCertFile = flag.String("cert", "", "The file with server certificates in PEM format.")
+	flagKeyFile  = flag.String("key", "", "The file with server key in PEM format.")
+	flagACME     = flag.Bool("acme", false,
+		"Obtain and renew the TLS certificate automatically from an ACME CA such as Let's Encrypt. Requires -acme.hosts")
+	flagACMECacheDir = flag.String("acme.cache-dir", "./acme",
+		"Directory to cache ACME certificates and account key in")
+	flagACMEEmail = flag.String("acme.email", "",
+		"Contact email for the ACME account (optional)")
+	flagACMEDirectory = flag.String("acme.directory-url", "",
+		"ACME directory URL. If empty, Let's Encrypt's production directory is used")
 	flagEndpoint          = flag.String("wss_addr", ":4443", "Listen address/port for TLS connections")
 	flagEndpointCleartext = flag.String("ws_addr", ":8080", "Listen address/port for cleartext connections")
 	flagDataDir           = flag.String("datadir", "./data", "Directory to store data in")
-	flagLatencyEndpoint   = flag.String("latency_addr", ":1053", "Listen address/port for UDP latency tests")
-	flagLatencyTTL        = flag.Duration("latency_ttl",
-		latency1spec.DefaultSessionCacheTTL, "Session cache's TTL")
+	flagIPFamily          = flag.String("ip-family", netx.FamilyDual, "IP family of the TCP and UDP listeners: dual, ipv4 or ipv6. Sockets passed by systemd must match it, unless dual")
+	flagAdvertisedHost    = flag.String("advertised-host", "", "Public host name or IP address of this server, archived with every result next to the socket's local address")
+	flagRateLimit         = flag.Float64("ratelimit.rate", 0,
+		"Average number of test requests per second allowed from each client IP or IPv6 /64 (0 = unlimited)")
+	flagRateLimitBurst = flag.Int("ratelimit.burst", 10,
+		"Maximum burst of test requests allowed from each client IP or IPv6 /64")
+	flagDrainTimeout = flag.Duration("shutdown.drain-timeout", 30*time.Second,
+		"On SIGTERM, maximum time to wait for in-flight tests to finish before stopping them")
+	flagLogFormat = flag.String("log.format", "text",
+		"Log format: text, logfmt or json. JSON logs are written to stdout, the others to stderr")
+	flagLogLevel = flag.String("log.level", "debug",
+		"Minimum level of the messages logged: debug, info, warn or error")
+	flagDebugAddr = flag.String("debug.addr", "",
+		"Listen address/port for the expvar runtime metrics under /debug/vars. If empty, it is disabled. Do not expose publicly")
+	flagStatsSnapshot = flag.Bool("stats_snapshot", true,
+		"Write a snapshot of the server's counters to the datadir on shutdown")
+	flagDataDirMinFree = flag.Int64("datadir.min-free-bytes", 0,
+		"Reject new tests while less than this many bytes are available in -datadir (0 = disabled)")
+	flagDataDirPurge = flag.Bool("datadir.purge", false,
+		"While -datadir is low on space, delete its oldest archives, uploaded or not, until -datadir.min-free-bytes are available")
+	flagDataDirCheckInterval = flag.Duration("datadir.check-interval", 10*time.Second,
+		"Interval between checks of the free space in -datadir")
+	adminToken     = flagx.FileBytes{}
 	tokenVerifyKey = flagx.FileBytesArray{}
+	corsOrigins    = flagx.StringArray{}
+	corsHeaders    = flagx.StringArray{}
+	acmeHosts      = flagx.StringArray{}
 	tokenVerify    bool
 	tokenMachine   string
 
@@ -42,6 +88,13 @@ func init() {
 	flag.Var(&tokenVerifyKey, "token.verify-key", "Public key for verifying access tokens")
 	flag.BoolVar(&tokenVerify, "token.verify", false, "Verify access tokens")
 	flag.StringVar(&tokenMachine, "token.machine", "", "Use given machine name to verify token claims")
+	flag.Var(&corsOrigins, "cors.allowed-origins",
+		"Origins allowed to send cross-origin requests, e.g. https://*.example.com. If empty, CORS is disabled")
+	flag.Var(&corsHeaders, "cors.allowed-headers",
+		"Request headers allowed in cross-origin requests, e.g. Authorization")
+	flag.Var(&acmeHosts, "acme.hosts",
+		"Host names to obtain ACME certificates for. Requests for other names are refused")
+	flag.Var(&adminToken, "admin.token", "File containing the bearer token for admin endpoints. If empty, admin endpoints are disabled")
 }
 
 // httpServer creates a new *http.Server with explicit Read and Write
@@ -69,92 +122,460 @@ func httpServer(addr string, handler http.Handler) *http.Server {
 	return s
 }
 
+// route is a handler and the pattern it is registered with.
+type route struct {
+	pattern string
+	handler http.Handler
+}
+
+// newMux returns a ServeMux serving every route in routes.
+func newMux(routes ...[]route) *http.ServeMux {
+	mux := http.NewServeMux()
+	for _, rs := range routes {
+		for _, r := range rs {
+			mux.Handle(r.pattern, r.handler)
+		}
+	}
+	return mux
+}
+
+// listener is an HTTP listener serving handler on addr. name identifies it
+// in logs and health checks.
+type listener struct {
+	name    string
+	addr    string
+	handler http.Handler
+	tls     bool
+}
+
+// logFormats maps the values of -log.format to log formatters.
+var logFormats = map[string]log.Formatter{
+	"text":   log.TextFormatter,
+	"logfmt": log.LogfmtFormatter,
+	"json":   log.JSONFormatter,
+}
+
+// validateFlags returns an error describing the first inconsistency among
+// the flags, including those of the enabled protocols, if any.
+func validateFlags(env protocol.Env) error {
+	protocols := protocol.Enabled()
+	if len(protocols) == 0 {
+		return errors.New("at least one protocol must be enabled")
+	}
+	if (*flagCertFile == "") != (*flagKeyFile == "") {
+		return errors.New("-cert and -key must be set together")
+	}
+	if *flagACME && *flagCertFile != "" {
+		return errors.New("-acme cannot be used with -cert and -key")
+	}
+	if *flagACME && len(acmeHosts) == 0 {
+		return errors.New("-acme requires -acme.hosts")
+	}
+	for _, p := range protocols {
+		if _, tlsAddr := p.Addrs(); tlsAddr != "" &&
+			*flagCertFile == "" && !*flagACME {
+			return fmt.Errorf("-%s.tls-addr requires -cert and -key, or -acme", p.Name())
+		}
+		if err := p.Validate(env); err != nil {
+			return err
+		}
+	}
+	if _, err := netx.ListenNetwork("tcp", *flagIPFamily); err != nil {
+		return fmt.Errorf("invalid -ip-family: %w", err)
+	}
+	if _, ok := logFormats[*flagLogFormat]; !ok {
+		return fmt.Errorf("invalid -log.format: %q", *flagLogFormat)
+	}
+	switch *flagLogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("invalid -log.level: %q", *flagLogLevel)
+	}
+	if tokenVerify && len(tokenVerifyKey.Get()) == 0 {
+		return errors.New("-token.verify requires -token.verify-key")
+	}
+	if *flagRateLimit < 0 || *flagRateLimitBurst < 0 {
+		return errors.New("-ratelimit.rate and -ratelimit.burst must not be negative")
+	}
+	if *flagDataDirMinFree < 0 {
+		return errors.New("-datadir.min-free-bytes must not be negative")
+	}
+	if *flagDataDirMinFree > 0 && *flagDataDirCheckInterval <= 0 {
+		return errors.New("-datadir.check-interval must be positive")
+	}
+	return nil
+}
+
+// reloadableFlags are the flags, other than those of the protocols, that can
+// be reloaded on SIGHUP.
+var reloadableFlags = []string{"ratelimit.rate", "ratelimit.burst"}
+
+// reload re-reads the reloadable flags of the server and of the started
+// protocols from the configuration file, and applies them if they are valid.
+// If any of them is invalid, none is applied and the flags keep their
+// previous values.
+func reload(env protocol.Env, limiter *ratelimit.Limiter, protocols []protocol.Protocol) error {
+	if *flagConfig == "" {
+		return errors.New("no configuration file to reload, -config is not set")
+	}
+	names := append([]string{}, reloadableFlags...)
+	var reloaders []protocol.Reloader
+	for _, p := range protocols {
+		if r, ok := p.(protocol.Reloader); ok {
+			names = append(names, r.ReloadableFlags()...)
+			reloaders = append(reloaders, r)
+		}
+	}
+	validate := func() error { return validateFlags(env) }
+	if err := config.Reload(flag.CommandLine, *flagConfig, validate, names...); err != nil {
+		return err
+	}
+	limiter.SetLimit(*flagRateLimit, *flagRateLimitBurst)
+	for _, r := range reloaders {
+		if err := r.Reload(env); err != nil {
+			return err
+		}
+	}
+	log.Info("Configuration reloaded", "path", *flagConfig, "flags", names)
+	return nil
+}
+
+// shutdown drains the started protocols, so that in-flight tests can finish
+// and be archived within the drain timeout while new tests are rejected. It
+// then stops the HTTP servers and closes the protocols.
+func shutdown(servers []*http.Server, protocols []protocol.Protocol) {
+	log.Info("Draining in-flight tests", "timeout", *flagDrainTimeout)
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), *flagDrainTimeout)
+	defer drainCancel()
+
+	var wg sync.WaitGroup
+	for _, p := range protocols {
+		wg.Add(1)
+		go func(p protocol.Protocol) {
+			defer wg.Done()
+			if err := p.Drain(drainCtx); err != nil {
+				log.Warn("Stopped tests before their end", "protocol", p.Name(),
+					"error", err)
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	// The handlers are idle, so there are no connections left to wait for
+	// other than idle keep-alive ones.
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), time.Second)
+	defer shutdownCancel()
+	for _, s := range servers {
+		if err := s.Shutdown(shutdownCtx); err != nil {
+			log.Warn("Failed to shut down server", "addr", s.Addr, "error", err)
+			s.Close()
+		}
+	}
+	for _, p := range protocols {
+		if err := p.Close(); err != nil {
+			log.Warn("Failed to close protocol", "protocol", p.Name(), "error", err)
+		}
+	}
+	log.Info("Shutdown complete")
+}
+
 func main() {
 	flag.Parse()
+	rtx.Must(flagx.ArgsFromEnvWithLog(flag.CommandLine, false),
+		"Failed to read flags from the environment")
+	if *flagConfig != "" {
+		rtx.Must(config.Load(flag.CommandLine, *flagConfig, "config"),
+			"Failed to load configuration file")
+	}
+	env := protocol.Env{
+		DataDir:        *flagDataDir,
+		IPFamily:       *flagIPFamily,
+		AdvertisedHost: *flagAdvertisedHost,
+		TokenVerify:    tokenVerify,
+		TokenMachine:   tokenMachine,
+		AdminToken:     strings.TrimSpace(string(adminToken)),
+		Registerer:     prometheus.DefaultRegisterer,
+	}
+	rtx.Must(validateFlags(env), "Invalid configuration")
+	startTime := time.Now()
+
+	// Cancel the main context on SIGINT/SIGTERM so that the server can drain
+	// in-flight tests and shut down cleanly.
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		log.Info("Received signal, shutting down", "signal", sig)
+		cancel()
+		// A second signal skips draining.
+		sig = <-sigCh
+		log.Fatal("Received signal while draining, exiting", "signal", sig)
+	}()
 
 	// Initialize logging and metrics.
 	log.SetReportCaller(true)
 	log.SetReportTimestamp(true)
-	log.SetLevel(log.DebugLevel)
+	log.SetLevel(log.ParseLevel(*flagLogLevel))
+	log.SetFormatter(logFormats[*flagLogFormat])
+	if *flagLogFormat == "json" {
+		log.SetOutput(os.Stdout)
+	}
 
 	promSrv := prometheusx.MustServeMetrics()
 	defer promSrv.Close()
 
+	if *flagDebugAddr != "" {
+		debugSrv := &http.Server{
+			Addr:    *flagDebugAddr,
+			Handler: admin.DebugHandler(),
+		}
+		log.Info("About to listen for debug requests", "endpoint", *flagDebugAddr)
+		go func() {
+			err := debugSrv.ListenAndServe()
+			if err != http.ErrServerClosed {
+				rtx.Must(err, "Could not start debug server")
+			}
+		}()
+		defer debugSrv.Close()
+	}
+
+	// Under systemd socket activation, listeners use the sockets passed by
+	// systemd whose FileDescriptorName matches their name.
+	sockets, err := activation.New()
+	rtx.Must(err, "cannot read activated sockets")
+
 	v, err := token.NewVerifier(tokenVerifyKey.Get()...)
 	if (tokenVerify) && err != nil {
 		rtx.Must(err, "Failed to load verifier")
 	}
-	// Enforce tokens and txcontroller on every endpoint.
-	txControllerPaths := controller.Paths{
-		spec.DownloadPath:        true,
-		spec.UploadPath:          true,
-		latency1spec.AuthorizeV1: true,
-		latency1spec.ResultV1:    true,
+
+	// While in maintenance mode, new tests are rejected.
+	maintenance := admin.NewMaintenance()
+
+	// Subsystems register their health checks once they are started. Health
+	// checks and the build information are served on every listener.
+	health := admin.NewHealth(maintenance)
+	healthRoutes := []route{
+		{admin.HealthPath, health.LivenessHandler()},
+		{admin.ReadyPath, health.ReadinessHandler()},
+		{admin.VersionPath, admin.VersionHandler()},
+	}
+	health.Register("datadir", admin.WritableDirCheck(*flagDataDir))
+
+	// If configured, reject new tests while the datadir is low on space, so
+	// that the results of running tests can still be written.
+	diskGuard := func(h http.Handler) http.Handler { return h }
+	if *flagDataDirMinFree > 0 {
+		guard := admin.NewDiskGuard(*flagDataDir, *flagDataDirMinFree,
+			*flagDataDirPurge)
+		go guard.Run(ctx, *flagDataDirCheckInterval)
+		health.Register("datadir-space", guard.Check)
+		diskGuard = guard.Middleware
 	}
-	tokenPaths := controller.Paths{
-		spec.DownloadPath:        true,
-		spec.UploadPath:          true,
-		latency1spec.AuthorizeV1: true,
-		latency1spec.ResultV1:    true,
+
+	// If configured, limit the rate of test requests from each client. The
+	// limiter allows every request while the rate is zero, so that a limit
+	// can be set on SIGHUP.
+	limiter := ratelimit.New(*flagRateLimit, *flagRateLimitBurst)
+	defer limiter.Stop()
+
+	var adminRoutes []route
+	if env.AdminToken != "" {
+		archives := admin.NewArchives(*flagDataDir)
+		adminRoutes = append(adminRoutes,
+			route{admin.MaintenancePath,
+				admin.RequireToken(env.AdminToken, maintenance)},
+			route{admin.ArchivesPath,
+				admin.RequireToken(env.AdminToken, archives.ListHandler())},
+			route{admin.ArchivePath,
+				admin.RequireToken(env.AdminToken, archives.GetHandler())})
+	}
+
+	// Start every enabled protocol. Access tokens and the transaction
+	// controller are enforced on their authorized routes, while routes
+	// starting tests are also subject to maintenance mode, the datadir's
+	// free space and rate limits.
+	env.Sockets = sockets
+	env.Health = health
+	protocols := protocol.Enabled()
+	protocolRoutes := make([][]route, len(protocols))
+	txControllerPaths := controller.Paths{}
+	tokenPaths := controller.Paths{}
+	for i, p := range protocols {
+		routes, err := p.Start(env)
+		rtx.Must(err, "cannot start %s", p.Name())
+		log.Info("Protocol started", "protocol", p.Name(),
+			"datatype", p.Datatype())
+		for _, r := range routes {
+			handler := r.Handler
+			if r.StartsTest {
+				handler = maintenance.Middleware(
+					diskGuard(limiter.Middleware(handler)))
+			}
+			if r.Authorized {
+				txControllerPaths[r.Path] = true
+				tokenPaths[r.Path] = true
+			}
+			protocolRoutes[i] = append(protocolRoutes[i], route{r.Path, handler})
+		}
 	}
 	acm, _ := controller.Setup(ctx, v, tokenVerify, tokenMachine,
 		txControllerPaths, tokenPaths)
 
-	mux := http.NewServeMux()
-	latency1Handler := latency1.NewHandler(*flagDataDir, *flagLatencyTTL)
-	throughput1Handler := handler.New(*flagDataDir)
-
-	mux.Handle(spec.DownloadPath, http.HandlerFunc(throughput1Handler.Download))
-	mux.Handle(spec.UploadPath, http.HandlerFunc(throughput1Handler.Upload))
-	mux.Handle(latency1spec.AuthorizeV1, http.HandlerFunc(
-		latency1Handler.Authorize))
-	mux.Handle(latency1spec.ResultV1, http.HandlerFunc(
-		latency1Handler.Result))
-	serverCleartext := httpServer(
-		*flagEndpointCleartext,
-		acm.Then(mux))
-
-	log.Info("About to listen for ws tests", "endpoint", *flagEndpointCleartext)
-
-	tcpl, err := net.Listen("tcp", serverCleartext.Addr)
-	rtx.Must(err, "failed to create listener")
-	l := netx.NewListener(tcpl.(*net.TCPListener))
-	defer l.Close()
-
-	go func() {
-		err := serverCleartext.Serve(l)
-		rtx.Must(err, "Could not start cleartext server")
-		defer serverCleartext.Close()
-	}()
+	// Preflight requests do not carry access tokens, so CORS must be handled
+	// before the access controllers.
+	newHandler := func(routes ...[]route) http.Handler {
+		handler := acm.Then(newMux(routes...))
+		if len(corsOrigins) > 0 {
+			handler = cors.New(corsOrigins, corsHeaders).Middleware(handler)
+		}
+		return handler
+	}
 
-	// Only start TLS-based services if certs and keys are provided
-	if *flagCertFile != "" && *flagKeyFile != "" {
-		server := httpServer(
-			*flagEndpoint,
-			acm.Then(mux))
-		log.Info("About to listen for wss tests", "endpoint", *flagEndpoint)
+	// Protocols with a dedicated address are only served on their own
+	// listeners, every other protocol on the shared ones.
+	cleartextRoutes := [][]route{healthRoutes, adminRoutes}
+	tlsRoutes := [][]route{healthRoutes, adminRoutes}
+	var listeners []listener
+	for i, p := range protocols {
+		routes := protocolRoutes[i]
+		addr, tlsAddr := p.Addrs()
+		if addr != "" {
+			listeners = append(listeners, listener{name: p.Name() + "-cleartext",
+				addr: addr, handler: newHandler(healthRoutes, routes)})
+		} else {
+			cleartextRoutes = append(cleartextRoutes, routes)
+		}
+		if tlsAddr != "" {
+			listeners = append(listeners, listener{name: p.Name() + "-tls",
+				addr: tlsAddr, handler: newHandler(healthRoutes, routes),
+				tls: true})
+		} else {
+			tlsRoutes = append(tlsRoutes, routes)
+		}
+	}
+	handler := newHandler(cleartextRoutes...)
 
-		tcpl, err := net.Listen("tcp", server.Addr)
-		rtx.Must(err, "failed to create listener")
-		l := netx.NewListener(tcpl.(*net.TCPListener))
-		defer l.Close()
+	// In ACME mode, the shared cleartext server answers http-01 challenges
+	// and redirects every other request to the shared TLS server, except for
+	// health checks.
+	var acmeManager *autocert.Manager
+	cleartextHandler := handler
+	if *flagACME {
+		acmeManager = certs.NewACMEManager(acmeHosts, *flagACMECacheDir,
+			*flagACMEEmail, *flagACMEDirectory)
+		redirect, err := certs.RedirectHandler(*flagEndpoint)
+		rtx.Must(err, "invalid TLS endpoint")
+		acmeMux := http.NewServeMux()
+		acmeMux.Handle("/", acmeManager.HTTPHandler(redirect))
+		acmeMux.Handle(admin.HealthPath, handler)
+		acmeMux.Handle(admin.ReadyPath, handler)
+		acmeMux.Handle(admin.VersionPath, handler)
+		cleartextHandler = acmeMux
+	}
+	listeners = append([]listener{{name: "cleartext",
+		addr: *flagEndpointCleartext, handler: cleartextHandler}}, listeners...)
 
-		go func() {
-			err := server.ServeTLS(l, *flagCertFile, *flagKeyFile)
-			rtx.Must(err, "Could not start cleartext server")
-			defer server.Close()
-		}()
+	// Only start TLS-based services if certs and keys are provided or ACME is
+	// enabled.
+	var (
+		getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+		certCheck      admin.Check
+	)
+	if acmeManager != nil {
+		getCertificate = acmeManager.GetCertificate
+	} else if *flagCertFile != "" && *flagKeyFile != "" {
+		// Certificates are reloaded when their files change, so that
+		// rotated certificates are used for new connections without a
+		// restart.
+		reloader, err := certs.NewReloader(*flagCertFile, *flagKeyFile)
+		rtx.Must(err, "failed to load TLS certificate")
+		getCertificate = reloader.GetCertificate
+		certCheck = reloader.Check
+	}
+	if getCertificate != nil {
+		listeners = append(listeners, listener{name: "tls",
+			addr: *flagEndpoint, handler: newHandler(tlsRoutes...), tls: true})
 	}
 
-	// Start a UDP server for latency measurements.
-	addr, err := net.ResolveUDPAddr("udp", *flagLatencyEndpoint)
-	rtx.Must(err, "failed to resolve latency endpoint address")
-	udpListener, err := net.ListenUDP("udp", addr)
-	rtx.Must(err, "cannot start latency UDP server")
-	defer udpListener.Close()
+	var servers []*http.Server
+	for _, ln := range listeners {
+		srv := httpServer(ln.addr, ln.handler)
+		tcpl, err := sockets.TCPListener(ln.name)
+		rtx.Must(err, "cannot use activated socket %s", ln.name)
+		if tcpl != nil {
+			rtx.Must(netx.CheckFamily(tcpl, *flagIPFamily),
+				"activated socket %s does not match -ip-family", ln.name)
+		} else {
+			network, _ := netx.ListenNetwork("tcp", *flagIPFamily)
+			l, err := net.Listen(network, srv.Addr)
+			rtx.Must(err, "failed to create listener")
+			tcpl = l.(*net.TCPListener)
+		}
+		log.Info("About to listen for tests", "listener", ln.name,
+			"endpoint", tcpl.Addr())
+		l := netx.NewListener(tcpl)
 
-	go latency1Handler.ProcessPacketLoop(udpListener)
+		checks := []admin.Check{admin.DialCheck(l.Addr().String())}
+		serve := func() error { return srv.Serve(l) }
+		if ln.tls {
+			srv.TLSConfig.GetCertificate = getCertificate
+			if acmeManager != nil {
+				// ServeTLS adds the HTTP protocols to NextProtos.
+				srv.TLSConfig.NextProtos = []string{certs.ALPNProto}
+			}
+			if certCheck != nil {
+				checks = append(checks, certCheck)
+			}
+			serve = func() error { return srv.ServeTLS(l, "", "") }
+		}
+		health.Register(ln.name, func() error {
+			for _, check := range checks {
+				if err := check(); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+		go func(name string) {
+			err := serve()
+			if err != http.ErrServerClosed {
+				rtx.Must(err, "Could not start %s server", name)
+			}
+		}(ln.name)
+		servers = append(servers, srv)
+	}
+	if unused := sockets.Names(); len(unused) > 0 {
+		log.Warn("Ignoring activated sockets not matching any listener",
+			"names", unused)
+	}
+	sockets.Close()
+
+	// Reload the reloadable flags from the configuration file on SIGHUP.
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	defer signal.Stop(hupCh)
+	go func() {
+		for range hupCh {
+			if err := reload(env, limiter, protocols); err != nil {
+				log.Error("Failed to reload configuration", "error", err)
+			}
+		}
+	}()
 
 	<-ctx.Done()
 	cancel()
+
+	shutdown(servers, protocols)
+
+	if *flagStatsSnapshot {
+		df, err := stats.WriteSnapshot(*flagDataDir, startTime,
+			prometheus.DefaultGatherer)
+		if err != nil {
+			log.Error("failed to write stats snapshot", "error", err)
+			return
+		}
+		log.Info("Stats snapshot written", "path", df.Path)
+	}
 }
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+
+	"github.com/charmbracelet/log"
+	"github.com/m-lab/go/flagx"
+	"github.com/m-lab/msak/internal/admin"
+	"github.com/m-lab/msak/internal/netx"
+	"github.com/m-lab/msak/internal/protocol"
+	"github.com/m-lab/msak/pkg/options"
+	"github.com/m-lab/msak/pkg/quota"
+	"github.com/m-lab/msak/pkg/throughput1/server"
+	"github.com/m-lab/msak/pkg/throughput1/spec"
+)
+
+var (
+	flagThroughput1Enable = flag.Bool("throughput1.enable", true,
+		"Enable the throughput1 subsystem")
+	flagThroughput1Addr = flag.String("throughput1.addr", "",
+		"Dedicated listen address/port for cleartext throughput1 tests. If empty, they are served on -ws_addr")
+	flagThroughput1TLSAddr = flag.String("throughput1.tls-addr", "",
+		"Dedicated listen address/port for TLS throughput1 tests. If empty, they are served on -wss_addr")
+	flagAllowCompression = flag.Bool("throughput1.allow-compression", false,
+		"Allow clients to negotiate WebSocket compression (for experiments only)")
+	flagMaxStreamsPerMID = flag.Int("throughput1.max-streams-per-mid", 16,
+		"Maximum number of concurrent throughput1 streams per mid (0 = unlimited)")
+	flagGenerateMID = flag.Bool("throughput1.generate-mid", false,
+		"Generate a mid for throughput1 requests without one. Ignored if -token.verify is set")
+	flagMaxRuntime = flag.Duration("throughput1.max-runtime", spec.MaxRuntime,
+		"Maximum runtime of a throughput1 stream")
+	flagDefaultDuration = flag.Duration("throughput1.default-duration", options.DefaultDuration,
+		"Duration of throughput1 streams whose client does not request one")
+	flagDownsampling = flag.Int("throughput1.downsampling", 0,
+		"Archive only one every N throughput1 measurements, plus the first, last and RTT extremes (0 or 1 = archive all)")
+	flagCaptureDir = flag.String("throughput1.capture-dir", "",
+		"Directory to record the WebSocket messages of every throughput1 test to, for replay with msak-replay (debugging only)")
+	flagFinalFlushTimeout = flag.Duration("throughput1.final-flush-timeout", spec.FinalFlushTimeout,
+		"Time allowed to send the final measurement of a throughput1 stream once it is over")
+	flagMaxConcurrentTests = flag.Int("throughput1.max-concurrent-tests", 0,
+		"Maximum number of concurrent throughput1 connections (0 = unlimited)")
+	flagMemoryBudget = flag.Int64("throughput1.memory-budget", 0,
+		"Maximum memory in bytes committed to WebSocket buffers across throughput1 connections (0 = unlimited)")
+	flagSndBuf = flag.Int("throughput1.sndbuf", 0,
+		"SO_SNDBUF size in bytes for throughput1 connections (0 = kernel default)")
+	flagRcvBuf = flag.Int("throughput1.rcvbuf", 0,
+		"SO_RCVBUF size in bytes for throughput1 connections (0 = kernel default)")
+	flagNotSentLowat = flag.Int("throughput1.notsent-lowat", 0,
+		"TCP_NOTSENT_LOWAT in bytes for throughput1 download connections (0 = unset)")
+	flagNDT7 = flag.Bool("throughput1.ndt7", false,
+		"Serve single-stream throughput1 tests to ndt7 clients on /ndt/v7/download and /ndt/v7/upload, archived as ndt7shim")
+	flagHostStats = flag.Bool("throughput1.host-stats", false,
+		"Record the drops and errors of the serving network interface and its qdisc in every throughput1 result")
+	flagTokenExpiryPolicy = flag.String("throughput1.token-expiry-policy", string(server.TokenExpiryClamp),
+		"What to do with streams whose duration exceeds their access token's validity: clamp, reject or ignore")
+	flagQuotaTests = flag.Int64("throughput1.quota-tests", 0,
+		"Maximum number of throughput1 tests per access token subject per day (0 = unlimited). Requires -token.verify")
+	flagQuotaBytes = flag.Int64("throughput1.quota-bytes", 0,
+		"Maximum number of throughput1 bytes per access token subject per day (0 = unlimited). Requires -token.verify")
+	flagQuotaFile = flag.String("throughput1.quota-file", "",
+		"File where per-subject quota usage is persisted every minute and at shutdown. If empty, usage is only kept in memory")
+	flagMetadataMaxKeyLength = flag.Int("throughput1.metadata-max-key-length",
+		options.MaxMetadataKeyLength, "Maximum length of a throughput1 client metadata key")
+	flagMetadataMaxValueLength = flag.Int("throughput1.metadata-max-value-length",
+		options.MaxMetadataValueLength, "Maximum length of a throughput1 client metadata value")
+	flagMetadataMaxCount = flag.Int("throughput1.metadata-max-count", 0,
+		"Maximum number of throughput1 client metadata parameters (0 = unlimited)")
+	allowedCC       = flagx.StringArray{}
+	allowedMetadata = flagx.StringArray{}
+	allowedOrigins  = flagx.StringArray{}
+)
+
+func init() {
+	flag.Var(&allowedCC, "throughput1.allowed-cc",
+		"Congestion control algorithms clients can request. If empty, the algorithms allowed by the kernel are used")
+	flag.Var(&allowedMetadata, "throughput1.allowed-metadata",
+		"Client metadata keys to archive. If empty, every key is archived. Other keys are dropped")
+	flag.Var(&allowedOrigins, "throughput1.allowed-origins",
+		"Origins allowed to start throughput1 tests, e.g. https://*.example.com. If empty, every origin is allowed")
+	protocol.Register(&throughput1Protocol{})
+}
+
+// throughput1Protocol serves the throughput1 protocol.
+type throughput1Protocol struct {
+	handler *server.Handler
+
+	// stopQuota stops persisting the quota store, if any, and returns once
+	// its usage is saved.
+	stopQuota func()
+}
+
+// Name returns "throughput1".
+func (p *throughput1Protocol) Name() string {
+	return "throughput1"
+}
+
+// Datatype returns "throughput1".
+func (p *throughput1Protocol) Datatype() string {
+	return "throughput1"
+}
+
+// Enabled returns the value of -throughput1.enable.
+func (p *throughput1Protocol) Enabled() bool {
+	return *flagThroughput1Enable
+}
+
+// Addrs returns the values of -throughput1.addr and -throughput1.tls-addr.
+func (p *throughput1Protocol) Addrs() (string, string) {
+	return *flagThroughput1Addr, *flagThroughput1TLSAddr
+}
+
+// Validate checks the consistency of the throughput1 flags.
+func (p *throughput1Protocol) Validate(env protocol.Env) error {
+	if *flagDefaultDuration > *flagMaxRuntime {
+		return fmt.Errorf("-throughput1.default-duration (%v) exceeds -throughput1.max-runtime (%v)",
+			*flagDefaultDuration, *flagMaxRuntime)
+	}
+	if !env.TokenVerify && (*flagQuotaTests > 0 || *flagQuotaBytes > 0) {
+		return errors.New("-throughput1.quota-tests and -throughput1.quota-bytes require -token.verify")
+	}
+	switch server.TokenExpiryPolicy(*flagTokenExpiryPolicy) {
+	case server.TokenExpiryClamp, server.TokenExpiryReject, server.TokenExpiryIgnore:
+	default:
+		return fmt.Errorf("invalid -throughput1.token-expiry-policy: %q", *flagTokenExpiryPolicy)
+	}
+	return nil
+}
+
+// Start creates the throughput1 handler and returns its routes.
+func (p *throughput1Protocol) Start(env protocol.Env) ([]protocol.Route, error) {
+	var store *quota.Store
+	if env.TokenVerify && (*flagQuotaTests > 0 || *flagQuotaBytes > 0) {
+		var err error
+		store, err = quota.NewStore(*flagQuotaFile, *flagQuotaTests, *flagQuotaBytes)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load quota store: %w", err)
+		}
+	}
+	h, err := newThroughput1Handler(env, store)
+	if err != nil {
+		return nil, err
+	}
+	p.handler = h
+	if store != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			store.Run(ctx, quota.FlushInterval)
+		}()
+		p.stopQuota = func() {
+			cancel()
+			<-done
+		}
+	}
+	routes := []protocol.Route{
+		{Path: spec.DownloadPath, Handler: http.HandlerFunc(h.Download),
+			Authorized: true, StartsTest: true},
+		{Path: spec.UploadPath, Handler: http.HandlerFunc(h.Upload),
+			Authorized: true, StartsTest: true},
+	}
+	if *flagNDT7 {
+		routes = append(routes,
+			protocol.Route{Path: spec.NDT7DownloadPath, Handler: http.HandlerFunc(h.NDT7Download),
+				Authorized: true, StartsTest: true},
+			protocol.Route{Path: spec.NDT7UploadPath, Handler: http.HandlerFunc(h.NDT7Upload),
+				Authorized: true, StartsTest: true})
+	}
+	if env.AdminToken != "" {
+		routes = append(routes, protocol.Route{Path: spec.MonitorPath,
+			Handler: admin.RequireToken(env.AdminToken,
+				http.HandlerFunc(h.Monitor))})
+	}
+	return routes, nil
+}
+
+// Drain drains the throughput1 handler.
+func (p *throughput1Protocol) Drain(ctx context.Context) error {
+	return p.handler.Drain(ctx)
+}
+
+// Close saves the usage of the quota store, if any. There is nothing else
+// to close, since throughput1 is only served over HTTP.
+func (p *throughput1Protocol) Close() error {
+	if p.stopQuota != nil {
+		p.stopQuota()
+	}
+	return nil
+}
+
+// ReloadableFlags returns the throughput1 flags that can be reloaded on
+// SIGHUP: the CC, metadata and origin allowlists, and the metadata limits.
+func (p *throughput1Protocol) ReloadableFlags() []string {
+	return []string{
+		"throughput1.allowed-cc",
+		"throughput1.allowed-metadata",
+		"throughput1.allowed-origins",
+		"throughput1.metadata-max-key-length",
+		"throughput1.metadata-max-value-length",
+		"throughput1.metadata-max-count",
+	}
+}
+
+// Reload applies the reloadable flags to the throughput1 handler.
+func (p *throughput1Protocol) Reload(env protocol.Env) error {
+	p.handler.Reload(server.Reloadable{
+		AllowedOrigins: allowedOrigins,
+		AllowedCC:      throughput1CC(),
+		MetadataPolicy: throughput1MetadataPolicy(),
+	})
+	return nil
+}
+
+// throughput1CC returns the congestion control algorithms throughput1
+// clients can request. If no CC allowlist is configured, these are the
+// algorithms the kernel lets unprivileged processes select. If they cannot
+// be read either, it returns nil so that the handler's defaults are used.
+func throughput1CC() []string {
+	ccAlgorithms := []string(allowedCC)
+	if len(ccAlgorithms) == 0 {
+		var err error
+		ccAlgorithms, err = netx.AllowedCC()
+		if err != nil {
+			log.Info("Cannot read the allowed congestion control algorithms, using defaults",
+				"error", err)
+		}
+	}
+	return ccAlgorithms
+}
+
+// throughput1MetadataPolicy returns the metadata policy configured by the
+// throughput1 flags.
+func throughput1MetadataPolicy() options.MetadataPolicy {
+	return options.MetadataPolicy{
+		MaxKeyLength:   *flagMetadataMaxKeyLength,
+		MaxValueLength: *flagMetadataMaxValueLength,
+		MaxCount:       *flagMetadataMaxCount,
+		Allowed:        allowedMetadata,
+	}
+}
+
+// newThroughput1Handler returns a throughput1 handler configured according
+// to the command line flags, enforcing the quotas of store if not nil.
+func newThroughput1Handler(env protocol.Env, store *quota.Store) (*server.Handler, error) {
+	ccAlgorithms := throughput1CC()
+	// Detect whether fq pacing is available, since BBR behaves differently
+	// without it. Results record the serving interface's root qdisc, and
+	// only fall back to the default one if it cannot be read.
+	qdisc, err := netx.DefaultQdisc()
+	if err != nil {
+		log.Info("Cannot read the default qdisc", "error", err)
+	}
+	log.Info("Default qdisc", "qdisc", qdisc, "fq-pacing", netx.FQPacing(qdisc))
+	throughputOpts := []server.Option{
+		server.WithDataDir(env.DataDir),
+		server.WithRegistry(env.Registerer),
+		server.WithMaxStreamsPerMID(*flagMaxStreamsPerMID),
+		server.WithMaxRuntime(*flagMaxRuntime),
+		server.WithDefaultDuration(*flagDefaultDuration),
+		server.WithFinalFlushTimeout(*flagFinalFlushTimeout),
+		server.WithCaptureDir(*flagCaptureDir),
+		server.WithDownsampling(*flagDownsampling),
+		server.WithMemoryBudget(*flagMemoryBudget),
+		server.WithMaxConcurrentTests(*flagMaxConcurrentTests),
+		server.WithSocketBuffers(*flagSndBuf, *flagRcvBuf),
+		server.WithNotSentLowat(*flagNotSentLowat),
+		server.WithQdisc(qdisc),
+		server.WithAdvertisedServer(env.AdvertisedHost),
+		server.WithHostStats(*flagHostStats),
+		server.WithAllowCompression(*flagAllowCompression),
+		server.WithGenerateMID(*flagGenerateMID && !env.TokenVerify),
+		server.WithAllowedOrigins(allowedOrigins...),
+		server.WithTokenMachine(env.TokenMachine),
+		server.WithTokenExpiryPolicy(server.TokenExpiryPolicy(*flagTokenExpiryPolicy)),
+		server.WithMetadataPolicy(throughput1MetadataPolicy()),
+	}
+	if len(ccAlgorithms) > 0 {
+		log.Info("Allowed congestion control algorithms", "cc", ccAlgorithms)
+		throughputOpts = append(throughputOpts, server.WithAllowedCC(ccAlgorithms...))
+	}
+	if store != nil {
+		throughputOpts = append(throughputOpts, server.WithQuota(store))
+	}
+	return server.New(throughputOpts...), nil
+}
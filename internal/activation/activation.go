@@ -0,0 +1,133 @@
+// Package activation retrieves the listening sockets passed by systemd socket
+// activation, so that the server can be restarted without closing them.
+//
+// Sockets are identified by the FileDescriptorName= of their .socket unit.
+package activation
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd.
+var listenFdsStart = 3
+
+const (
+	envPID     = "LISTEN_PID"
+	envFDs     = "LISTEN_FDS"
+	envFDNames = "LISTEN_FDNAMES"
+)
+
+// ErrNotTCP and ErrNotUDP are returned when an activated socket is not of the
+// expected type.
+var (
+	ErrNotTCP = errors.New("activated socket is not a TCP listener")
+	ErrNotUDP = errors.New("activated socket is not a UDP socket")
+)
+
+// Sockets holds the sockets passed by systemd, by name.
+type Sockets struct {
+	files map[string]*os.File
+}
+
+// New returns the sockets passed to this process by systemd. It returns an
+// empty Sockets if the process was not socket-activated. The environment
+// variables describing the sockets are unset, so that they are not inherited
+// by child processes.
+func New() (*Sockets, error) {
+	defer func() {
+		os.Unsetenv(envPID)
+		os.Unsetenv(envFDs)
+		os.Unsetenv(envFDNames)
+	}()
+	s := &Sockets{files: map[string]*os.File{}}
+	pid, err := strconv.Atoi(os.Getenv(envPID))
+	if err != nil || pid != os.Getpid() {
+		return s, nil
+	}
+	n, err := strconv.Atoi(os.Getenv(envFDs))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid %s: %q", envFDs, os.Getenv(envFDs))
+	}
+	var names []string
+	if v := os.Getenv(envFDNames); v != "" {
+		names = strings.Split(v, ":")
+	}
+	if len(names) != n {
+		return nil, fmt.Errorf("%s must name each of the %d sockets", envFDNames, n)
+	}
+	for i, name := range names {
+		fd := listenFdsStart + i
+		if _, ok := s.files[name]; ok {
+			return nil, fmt.Errorf("duplicate socket name: %q", name)
+		}
+		s.files[name] = os.NewFile(uintptr(fd), name)
+	}
+	return s, nil
+}
+
+// Names returns the names of the sockets not retrieved yet.
+func (s *Sockets) Names() []string {
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	return names
+}
+
+// TCPListener returns the TCP listener called name, or nil if there is none.
+func (s *Sockets) TCPListener(name string) (*net.TCPListener, error) {
+	f, ok := s.take(name)
+	if !ok {
+		return nil, nil
+	}
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	tcpl, ok := l.(*net.TCPListener)
+	if !ok {
+		l.Close()
+		return nil, fmt.Errorf("%w: %q", ErrNotTCP, name)
+	}
+	return tcpl, nil
+}
+
+// UDPConn returns the UDP socket called name, or nil if there is none.
+func (s *Sockets) UDPConn(name string) (*net.UDPConn, error) {
+	f, ok := s.take(name)
+	if !ok {
+		return nil, nil
+	}
+	defer f.Close()
+	c, err := net.FilePacketConn(f)
+	if err != nil {
+		return nil, err
+	}
+	udpc, ok := c.(*net.UDPConn)
+	if !ok {
+		c.Close()
+		return nil, fmt.Errorf("%w: %q", ErrNotUDP, name)
+	}
+	return udpc, nil
+}
+
+// Close closes the sockets not retrieved yet.
+func (s *Sockets) Close() {
+	for name, f := range s.files {
+		f.Close()
+		delete(s.files, name)
+	}
+}
+
+// take removes the socket called name from s and returns it.
+func (s *Sockets) take(name string) (*os.File, bool) {
+	f, ok := s.files[name]
+	delete(s.files, name)
+	return f, ok
+}
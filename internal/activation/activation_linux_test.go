@@ -0,0 +1,80 @@
+package activation
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/m-lab/go/testingx"
+)
+
+// passSocket duplicates the socket of f onto fd, as systemd would.
+func passSocket(t *testing.T, f interface{ File() (*os.File, error) }, fd int) {
+	file, err := f.File()
+	testingx.Must(t, err, "cannot get socket file")
+	defer file.Close()
+	testingx.Must(t, syscall.Dup3(int(file.Fd()), fd, 0), "cannot duplicate socket")
+}
+
+func TestNew(t *testing.T) {
+	tcpl, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	testingx.Must(t, err, "cannot listen")
+	defer tcpl.Close()
+	udpc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	testingx.Must(t, err, "cannot listen")
+	defer udpc.Close()
+
+	listenFdsStart = 100
+	defer func() { listenFdsStart = 3 }()
+	passSocket(t, tcpl, 100)
+	passSocket(t, udpc, 101)
+	passSocket(t, tcpl, 102)
+	t.Setenv(envPID, strconv.Itoa(os.Getpid()))
+	t.Setenv(envFDs, "3")
+	t.Setenv(envFDNames, "cleartext:latency1:unused")
+
+	s, err := New()
+	testingx.Must(t, err, "New failed")
+	if os.Getenv(envFDs) != "" {
+		t.Errorf("%s not unset", envFDs)
+	}
+
+	l, err := s.TCPListener("cleartext")
+	testingx.Must(t, err, "cannot get TCP listener")
+	if l == nil || l.Addr().String() != tcpl.Addr().String() {
+		t.Errorf("TCPListener() = %v, want a listener on %s", l, tcpl.Addr())
+	}
+	defer l.Close()
+	if _, err := s.TCPListener("latency1"); err == nil {
+		t.Errorf("TCPListener() with a UDP socket did not fail")
+	}
+	if l, err := s.TCPListener("tls"); l != nil || err != nil {
+		t.Errorf("TCPListener() with a missing socket = %v, %v", l, err)
+	}
+	if names := s.Names(); len(names) != 1 || names[0] != "unused" {
+		t.Errorf("Names() = %v, want [unused]", names)
+	}
+	s.Close()
+	if names := s.Names(); len(names) != 0 {
+		t.Errorf("Names() after Close = %v", names)
+	}
+}
+
+func TestNew_notActivated(t *testing.T) {
+	t.Setenv(envPID, "1")
+	t.Setenv(envFDs, "1")
+	s, err := New()
+	testingx.Must(t, err, "New failed")
+	if names := s.Names(); len(names) != 0 {
+		t.Errorf("Names() = %v, want none", names)
+	}
+
+	t.Setenv(envPID, strconv.Itoa(os.Getpid()))
+	t.Setenv(envFDs, "2")
+	t.Setenv(envFDNames, "cleartext")
+	if _, err := New(); err == nil {
+		t.Errorf("New() with missing names did not fail")
+	}
+}
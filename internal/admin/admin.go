@@ -0,0 +1,42 @@
+// Package admin contains HTTP handlers for administrative endpoints of
+// msak-server, such as the maintenance mode toggle and the health checks, and
+// the authentication middleware protecting them.
+package admin
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var adminRequests = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "msak",
+		Subsystem: "admin",
+		Name:      "requests_total",
+		Help:      "Number of requests to administrative endpoints.",
+	},
+	[]string{"status"},
+)
+
+// RequireToken returns a handler that only calls next if the request includes
+// an "Authorization: Bearer <token>" header matching the provided token. Other
+// requests receive a 401 Unauthorized response.
+//
+// If token is empty, every request is rejected.
+func RequireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		provided, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" ||
+			subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			adminRequests.WithLabelValues("unauthorized").Inc()
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		adminRequests.WithLabelValues("ok").Inc()
+		next.ServeHTTP(rw, req)
+	})
+}
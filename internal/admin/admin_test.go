@@ -0,0 +1,56 @@
+package admin_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/m-lab/msak/internal/admin"
+)
+
+func TestRequireToken(t *testing.T) {
+	ok := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	tests := []struct {
+		name       string
+		token      string
+		header     string
+		statusCode int
+	}{
+		{
+			name:       "valid token",
+			token:      "secret",
+			header:     "Bearer secret",
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "wrong token",
+			token:      "secret",
+			header:     "Bearer wrong",
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "missing header",
+			token:      "secret",
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "empty token",
+			token:      "",
+			header:     "Bearer ",
+			statusCode: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			admin.RequireToken(tt.token, ok).ServeHTTP(rw, req)
+			if rw.Code != tt.statusCode {
+				t.Errorf("unexpected status code %d (expected %d)", rw.Code, tt.statusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/m-lab/msak/internal/persistence"
+)
+
+const (
+	// ArchivesPath is the path of the endpoint listing recent archives.
+	ArchivesPath = "/admin/v1/archives"
+	// ArchivePath is the path of the endpoint returning the archives of a
+	// measurement.
+	ArchivePath = "/admin/v1/archive"
+
+	// DefaultArchivesLimit is the number of archives returned when the
+	// request does not set a limit. MaxArchivesLimit is the highest limit
+	// accepted.
+	DefaultArchivesLimit = 100
+	MaxArchivesLimit     = 1000
+)
+
+// ArchiveFile describes an archive in the data directory.
+type ArchiveFile struct {
+	// Path is the archive's path relative to the data directory.
+	Path string
+	// Datatype is the archive's datatype, i.e. its top-level directory.
+	Datatype string
+	// Size is the archive's size in bytes.
+	Size int64
+	// ModTime is when the archive was written.
+	ModTime time.Time
+}
+
+// Archive is an archive and its content.
+type Archive struct {
+	ArchiveFile
+	// Data is the archived JSON document.
+	Data json.RawMessage
+}
+
+// Archives serves the archives written to a data directory, so that the
+// results of a test can be inspected without shell access to the server.
+type Archives struct {
+	dir string
+}
+
+// NewArchives returns Archives serving the archives found in dir.
+func NewArchives(dir string) *Archives {
+	return &Archives{dir: dir}
+}
+
+// ListHandler returns the handler of the archives listing endpoint. It
+// responds to GET requests with the most recent ArchiveFiles first. The
+// "datatype", "mid" and "uuid" querystring parameters restrict the listing
+// to the matching archives, and "limit" sets the maximum number of entries.
+//
+// Only archives whose name includes the hash of the mid, such as throughput1
+// results, can be found by mid.
+//
+// This handler does not perform authentication and should be wrapped with
+// RequireToken.
+func (a *Archives) ListHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		files, ok := a.serveFind(rw, req)
+		if !ok {
+			return
+		}
+		writeJSON(rw, http.StatusOK, files)
+	})
+}
+
+// GetHandler returns the handler of the archive endpoint. It responds to GET
+// requests with the matching Archives, most recent first. The request must
+// include a "uuid" or "mid" querystring parameter, and accepts the same
+// parameters as ListHandler.
+//
+// This handler does not perform authentication and should be wrapped with
+// RequireToken.
+func (a *Archives) GetHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		if query.Get("uuid") == "" && query.Get("mid") == "" {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		files, ok := a.serveFind(rw, req)
+		if !ok {
+			return
+		}
+		archives := []Archive{}
+		for _, f := range files {
+			data, err := os.ReadFile(filepath.Join(a.dir, f.Path))
+			if err != nil {
+				rw.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			archives = append(archives, Archive{ArchiveFile: f, Data: data})
+		}
+		writeJSON(rw, http.StatusOK, archives)
+	})
+}
+
+// serveFind returns the archives matching the request's querystring. If the
+// request is invalid or the archives cannot be listed, it writes the error
+// response and returns false.
+func (a *Archives) serveFind(rw http.ResponseWriter, req *http.Request) ([]ArchiveFile, bool) {
+	if req.Method != http.MethodGet {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	query := req.URL.Query()
+	limit := DefaultArchivesLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > MaxArchivesLimit {
+			rw.WriteHeader(http.StatusBadRequest)
+			return nil, false
+		}
+		limit = n
+	}
+	files, err := a.find(query.Get("datatype"), query.Get("mid"),
+		query.Get("uuid"), limit)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return nil, false
+	}
+	return files, true
+}
+
+// find returns up to limit archives with the given datatype, mid and uuid,
+// most recent first. Empty values match every archive.
+func (a *Archives) find(datatype, mid, uuid string, limit int) ([]ArchiveFile, error) {
+	var suffix string
+	switch {
+	case mid != "" && uuid != "":
+		suffix = "." + persistence.ArchiveID(mid, uuid) + ".json"
+	case mid != "":
+		suffix = "." + persistence.MIDHash(mid) + "."
+	case uuid != "":
+		suffix = "." + uuid + ".json"
+	}
+	files := []ArchiveFile{}
+	err := a.walk(datatype, suffix, true, func(f ArchiveFile) bool {
+		files = append(files, f)
+		return len(files) < limit
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// walk calls fn with the archives with the given datatype whose name contains
+// substr, until it returns false. Empty values match every archive. Archives
+// are stored as <datatype>/<yyyy>/<mm>/<dd>/<name>, and are visited one date
+// directory at a time, from the most recent if newestFirst is true or from
+// the oldest otherwise, so that only the directories needed are read. The
+// archives of a date are ordered by modification time in the same direction.
+func (a *Archives) walk(datatype, substr string, newestFirst bool, fn func(ArchiveFile) bool) error {
+	datatypes, err := subdirs(a.dir)
+	if err != nil {
+		return err
+	}
+	// Map each date directory, as yyyy/mm/dd, to the datatypes having it.
+	dates := map[string][]string{}
+	for _, dt := range datatypes {
+		if datatype != "" && dt != datatype {
+			continue
+		}
+		years, err := subdirs(filepath.Join(a.dir, dt))
+		if err != nil {
+			return err
+		}
+		for _, y := range years {
+			months, err := subdirs(filepath.Join(a.dir, dt, y))
+			if err != nil {
+				return err
+			}
+			for _, m := range months {
+				days, err := subdirs(filepath.Join(a.dir, dt, y, m))
+				if err != nil {
+					return err
+				}
+				for _, d := range days {
+					date := y + "/" + m + "/" + d
+					dates[date] = append(dates[date], dt)
+				}
+			}
+		}
+	}
+	sorted := make([]string, 0, len(dates))
+	for date := range dates {
+		sorted = append(sorted, date)
+	}
+	sort.Strings(sorted)
+	if newestFirst {
+		sort.Sort(sort.Reverse(sort.StringSlice(sorted)))
+	}
+
+	for _, date := range sorted {
+		files := []ArchiveFile{}
+		for _, dt := range dates[date] {
+			rel := dt + "/" + date
+			entries, err := os.ReadDir(filepath.Join(a.dir, filepath.FromSlash(rel)))
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				name := e.Name()
+				if e.IsDir() || !strings.HasSuffix(name, ".json") ||
+					!strings.Contains(name, substr) {
+					continue
+				}
+				info, err := e.Info()
+				if errors.Is(err, fs.ErrNotExist) {
+					// The archive was removed since the directory was read.
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				files = append(files, ArchiveFile{
+					Path:     rel + "/" + name,
+					Datatype: dt,
+					Size:     info.Size(),
+					ModTime:  info.ModTime(),
+				})
+			}
+		}
+		sort.Slice(files, func(i, j int) bool {
+			if newestFirst {
+				return files[i].ModTime.After(files[j].ModTime)
+			}
+			return files[i].ModTime.Before(files[j].ModTime)
+		})
+		for _, f := range files {
+			if !fn(f) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// subdirs returns the names of the directories in dir, or none if dir does
+// not exist.
+func subdirs(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,138 @@
+package admin_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/msak/internal/admin"
+	"github.com/m-lab/msak/internal/persistence"
+)
+
+// writeArchive writes an archive in the date directory of modTime.
+func writeArchive(t *testing.T, dir, datatype, id string, modTime time.Time) {
+	path := filepath.Join(dir, datatype, modTime.UTC().Format("2006/01/02"),
+		datatype+"-download-"+modTime.UTC().Format("20060102T150405.000000000Z")+
+			"."+id+".json")
+	rtx.Must(os.MkdirAll(filepath.Dir(path), 0755), "cannot create dir")
+	rtx.Must(os.WriteFile(path, []byte(`{"ID":"`+id+`"}`), 0644),
+		"cannot write archive")
+	rtx.Must(os.Chtimes(path, modTime, modTime), "cannot set mtime")
+}
+
+func TestArchives(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	writeArchive(t, dir, "throughput1", persistence.ArchiveID("mid-a", "uuid-1"),
+		now.Add(-2*time.Minute))
+	writeArchive(t, dir, "throughput1", persistence.ArchiveID("mid-a", "uuid-2"),
+		now.Add(-time.Minute))
+	writeArchive(t, dir, "latency1", "uuid-3", now)
+	// Files outside the archive layout are ignored.
+	rtx.Must(os.WriteFile(filepath.Join(dir, "other.json"), []byte("{}"), 0644),
+		"cannot write file")
+	archives := admin.NewArchives(dir)
+
+	tests := []struct {
+		name    string
+		handler http.Handler
+		query   string
+		code    int
+		want    []string
+	}{
+		{"list all", archives.ListHandler(), "", http.StatusOK,
+			[]string{"latency1", "throughput1", "throughput1"}},
+		{"list with limit", archives.ListHandler(), "?limit=1", http.StatusOK,
+			[]string{"latency1"}},
+		{"list by datatype", archives.ListHandler(), "?datatype=throughput1",
+			http.StatusOK, []string{"throughput1", "throughput1"}},
+		{"list by mid", archives.ListHandler(), "?mid=mid-a", http.StatusOK,
+			[]string{"throughput1", "throughput1"}},
+		{"list by unknown mid", archives.ListHandler(), "?mid=mid-b",
+			http.StatusOK, []string{}},
+		{"invalid limit", archives.ListHandler(), "?limit=0",
+			http.StatusBadRequest, nil},
+		{"get by uuid", archives.GetHandler(), "?uuid=uuid-3", http.StatusOK,
+			[]string{"latency1"}},
+		{"get by mid and uuid", archives.GetHandler(), "?mid=mid-a&uuid=uuid-1",
+			http.StatusOK, []string{"throughput1"}},
+		{"get without uuid or mid", archives.GetHandler(), "",
+			http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			tt.handler.ServeHTTP(rw, httptest.NewRequest(http.MethodGet,
+				admin.ArchivesPath+tt.query, nil))
+			if rw.Code != tt.code {
+				t.Fatalf("status code = %d, want %d", rw.Code, tt.code)
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+			var got []admin.Archive
+			rtx.Must(json.Unmarshal(rw.Body.Bytes(), &got), "cannot unmarshal response")
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d archives, want %d: %+v", len(got), len(tt.want), got)
+			}
+			for i, a := range got {
+				if a.Datatype != tt.want[i] || a.Size == 0 {
+					t.Errorf("archive %d = %+v, want datatype %s", i, a, tt.want[i])
+				}
+			}
+		})
+	}
+
+	// The content of the archives is returned as JSON.
+	rw := httptest.NewRecorder()
+	archives.GetHandler().ServeHTTP(rw, httptest.NewRequest(http.MethodGet,
+		admin.ArchivePath+"?uuid=uuid-3", nil))
+	var got []admin.Archive
+	rtx.Must(json.Unmarshal(rw.Body.Bytes(), &got), "cannot unmarshal response")
+	if len(got) != 1 || string(got[0].Data) != `{"ID":"uuid-3"}` {
+		t.Errorf("unexpected archive content: %+v", got)
+	}
+}
+
+func TestArchives_dates(t *testing.T) {
+	dir := t.TempDir()
+	day := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	// Write the archives out of order, across datatypes and months.
+	writeArchive(t, dir, "throughput1", "uuid-2", day.AddDate(0, 0, -1))
+	writeArchive(t, dir, "latency1", "uuid-4", day.Add(time.Hour))
+	writeArchive(t, dir, "throughput1", "uuid-1", day.AddDate(0, -1, 0))
+	writeArchive(t, dir, "throughput1", "uuid-3", day)
+	archives := admin.NewArchives(dir)
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"uuid-4", "uuid-3", "uuid-2", "uuid-1"}},
+		{"?limit=3", []string{"uuid-4", "uuid-3", "uuid-2"}},
+		{"?datatype=throughput1&limit=2", []string{"uuid-3", "uuid-2"}},
+	}
+	for _, tt := range tests {
+		rw := httptest.NewRecorder()
+		archives.ListHandler().ServeHTTP(rw, httptest.NewRequest(http.MethodGet,
+			admin.ArchivesPath+tt.query, nil))
+		var got []admin.ArchiveFile
+		rtx.Must(json.Unmarshal(rw.Body.Bytes(), &got), "cannot unmarshal response")
+		if len(got) != len(tt.want) {
+			t.Fatalf("%q: got %d archives, want %d: %+v", tt.query, len(got),
+				len(tt.want), got)
+		}
+		for i, f := range got {
+			if !strings.HasSuffix(f.Path, "."+tt.want[i]+".json") {
+				t.Errorf("%q: archive %d = %s, want %s", tt.query, i, f.Path,
+					tt.want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package admin
+
+import (
+	"expvar"
+	"net/http"
+)
+
+// DebugHandler returns a handler serving the runtime metrics published by
+// expvar (command line and memory statistics) under /debug/vars. The pprof
+// profiles are already served by prometheusx on the metrics listener.
+//
+// This endpoint is not authenticated: the handler should only be exposed on a
+// listener that is not publicly reachable.
+func DebugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
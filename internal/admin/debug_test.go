@@ -0,0 +1,42 @@
+package admin_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/msak/internal/admin"
+)
+
+func TestDebugHandler(t *testing.T) {
+	h := admin.DebugHandler()
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/debug/vars", want: "memstats"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rw.Code != http.StatusOK {
+				t.Errorf("status code = %d, want %d", rw.Code, http.StatusOK)
+			}
+			if !strings.Contains(rw.Body.String(), tt.want) {
+				t.Errorf("body does not contain %q", tt.want)
+			}
+		})
+	}
+
+	// The pprof profiles are served by prometheusx instead.
+	for _, path := range []string{"/", "/debug/pprof/"} {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, path, nil))
+		if rw.Code != http.StatusNotFound {
+			t.Errorf("status code for %s = %d, want %d", path, rw.Code,
+				http.StatusNotFound)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package admin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	dataDirFreeBytes = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "msak",
+			Subsystem: "admin",
+			Name:      "datadir_free_bytes",
+			Help:      "Bytes available in the data directory's filesystem.",
+		},
+	)
+	lowDiskRejected = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "msak",
+			Subsystem: "admin",
+			Name:      "low_disk_rejected_total",
+			Help:      "Number of requests rejected because the data directory is low on space.",
+		},
+	)
+	purgedArchives = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "msak",
+			Subsystem: "admin",
+			Name:      "purged_archives_total",
+			Help:      "Number of archives deleted to reclaim space in the data directory.",
+		},
+	)
+)
+
+// DiskGuard monitors the free space in the data directory. While it is below
+// a threshold, new tests are rejected, so that the results of the tests in
+// progress can still be written instead of failing at the end of the test.
+// If enabled, the oldest archives are deleted to reclaim space.
+type DiskGuard struct {
+	dir     string
+	minFree uint64
+	purge   bool
+	low     atomic.Bool
+}
+
+// NewDiskGuard returns a DiskGuard for dir, rejecting tests while less than
+// minFree bytes are available. If purge is true, Update deletes the oldest
+// archives in dir until minFree bytes are available, whether or not they were
+// uploaded already.
+func NewDiskGuard(dir string, minFree int64, purge bool) *DiskGuard {
+	return &DiskGuard{
+		dir:     dir,
+		minFree: uint64(minFree),
+		purge:   purge,
+	}
+}
+
+// Low returns true if the data directory was low on space at the last
+// Update.
+func (g *DiskGuard) Low() bool {
+	return g.low.Load()
+}
+
+// Update reads the free space in the data directory, creating it if needed
+// and purging archives if enabled and needed, and updates the state returned
+// by Low. If the free space cannot be read, the previous state is kept.
+func (g *DiskGuard) Update() error {
+	if err := os.MkdirAll(g.dir, 0755); err != nil {
+		return err
+	}
+	free, err := diskFree(g.dir)
+	if err != nil {
+		return err
+	}
+	if free < g.minFree && g.purge {
+		free, err = g.purgeArchives(free)
+		if err != nil {
+			log.Error("Failed to purge archives", "dir", g.dir, "error", err)
+		}
+	}
+	dataDirFreeBytes.Set(float64(free))
+	low := free < g.minFree
+	if g.low.Swap(low) != low {
+		log.Info("Data directory space updated", "dir", g.dir, "low", low,
+			"free", free, "min-free", g.minFree)
+	}
+	return nil
+}
+
+// purgeArchives deletes the oldest archives until minFree bytes are available
+// or no archives are left, and returns the free space.
+func (g *DiskGuard) purgeArchives(free uint64) (uint64, error) {
+	var purgeErr error
+	err := NewArchives(g.dir).walk("", "", false, func(f ArchiveFile) bool {
+		path := filepath.Join(g.dir, filepath.FromSlash(f.Path))
+		if purgeErr = os.Remove(path); purgeErr != nil {
+			return false
+		}
+		purgedArchives.Inc()
+		log.Info("Purged archive", "path", path)
+		if free, purgeErr = diskFree(g.dir); purgeErr != nil {
+			return false
+		}
+		return free < g.minFree
+	})
+	if err == nil {
+		err = purgeErr
+	}
+	return free, err
+}
+
+// Run calls Update every interval until ctx is done.
+func (g *DiskGuard) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := g.Update(); err != nil {
+			log.Warn("Cannot read the data directory's free space", "dir", g.dir,
+				"error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check is a health check failing while the data directory is low on space.
+func (g *DiskGuard) Check() error {
+	if g.Low() {
+		return fmt.Errorf("less than %d bytes available in %s", g.minFree, g.dir)
+	}
+	return nil
+}
+
+// Middleware returns a handler that rejects requests with a 503 Service
+// Unavailable status while the data directory is low on space, and calls
+// next otherwise.
+func (g *DiskGuard) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if g.Low() {
+			lowDiskRejected.Inc()
+			rw.Header().Set("Connection", "Close")
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
@@ -0,0 +1,13 @@
+package admin
+
+import "syscall"
+
+// diskFree returns the bytes available to unprivileged users in the
+// filesystem containing dir.
+func diskFree(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
@@ -0,0 +1,51 @@
+package admin_test
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/msak/internal/admin"
+)
+
+func TestDiskGuard(t *testing.T) {
+	dir := t.TempDir()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	serve := func(g *admin.DiskGuard) int {
+		rw := httptest.NewRecorder()
+		g.Middleware(next).ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+		return rw.Code
+	}
+
+	g := admin.NewDiskGuard(dir, 1, false)
+	rtx.Must(g.Update(), "cannot update")
+	if g.Low() || g.Check() != nil || serve(g) != http.StatusOK {
+		t.Errorf("tests rejected with enough space")
+	}
+
+	// No filesystem has this much space, even after purging every archive.
+	archive := filepath.Join(dir, "throughput1", "2024", "01", "02", "a.json")
+	rtx.Must(os.MkdirAll(filepath.Dir(archive), 0755), "cannot create dir")
+	rtx.Must(os.WriteFile(archive, []byte("{}"), 0644), "cannot write archive")
+	g = admin.NewDiskGuard(dir, math.MaxInt64, false)
+	rtx.Must(g.Update(), "cannot update")
+	if !g.Low() || g.Check() == nil || serve(g) != http.StatusServiceUnavailable {
+		t.Errorf("tests not rejected while low on space")
+	}
+	if _, err := os.Stat(archive); err != nil {
+		t.Errorf("archive purged without purge enabled: %v", err)
+	}
+	g = admin.NewDiskGuard(dir, math.MaxInt64, true)
+	rtx.Must(g.Update(), "cannot update")
+	if _, err := os.Stat(archive); !os.IsNotExist(err) {
+		t.Errorf("archive not purged: %v", err)
+	}
+
+	if err := admin.NewDiskGuard("/proc/does/not/exist", 1, false).Update(); err == nil {
+		t.Errorf("Update() of a missing directory did not fail")
+	}
+}
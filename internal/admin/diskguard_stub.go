@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package admin
+
+import "errors"
+
+// diskFree is not supported on this platform.
+func diskFree(dir string) (uint64, error) {
+	return 0, errors.New("free space is not supported on this platform")
+}
@@ -0,0 +1,181 @@
+package admin
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// HealthPath is the path of the liveness endpoint.
+	HealthPath = "/health"
+	// ReadyPath is the path of the readiness endpoint.
+	ReadyPath = "/ready"
+)
+
+// Values of HealthStatus.Status.
+const (
+	// StatusOK means that every subsystem is healthy.
+	StatusOK = "ok"
+	// StatusDegraded means that some, but not all, subsystems are unhealthy.
+	StatusDegraded = "degraded"
+	// StatusDown means that every subsystem is unhealthy.
+	StatusDown = "down"
+)
+
+// dialTimeout is the timeout for connecting to a listener in DialCheck.
+const dialTimeout = time.Second
+
+var subsystemHealthy = promauto.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "msak",
+		Subsystem: "admin",
+		Name:      "subsystem_healthy",
+		Help:      "Whether each subsystem passed its last health check (1) or not (0).",
+	},
+	[]string{"subsystem"},
+)
+
+// Check returns an error if a subsystem is unhealthy.
+type Check func() error
+
+// SubsystemStatus is the result of the health check of a subsystem.
+type SubsystemStatus struct {
+	Name    string
+	Healthy bool
+	// Error is the error returned by the check, if any.
+	Error string `json:",omitempty"`
+}
+
+// HealthStatus is the JSON representation of the server's health.
+type HealthStatus struct {
+	// Status is one of StatusOK, StatusDegraded and StatusDown.
+	Status string
+	// Draining is true if the server is in maintenance mode.
+	Draining   bool
+	Subsystems []SubsystemStatus
+}
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Health runs the health checks of the server's subsystems and serves the
+// liveness and readiness endpoints.
+type Health struct {
+	maintenance *Maintenance
+
+	mu     sync.Mutex
+	checks []namedCheck
+}
+
+// NewHealth returns a Health with no subsystems. The server is reported as
+// not ready while m is draining.
+func NewHealth(m *Maintenance) *Health {
+	return &Health{maintenance: m}
+}
+
+// Register adds a subsystem with the provided name and health check.
+// Subsystems are reported in the order they are registered.
+func (h *Health) Register(name string, check Check) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks = append(h.checks, namedCheck{name: name, check: check})
+}
+
+// Status runs every health check and returns the results.
+func (h *Health) Status() HealthStatus {
+	h.mu.Lock()
+	checks := h.checks
+	h.mu.Unlock()
+
+	status := HealthStatus{
+		Draining:   h.maintenance.Draining(),
+		Subsystems: make([]SubsystemStatus, 0, len(checks)),
+	}
+	healthy := 0
+	for _, c := range checks {
+		s := SubsystemStatus{Name: c.name, Healthy: true}
+		if err := c.check(); err != nil {
+			s.Healthy = false
+			s.Error = err.Error()
+			subsystemHealthy.WithLabelValues(c.name).Set(0)
+		} else {
+			healthy++
+			subsystemHealthy.WithLabelValues(c.name).Set(1)
+		}
+		status.Subsystems = append(status.Subsystems, s)
+	}
+	switch {
+	case healthy == len(checks):
+		status.Status = StatusOK
+	case healthy == 0:
+		status.Status = StatusDown
+	default:
+		status.Status = StatusDegraded
+	}
+	return status
+}
+
+// LivenessHandler returns the handler of the liveness endpoint. It responds
+// with the HealthStatus and a 503 Service Unavailable status code if every
+// subsystem is unhealthy, or 200 OK otherwise.
+func (h *Health) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		status := h.Status()
+		code := http.StatusOK
+		if status.Status == StatusDown {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(rw, code, status)
+	})
+}
+
+// ReadinessHandler returns the handler of the readiness endpoint. It
+// responds with the HealthStatus and a 200 OK status code only if every
+// subsystem is healthy and the server is not draining, or 503 Service
+// Unavailable otherwise.
+func (h *Health) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		status := h.Status()
+		code := http.StatusOK
+		if status.Status != StatusOK || status.Draining {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(rw, code, status)
+	})
+}
+
+// DialCheck returns a Check that succeeds if a TCP connection to addr can be
+// established.
+func DialCheck(addr string) Check {
+	return func() error {
+		conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// WritableDirCheck returns a Check that succeeds if a file can be created in
+// dir.
+func WritableDirCheck(dir string) Check {
+	return func() error {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		f, err := os.CreateTemp(dir, ".health-*")
+		if err != nil {
+			return err
+		}
+		f.Close()
+		return os.Remove(f.Name())
+	}
+}
@@ -0,0 +1,101 @@
+package admin_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/m-lab/msak/internal/admin"
+)
+
+func TestHealth(t *testing.T) {
+	m := admin.NewMaintenance()
+	h := admin.NewHealth(m)
+	failing := errors.New("failing")
+	var aErr, bErr error
+	h.Register("a", func() error { return aErr })
+	h.Register("b", func() error { return bErr })
+
+	tests := []struct {
+		name       string
+		aErr, bErr error
+		draining   bool
+		want       string
+		liveness   int
+		readiness  int
+	}{
+		{name: "ok", want: admin.StatusOK,
+			liveness: http.StatusOK, readiness: http.StatusOK},
+		{name: "degraded", bErr: failing, want: admin.StatusDegraded,
+			liveness: http.StatusOK, readiness: http.StatusServiceUnavailable},
+		{name: "down", aErr: failing, bErr: failing, want: admin.StatusDown,
+			liveness: http.StatusServiceUnavailable, readiness: http.StatusServiceUnavailable},
+		{name: "draining", draining: true, want: admin.StatusOK,
+			liveness: http.StatusOK, readiness: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			aErr, bErr = tt.aErr, tt.bErr
+			m.Set(tt.draining, "")
+
+			rw := httptest.NewRecorder()
+			h.LivenessHandler().ServeHTTP(rw, httptest.NewRequest(http.MethodGet, admin.HealthPath, nil))
+			if rw.Code != tt.liveness {
+				t.Errorf("liveness status code = %d, want %d", rw.Code, tt.liveness)
+			}
+			var status admin.HealthStatus
+			if err := json.Unmarshal(rw.Body.Bytes(), &status); err != nil {
+				t.Fatalf("cannot unmarshal response body: %v", err)
+			}
+			if status.Status != tt.want || status.Draining != tt.draining ||
+				len(status.Subsystems) != 2 || status.Subsystems[0].Name != "a" {
+				t.Errorf("unexpected status: %+v", status)
+			}
+			if tt.bErr != nil && (status.Subsystems[1].Healthy ||
+				status.Subsystems[1].Error != tt.bErr.Error()) {
+				t.Errorf("unexpected subsystem status: %+v", status.Subsystems[1])
+			}
+
+			rw = httptest.NewRecorder()
+			h.ReadinessHandler().ServeHTTP(rw, httptest.NewRequest(http.MethodGet, admin.ReadyPath, nil))
+			if rw.Code != tt.readiness {
+				t.Errorf("readiness status code = %d, want %d", rw.Code, tt.readiness)
+			}
+		})
+	}
+}
+
+func TestDialCheck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	check := admin.DialCheck(l.Addr().String())
+	if err := check(); err != nil {
+		t.Errorf("DialCheck() on a listening address failed: %v", err)
+	}
+	l.Close()
+	if err := check(); err == nil {
+		t.Errorf("DialCheck() on a closed listener did not fail")
+	}
+}
+
+func TestWritableDirCheck(t *testing.T) {
+	dir := t.TempDir()
+	if err := admin.WritableDirCheck(filepath.Join(dir, "data"))(); err != nil {
+		t.Errorf("WritableDirCheck() failed: %v", err)
+	}
+	// A directory cannot be created under a file.
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatalf("cannot create file: %v", err)
+	}
+	if err := admin.WritableDirCheck(filepath.Join(file, "data"))(); err == nil {
+		t.Errorf("WritableDirCheck() on a path under a file did not fail")
+	}
+}
@@ -0,0 +1,148 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// MaintenancePath is the path of the maintenance mode endpoint.
+const MaintenancePath = "/admin/v1/maintenance"
+
+var (
+	maintenanceMode = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "msak",
+			Subsystem: "admin",
+			Name:      "maintenance_mode",
+			Help:      "Whether the server is draining (1) or serving (0).",
+		},
+	)
+	maintenanceRejected = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "msak",
+			Subsystem: "admin",
+			Name:      "maintenance_rejected_total",
+			Help:      "Number of requests rejected while in maintenance mode.",
+		},
+	)
+)
+
+// MaintenanceStatus is the JSON representation of the maintenance state.
+type MaintenanceStatus struct {
+	// Draining is true if new tests are being rejected.
+	Draining bool
+	// Reason is the reason provided when maintenance mode was enabled.
+	Reason string `json:",omitempty"`
+	// Since is the time when the current state was set.
+	Since time.Time
+}
+
+// Maintenance tracks whether the server is in maintenance ("draining") mode.
+// While draining, tests already in progress are allowed to finish but new
+// test requests are rejected.
+type Maintenance struct {
+	mu     sync.Mutex
+	status MaintenanceStatus
+}
+
+// NewMaintenance returns a new Maintenance in serving state.
+func NewMaintenance() *Maintenance {
+	return &Maintenance{
+		status: MaintenanceStatus{
+			Since: time.Now(),
+		},
+	}
+}
+
+// Draining returns true if the server is in maintenance mode. Health reports
+// (e.g. heartbeats sent to the Locate service) should advertise the server as
+// unhealthy while this is true.
+func (m *Maintenance) Draining() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status.Draining
+}
+
+// Set enables or disables maintenance mode with the provided reason.
+func (m *Maintenance) Set(draining bool, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !draining {
+		reason = ""
+	}
+	m.status = MaintenanceStatus{
+		Draining: draining,
+		Reason:   reason,
+		Since:    time.Now(),
+	}
+	if draining {
+		maintenanceMode.Set(1)
+	} else {
+		maintenanceMode.Set(0)
+	}
+	log.Info("Maintenance mode updated", "draining", draining, "reason", reason)
+}
+
+// Status returns the current maintenance status.
+func (m *Maintenance) Status() MaintenanceStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+// ServeHTTP implements the maintenance mode endpoint. GET requests return the
+// current MaintenanceStatus. POST requests update it according to the
+// "draining" (bool) and "reason" querystring parameters.
+//
+// This handler does not perform authentication and should be wrapped with
+// RequireToken.
+func (m *Maintenance) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		draining, err := strconv.ParseBool(req.URL.Query().Get("draining"))
+		if err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		m.Set(draining, req.URL.Query().Get("reason"))
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(rw, http.StatusOK, m.Status())
+}
+
+// Middleware returns a handler that rejects requests with a 503 Service
+// Unavailable status and a JSON body containing the MaintenanceStatus while in
+// maintenance mode, and calls next otherwise.
+func (m *Maintenance) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		status := m.Status()
+		if status.Draining {
+			maintenanceRejected.Inc()
+			writeJSON(rw, http.StatusServiceUnavailable, status)
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// writeJSON writes v as a JSON response body with the provided status code.
+func writeJSON(rw http.ResponseWriter, code int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	rw.Write(b)
+}
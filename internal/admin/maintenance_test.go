@@ -0,0 +1,70 @@
+package admin_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/m-lab/msak/internal/admin"
+)
+
+func TestMaintenance(t *testing.T) {
+	m := admin.NewMaintenance()
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	h := m.Middleware(next)
+
+	// Requests are allowed while serving.
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rw.Code != http.StatusOK {
+		t.Errorf("unexpected status code %d while serving", rw.Code)
+	}
+
+	// Invalid toggle requests.
+	rw = httptest.NewRecorder()
+	m.ServeHTTP(rw, httptest.NewRequest(http.MethodPost,
+		admin.MaintenancePath+"?draining=invalid", nil))
+	if rw.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status code %d for invalid toggle", rw.Code)
+	}
+	rw = httptest.NewRecorder()
+	m.ServeHTTP(rw, httptest.NewRequest(http.MethodDelete, admin.MaintenancePath, nil))
+	if rw.Code != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected status code %d for invalid method", rw.Code)
+	}
+
+	// Enable maintenance mode.
+	rw = httptest.NewRecorder()
+	m.ServeHTTP(rw, httptest.NewRequest(http.MethodPost,
+		admin.MaintenancePath+"?draining=true&reason=upgrade", nil))
+	if rw.Code != http.StatusOK || !m.Draining() {
+		t.Fatalf("failed to enable maintenance mode")
+	}
+
+	// New requests are rejected with a JSON reason.
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status code %d while draining", rw.Code)
+	}
+	var status admin.MaintenanceStatus
+	if err := json.Unmarshal(rw.Body.Bytes(), &status); err != nil {
+		t.Fatalf("cannot unmarshal response body: %v", err)
+	}
+	if !status.Draining || status.Reason != "upgrade" {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	// Disable maintenance mode and check the status.
+	m.Set(false, "ignored")
+	rw = httptest.NewRecorder()
+	m.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, admin.MaintenancePath, nil))
+	status = admin.MaintenanceStatus{}
+	if err := json.Unmarshal(rw.Body.Bytes(), &status); err != nil {
+		t.Fatalf("cannot unmarshal response body: %v", err)
+	}
+	if status.Draining || status.Reason != "" {
+		t.Errorf("unexpected status after disabling: %+v", status)
+	}
+}
@@ -0,0 +1,18 @@
+package admin
+
+import (
+	"net/http"
+
+	"github.com/m-lab/msak/pkg/version"
+)
+
+// VersionPath is the path of the version endpoint.
+const VersionPath = "/version"
+
+// VersionHandler returns the handler of the version endpoint. It responds
+// with the version.Info of the running binary.
+func VersionHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		writeJSON(rw, http.StatusOK, version.Get())
+	})
+}
@@ -0,0 +1,27 @@
+package admin_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/m-lab/msak/internal/admin"
+	"github.com/m-lab/msak/pkg/version"
+)
+
+func TestVersionHandler(t *testing.T) {
+	rw := httptest.NewRecorder()
+	admin.VersionHandler().ServeHTTP(rw,
+		httptest.NewRequest(http.MethodGet, admin.VersionPath, nil))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("status code = %d, want %d", rw.Code, http.StatusOK)
+	}
+	var got version.Info
+	if err := json.Unmarshal(rw.Body.Bytes(), &got); err != nil {
+		t.Fatalf("cannot unmarshal response: %v", err)
+	}
+	if got != version.Get() {
+		t.Errorf("VersionHandler() = %+v, want %+v", got, version.Get())
+	}
+}
@@ -0,0 +1,61 @@
+package certs
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ALPNProto is the ALPN protocol to add to the TLS configuration's NextProtos
+// to answer tls-alpn-01 challenges.
+const ALPNProto = acme.ALPNProto
+
+// NewACMEManager returns an autocert.Manager that obtains and renews the
+// certificates for hosts from the ACME directory at directoryURL, accepting
+// its terms of service. Certificates and the account key are cached in
+// cacheDir. If directoryURL is empty, Let's Encrypt's production directory is
+// used.
+func NewACMEManager(hosts []string, cacheDir, email, directoryURL string) *autocert.Manager {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      email,
+	}
+	if directoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: directoryURL}
+	}
+	return m
+}
+
+// RedirectHandler returns a handler redirecting every request to the same
+// URL on the TLS endpoint listening on tlsAddr. Plain HTTP requests are
+// redirected to https and WebSocket handshakes to wss, preserving the method
+// and the query string.
+func RedirectHandler(tlsAddr string) (http.Handler, error) {
+	_, port, err := net.SplitHostPort(tlsAddr)
+	if err != nil {
+		return nil, err
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		// The default port is omitted from the URL.
+		u := url.URL{
+			Scheme:   "https",
+			Host:     strings.TrimSuffix(net.JoinHostPort(host, port), ":443"),
+			Path:     req.URL.Path,
+			RawQuery: req.URL.RawQuery,
+		}
+		if req.Header.Get("Upgrade") != "" {
+			u.Scheme = "wss"
+		}
+		http.Redirect(rw, req, u.String(), http.StatusPermanentRedirect)
+	}), nil
+}
@@ -0,0 +1,61 @@
+package certs
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		name    string
+		tlsAddr string
+		target  string
+		upgrade bool
+		want    string
+	}{
+		{
+			name:    "https on default port",
+			tlsAddr: ":443",
+			target:  "http://example.com:80/throughput/v1/download?mid=x",
+			want:    "https://example.com/throughput/v1/download?mid=x",
+		},
+		{
+			name:    "wss on custom port",
+			tlsAddr: ":4443",
+			target:  "http://example.com:8080/throughput/v1/upload?mid=x",
+			upgrade: true,
+			want:    "wss://example.com:4443/throughput/v1/upload?mid=x",
+		},
+		{
+			name:    "ipv6",
+			tlsAddr: "[::]:443",
+			target:  "http://[::1]:8080/",
+			want:    "https://[::1]/",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := RedirectHandler(tt.tlsAddr)
+			if err != nil {
+				t.Fatalf("RedirectHandler() error = %v", err)
+			}
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.upgrade {
+				req.Header.Set("Upgrade", "websocket")
+			}
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+			if rw.Code != http.StatusPermanentRedirect {
+				t.Errorf("status = %d, want %d", rw.Code, http.StatusPermanentRedirect)
+			}
+			if got := rw.Header().Get("Location"); got != tt.want {
+				t.Errorf("Location = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := RedirectHandler("invalid"); err == nil {
+		t.Errorf("RedirectHandler() with an invalid address did not fail")
+	}
+}
@@ -0,0 +1,155 @@
+// Package certs serves TLS certificates that are reloaded from disk when
+// they change, so that rotated certificates are picked up without restarting
+// the server or dropping active connections.
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// CheckInterval is the minimum interval between two checks of the
+// certificate files for changes.
+const CheckInterval = 10 * time.Second
+
+var (
+	reloads = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "msak",
+			Subsystem: "tls",
+			Name:      "certificate_reloads_total",
+			Help:      "Number of attempts to reload the TLS certificate after its files changed.",
+		},
+		[]string{"status"},
+	)
+	expiry = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "msak",
+			Subsystem: "tls",
+			Name:      "certificate_expiry_timestamp_seconds",
+			Help:      "Expiration time of the TLS certificate being served.",
+		},
+	)
+)
+
+// Reloader serves the certificate in a pair of PEM files, reloading them
+// when their modification time changes.
+type Reloader struct {
+	certFile, keyFile string
+	// checkInterval is the minimum interval between two checks.
+	checkInterval time.Duration
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// NewReloader returns a Reloader for the provided certificate and key files.
+// It returns an error if the files cannot be loaded.
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{
+		certFile:      certFile,
+		keyFile:       keyFile,
+		checkInterval: CheckInterval,
+	}
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTime); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the current certificate, reloading it first if its
+// files have changed. It is meant to be used as tls.Config.GetCertificate.
+// If reloading fails, the previous certificate keeps being served.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	cert := r.cert
+	due := time.Since(r.lastCheck) >= r.checkInterval
+	r.mu.RUnlock()
+	if !due {
+		return cert, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Another handshake may have checked in the meantime.
+	if time.Since(r.lastCheck) < r.checkInterval {
+		return r.cert, nil
+	}
+	r.lastCheck = time.Now()
+	modTime, err := r.latestModTime()
+	if err != nil {
+		log.Error("Cannot check TLS certificate files", "error", err)
+		return r.cert, nil
+	}
+	if modTime.Equal(r.modTime) {
+		return r.cert, nil
+	}
+	if err := r.load(modTime); err != nil {
+		reloads.WithLabelValues("error").Inc()
+		log.Error("Cannot reload TLS certificate, keeping the previous one",
+			"cert", r.certFile, "error", err)
+		return r.cert, nil
+	}
+	reloads.WithLabelValues("ok").Inc()
+	log.Info("TLS certificate reloaded", "cert", r.certFile)
+	return r.cert, nil
+}
+
+// load loads the certificate files, whose latest modification time is
+// modTime. The caller must hold mu, unless r is not shared yet.
+func (r *Reloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	cert.Leaf = leaf
+	expiry.Set(float64(leaf.NotAfter.Unix()))
+	r.cert = &cert
+	r.modTime = modTime
+	r.lastCheck = time.Now()
+	return nil
+}
+
+// latestModTime returns the latest modification time of the certificate and
+// key files.
+func (r *Reloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Check returns an error if the certificate being served has expired.
+func (r *Reloader) Check() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if notAfter := r.cert.Leaf.NotAfter; time.Now().After(notAfter) {
+		return fmt.Errorf("certificate expired at %s", notAfter.Format(time.RFC3339))
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/testingx"
+)
+
+// writeCert writes a self-signed certificate with the provided serial number
+// and its key to certFile and keyFile, with modification time modTime.
+func writeCert(t *testing.T, certFile, keyFile string, serial int64, modTime time.Time) {
+	writeCertExpiring(t, certFile, keyFile, serial, modTime, time.Now().Add(time.Hour))
+}
+
+// writeCertExpiring is like writeCert, with a certificate expiring at
+// notAfter.
+func writeCertExpiring(t *testing.T, certFile, keyFile string, serial int64,
+	modTime, notAfter time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	testingx.Must(t, err, "cannot generate key")
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	testingx.Must(t, err, "cannot create certificate")
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	testingx.Must(t, err, "cannot marshal key")
+
+	testingx.Must(t, os.WriteFile(certFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600),
+		"cannot write certificate")
+	testingx.Must(t, os.WriteFile(keyFile,
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600),
+		"cannot write key")
+	for _, f := range []string{certFile, keyFile} {
+		testingx.Must(t, os.Chtimes(f, modTime, modTime), "cannot set modification time")
+	}
+}
+
+func serial(t *testing.T, r *Reloader) int64 {
+	cert, err := r.GetCertificate(nil)
+	testingx.Must(t, err, "GetCertificate failed")
+	return cert.Leaf.SerialNumber.Int64()
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	start := time.Now().Add(-time.Minute)
+	writeCert(t, certFile, keyFile, 1, start)
+
+	r, err := NewReloader(certFile, keyFile)
+	testingx.Must(t, err, "cannot create reloader")
+	if got := serial(t, r); got != 1 {
+		t.Errorf("serial = %d, want 1", got)
+	}
+
+	// Changes are not picked up before the check interval expires.
+	writeCert(t, certFile, keyFile, 2, start.Add(time.Second))
+	if got := serial(t, r); got != 1 {
+		t.Errorf("serial = %d, want 1 before the check interval", got)
+	}
+
+	r.checkInterval = 0
+	if got := serial(t, r); got != 2 {
+		t.Errorf("serial = %d, want 2 after reloading", got)
+	}
+
+	// An invalid certificate is not loaded.
+	testingx.Must(t, os.WriteFile(certFile, []byte("invalid"), 0600), "cannot write certificate")
+	later := start.Add(2 * time.Second)
+	testingx.Must(t, os.Chtimes(certFile, later, later), "cannot set modification time")
+	if got := serial(t, r); got != 2 {
+		t.Errorf("serial = %d, want the previous certificate to be kept", got)
+	}
+}
+
+func TestNewReloader_errors(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := NewReloader(filepath.Join(dir, "missing.pem"),
+		filepath.Join(dir, "missing.key")); err == nil {
+		t.Errorf("NewReloader() with missing files did not fail")
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	testingx.Must(t, os.WriteFile(certFile, []byte("invalid"), 0600), "cannot write certificate")
+	if _, err := NewReloader(certFile, certFile); err == nil {
+		t.Errorf("NewReloader() with invalid files did not fail")
+	}
+}
+
+func TestReloader_Check(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeCert(t, certFile, keyFile, 1, time.Now())
+	r, err := NewReloader(certFile, keyFile)
+	testingx.Must(t, err, "cannot create reloader")
+	if err := r.Check(); err != nil {
+		t.Errorf("Check() = %v, want nil", err)
+	}
+
+	writeCertExpiring(t, certFile, keyFile, 2, time.Now().Add(time.Minute),
+		time.Now().Add(-time.Minute))
+	r.checkInterval = 0
+	serial(t, r)
+	if err := r.Check(); err == nil {
+		t.Errorf("Check() with an expired certificate did not fail")
+	}
+}
@@ -0,0 +1,250 @@
+// Package config loads command-line flag values from a YAML configuration
+// file, so that servers with many options can be configured declaratively.
+//
+// The file is a YAML map from flag names to values. Nested maps are
+// flattened by joining keys with a dot, so the following are equivalent:
+//
+//	throughput1.max-runtime: 15s
+//
+//	throughput1:
+//	  max-runtime: 15s
+//
+// Lists set repeatable flags once per element.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+
+	"github.com/m-lab/go/flagx"
+	"gopkg.in/yaml.v2"
+)
+
+// Load sets the flags in fs from the YAML configuration file at path. Flags
+// explicitly set on the command line or via their environment variable, as
+// defined by flagx.ArgsFromEnv, take precedence over the file and are not
+// modified. Flags named in skip, e.g. the flag selecting the configuration
+// file itself, cannot be set in the file.
+//
+// Load returns an error naming the offending option if the file contains
+// unknown options or invalid values.
+func Load(fs *flag.FlagSet, path string, skip ...string) error {
+	values, err := read(path)
+	if err != nil {
+		return err
+	}
+	for _, name := range skip {
+		if _, ok := values[name]; ok {
+			return fmt.Errorf("%s: option %q cannot be set in a configuration file",
+				path, name)
+		}
+	}
+	return apply(fs, path, values)
+}
+
+// Reload sets the flags in fs named in names from the YAML configuration file
+// at path, so that a running program can pick up changes to the file. These
+// flags are reset to their default value first, so that options removed from
+// the file are reset too. As with Load, flags explicitly set on the command
+// line or in the environment are not modified. Other options in the file are
+// ignored, but must exist in fs.
+//
+// The new values are parsed into a scratch FlagSet first, so that fs is not
+// modified if any of them is invalid. They are then applied together and
+// validate, if not nil, is called to check them along with the other flags.
+// If it returns an error, the previous values are restored.
+func Reload(fs *flag.FlagSet, path string, validate func() error, names ...string) error {
+	values, err := read(path)
+	if err != nil {
+		return err
+	}
+	for name := range values {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("%s: unknown option %q", path, name)
+		}
+	}
+	assigned := flagx.AssignedFlags(fs)
+	scratch := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	for _, name := range names {
+		f := fs.Lookup(name)
+		if f == nil {
+			return fmt.Errorf("unknown flag %q", name)
+		}
+		if explicit(assigned, name) {
+			continue
+		}
+		v, err := newValue(f)
+		if err != nil {
+			return fmt.Errorf("cannot reset option %q: %w", name, err)
+		}
+		scratch.Var(v, name, f.Usage)
+	}
+	reloaded := map[string]interface{}{}
+	for name, v := range values {
+		if scratch.Lookup(name) != nil {
+			reloaded[name] = v
+		}
+	}
+	if err := apply(scratch, path, reloaded); err != nil {
+		return err
+	}
+
+	// Swap the new values with the current ones, so that swapping them
+	// again restores the previous values.
+	swapAll := func() {
+		scratch.VisitAll(func(f *flag.Flag) {
+			swap(fs.Lookup(f.Name).Value, f.Value)
+		})
+	}
+	swapAll()
+	if validate != nil {
+		if err := validate(); err != nil {
+			swapAll()
+			return err
+		}
+	}
+	return nil
+}
+
+// newValue returns a new flag.Value of the same type as f's, set to f's
+// default value. f's value must be a pointer, as are those of the flag
+// package and of flagx.
+func newValue(f *flag.Flag) (flag.Value, error) {
+	t := reflect.TypeOf(f.Value)
+	if t.Kind() != reflect.Pointer {
+		return nil, fmt.Errorf("unsupported flag type %v", t)
+	}
+	v, ok := reflect.New(t.Elem()).Interface().(flag.Value)
+	if !ok {
+		return nil, fmt.Errorf("unsupported flag type %v", t)
+	}
+	if err := reset(&flag.Flag{Name: f.Name, Value: v, DefValue: f.DefValue}); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// swap exchanges the values a and b point to. They must have the same type.
+func swap(a, b flag.Value) {
+	av := reflect.ValueOf(a).Elem()
+	bv := reflect.ValueOf(b).Elem()
+	tmp := reflect.New(av.Type()).Elem()
+	tmp.Set(av)
+	av.Set(bv)
+	bv.Set(tmp)
+}
+
+// read returns the options in the configuration file at path, by name.
+func read(path string) (map[string]interface{}, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	values := map[string]interface{}{}
+	if err := flatten("", doc, values); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return values, nil
+}
+
+// apply sets the flags in fs to values read from path, skipping the flags
+// explicitly set on the command line or in the environment.
+func apply(fs *flag.FlagSet, path string, values map[string]interface{}) error {
+	assigned := flagx.AssignedFlags(fs)
+	// Sort names so that errors are deterministic.
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := fs.Lookup(name)
+		if f == nil {
+			return fmt.Errorf("%s: unknown option %q", path, name)
+		}
+		if explicit(assigned, name) {
+			continue
+		}
+		if err := set(f, values[name]); err != nil {
+			return fmt.Errorf("%s: invalid value for option %q: %w", path, name, err)
+		}
+	}
+	return nil
+}
+
+// explicit reports whether the flag name is set on the command line, i.e. in
+// assigned, or via its environment variable.
+func explicit(assigned map[string]struct{}, name string) bool {
+	if _, ok := assigned[name]; ok {
+		return true
+	}
+	_, ok := os.LookupEnv(flagx.MakeShellVariableName(name))
+	return ok
+}
+
+// reset sets f to its default value. Repeatable flagx.StringArray flags are
+// emptied instead, since setting them appends to their value.
+func reset(f *flag.Flag) error {
+	if sa, ok := f.Value.(*flagx.StringArray); ok {
+		*sa = nil
+		return nil
+	}
+	return f.Value.Set(f.DefValue)
+}
+
+// flatten adds the values in m to values, prefixing their keys with prefix
+// and flattening nested maps.
+func flatten(prefix string, m map[string]interface{}, values map[string]interface{}) error {
+	for k, v := range m {
+		name := k
+		if prefix != "" {
+			name = prefix + "." + k
+		}
+		switch v := v.(type) {
+		case map[interface{}]interface{}:
+			nested := map[string]interface{}{}
+			for nk, nv := range v {
+				s, ok := nk.(string)
+				if !ok {
+					return fmt.Errorf("invalid key %v in option %q", nk, name)
+				}
+				nested[s] = nv
+			}
+			if err := flatten(name, nested, values); err != nil {
+				return err
+			}
+		default:
+			if _, ok := values[name]; ok {
+				return fmt.Errorf("option %q is set more than once", name)
+			}
+			values[name] = v
+		}
+	}
+	return nil
+}
+
+// set sets the flag f to v. Lists set f once per element.
+func set(f *flag.Flag, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		return fmt.Errorf("missing value")
+	case []interface{}:
+		for _, elem := range v {
+			if err := set(f, elem); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[interface{}]interface{}:
+		return fmt.Errorf("unexpected map")
+	default:
+		return f.Value.Set(fmt.Sprint(v))
+	}
+}
@@ -0,0 +1,224 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/flagx"
+	"github.com/m-lab/go/testingx"
+)
+
+type testFlags struct {
+	fs       *flag.FlagSet
+	datadir  *string
+	runtime  *time.Duration
+	verify   *bool
+	cc       *flagx.StringArray
+	override *string
+}
+
+func newTestFlags() *testFlags {
+	tf := &testFlags{
+		fs: flag.NewFlagSet("test", flag.ContinueOnError),
+		cc: &flagx.StringArray{},
+	}
+	tf.datadir = tf.fs.String("datadir", "./data", "")
+	tf.runtime = tf.fs.Duration("throughput1.max-runtime", 15*time.Second, "")
+	tf.verify = tf.fs.Bool("token.verify", false, "")
+	tf.fs.Var(tf.cc, "throughput1.allowed-cc", "")
+	tf.override = tf.fs.String("config-test.override", "default", "")
+	tf.fs.String("config", "", "")
+	return tf
+}
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	testingx.Must(t, os.WriteFile(path, []byte(content), 0644), "cannot write config")
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	tf := newTestFlags()
+	testingx.Must(t, tf.fs.Parse([]string{"-datadir=/from/flag"}), "cannot parse flags")
+	t.Setenv("CONFIG_TEST_OVERRIDE", "env")
+
+	path := writeConfig(t, `
+datadir: /from/config
+token.verify: true
+config-test.override: config
+throughput1:
+  max-runtime: 30s
+  allowed-cc: [bbr, cubic]
+`)
+	testingx.Must(t, Load(tf.fs, path, "config"), "cannot load config")
+
+	if *tf.datadir != "/from/flag" {
+		t.Errorf("datadir = %q, command line should take precedence", *tf.datadir)
+	}
+	if *tf.override != "default" {
+		t.Errorf("override = %q, environment should take precedence", *tf.override)
+	}
+	if *tf.runtime != 30*time.Second {
+		t.Errorf("max-runtime = %v, want 30s", *tf.runtime)
+	}
+	if !*tf.verify {
+		t.Errorf("token.verify not set")
+	}
+	if len(*tf.cc) != 2 || !tf.cc.Contains("bbr") || !tf.cc.Contains("cubic") {
+		t.Errorf("allowed-cc = %v, want [bbr cubic]", *tf.cc)
+	}
+}
+
+func TestLoad_errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{
+			name:    "unknown option",
+			content: "throughput1.max-runtim: 30s",
+			want:    `unknown option "throughput1.max-runtim"`,
+		},
+		{
+			name:    "invalid value",
+			content: "throughput1:\n  max-runtime: forever",
+			want:    `invalid value for option "throughput1.max-runtime"`,
+		},
+		{
+			name:    "missing value",
+			content: "datadir:",
+			want:    `invalid value for option "datadir"`,
+		},
+		{
+			name:    "duplicate option",
+			content: "throughput1.max-runtime: 1s\nthroughput1:\n  max-runtime: 2s",
+			want:    `option "throughput1.max-runtime" is set more than once`,
+		},
+		{
+			name:    "skipped option",
+			content: "config: other.yaml",
+			want:    `option "config" cannot be set`,
+		},
+		{
+			name:    "invalid yaml",
+			content: "datadir: [",
+			want:    "yaml",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tf := newTestFlags()
+			err := Load(tf.fs, writeConfig(t, tt.content), "config")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Load() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+
+	if err := Load(newTestFlags().fs, "/does/not/exist.yaml"); err == nil {
+		t.Errorf("Load() of a missing file did not fail")
+	}
+}
+
+func TestReload(t *testing.T) {
+	tf := newTestFlags()
+	testingx.Must(t, tf.fs.Parse([]string{"-datadir=/from/flag"}), "cannot parse flags")
+	path := writeConfig(t, `
+throughput1:
+  max-runtime: 30s
+  allowed-cc: [bbr, cubic]
+`)
+	testingx.Must(t, Load(tf.fs, path, "config"), "cannot load config")
+
+	// Options removed from the file are reset and lists are replaced, not
+	// appended to. Options not named are ignored, even if they changed.
+	testingx.Must(t, os.WriteFile(path, []byte(`
+datadir: /from/config
+token.verify: true
+throughput1.allowed-cc: [reno]
+`), 0644), "cannot rewrite config")
+	testingx.Must(t, Reload(tf.fs, path, nil, "datadir", "throughput1.max-runtime",
+		"throughput1.allowed-cc"), "cannot reload config")
+
+	if *tf.datadir != "/from/flag" {
+		t.Errorf("datadir = %q, command line should take precedence", *tf.datadir)
+	}
+	if *tf.runtime != 15*time.Second {
+		t.Errorf("max-runtime = %v, want the default", *tf.runtime)
+	}
+	if len(*tf.cc) != 1 || !tf.cc.Contains("reno") {
+		t.Errorf("allowed-cc = %v, want [reno]", *tf.cc)
+	}
+	if *tf.verify {
+		t.Errorf("token.verify reloaded without being named")
+	}
+
+	if err := Reload(tf.fs, path, nil, "no-such-flag"); err == nil {
+		t.Errorf("Reload() of an unknown flag did not fail")
+	}
+	testingx.Must(t, os.WriteFile(path, []byte("unknown: 1"), 0644),
+		"cannot rewrite config")
+	if err := Reload(tf.fs, path, nil, "datadir"); err == nil {
+		t.Errorf("Reload() of a file with unknown options did not fail")
+	}
+}
+
+func TestReload_atomic(t *testing.T) {
+	tf := newTestFlags()
+	path := writeConfig(t, `
+throughput1:
+  max-runtime: 30s
+  allowed-cc: [bbr]
+`)
+	testingx.Must(t, Load(tf.fs, path, "config"), "cannot load config")
+	names := []string{"throughput1.max-runtime", "throughput1.allowed-cc"}
+	check := func(t *testing.T) {
+		t.Helper()
+		if *tf.runtime != 30*time.Second {
+			t.Errorf("max-runtime = %v, want the previous 30s", *tf.runtime)
+		}
+		if len(*tf.cc) != 1 || !tf.cc.Contains("bbr") {
+			t.Errorf("allowed-cc = %v, want the previous [bbr]", *tf.cc)
+		}
+	}
+
+	t.Run("invalid value", func(t *testing.T) {
+		// The valid option sorts before the invalid one, but is not
+		// applied either.
+		testingx.Must(t, os.WriteFile(path, []byte(`
+throughput1:
+  allowed-cc: [reno]
+  max-runtime: forever
+`), 0644), "cannot rewrite config")
+		if err := Reload(tf.fs, path, nil, names...); err == nil {
+			t.Errorf("Reload() of an invalid value did not fail")
+		}
+		check(t)
+	})
+
+	t.Run("validation failure", func(t *testing.T) {
+		testingx.Must(t, os.WriteFile(path, []byte(`
+throughput1:
+  allowed-cc: [reno]
+  max-runtime: 1s
+`), 0644), "cannot rewrite config")
+		var validated time.Duration
+		validate := func() error {
+			validated = *tf.runtime
+			return errors.New("invalid")
+		}
+		if err := Reload(tf.fs, path, validate, names...); err == nil {
+			t.Errorf("Reload() did not return the validation error")
+		}
+		if validated != time.Second {
+			t.Errorf("validated max-runtime = %v, want the new 1s", validated)
+		}
+		check(t)
+	})
+}
@@ -0,0 +1,79 @@
+// Package cors provides an HTTP middleware implementing Cross-Origin Resource
+// Sharing, so that browser-based clients served from a different origin can
+// call the server's plain HTTP endpoints.
+package cors
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/m-lab/msak/pkg/throughput1"
+)
+
+// MaxAge is how long browsers may cache the result of a preflight request.
+const MaxAge = 10 * time.Minute
+
+// allowedMethods are the methods cross-origin requests can use. Every msak
+// endpoint is a GET.
+const allowedMethods = "GET, OPTIONS"
+
+// CORS adds CORS headers to the responses to requests from allowed origins and
+// answers preflight requests.
+type CORS struct {
+	origins []string
+	headers string
+}
+
+// New returns a CORS allowing the origins matching one of the provided
+// patterns, as accepted by throughput1.OriginAllowed, to send requests with
+// the provided headers.
+func New(origins, headers []string) *CORS {
+	return &CORS{
+		origins: origins,
+		headers: strings.Join(headers, ", "),
+	}
+}
+
+// Allowed returns true if the request's Origin is allowed. Requests without an
+// Origin header are not cross-origin requests, so they are never allowed.
+func (c *CORS) Allowed(r *http.Request) bool {
+	if len(c.origins) == 0 || r.Header.Get("Origin") == "" {
+		return false
+	}
+	return throughput1.OriginAllowed(r, c.origins)
+}
+
+// Middleware adds the CORS headers to the responses to requests from allowed
+// origins. Preflight requests are answered directly, without calling next, so
+// that they do not need to carry access tokens; preflight requests from other
+// origins are rejected with 403 Forbidden. Any other request is passed to
+// next, and the browser enforces the policy.
+func (c *CORS) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		preflight := r.Method == http.MethodOptions &&
+			r.Header.Get("Access-Control-Request-Method") != ""
+		rw.Header().Add("Vary", "Origin")
+		if !c.Allowed(r) {
+			if preflight {
+				rw.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(rw, r)
+			return
+		}
+		rw.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
+		if !preflight {
+			next.ServeHTTP(rw, r)
+			return
+		}
+		rw.Header().Set("Access-Control-Allow-Methods", allowedMethods)
+		if c.headers != "" {
+			rw.Header().Set("Access-Control-Allow-Headers", c.headers)
+		}
+		rw.Header().Set("Access-Control-Max-Age",
+			strconv.Itoa(int(MaxAge.Seconds())))
+		rw.WriteHeader(http.StatusNoContent)
+	})
+}
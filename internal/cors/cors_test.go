@@ -0,0 +1,90 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORS_Middleware(t *testing.T) {
+	c := New([]string{"https://*.example.com"}, []string{"Authorization"})
+	var called bool
+	h := c.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+
+	tests := []struct {
+		name        string
+		method      string
+		origin      string
+		preflight   bool
+		wantStatus  int
+		wantOrigin  string
+		wantHeaders string
+		wantCalled  bool
+	}{
+		{
+			name:       "same origin",
+			method:     http.MethodGet,
+			wantStatus: http.StatusOK,
+			wantCalled: true,
+		},
+		{
+			name:       "allowed origin",
+			method:     http.MethodGet,
+			origin:     "https://www.example.com",
+			wantStatus: http.StatusOK,
+			wantOrigin: "https://www.example.com",
+			wantCalled: true,
+		},
+		{
+			name:       "other origin",
+			method:     http.MethodGet,
+			origin:     "https://www.example.org",
+			wantStatus: http.StatusOK,
+			wantCalled: true,
+		},
+		{
+			name:        "preflight from allowed origin",
+			method:      http.MethodOptions,
+			origin:      "https://www.example.com",
+			preflight:   true,
+			wantStatus:  http.StatusNoContent,
+			wantOrigin:  "https://www.example.com",
+			wantHeaders: "Authorization",
+		},
+		{
+			name:       "preflight from other origin",
+			method:     http.MethodOptions,
+			origin:     "http://www.example.com",
+			preflight:  true,
+			wantStatus: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called = false
+			req := httptest.NewRequest(tt.method, "/latency/v1/result", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.preflight {
+				req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+			}
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+			if rw.Code != tt.wantStatus {
+				t.Errorf("unexpected status code %d", rw.Code)
+			}
+			if got := rw.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("unexpected Access-Control-Allow-Origin %q", got)
+			}
+			if got := rw.Header().Get("Access-Control-Allow-Headers"); got != tt.wantHeaders {
+				t.Errorf("unexpected Access-Control-Allow-Headers %q", got)
+			}
+			if called != tt.wantCalled {
+				t.Errorf("next called = %v, want %v", called, tt.wantCalled)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package latency1
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+)
+
+var errorJSONTooDeep = errors.New("maximum JSON depth exceeded")
+
+// blocklist counts malformed packets per session and temporarily blocks
+// sessions exceeding a threshold. Sessions are identified by their mid rather
+// than by the packets' source address, which can be spoofed to get another
+// client's address blocked.
+//
+// Packets that cannot be attributed to a session, i.e. oversized, too deeply
+// nested or invalid JSON ones, are deliberately not blocklisted, not even per
+// /24 or /64 source prefix: since UDP source addresses are not verified, an
+// attacker could spoof them to block every client of a network. These packets
+// are only counted. Rejecting them is already cheap, since they are never
+// read beyond the maximum packet size, and floods of them are better
+// rate-limited by the host's firewall.
+type blocklist struct {
+	threshold int
+	duration  time.Duration
+
+	// malformed maps a mid to the number of malformed packets received for
+	// it within the configured window.
+	malformed *ttlcache.Cache[string, int]
+	// blocked contains the currently blocklisted mids.
+	blocked *ttlcache.Cache[string, struct{}]
+	mu      sync.Mutex
+}
+
+// newBlocklist returns a blocklist that blocks a session for the provided
+// duration after threshold malformed packets have been received for it within
+// window.
+func newBlocklist(threshold int, window, duration time.Duration) *blocklist {
+	return &blocklist{
+		threshold: threshold,
+		duration:  duration,
+		malformed: ttlcache.New(
+			ttlcache.WithTTL[string, int](window),
+			ttlcache.WithDisableTouchOnHit[string, int](),
+		),
+		blocked: ttlcache.New(
+			ttlcache.WithTTL[string, struct{}](duration),
+			ttlcache.WithDisableTouchOnHit[string, struct{}](),
+		),
+	}
+}
+
+// IsBlocked returns true if the session with the given mid is currently
+// blocklisted.
+func (b *blocklist) IsBlocked(mid string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.blocked.Get(mid) != nil
+}
+
+// RecordMalformed records a malformed packet for the session with the given
+// mid. It returns true if this caused the session to be blocklisted.
+func (b *blocklist) RecordMalformed(mid string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	count := 1
+	if item := b.malformed.Get(mid); item != nil {
+		count = item.Value() + 1
+	}
+	if count >= b.threshold {
+		b.malformed.Delete(mid)
+		b.blocked.Set(mid, struct{}{}, ttlcache.DefaultTTL)
+		return true
+	}
+	b.malformed.Set(mid, count, ttlcache.DefaultTTL)
+	return false
+}
+
+// DeleteExpired removes expired entries from the blocklist.
+func (b *blocklist) DeleteExpired() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.malformed.DeleteExpired()
+	b.blocked.DeleteExpired()
+}
+
+// checkJSONDepth returns an error if the JSON document in b has objects or
+// arrays nested deeper than maxDepth. It does not validate the document.
+func checkJSONDepth(b []byte, maxDepth int) error {
+	depth := 0
+	inString := false
+	escaped := false
+	for _, c := range b {
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+		case '{', '[':
+			depth++
+			if depth > maxDepth {
+				return errorJSONTooDeep
+			}
+		case '}', ']':
+			depth--
+		}
+	}
+	return nil
+}
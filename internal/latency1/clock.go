@@ -0,0 +1,34 @@
+package latency1
+
+import "time"
+
+// clock is the source of time for a Handler. Wall clock readings are only
+// used for timestamps, while RTTs are only computed from monotonic readings,
+// so that they are not affected by wall clock adjustments (e.g. an NTP step)
+// during a session.
+type clock interface {
+	// Now returns the current wall clock time.
+	Now() time.Time
+	// Mono returns the time elapsed since a fixed, arbitrary point, according
+	// to the monotonic clock.
+	Mono() time.Duration
+}
+
+// systemClock is a clock using the system's wall and monotonic clocks.
+type systemClock struct {
+	start time.Time
+}
+
+func newSystemClock() systemClock {
+	return systemClock{start: time.Now()}
+}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Mono uses time.Since, which relies on the monotonic clock reading included
+// in time.Now()'s result.
+func (c systemClock) Mono() time.Duration {
+	return time.Since(c.start)
+}
@@ -0,0 +1,76 @@
+package latency1
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/m-lab/msak/pkg/latency1/model"
+)
+
+// fakeClock is a clock whose wall and monotonic readings can be changed
+// independently, to simulate wall clock adjustments.
+type fakeClock struct {
+	wall time.Time
+	mono time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.wall
+}
+
+func (c *fakeClock) Mono() time.Duration {
+	return c.mono
+}
+
+func TestHandler_RTTWallClockStep(t *testing.T) {
+	h := NewHandler(t.TempDir(), time.Minute)
+	defer h.sessions.Stop()
+	clock := &fakeClock{wall: time.Now(), mono: time.Hour}
+	h.clock = clock
+	conn := discardConn{}
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+
+	tests := []struct {
+		name string
+		step time.Duration
+	}{
+		{name: "backward step", step: -time.Hour},
+		{name: "forward step", step: time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := model.NewSession("test")
+			session.SendTimes = append(session.SendTimes, clock.Mono())
+			session.RoundTrips = append(session.RoundTrips, model.RoundTrip{Lost: true})
+			h.sessions.Set("test", session, ttlcache.DefaultTTL)
+
+			// The wall clock is stepped while the ping is in flight.
+			clock.wall = clock.wall.Add(tt.step)
+			clock.mono += 20 * time.Millisecond
+
+			err := h.processPacket(conn, addr,
+				[]byte(`{"ID":"test","Type":"s2c","Seq":0}`), clock.Mono())
+			if err != nil {
+				t.Fatalf("processPacket() error: %v", err)
+			}
+			want := (20 * time.Millisecond).Microseconds()
+			if rtt := session.RoundTrips[0].RTT; int64(rtt) != want {
+				t.Errorf("RTT = %d, want %d", rtt, want)
+			}
+			if rtt := session.LastRTT.Load(); rtt != want {
+				t.Errorf("LastRTT = %d, want %d", rtt, want)
+			}
+		})
+	}
+}
+
+func Test_systemClock(t *testing.T) {
+	c := newSystemClock()
+	first := c.Mono()
+	time.Sleep(time.Millisecond)
+	if second := c.Mono(); second <= first {
+		t.Errorf("monotonic clock did not advance: %v <= %v", second, first)
+	}
+}
@@ -0,0 +1,50 @@
+package latency1
+
+import (
+	"context"
+	"time"
+)
+
+// drainPollInterval is how often Drain checks whether the send loops are
+// over.
+const drainPollInterval = 100 * time.Millisecond
+
+// Drain stops accepting new sessions and waits until the running send loops
+// are over, or stops them early if ctx is done first. It then archives
+// every session still in the cache, including the ones whose results were
+// not fetched by the client, and waits for the archives to be written.
+// It returns ctx.Err() if the send loops had to be stopped early.
+//
+// The handler cannot be used after Drain returns.
+func (h *Handler) Drain(ctx context.Context) error {
+	h.draining.Store(true)
+	err := h.waitIdle(ctx)
+	if err != nil {
+		h.cancel()
+		// Stopped loops return at their next tick.
+		timeout, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		h.waitIdle(timeout)
+	}
+	h.cancel()
+
+	h.sessions.DeleteAll()
+	h.stopArchiving()
+	h.sessions.Stop()
+	return err
+}
+
+// waitIdle waits until there are no running send loops. It returns
+// ctx.Err() if ctx is done first.
+func (h *Handler) waitIdle(ctx context.Context) error {
+	t := time.NewTicker(drainPollInterval)
+	defer t.Stop()
+	for h.activeLoops.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package latency1
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/msak/internal/netx"
+	"github.com/m-lab/msak/internal/persistence"
+	"github.com/m-lab/msak/pkg/latency1/model"
+)
+
+func TestHandler_Drain(t *testing.T) {
+	h := NewHandler(t.TempDir(), time.Minute)
+	var (
+		mu       sync.Mutex
+		archived = map[string]bool{}
+	)
+	h.SetWriter(persistence.WriterFunc(
+		func(datatype, subtest, uuid string, data interface{}) error {
+			mu.Lock()
+			archived[uuid] = true
+			mu.Unlock()
+			return nil
+		}))
+
+	serverConn, err := net.ListenUDP("udp", nil)
+	rtx.Must(err, "cannot create test socket")
+	defer serverConn.Close()
+	clientConn, err := net.Dial("udp", serverConn.LocalAddr().String())
+	rtx.Must(err, "cannot connect to test socket")
+	defer clientConn.Close()
+
+	// Start a send loop that lasts longer than the drain timeout, and leave
+	// another session without a kickoff.
+	h.sessions.Set("running", model.NewSession("running"), ttlcache.DefaultTTL)
+	h.sessions.Set("pending", model.NewSession("pending"), ttlcache.DefaultTTL)
+	err = h.processPacket(serverConn, clientConn.LocalAddr(),
+		[]byte(`{"ID":"running","Type":"c2s"}`), h.clock.Mono())
+	rtx.Must(err, "cannot start send loop")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := h.Drain(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Drain() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Drain() took %v, the send loop was not stopped", elapsed)
+	}
+	if n := h.activeLoops.Load(); n != 0 {
+		t.Errorf("%d send loops still running", n)
+	}
+	// Both sessions are archived by the time Drain returns.
+	mu.Lock()
+	if !archived["running"] || !archived["pending"] {
+		t.Errorf("sessions not archived: %v", archived)
+	}
+	mu.Unlock()
+
+	// New sessions are rejected.
+	rw := httptest.NewRecorder()
+	conn := netx.Conn{}
+	req, err := http.NewRequestWithContext(conn.SaveUUID(context.Background()),
+		http.MethodGet, "/latency/v1/authorize?mid=test", nil)
+	rtx.Must(err, "cannot create request")
+	h.Authorize(rw, req)
+	if rw.Result().StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("invalid HTTP status code %d (expected %d)",
+			rw.Result().StatusCode, http.StatusServiceUnavailable)
+	}
+}
+
+func TestHandler_processPacketDraining(t *testing.T) {
+	h := NewHandler(t.TempDir(), time.Minute)
+	serverConn, err := net.ListenUDP("udp", nil)
+	rtx.Must(err, "cannot create test socket")
+	defer serverConn.Close()
+
+	h.sessions.Set("test", model.NewSession("test"), ttlcache.DefaultTTL)
+	h.draining.Store(true)
+	err = h.processPacket(serverConn, serverConn.LocalAddr(),
+		[]byte(`{"ID":"test","Type":"c2s"}`), h.clock.Mono())
+	if err != errorDraining {
+		t.Errorf("wrong error: expected %v, got %v", errorDraining, err)
+	}
+	if n := h.activeLoops.Load(); n != 0 {
+		t.Errorf("%d send loops started while draining", n)
+	}
+}
@@ -0,0 +1,105 @@
+package latency1
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/m-lab/msak/pkg/latency1/model"
+	"github.com/m-lab/msak/pkg/latency1/spec"
+)
+
+// discardConn is a net.PacketConn that discards all writes.
+type discardConn struct {
+	net.PacketConn
+}
+
+func (discardConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return len(b), nil
+}
+
+func (discardConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("192.0.2.100"), Port: 1053}
+}
+
+func FuzzProcessPacket(f *testing.F) {
+	f.Add([]byte(`{"ID":"test","Type":"c2s"}`))
+	f.Add([]byte(`{"ID":"test","Type":"s2c","Seq":0}`))
+	f.Add([]byte(`{"ID":"test","Type":"s2c","Seq":-1}`))
+	f.Add([]byte(`{"ID":"test","Type":"s2c","Seq":1000}`))
+	f.Add([]byte(`{"ID":"test","Type":"foo","Seq":1e30}`))
+	f.Add([]byte(`{"ID":"test","X":[[[[[1]]]]]}`))
+	f.Add([]byte("junk"))
+
+	h := NewHandler(f.TempDir(), time.Minute)
+	defer h.sessions.Stop()
+	// Never blocklist the fuzzer's session.
+	h.blocklist = newBlocklist(math.MaxInt, time.Minute, time.Minute)
+	conn := discardConn{}
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		// Use a fresh session with a few pings already sent. Mark it as
+		// started so that kickoff packets do not start a send loop.
+		session := model.NewSession("test")
+		session.Started = true
+		for i := 0; i < 3; i++ {
+			session.SendTimes = append(session.SendTimes, h.clock.Mono())
+			session.RoundTrips = append(session.RoundTrips, model.RoundTrip{Lost: true})
+		}
+		h.sessions.Set("test", session, ttlcache.DefaultTTL)
+		addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+		err := h.processPacket(conn, addr, packet, h.clock.Mono())
+		if err != nil {
+			return
+		}
+		// Packets accepted by processPacket must be valid JSON.
+		if !json.Valid(packet) {
+			t.Errorf("invalid JSON accepted: %q", packet)
+		}
+		if len(session.RoundTrips) != len(session.SendTimes) {
+			t.Errorf("RoundTrips and SendTimes are out of sync")
+		}
+	})
+}
+
+func FuzzCheckJSONDepth(f *testing.F) {
+	f.Add([]byte(`{"ID":"test"}`))
+	f.Add([]byte(`{"ID":"[[[[[\"{{{{"}`))
+	f.Add([]byte(`[[[[[[[[`))
+	f.Add([]byte(`"\\"`))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		if checkJSONDepth(b, spec.MaxJSONDepth) != nil {
+			return
+		}
+		// Documents within the depth limit must unmarshal without
+		// exceeding it.
+		var v interface{}
+		if err := json.Unmarshal(b, &v); err == nil && depth(v) > spec.MaxJSONDepth {
+			t.Errorf("depth limit not enforced: %q", b)
+		}
+	})
+}
+
+// depth returns the nesting depth of objects and arrays in v.
+func depth(v interface{}) int {
+	max := 0
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, e := range v {
+			if d := depth(e); d > max {
+				max = d
+			}
+		}
+		return max + 1
+	case []interface{}:
+		for _, e := range v {
+			if d := depth(e); d > max {
+				max = d
+			}
+		}
+		return max + 1
+	}
+	return 0
+}
@@ -0,0 +1,33 @@
+package latency1
+
+const (
+	// labelUnknown is the label value used when the client did not report
+	// a value.
+	labelUnknown = "unknown"
+	// labelOther is the label value used for values not in the allowlist.
+	labelOther = "other"
+)
+
+// allowlistLabel maps client-provided values to metric label values, keeping
+// the number of distinct values bounded. Values in the allowlist are used
+// as-is; any other value is reported as labelOther.
+type allowlistLabel map[string]struct{}
+
+func newAllowlistLabel(allowed []string) allowlistLabel {
+	a := allowlistLabel{}
+	for _, v := range allowed {
+		a[v] = struct{}{}
+	}
+	return a
+}
+
+// Value returns the label value to use for v.
+func (a allowlistLabel) Value(v string) string {
+	if v == "" {
+		return labelUnknown
+	}
+	if _, ok := a[v]; ok {
+		return v
+	}
+	return labelOther
+}
@@ -2,55 +2,221 @@ package latency1
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	mrand "math/rand"
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/charmbracelet/log"
+	guuid "github.com/google/uuid"
 	"github.com/jellydator/ttlcache/v3"
+	"github.com/m-lab/access/controller"
 	"github.com/m-lab/go/memoryless"
 	"github.com/m-lab/go/rtx"
-	"github.com/m-lab/msak/internal/handler"
 	"github.com/m-lab/msak/internal/netx"
 	"github.com/m-lab/msak/internal/persistence"
 	"github.com/m-lab/msak/pkg/latency1/model"
+	"github.com/m-lab/msak/pkg/latency1/spec"
+	"github.com/m-lab/msak/pkg/options"
+	"github.com/m-lab/msak/pkg/throughput1/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 const sendDuration = 5 * time.Second
 
+// sendInterval configures the intervals between s2c packets. Using randomized
+// intervals allows to detect cyclic network behaviors where a fixed interval
+// could align to the cycle.
+var sendInterval = memoryless.Config{
+	Expected: 25 * time.Millisecond,
+	Min:      10 * time.Millisecond,
+	Max:      40 * time.Millisecond,
+}
+
 var (
 	errorUnauthorized = errors.New("unauthorized")
 	errorInvalidSeqN  = errors.New("invalid sequence number")
+	errorOversized    = errors.New("packet too large")
+	errorInvalidType  = errors.New("invalid packet type")
+	errorBlocklisted  = errors.New("session is blocklisted")
+	errorDraining     = errors.New("handler is draining")
+	errorNotReading   = errors.New("UDP packets are not being read")
+	errorEchoMismatch = errors.New("echoed nonce does not match")
+)
+
+var (
+	malformedPackets = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "msak",
+			Subsystem: "latency1",
+			Name:      "malformed_packets_total",
+			Help:      "Number of malformed packets received, by reason.",
+		},
+		[]string{"reason"},
+	)
+	blocklistedPackets = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "msak",
+			Subsystem: "latency1",
+			Name:      "blocklisted_packets_total",
+			Help:      "Number of packets discarded because their session is blocklisted.",
+		},
+	)
+	blocklistedSessions = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "msak",
+			Subsystem: "latency1",
+			Name:      "blocklisted_sessions_total",
+			Help:      "Number of times a session has been blocklisted for sending malformed packets.",
+		},
+	)
+	echoMismatches = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "msak",
+			Subsystem: "latency1",
+			Name:      "echo_mismatches_total",
+			Help:      "Number of replies whose echoed nonce did not match the ping's.",
+		},
+	)
+	runningTests = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "msak",
+			Subsystem: "latency1",
+			Name:      "running_tests",
+			Help:      "Number of latency1 sessions currently sending pings.",
+		},
+	)
+	testDuration = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "msak",
+			Subsystem: "latency1",
+			Name:      "test_duration_seconds",
+			Help:      "Runtime of the send loops of completed latency1 sessions.",
+			// 100ms to ~51s.
+			Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
+		},
+	)
+	sendDelay = promauto.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "msak",
+			Subsystem: "latency1",
+			Name:      "send_delay_seconds",
+			Help:      "Delay between the scheduled and the actual send time of s2c packets. High values indicate CPU contention affecting the measurement.",
+			// 10us to ~160ms.
+			Buckets: prometheus.ExponentialBuckets(0.00001, 2, 15),
+		},
+	)
+	roundTripTimes = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "msak",
+			Subsystem: "latency1",
+			Name:      "rtt_seconds",
+			Help:      "Round-trip times measured by latency1 tests, by client platform.",
+			// 500us to ~8s.
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 15),
+		},
+		[]string{"client_name", "client_os"},
+	)
 )
 
 // Handler is the handler for latency tests.
 type Handler struct {
-	dataDir    string
-	sessions   *ttlcache.Cache[string, *model.Session]
-	sessionsMu sync.Mutex
+	dataDir  string
+	writer   persistence.Writer
+	sessions *sessionStore
+
+	// maxPacketSize is the maximum size of a packet accepted by the server.
+	maxPacketSize int
+	// blocklist tracks sessions sending malformed packets.
+	blocklist *blocklist
+
+	// clientNames and clientOSes bound the cardinality of the client_name
+	// and client_os metric labels.
+	clientNames allowlistLabel
+	clientOSes  allowlistLabel
+
+	// tokenMachine is the machine name access tokens are verified against.
+	tokenMachine string
+
+	// advertisedServer is the server's public host name or address, if
+	// configured.
+	advertisedServer string
+
+	// echoVerification is true if pings carry a random nonce that replies
+	// must echo.
+	echoVerification bool
+
+	// sendDelay observes how late each s2c packet is sent with respect to its
+	// scheduled send time.
+	sendDelay prometheus.Observer
+
+	// clock provides wall clock timestamps and the monotonic readings used
+	// to compute RTTs.
+	clock clock
+
+	// ctx is the parent context of every send loop. cancel stops them.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// draining is true once Drain has been called. New sessions are rejected
+	// while draining. activeLoops is the number of running send loops.
+	draining    atomic.Bool
+	activeLoops atomic.Int64
+	// readers is the number of goroutines reading packets in
+	// ProcessPacketLoop. processing is the number of them currently running.
+	readers    int
+	processing atomic.Int64
+	// stopArchiving unsubscribes the eviction handler archiving sessions and
+	// waits for the pending writes.
+	stopArchiving func()
 }
 
 // NewHandler returns a new handler for the UDP latency test.
 // It sets up a cache for sessions that writes the results to disk on item
-// eviction.
+// eviction. A different sink for the results can be configured with
+// SetWriter.
 func NewHandler(dir string, cacheTTL time.Duration) *Handler {
+	return NewShardedHandler(dir, cacheTTL, 1)
+}
 
-	cache := ttlcache.New(
-		ttlcache.WithTTL[string, *model.Session](cacheTTL),
-		ttlcache.WithDisableTouchOnHit[string, *model.Session](),
-	)
-	cache.OnEviction(func(ctx context.Context,
+// NewShardedHandler is like NewHandler, but partitions the sessions cache
+// into the provided number of shards by a hash of the mid, and reads packets
+// from the UDP socket with as many goroutines. This reduces lock contention
+// on high-throughput deployments.
+func NewShardedHandler(dir string, cacheTTL time.Duration, shards int) *Handler {
+	if shards < 1 {
+		shards = 1
+	}
+	cache := newSessionStore(shards, cacheTTL)
+	h := &Handler{
+		dataDir:       dir,
+		writer:        &persistence.FileWriter{Dir: dir},
+		sessions:      cache,
+		maxPacketSize: spec.DefaultMaxPacketSize,
+		blocklist: newBlocklist(spec.MaxMalformedPackets,
+			spec.MalformedPacketWindow, spec.BlocklistDuration),
+		clientNames: newAllowlistLabel(spec.DefaultClientNames),
+		clientOSes:  newAllowlistLabel(spec.DefaultClientOSes),
+		sendDelay:   sendDelay,
+		clock:       newSystemClock(),
+		readers:     shards,
+	}
+	h.ctx, h.cancel = context.WithCancel(context.Background())
+	h.stopArchiving = cache.OnEviction(func(ctx context.Context,
 		er ttlcache.EvictionReason,
 		i *ttlcache.Item[string, *model.Session]) {
-		log.Debug("Session expired", "id", i.Key(), "reason", er)
-
-		// Save data to disk when the session expires.
+		// Archive the session's data when it expires.
 		archive := i.Value().Archive()
-		archive.EndTime = time.Now()
-		_, err := persistence.WriteDataFile(dir, "latency1", "application", archive.ID, archive)
+		archive.EndTime = h.clock.Now()
+		archive.AdvertisedServer = h.advertisedServer
+		logSummary(i.Key(), archive, er)
+		err := h.writer.Write("latency1", "application", archive.ID, archive)
 		if err != nil {
 			log.Error("failed to write latency result", "mid", archive.ID, "error", err)
 			return
@@ -58,10 +224,70 @@ func NewHandler(dir string, cacheTTL time.Duration) *Handler {
 	})
 
 	go cache.Start()
-	return &Handler{
-		dataDir:  dir,
-		sessions: cache,
+	return h
+}
+
+// logSummary logs a single line summarizing a session evicted from the
+// cache for reason, meant to be ingested by log pipelines. Sessions deleted
+// after their result is fetched, or when draining, are reported as "ok".
+func logSummary(mid string, archive *model.ArchivalData,
+	reason ttlcache.EvictionReason) {
+	status := "ok"
+	if reason == ttlcache.EvictionReasonExpired {
+		status = "expired"
 	}
+	log.Info("Test completed",
+		"protocol", "latency1",
+		"mid", mid,
+		"uuid", archive.ID,
+		"direction", "s2c",
+		"duration", archive.EndTime.Sub(archive.StartTime),
+		"packets_sent", archive.PacketsSent,
+		"packets_received", archive.PacketsReceived,
+		"status", status)
+}
+
+// SetWriter sets the Writer that session archives are delivered to when a
+// session expires, in place of the JSON files in the data directory. It must
+// be called before the handler starts serving requests.
+func (h *Handler) SetWriter(w persistence.Writer) {
+	h.writer = w
+}
+
+// SetMaxPacketSize sets the maximum size of a latency packet accepted by the
+// server. Larger packets are discarded and counted as malformed.
+func (h *Handler) SetMaxPacketSize(size int) {
+	h.maxPacketSize = size
+}
+
+// SetTokenMachine sets the machine name access tokens are verified against,
+// so it can be recorded in the archived AccessToken.
+func (h *Handler) SetTokenMachine(machine string) {
+	h.tokenMachine = machine
+}
+
+// SetAdvertisedServer sets the host name or IP address the server is publicly
+// reachable at, recorded in every archive next to the UDP socket's local
+// address.
+func (h *Handler) SetAdvertisedServer(host string) {
+	h.advertisedServer = host
+}
+
+// SetClientLabels sets the client names and operating systems used as
+// client_name and client_os metric labels. Other values are reported as
+// "other". It must be called before the handler starts serving requests.
+func (h *Handler) SetClientLabels(names, oses []string) {
+	h.clientNames = newAllowlistLabel(names)
+	h.clientOSes = newAllowlistLabel(oses)
+}
+
+// SetEchoVerification enables or disables echo verification. When enabled,
+// every ping carries a random nonce, and replies that do not echo it are not
+// counted as received but as echo mismatches in the session's archive. This
+// detects middleboxes regenerating or spoofing UDP responses. It must be
+// called before the handler starts serving requests.
+func (h *Handler) SetEchoVerification(enabled bool) {
+	h.echoVerification = enabled
 }
 
 // Authorize verifies that the request includes a valid JWT, extracts its jti
@@ -69,7 +295,7 @@ func NewHandler(dir string, cacheTTL time.Duration) *Handler {
 // It returns a valid kickoff LatencyPacket for this new session in the
 // response body.
 func (h *Handler) Authorize(rw http.ResponseWriter, req *http.Request) {
-	mid, err := handler.GetMIDFromRequest(req)
+	mid, err := server.GetMIDFromRequest(req)
 	if err != nil {
 		log.Info("Received request without mid", "source", req.RemoteAddr,
 			"error", err)
@@ -78,6 +304,32 @@ func (h *Handler) Authorize(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	h.startSession(rw, req, mid)
+}
+
+// Issue generates a random mid, adds a new empty session for it to the
+// sessions cache and returns a valid kickoff LatencyPacket for this session
+// in the response body. The mid can be read from the kickoff packet's ID.
+//
+// This endpoint does not require any authorization and is only meant for
+// anonymous deployments where clients cannot obtain access tokens.
+func (h *Handler) Issue(rw http.ResponseWriter, req *http.Request) {
+	h.startSession(rw, req, guuid.NewString())
+}
+
+// startSession adds a new empty session for mid to the sessions cache and
+// writes a valid kickoff LatencyPacket for this session to rw.
+func (h *Handler) startSession(rw http.ResponseWriter, req *http.Request,
+	mid string) {
+	// While draining, reject new sessions so that clients can retry on
+	// another server.
+	if h.draining.Load() {
+		log.Info("Rejecting session while draining", "source", req.RemoteAddr)
+		rw.Header().Set("Connection", "Close")
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
 	// Retrieve the connection's UUID from context.
 	uuid := netx.LoadUUID(req.Context())
 	if uuid == "" {
@@ -87,9 +339,10 @@ func (h *Handler) Authorize(rw http.ResponseWriter, req *http.Request) {
 
 	// Create a new session for this mid.
 	session := model.NewSession(uuid)
-	h.sessionsMu.Lock()
+	session.ClientInfo = clientInfo(req)
+	session.AccessToken = h.accessToken(req)
+	session.EchoVerification = h.echoVerification
 	h.sessions.Set(mid, session, ttlcache.DefaultTTL)
-	h.sessionsMu.Unlock()
 
 	log.Debug("session created", "id", mid, "uuid", uuid)
 
@@ -110,7 +363,47 @@ func (h *Handler) Authorize(rw http.ResponseWriter, req *http.Request) {
 		// TODO: add Prometheus metric for write errors.
 		return
 	}
+}
+
+// clientInfo returns the ClientInfo reported in the request's querystring, or
+// nil if the client did not report any. Values are truncated to the maximum
+// metadata value length.
+func clientInfo(req *http.Request) *model.ClientInfo {
+	query := req.URL.Query()
+	get := func(name string) string {
+		v := query.Get(name)
+		if len(v) > options.MaxMetadataValueLength {
+			v = v[:options.MaxMetadataValueLength]
+		}
+		return v
+	}
+	info := &model.ClientInfo{
+		Name:    get(spec.ClientNameParameterName),
+		OS:      get(spec.ClientOSParameterName),
+		Version: get(spec.ClientVersionParameterName),
+	}
+	if *info == (model.ClientInfo{}) {
+		return nil
+	}
+	return info
+}
 
+// accessToken returns the claims of the request's verified access token to
+// be archived, or nil if the request has no verified access token.
+func (h *Handler) accessToken(req *http.Request) *model.AccessToken {
+	claims := controller.GetClaim(req.Context())
+	if claims == nil {
+		return nil
+	}
+	token := &model.AccessToken{
+		Issuer:   claims.Issuer,
+		Audience: claims.Audience,
+		Machine:  h.tokenMachine,
+	}
+	if claims.Expiry != nil {
+		token.Expiry = claims.Expiry.Time()
+	}
+	return token
 }
 
 // Result returns a result for a given measurement id. Possible status codes
@@ -119,7 +412,7 @@ func (h *Handler) Authorize(rw http.ResponseWriter, req *http.Request) {
 // - 404 if the mid is not found in the sessions cache
 // - 500 if the session JSON cannot be marshalled
 func (h *Handler) Result(rw http.ResponseWriter, req *http.Request) {
-	mid, err := handler.GetMIDFromRequest(req)
+	mid, err := server.GetMIDFromRequest(req)
 	if err != nil {
 		log.Info("Received request without mid", "source", req.RemoteAddr,
 			"error", err)
@@ -128,9 +421,7 @@ func (h *Handler) Result(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	h.sessionsMu.Lock()
 	cachedResult := h.sessions.Get(mid)
-	h.sessionsMu.Unlock()
 	if cachedResult == nil {
 		rw.WriteHeader(http.StatusNotFound)
 		return
@@ -158,80 +449,172 @@ func (h *Handler) Result(rw http.ResponseWriter, req *http.Request) {
 func (h *Handler) sendLoop(ctx context.Context, conn net.PacketConn,
 	remoteAddr net.Addr, id string, session *model.Session, duration time.Duration) error {
 	seq := 0
-	var err error
 
 	timeout, cancel := context.WithTimeout(ctx, duration)
 	defer cancel()
 
-	memoryless.Run(timeout, func() {
+	// Packets are sent at memoryless intervals, each drawn when the previous
+	// packet is sent. Unlike a memoryless.Ticker, which silently drops ticks
+	// when the loop falls behind, this keeps track of when each packet was
+	// scheduled to be sent, so that send delays can be measured.
+	if err := sendInterval.Check(); err != nil {
+		return err
+	}
+	wait := nextSendInterval()
+	scheduled := time.Now().Add(wait)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timeout.Done():
+			return h.sendFinal(conn, remoteAddr, id, session, seq)
+		case <-timer.C:
+		}
+		var nonce string
+		if session.EchoVerification {
+			nonce = newNonce()
+		}
 		b, marshalErr := json.Marshal(&model.LatencyPacket{
 			ID:      id,
 			Type:    "s2c",
 			Seq:     seq,
 			LastRTT: int(session.LastRTT.Load()),
+			Nonce:   nonce,
 		})
 
 		// This should never happen, since we should always be able to marshal
 		// a LatencyPacket struct.
 		rtx.Must(marshalErr, "cannot marshal LatencyPacket")
 
-		// Call time.Now() just before writing to the socket. The RTT will
+		// Read the clock just before writing to the socket. The RTT will
 		// include the ping packet's write time. This is intentional.
-		sendTime := time.Now()
+		sendTime := h.clock.Mono()
+		h.sendDelay.Observe(time.Since(scheduled).Seconds())
 		// As the kernel's socket buffers are usually much larger than the
 		// packets we send here, calling conn.WriteTo is expected to take a
 		// negligible time.
 		n, writeErr := conn.WriteTo(b, remoteAddr)
 		if writeErr != nil {
-			err = writeErr
-			cancel()
-			return
+			return writeErr
 		}
 		if n != len(b) {
-			err = errors.New("partial write")
-			cancel()
-			return
+			return errors.New("partial write")
 		}
 
-		// Update the SendTimes map after a successful write.
+		// Update SendTimes after a successful write and add this packet to
+		// the RoundTrips slice. Round trips are "lost" until a reply is
+		// received from the client. Both slices are updated under the same
+		// lock, so that a reply can never see them out of sync.
 		session.SendTimesMu.Lock()
+		inFlight := session.InFlight(sendTime, spec.InFlightTimeout)
 		session.SendTimes = append(session.SendTimes, sendTime)
-		session.SendTimesMu.Unlock()
-
-		// Add this packet to the Results slice. Results are "lost" until a
-		// reply is received from the server.
 		session.RoundTrips = append(session.RoundTrips, model.RoundTrip{
-			Lost: true,
+			Lost:     true,
+			InFlight: inFlight,
 		})
+		if session.EchoVerification {
+			session.Nonces = append(session.Nonces, nonce)
+		}
+		session.SendTimesMu.Unlock()
 
 		seq++
 
 		log.Debug("packet sent", "len", n, "uuid", session.UUID, "seq", seq)
 
-	}, memoryless.Config{
-		// Using randomized intervals allows to detect cyclic network
-		// behaviors where a fixed interval could align to the cycle.
-		Expected: 25 * time.Millisecond,
-		Min:      10 * time.Millisecond,
-		Max:      40 * time.Millisecond,
-	})
-	return err
+		wait = nextSendInterval()
+		scheduled = time.Now().Add(wait)
+		timer.Reset(wait)
+	}
+}
+
+// nextSendInterval returns the time to wait before sending the next packet,
+// drawn like memoryless.Ticker does from an exponential distribution with
+// mean sendInterval.Expected, clamped to [sendInterval.Min, sendInterval.Max].
+func nextSendInterval() time.Duration {
+	wait := time.Duration(mrand.ExpFloat64() * float64(sendInterval.Expected))
+	if wait < sendInterval.Min {
+		wait = sendInterval.Min
+	}
+	if wait > sendInterval.Max {
+		wait = sendInterval.Max
+	}
+	return wait
+}
+
+// newNonce returns a random nonce for a ping. It is unpredictable, so that
+// replies cannot be forged without receiving the ping.
+func newNonce() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	// This should never happen.
+	rtx.Must(err, "cannot read random bytes")
+	return hex.EncodeToString(b)
+}
+
+// sendFinal sends the final s2c packet of a session, telling the client that
+// the session is complete. Its sequence number is the one following the last
+// ping, and it is not tracked in the session's SendTimes.
+func (h *Handler) sendFinal(conn net.PacketConn, remoteAddr net.Addr, id string,
+	session *model.Session, seq int) error {
+	session.SendTimesMu.Lock()
+	final := &model.LatencyPacket{
+		ID:              id,
+		Type:            "s2c",
+		Seq:             seq,
+		LastRTT:         int(session.LastRTT.Load()),
+		Final:           true,
+		PacketsSent:     len(session.SendTimes),
+		PacketsReceived: session.PacketsReceived(),
+	}
+	session.SendTimesMu.Unlock()
+
+	b, err := json.Marshal(final)
+	// This should never happen.
+	rtx.Must(err, "cannot marshal LatencyPacket")
+	n, err := conn.WriteTo(b, remoteAddr)
+	if err != nil {
+		return err
+	}
+	if n != len(b) {
+		return errors.New("partial write")
+	}
+	log.Debug("final packet sent", "uuid", session.UUID, "seq", seq)
+	return nil
 }
 
-// processPacket processes a single UDP latency packet.
+// processPacket processes a single UDP latency packet. recvTime is the
+// packet's receive time, as returned by h.clock.Mono().
 func (h *Handler) processPacket(conn net.PacketConn, remoteAddr net.Addr,
-	packet []byte, recvTime time.Time) error {
+	packet []byte, recvTime time.Duration) error {
+	// Reject oversized or excessively nested packets before attempting to
+	// unmarshal them. These cannot be attributed to a session, so they are
+	// counted but never blocklisted: see blocklist.
+	if len(packet) > h.maxPacketSize {
+		malformedPackets.WithLabelValues("oversized").Inc()
+		return errorOversized
+	}
+	if err := checkJSONDepth(packet, spec.MaxJSONDepth); err != nil {
+		malformedPackets.WithLabelValues("too-deep").Inc()
+		return err
+	}
+
 	// Attempt to unmarshal the packet.
 	var m model.LatencyPacket
 	err := json.Unmarshal(packet, &m)
 	if err != nil {
+		malformedPackets.WithLabelValues("invalid-json").Inc()
 		return err
 	}
 
+	// Discard packets for blocklisted sessions as early as possible.
+	if h.blocklist.IsBlocked(m.ID) {
+		blocklistedPackets.Inc()
+		return errorBlocklisted
+	}
+
 	// Check if this is a known session.
-	h.sessionsMu.Lock()
 	cachedResult := h.sessions.Get(m.ID)
-	h.sessionsMu.Unlock()
 	if cachedResult == nil {
 		return errorUnauthorized
 	}
@@ -241,9 +624,14 @@ func (h *Handler) processPacket(conn net.PacketConn, remoteAddr net.Addr,
 	// If this message's type is s2c, it was a server ping echoed back by the
 	// client. Store it in the session's result and compute the RTT.
 	if m.Type == "s2c" {
+		// The final packet is not a ping. Clients should not echo it, but
+		// there is nothing to measure if they do.
+		if m.Final {
+			return nil
+		}
 		session.SendTimesMu.Lock()
 		defer session.SendTimesMu.Unlock()
-		if m.Seq >= len(session.SendTimes) {
+		if m.Seq < 0 || m.Seq >= len(session.SendTimes) {
 			// TODO: Add Prometheus metric.
 			log.Info("received packet with valid mid and invalid seq number",
 				"mid", m.ID,
@@ -251,9 +639,23 @@ func (h *Handler) processPacket(conn net.PacketConn, remoteAddr net.Addr,
 				"addr", remoteAddr.String())
 			return errorInvalidSeqN
 		}
+		// A reply that does not echo the ping's nonce was not sent by the
+		// client in response to the ping.
+		if session.EchoVerification && m.Nonce != session.Nonces[m.Seq] {
+			session.EchoMismatches++
+			echoMismatches.Inc()
+			log.Info("received packet with mismatched nonce",
+				"mid", m.ID,
+				"seq", m.Seq,
+				"addr", remoteAddr.String())
+			return errorEchoMismatch
+		}
 
-		rtt := recvTime.Sub(session.SendTimes[m.Seq]).Microseconds()
+		// Both times are monotonic clock readings.
+		rttDuration := recvTime - session.SendTimes[m.Seq]
+		rtt := rttDuration.Microseconds()
 		session.LastRTT.Store(rtt)
+		h.observeRTT(session, rttDuration)
 		session.RoundTrips[m.Seq].RTT = int(rtt)
 		session.RoundTrips[m.Seq].Lost = false
 
@@ -263,37 +665,114 @@ func (h *Handler) processPacket(conn net.PacketConn, remoteAddr net.Addr,
 		return nil
 	}
 
-	// If this message's type is c2s, it's a kickoff packet. Record
-	// local/remote addresses and trigger the send loop.
-	if m.Type == "c2s" {
-		session.StartedMu.Lock()
-		defer session.StartedMu.Unlock()
-		if !session.Started {
-			session.Started = true
-			session.Client = remoteAddr.String()
-			session.Server = conn.LocalAddr().String()
-			go h.sendLoop(context.Background(), conn, remoteAddr, m.ID, session,
-				sendDuration)
+	// Any other type than c2s is invalid.
+	if m.Type != "c2s" {
+		h.recordMalformed(m.ID, remoteAddr, "invalid-type")
+		return errorInvalidType
+	}
+
+	// This is a kickoff packet. Record local/remote addresses and trigger
+	// the send loop.
+	session.StartedMu.Lock()
+	defer session.StartedMu.Unlock()
+	if !session.Started {
+		// Sessions authorized before draining started are not kicked off.
+		// Checking after incrementing activeLoops guarantees that Drain
+		// waits for every loop that is started.
+		h.activeLoops.Add(1)
+		if h.draining.Load() {
+			h.activeLoops.Add(-1)
+			return errorDraining
 		}
+		session.Started = true
+		session.Client = remoteAddr.String()
+		session.Server = conn.LocalAddr().String()
+		session.AddressFamily = netx.AddressFamily(remoteAddr)
+		go func() {
+			defer h.activeLoops.Add(-1)
+			runningTests.Inc()
+			defer runningTests.Dec()
+			start := h.clock.Mono()
+			h.sendLoop(h.ctx, conn, remoteAddr, m.ID, session, sendDuration)
+			testDuration.Observe((h.clock.Mono() - start).Seconds())
+		}()
+	}
+	return nil
+}
+
+// observeRTT records rtt in the round-trip times histogram, labeled with the
+// session's client name and operating system.
+func (h *Handler) observeRTT(session *model.Session, rtt time.Duration) {
+	var name, os string
+	if session.ClientInfo != nil {
+		name, os = session.ClientInfo.Name, session.ClientInfo.OS
 	}
+	roundTripTimes.WithLabelValues(h.clientNames.Value(name),
+		h.clientOSes.Value(os)).Observe(rtt.Seconds())
+}
+
+// recordMalformed counts a malformed packet for the session with the given
+// mid, received from remoteAddr, and blocklists the session if too many of
+// them have been received.
+func (h *Handler) recordMalformed(mid string, remoteAddr net.Addr, reason string) {
+	malformedPackets.WithLabelValues(reason).Inc()
+	if h.blocklist.RecordMalformed(mid) {
+		blocklistedSessions.Inc()
+		log.Info("session blocklisted after sending malformed packets",
+			"mid", mid, "addr", remoteAddr.String())
+	}
+}
 
+// CheckUDP returns an error if ProcessPacketLoop is not running, i.e. if the
+// packets sent to the UDP socket are not being read.
+func (h *Handler) CheckUDP() error {
+	if h.processing.Load() == 0 {
+		return errorNotReading
+	}
 	return nil
 }
 
 // ProcessPacketLoop is the main packet processing loop. For each incoming
 // packet, it records its timestamp and acts depending on the packet type.
+// Packets are read by one goroutine per shard of the sessions cache.
+// It returns when conn is closed.
 func (h *Handler) ProcessPacketLoop(conn net.PacketConn) {
-	log.Info("Accepting UDP packets...")
-	buf := make([]byte, 1024)
+	log.Info("Accepting UDP packets...", "readers", h.readers)
+	var wg sync.WaitGroup
+	for i := 0; i < h.readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.readPackets(conn)
+		}()
+	}
+	wg.Wait()
+}
+
+// readPackets reads and processes packets from conn until it is closed.
+func (h *Handler) readPackets(conn net.PacketConn) {
+	h.processing.Add(1)
+	defer h.processing.Add(-1)
+	// The buffer is one byte larger than the maximum packet size, so that
+	// oversized packets can be detected rather than silently truncated.
+	buf := make([]byte, h.maxPacketSize+1)
+	lastCleanup := h.clock.Mono()
 	for {
 		n, addr, err := conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			log.Error("error while reading UDP packet", "err", err)
 			continue
 		}
 		// The receive time should be recorded as soon as possible after
 		// reading the packet, to improve accuracy.
-		recvTime := time.Now()
+		recvTime := h.clock.Mono()
+		if recvTime-lastCleanup > spec.MalformedPacketWindow {
+			h.blocklist.DeleteExpired()
+			lastCleanup = recvTime
+		}
 		log.Debug("received UDP packet", "addr", addr, "n", n, "data", string(buf[:n]))
 		err = h.processPacket(conn, addr, buf[:n], recvTime)
 		if err != nil {
@@ -9,12 +9,20 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/jellydator/ttlcache/v3"
+	"github.com/m-lab/access/controller"
+	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/msak/internal/netx"
+	"github.com/m-lab/msak/internal/persistence"
 	"github.com/m-lab/msak/pkg/latency1/model"
+	"github.com/m-lab/msak/pkg/latency1/spec"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"gopkg.in/square/go-jose.v2/jwt"
 )
 
 func TestNewHandler(t *testing.T) {
@@ -64,6 +72,145 @@ func TestOnEviction(t *testing.T) {
 	}
 }
 
+func TestHandler_SetWriter(t *testing.T) {
+	tempDir := t.TempDir()
+	h := NewHandler(tempDir, 1*time.Millisecond)
+	h.SetAdvertisedServer("mlab1-lga0t.example.org")
+	written := make(chan string, 1)
+	h.SetWriter(persistence.WriterFunc(
+		func(datatype, subtest, uuid string, data interface{}) error {
+			archive, ok := data.(*model.ArchivalData)
+			if !ok {
+				t.Errorf("unexpected data type: %T", data)
+			} else if archive.AdvertisedServer != "mlab1-lga0t.example.org" {
+				t.Errorf("invalid AdvertisedServer: %q", archive.AdvertisedServer)
+			}
+			written <- uuid
+			return nil
+		}))
+	h.sessions.Set("test", model.NewSession("test"), ttlcache.DefaultTTL)
+
+	select {
+	case id := <-written:
+		if id != "test" {
+			t.Errorf("invalid archive id: %s", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("cache expired but archive not delivered to the writer")
+	}
+	files, err := os.ReadDir(tempDir)
+	rtx.Must(err, "cannot read temp data folder")
+	if len(files) != 0 {
+		t.Errorf("unexpected files written to the data folder")
+	}
+}
+
+func TestHandler_sendLoopDelay(t *testing.T) {
+	h := NewHandler(t.TempDir(), 5*time.Second)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	rtx.Must(err, "cannot listen")
+	defer conn.Close()
+
+	// Use a histogram of our own, since send loops started by other tests may
+	// still be observing the shared one.
+	delays := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test"})
+	h.sendDelay = delays
+	session := model.NewSession("test")
+	err = h.sendLoop(context.Background(), conn, conn.LocalAddr(), "test",
+		session, 200*time.Millisecond)
+	rtx.Must(err, "sendLoop failed")
+	m := &dto.Metric{}
+	rtx.Must(delays.Write(m), "cannot read histogram")
+	count := m.GetHistogram().GetSampleCount()
+	if sent := len(session.SendTimes); sent == 0 || count != uint64(sent) {
+		t.Errorf("send delay not observed for every packet: %d packets, %d observations",
+			sent, count)
+	}
+}
+
+func TestHandler_sendLoopInFlight(t *testing.T) {
+	h := NewHandler(t.TempDir(), 5*time.Second)
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	rtx.Must(err, "cannot listen")
+	defer conn.Close()
+
+	// No ping is ever answered, so the window grows by one with each ping.
+	session := model.NewSession("test")
+	err = h.sendLoop(context.Background(), conn, conn.LocalAddr(), "test",
+		session, 200*time.Millisecond)
+	rtx.Must(err, "sendLoop failed")
+	if len(session.RoundTrips) < 2 {
+		t.Fatalf("too few pings sent: %d", len(session.RoundTrips))
+	}
+	for i, rt := range session.RoundTrips {
+		if rt.InFlight != i {
+			t.Errorf("ping %d: in-flight window %d, want %d", i, rt.InFlight, i)
+		}
+	}
+	summary := session.Archive().InFlight
+	if summary == nil || summary.Max != len(session.RoundTrips)-1 {
+		t.Errorf("unexpected in-flight summary: %+v", summary)
+	}
+}
+
+func TestHandler_sendLoopFinal(t *testing.T) {
+	h := NewHandler(t.TempDir(), 5*time.Second)
+	serverConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	rtx.Must(err, "cannot listen")
+	defer serverConn.Close()
+	clientConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	rtx.Must(err, "cannot listen")
+	defer clientConn.Close()
+
+	session := model.NewSession("test")
+	err = h.sendLoop(context.Background(), serverConn, clientConn.LocalAddr(),
+		"test", session, 200*time.Millisecond)
+	rtx.Must(err, "sendLoop failed")
+
+	// Every ping is followed by a single final packet.
+	buf := make([]byte, 1024)
+	var packets []model.LatencyPacket
+	clientConn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		n, _, err := clientConn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		var m model.LatencyPacket
+		rtx.Must(json.Unmarshal(buf[:n], &m), "cannot unmarshal packet")
+		packets = append(packets, m)
+		if m.Final {
+			break
+		}
+	}
+	if len(packets) < 2 {
+		t.Fatalf("too few packets received: %d", len(packets))
+	}
+	final := packets[len(packets)-1]
+	sent := len(session.SendTimes)
+	if !final.Final || final.Seq != sent || final.PacketsSent != sent ||
+		final.PacketsReceived != 0 {
+		t.Errorf("unexpected final packet after %d pings: %+v", sent, final)
+	}
+	for _, m := range packets[:len(packets)-1] {
+		if m.Final {
+			t.Errorf("ping %d marked as final", m.Seq)
+		}
+	}
+}
+
+func TestSession_InFlight(t *testing.T) {
+	session := model.NewSession("test")
+	session.SendTimes = []time.Duration{0, time.Second, 2 * time.Second,
+		2500 * time.Millisecond}
+	session.RoundTrips = []model.RoundTrip{{Lost: true}, {Lost: true},
+		{RTT: 1000}, {Lost: true}}
+	// The first ping is too old to count and the third one was answered.
+	if n := session.InFlight(3*time.Second, 2*time.Second); n != 2 {
+		t.Errorf("InFlight() = %d, want 2", n)
+	}
+}
+
 func TestHandler_Authorize(t *testing.T) {
 	tempDir := t.TempDir()
 	h := NewHandler(tempDir, 5*time.Second)
@@ -95,6 +242,126 @@ func TestHandler_Authorize(t *testing.T) {
 	}
 }
 
+func TestHandler_Issue(t *testing.T) {
+	h := NewHandler(t.TempDir(), 5*time.Second)
+	defer h.sessions.Stop()
+
+	conn := netx.Conn{}
+	ctx := conn.SaveUUID(context.Background())
+	mids := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		rw := httptest.NewRecorder()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+			"/latency/v1/issue", nil)
+		if err != nil {
+			t.Fatalf("cannot create request: %v", err)
+		}
+		h.Issue(rw, req)
+		if rw.Code != http.StatusOK {
+			t.Fatalf("invalid HTTP status code %d (expected 200)", rw.Code)
+		}
+		var kickoff model.LatencyPacket
+		if err := json.Unmarshal(rw.Body.Bytes(), &kickoff); err != nil {
+			t.Fatalf("cannot unmarshal kickoff packet: %v", err)
+		}
+		if kickoff.ID == "" || kickoff.Type != "c2s" {
+			t.Errorf("invalid kickoff packet: %+v", kickoff)
+		}
+		if h.sessions.Get(kickoff.ID) == nil {
+			t.Errorf("no session created for issued mid %s", kickoff.ID)
+		}
+		mids[kickoff.ID] = true
+	}
+	if len(mids) != 2 {
+		t.Errorf("issued mids are not unique")
+	}
+}
+
+func TestHandler_ClientInfo(t *testing.T) {
+	h := NewHandler(t.TempDir(), 5*time.Second)
+	defer h.sessions.Stop()
+	h.SetClientLabels([]string{"test-client"}, []string{"linux"})
+
+	conn := netx.Conn{}
+	ctx := conn.SaveUUID(context.Background())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		"/latency/v1/authorize?mid=test&client_name=test-client&client_os=linux"+
+			"&client_version="+strings.Repeat("v", 1000), nil)
+	rtx.Must(err, "cannot create request")
+	h.Authorize(httptest.NewRecorder(), req)
+
+	session := h.sessions.Get("test").Value()
+	info := session.ClientInfo
+	if info == nil || info.Name != "test-client" || info.OS != "linux" ||
+		len(info.Version) != 512 {
+		t.Fatalf("invalid ClientInfo: %+v", info)
+	}
+	if summary := session.Summarize(); summary.ClientInfo != info {
+		t.Errorf("ClientInfo not included in summary")
+	}
+
+	// The RTT is observed with the client's labels.
+	h.observeRTT(session, 10*time.Millisecond)
+	m := &dto.Metric{}
+	rtx.Must(roundTripTimes.WithLabelValues("test-client", "linux").(prometheus.Histogram).Write(m),
+		"cannot read histogram")
+	if m.GetHistogram().GetSampleCount() == 0 {
+		t.Errorf("RTT not observed with client labels")
+	}
+
+	// Without client info, no ClientInfo is recorded.
+	req.URL.RawQuery = "mid=test2"
+	h.Authorize(httptest.NewRecorder(), req)
+	if info := h.sessions.Get("test2").Value().ClientInfo; info != nil {
+		t.Errorf("unexpected ClientInfo: %+v", info)
+	}
+}
+
+func TestHandler_AccessToken(t *testing.T) {
+	h := NewHandler(t.TempDir(), 5*time.Second)
+	defer h.sessions.Stop()
+	h.SetTokenMachine("mlab1-lga0t")
+
+	conn := netx.Conn{}
+	expiry := time.Now().Add(time.Minute).Truncate(time.Second)
+	ctx := controller.SetClaim(conn.SaveUUID(context.Background()),
+		&jwt.Claims{
+			ID:       "test",
+			Issuer:   "locate",
+			Audience: jwt.Audience{"mlab1-lga0t"},
+			Expiry:   jwt.NewNumericDate(expiry),
+		})
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		"/latency/v1/authorize", nil)
+	rtx.Must(err, "cannot create request")
+	h.Authorize(httptest.NewRecorder(), req)
+
+	item := h.sessions.Get("test")
+	if item == nil {
+		t.Fatalf("no session created")
+	}
+	token := item.Value().Archive().AccessToken
+	if token == nil || token.Issuer != "locate" || len(token.Audience) != 1 ||
+		token.Machine != "mlab1-lga0t" || !token.Expiry.Equal(expiry) {
+		t.Errorf("unexpected access token: %+v", token)
+	}
+}
+
+func Test_allowlistLabel(t *testing.T) {
+	b := newAllowlistLabel([]string{"a", "b"})
+	for _, tt := range []struct{ in, want string }{
+		{"", labelUnknown},
+		{"a", "a"},
+		{"c", labelOther},
+		{"b", "b"},
+		{"A", labelOther},
+	} {
+		if got := b.Value(tt.in); got != tt.want {
+			t.Errorf("Value(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
 func TestHandler_Result(t *testing.T) {
 	tempDir := t.TempDir()
 	h := NewHandler(tempDir, 5*time.Second)
@@ -162,6 +429,36 @@ func TestHandler_Result(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 }
 
+func TestHandler_CheckUDP(t *testing.T) {
+	h := NewHandler(t.TempDir(), 5*time.Second)
+	if err := h.CheckUDP(); err == nil {
+		t.Errorf("CheckUDP() before ProcessPacketLoop did not fail")
+	}
+
+	serverConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatalf("cannot create test socket")
+	}
+	done := make(chan struct{})
+	go func() {
+		h.ProcessPacketLoop(serverConn)
+		close(done)
+	}()
+	deadline := time.Now().Add(time.Second)
+	for h.CheckUDP() != nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := h.CheckUDP(); err != nil {
+		t.Errorf("CheckUDP() while reading packets failed: %v", err)
+	}
+
+	serverConn.Close()
+	<-done
+	if err := h.CheckUDP(); err == nil {
+		t.Errorf("CheckUDP() after ProcessPacketLoop returned did not fail")
+	}
+}
+
 func TestHandler_processPacket(t *testing.T) {
 	serverConn, err := net.ListenUDP("udp", nil)
 	if err != nil {
@@ -178,14 +475,14 @@ func TestHandler_processPacket(t *testing.T) {
 
 	invalidPayload := []byte("test")
 	err = h.processPacket(serverConn, clientConn.LocalAddr(),
-		invalidPayload, time.Now())
+		invalidPayload, h.clock.Mono())
 	if err == nil {
 		t.Errorf("expected error on invalid payload, got nil.")
 	}
 
 	invalidSession := []byte(`{"ID":"invalid"}`)
 	err = h.processPacket(serverConn, clientConn.LocalAddr(),
-		invalidSession, time.Now())
+		invalidSession, h.clock.Mono())
 	if err != errorUnauthorized {
 		t.Errorf("wrong error: expected %v, got %v", errorUnauthorized, err)
 	}
@@ -195,10 +492,17 @@ func TestHandler_processPacket(t *testing.T) {
 	// Send a kickoff message
 	validKickoff := []byte(`{"ID":"test","Type":"c2s"}`)
 	err = h.processPacket(serverConn, clientConn.LocalAddr(), validKickoff,
-		time.Now())
+		h.clock.Mono())
 	if err != nil {
 		t.Errorf("unexpected error with valid session: %v", err)
 	}
+	wantFamily := netx.FamilyIPv4
+	if clientConn.LocalAddr().(*net.UDPAddr).IP.To4() == nil {
+		wantFamily = netx.FamilyIPv6
+	}
+	if family := h.sessions.Get("test").Value().AddressFamily; family != wantFamily {
+		t.Errorf("AddressFamily = %q, want %q", family, wantFamily)
+	}
 	// Check that packets are received within 1s.
 	err = clientConn.SetDeadline(time.Now().Add(time.Second))
 	if err != nil {
@@ -229,6 +533,74 @@ func TestHandler_processPacket(t *testing.T) {
 	if packetsRead == 0 {
 		t.Errorf("did not receive any latency packets after kickoff")
 	}
+	// The send loop is still running.
+	m := &dto.Metric{}
+	rtx.Must(runningTests.Write(m), "cannot read gauge")
+	if m.GetGauge().GetValue() < 1 {
+		t.Errorf("running session not counted: %v", m.GetGauge().GetValue())
+	}
+}
+
+func TestHandler_processPacketIPv4Mapped(t *testing.T) {
+	// IPv4 clients of a dual-stack socket have IPv4-mapped IPv6 addresses.
+	serverConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatalf("cannot create test socket")
+	}
+	defer serverConn.Close()
+	if family, err := netx.SocketFamily(serverConn); err != nil || family != netx.FamilyDual {
+		t.Skipf("no dual-stack UDP socket: %q, %v", family, err)
+	}
+
+	h := NewHandler(t.TempDir(), 5*time.Second)
+	defer h.sessions.Stop()
+	h.sessions.Set("test", model.NewSession("test"), ttlcache.DefaultTTL)
+
+	port := serverConn.LocalAddr().(*net.UDPAddr).Port
+	clientConn, err := net.DialUDP("udp4", nil,
+		&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	if err != nil {
+		t.Fatalf("cannot connect to test socket: %v", err)
+	}
+	defer clientConn.Close()
+	_, err = clientConn.Write([]byte(`{"ID":"test","Type":"c2s"}`))
+	rtx.Must(err, "cannot send kickoff packet")
+
+	rtx.Must(serverConn.SetReadDeadline(time.Now().Add(time.Second)),
+		"cannot set deadline")
+	buf := make([]byte, 1024)
+	n, addr, err := serverConn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("cannot read kickoff packet: %v", err)
+	}
+	if ip := addr.(*net.UDPAddr).IP; len(ip) != net.IPv6len || ip.To4() == nil {
+		t.Fatalf("client address %v is not IPv4-mapped", ip)
+	}
+	err = h.processPacket(serverConn, addr, buf[:n], h.clock.Mono())
+	if err != nil {
+		t.Fatalf("unexpected error with valid session: %v", err)
+	}
+
+	session := h.sessions.Get("test").Value()
+	if session.AddressFamily != netx.FamilyIPv4 {
+		t.Errorf("AddressFamily = %q, want %q", session.AddressFamily,
+			netx.FamilyIPv4)
+	}
+	if host, _, err := net.SplitHostPort(session.Client); err != nil ||
+		net.ParseIP(host) == nil {
+		t.Errorf("invalid Client %q", session.Client)
+	}
+	// Pings are sent back to the IPv4 client.
+	rtx.Must(clientConn.SetReadDeadline(time.Now().Add(time.Second)),
+		"cannot set deadline")
+	n, err = clientConn.Read(buf)
+	if err != nil {
+		t.Fatalf("did not receive any latency packets: %v", err)
+	}
+	var latencyPacket model.LatencyPacket
+	if err := json.Unmarshal(buf[:n], &latencyPacket); err != nil {
+		t.Errorf("cannot unmarshal latency packet: %v", err)
+	}
 }
 
 func Test_processS2CPacket(t *testing.T) {
@@ -246,8 +618,8 @@ func Test_processS2CPacket(t *testing.T) {
 	}
 
 	// Create a valid session with a fake sendTime.
-	pingTime := time.Now()
-	pongTime := pingTime.Add(100 * time.Millisecond)
+	pingTime := h.clock.Mono()
+	pongTime := pingTime + 100*time.Millisecond
 	session := h.sessions.Set("test", model.NewSession("test"),
 		ttlcache.DefaultTTL)
 
@@ -269,15 +641,162 @@ func Test_processS2CPacket(t *testing.T) {
 
 	// Check the computed RTT.
 	rtt := session.Value().LastRTT.Load()
-	expected := pongTime.Sub(pingTime).Microseconds()
-	if session.Value().LastRTT.Load() != pongTime.Sub(pingTime).Microseconds() {
+	expected := (pongTime - pingTime).Microseconds()
+	if rtt != expected {
 		t.Errorf("wrong computed RTT (expected %d, got %d)", expected, rtt)
 	}
 
+	// An echoed final packet is ignored.
+	payload = []byte(`{"Type":"s2c","ID":"test","Seq":1,"Final":true}`)
+	err = h.processPacket(serverConn, clientConn.RemoteAddr(), payload, pongTime)
+	if err != nil {
+		t.Errorf("echoed final packet not ignored: %v", err)
+	}
+
 	// Process a pong packet with an unknown sequence number.
 	payload = []byte(`{"Type":"s2c","ID":"test","Seq":1000}`)
 	err = h.processPacket(serverConn, clientConn.RemoteAddr(), payload, pongTime)
 	if err != errorInvalidSeqN {
 		t.Errorf("wrong error returned: %v", err)
 	}
+
+	// Negative sequence numbers are rejected too.
+	payload = []byte(`{"Type":"s2c","ID":"test","Seq":-1}`)
+	err = h.processPacket(serverConn, clientConn.RemoteAddr(), payload, pongTime)
+	if err != errorInvalidSeqN {
+		t.Errorf("wrong error returned: %v", err)
+	}
+
+	// As are unknown packet types.
+	payload = []byte(`{"Type":"foo","ID":"test"}`)
+	err = h.processPacket(serverConn, clientConn.RemoteAddr(), payload, pongTime)
+	if err != errorInvalidType {
+		t.Errorf("wrong error returned: %v", err)
+	}
+}
+
+func Test_processS2CPacketEchoVerification(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", nil)
+	rtx.Must(err, "cannot create test socket")
+	defer serverConn.Close()
+	clientConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	rtx.Must(err, "cannot create test socket")
+	defer clientConn.Close()
+
+	h := NewHandler(t.TempDir(), 5*time.Second)
+	h.SetEchoVerification(true)
+	session := model.NewSession("test")
+	session.EchoVerification = true
+	h.sessions.Set("test", session, ttlcache.DefaultTTL)
+
+	err = h.sendLoop(context.Background(), serverConn, clientConn.LocalAddr(),
+		"test", session, 100*time.Millisecond)
+	rtx.Must(err, "sendLoop failed")
+	if len(session.Nonces) != len(session.SendTimes) || len(session.Nonces) < 2 {
+		t.Fatalf("got %d nonces for %d pings", len(session.Nonces),
+			len(session.SendTimes))
+	}
+
+	// Pings carry their nonce.
+	buf := make([]byte, 1024)
+	clientConn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := clientConn.ReadFrom(buf)
+	rtx.Must(err, "cannot read ping")
+	var ping model.LatencyPacket
+	rtx.Must(json.Unmarshal(buf[:n], &ping), "cannot unmarshal ping")
+	if ping.Nonce == "" || ping.Nonce != session.Nonces[ping.Seq] {
+		t.Errorf("ping %d carries nonce %q, want %q", ping.Seq, ping.Nonce,
+			session.Nonces[ping.Seq])
+	}
+
+	// A verbatim echo is a valid reply.
+	recvTime := h.clock.Mono()
+	err = h.processPacket(serverConn, clientConn.LocalAddr(), buf[:n], recvTime)
+	if err != nil {
+		t.Fatalf("verbatim echo rejected: %v", err)
+	}
+
+	// Replies with a wrong or missing nonce are counted as mismatches and
+	// the pings stay lost.
+	for _, payload := range []string{
+		`{"Type":"s2c","ID":"test","Seq":1,"Nonce":"0000000000000000"}`,
+		`{"Type":"s2c","ID":"test","Seq":1}`,
+	} {
+		err = h.processPacket(serverConn, clientConn.LocalAddr(),
+			[]byte(payload), recvTime)
+		if err != errorEchoMismatch {
+			t.Errorf("wrong error returned for %s: %v", payload, err)
+		}
+	}
+	archive := session.Archive()
+	if !archive.EchoVerification || archive.EchoMismatches != 2 {
+		t.Errorf("unexpected echo verification result: %v, %d mismatches",
+			archive.EchoVerification, archive.EchoMismatches)
+	}
+	if archive.PacketsReceived != 1 || !archive.RoundTrips[1].Lost {
+		t.Errorf("mismatched echo counted as received")
+	}
+}
+
+func TestHandler_processPacketMalformed(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatalf("cannot create test socket")
+	}
+	defer serverConn.Close()
+
+	h := NewHandler(t.TempDir(), 5*time.Second)
+	defer h.sessions.Stop()
+	h.SetMaxPacketSize(64)
+	h.sessions.Set("test", model.NewSession("test"), ttlcache.DefaultTTL)
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+
+	oversized := []byte(`{"ID":"test","Type":"s2c","Seq":0,"pad":"` +
+		strings.Repeat("x", 64) + `"}`)
+	err = h.processPacket(serverConn, addr, oversized, h.clock.Mono())
+	if err != errorOversized {
+		t.Errorf("wrong error: expected %v, got %v", errorOversized, err)
+	}
+
+	tooDeep := []byte(`{"ID":"test","X":[[[[[1]]]]]}`)
+	err = h.processPacket(serverConn, addr, tooDeep, h.clock.Mono())
+	if err != errorJSONTooDeep {
+		t.Errorf("wrong error: expected %v, got %v", errorJSONTooDeep, err)
+	}
+
+	// Brackets within strings do not count towards the depth.
+	notDeep := []byte(`{"ID":"[[[[[\"{{{{"}`)
+	if err := checkJSONDepth(notDeep, spec.MaxJSONDepth); err != nil {
+		t.Errorf("unexpected error for brackets in strings: %v", err)
+	}
+
+	// Packets that cannot be attributed to a session do not blocklist
+	// anything, since their content and source can be spoofed.
+	for i := 0; i < spec.MaxMalformedPackets; i++ {
+		h.processPacket(serverConn, addr, []byte("junk"), h.clock.Mono())
+	}
+	valid := []byte(`{"ID":"test","Type":"c2s"}`)
+	err = h.processPacket(serverConn, addr, valid, h.clock.Mono())
+	if err == errorBlocklisted {
+		t.Errorf("session blocklisted after unattributable packets")
+	}
+
+	// Keep sending malformed packets for the session until it is
+	// blocklisted.
+	h.sessions.Set("other", model.NewSession("other"), ttlcache.DefaultTTL)
+	invalidType := []byte(`{"ID":"test","Type":"foo"}`)
+	for i := 0; i < spec.MaxMalformedPackets; i++ {
+		h.processPacket(serverConn, addr, invalidType, h.clock.Mono())
+	}
+	err = h.processPacket(serverConn, addr, valid, h.clock.Mono())
+	if err != errorBlocklisted {
+		t.Errorf("wrong error: expected %v, got %v", errorBlocklisted, err)
+	}
+
+	// Other sessions from the same source are not affected.
+	otherValid := []byte(`{"ID":"other","Type":"c2s"}`)
+	err = h.processPacket(serverConn, addr, otherValid, h.clock.Mono())
+	if err == errorBlocklisted {
+		t.Errorf("unrelated session is blocklisted")
+	}
 }
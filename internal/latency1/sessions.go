@@ -0,0 +1,138 @@
+package latency1
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/m-lab/msak/pkg/latency1/model"
+)
+
+// sessionShard is a partition of the sessions cache.
+type sessionShard struct {
+	mu    sync.Mutex
+	cache *ttlcache.Cache[string, *model.Session]
+}
+
+// sessionStore is a sessions cache partitioned into shards by a hash of the
+// mid, so that concurrent lookups for different sessions rarely contend on
+// the same lock.
+type sessionStore struct {
+	shards []*sessionShard
+}
+
+// newSessionStore returns a sessionStore with n shards whose items expire
+// after ttl. n is at least 1.
+func newSessionStore(n int, ttl time.Duration) *sessionStore {
+	if n < 1 {
+		n = 1
+	}
+	s := &sessionStore{shards: make([]*sessionShard, n)}
+	for i := range s.shards {
+		s.shards[i] = &sessionShard{
+			cache: ttlcache.New(
+				ttlcache.WithTTL[string, *model.Session](ttl),
+				ttlcache.WithDisableTouchOnHit[string, *model.Session](),
+			),
+		}
+	}
+	return s
+}
+
+// shard returns the shard holding mid.
+func (s *sessionStore) shard(mid string) *sessionShard {
+	if len(s.shards) == 1 {
+		return s.shards[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(mid))
+	return s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+// Set adds or replaces the session for mid.
+func (s *sessionStore) Set(mid string, session *model.Session,
+	ttl time.Duration) *ttlcache.Item[string, *model.Session] {
+	sh := s.shard(mid)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return sh.cache.Set(mid, session, ttl)
+}
+
+// Get returns the session for mid, or nil if there is none.
+func (s *sessionStore) Get(mid string) *ttlcache.Item[string, *model.Session] {
+	sh := s.shard(mid)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return sh.cache.Get(mid)
+}
+
+// Delete removes the session for mid.
+func (s *sessionStore) Delete(mid string) {
+	sh := s.shard(mid)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	sh.cache.Delete(mid)
+}
+
+// DeleteAll removes every session.
+func (s *sessionStore) DeleteAll() {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		sh.cache.DeleteAll()
+		sh.mu.Unlock()
+	}
+}
+
+// DeleteExpired removes every expired session.
+func (s *sessionStore) DeleteExpired() {
+	for _, sh := range s.shards {
+		sh.cache.DeleteExpired()
+	}
+}
+
+// Len returns the number of sessions.
+func (s *sessionStore) Len() int {
+	n := 0
+	for _, sh := range s.shards {
+		n += sh.cache.Len()
+	}
+	return n
+}
+
+// OnEviction calls fn whenever a session is evicted from any shard. The
+// returned function unsubscribes fn.
+func (s *sessionStore) OnEviction(fn func(context.Context, ttlcache.EvictionReason,
+	*ttlcache.Item[string, *model.Session])) func() {
+	unsubscribe := make([]func(), len(s.shards))
+	for i, sh := range s.shards {
+		unsubscribe[i] = sh.cache.OnEviction(fn)
+	}
+	return func() {
+		for _, u := range unsubscribe {
+			u()
+		}
+	}
+}
+
+// Start starts the automatic cleanup of expired sessions in every shard. It
+// blocks until Stop is called.
+func (s *sessionStore) Start() {
+	var wg sync.WaitGroup
+	for _, sh := range s.shards {
+		wg.Add(1)
+		go func(c *ttlcache.Cache[string, *model.Session]) {
+			defer wg.Done()
+			c.Start()
+		}(sh.cache)
+	}
+	wg.Wait()
+}
+
+// Stop stops the automatic cleanup of expired sessions.
+func (s *sessionStore) Stop() {
+	for _, sh := range s.shards {
+		sh.cache.Stop()
+	}
+}
@@ -0,0 +1,136 @@
+package latency1
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/m-lab/msak/pkg/latency1/model"
+)
+
+func TestSessionStore(t *testing.T) {
+	s := newSessionStore(8, time.Minute)
+	defer s.Stop()
+	go s.Start()
+
+	used := map[*sessionShard]bool{}
+	for i := 0; i < 100; i++ {
+		mid := fmt.Sprintf("mid-%d", i)
+		s.Set(mid, model.NewSession(mid), ttlcache.DefaultTTL)
+		used[s.shard(mid)] = true
+	}
+	if len(used) != 8 {
+		t.Errorf("sessions stored in %d shards, want 8", len(used))
+	}
+	if n := s.Len(); n != 100 {
+		t.Errorf("Len() = %d, want 100", n)
+	}
+	item := s.Get("mid-42")
+	if item == nil || item.Value().UUID != "mid-42" {
+		t.Errorf("Get() returned the wrong session: %v", item)
+	}
+	s.Delete("mid-42")
+	if s.Get("mid-42") != nil {
+		t.Errorf("session not deleted")
+	}
+
+	evicted := make(chan string, 100)
+	stop := s.OnEviction(func(_ context.Context, _ ttlcache.EvictionReason,
+		i *ttlcache.Item[string, *model.Session]) {
+		evicted <- i.Key()
+	})
+	s.DeleteAll()
+	stop()
+	if n := s.Len(); n != 0 {
+		t.Errorf("Len() = %d after DeleteAll, want 0", n)
+	}
+	if n := len(evicted); n != 99 {
+		t.Errorf("%d sessions evicted, want 99", n)
+	}
+}
+
+func TestNewShardedHandler(t *testing.T) {
+	h := NewShardedHandler(t.TempDir(), time.Minute, 0)
+	defer h.sessions.Stop()
+	if len(h.sessions.shards) != 1 || h.readers != 1 {
+		t.Errorf("NewShardedHandler(0) has %d shards and %d readers, want 1",
+			len(h.sessions.shards), h.readers)
+	}
+}
+
+func TestHandler_ProcessPacketLoopSharded(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatalf("cannot create test socket")
+	}
+	h := NewShardedHandler(t.TempDir(), time.Minute, 4)
+	defer h.sessions.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		h.ProcessPacketLoop(serverConn)
+		close(done)
+	}()
+	deadline := time.Now().Add(time.Second)
+	for h.processing.Load() != 4 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := h.processing.Load(); n != 4 {
+		t.Errorf("%d readers running, want 4", n)
+	}
+
+	serverConn.Close()
+	<-done
+	if err := h.CheckUDP(); err == nil {
+		t.Errorf("CheckUDP() did not fail after the socket was closed")
+	}
+}
+
+// benchmarkSessions is the number of concurrent sessions in
+// BenchmarkHandler_processPacket.
+const benchmarkSessions = 256
+
+// BenchmarkHandler_processPacket measures the processing of pong packets for
+// many concurrent sessions, with different numbers of shards.
+func BenchmarkHandler_processPacket(b *testing.B) {
+	for _, shards := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			serverConn, err := net.ListenUDP("udp", nil)
+			if err != nil {
+				b.Fatalf("cannot create test socket")
+			}
+			defer serverConn.Close()
+			h := NewShardedHandler(b.TempDir(), time.Minute, shards)
+			defer h.sessions.Stop()
+
+			payloads := make([][]byte, benchmarkSessions)
+			for i := range payloads {
+				mid := fmt.Sprintf("bench-%d", i)
+				session := model.NewSession(mid)
+				session.SendTimes = []time.Duration{h.clock.Mono()}
+				session.RoundTrips = []model.RoundTrip{{}}
+				h.sessions.Set(mid, session, ttlcache.DefaultTTL)
+				payloads[i] = []byte(`{"Type":"s2c","ID":"` + mid + `","Seq":0}`)
+			}
+			addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+
+			var next atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(next.Add(1))
+				for pb.Next() {
+					payload := payloads[i%benchmarkSessions]
+					if err := h.processPacket(serverConn, addr, payload,
+						h.clock.Mono()); err != nil {
+						b.Errorf("processPacket failed: %v", err)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
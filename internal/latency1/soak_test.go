@@ -0,0 +1,101 @@
+//go:build soak
+// +build soak
+
+package latency1
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/m-lab/msak/internal/netx"
+)
+
+const (
+	// soakSessions is the number of latency sessions run by TestSoak.
+	soakSessions = 300
+	// soakSlack is the number of goroutines above the baseline tolerated at
+	// the end of the soak test.
+	soakSlack = 5
+)
+
+// TestSoak runs many latency sessions against a handler and checks that the
+// sessions cache is emptied and goroutines return to their baseline
+// afterwards.
+//
+// Run with: go test -tags soak ./internal/latency1/
+func TestSoak(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatalf("cannot create test socket")
+	}
+	defer serverConn.Close()
+	tempDir := t.TempDir()
+	h := NewHandler(tempDir, 10*time.Second)
+	defer h.sessions.Stop()
+
+	baselineGoroutines := runtime.NumGoroutine()
+
+	conn := netx.Conn{}
+	ctx := conn.SaveUUID(context.Background())
+	clients := make([]net.Conn, soakSessions)
+	for i := 0; i < soakSessions; i++ {
+		mid := fmt.Sprintf("soak-%d", i)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+			"/latency/v1/authorize?mid="+mid, nil)
+		if err != nil {
+			t.Fatalf("cannot create request: %v", err)
+		}
+		rw := httptest.NewRecorder()
+		h.Authorize(rw, req)
+		if rw.Code != http.StatusOK {
+			t.Fatalf("authorization failed for %s: %d", mid, rw.Code)
+		}
+
+		clients[i], err = net.Dial("udp", serverConn.LocalAddr().String())
+		if err != nil {
+			t.Fatalf("cannot connect to test socket")
+		}
+		defer clients[i].Close()
+		kickoff := []byte(`{"ID":"` + mid + `","Type":"c2s"}`)
+		err = h.processPacket(serverConn, clients[i].LocalAddr(), kickoff,
+			h.clock.Mono())
+		if err != nil {
+			t.Fatalf("cannot process kickoff for %s: %v", mid, err)
+		}
+	}
+
+	// Wait for all the send loops to complete and collect results for half
+	// of the sessions. The remaining ones expire from the cache.
+	time.Sleep(sendDuration + time.Second)
+	for i := 0; i < soakSessions/2; i++ {
+		req := httptest.NewRequest(http.MethodGet,
+			fmt.Sprintf("/latency/v1/result?mid=soak-%d", i), nil)
+		rw := httptest.NewRecorder()
+		h.Result(rw, req)
+		if rw.Code != http.StatusOK {
+			t.Errorf("result failed for soak-%d: %d", i, rw.Code)
+		}
+	}
+	h.sessions.DeleteExpired()
+	time.Sleep(5 * time.Second)
+	h.sessions.DeleteExpired()
+
+	if n := h.sessions.Len(); n != 0 {
+		t.Errorf("sessions cache not empty: %d items", n)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	n := runtime.NumGoroutine()
+	for n > baselineGoroutines+soakSlack && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		n = runtime.NumGoroutine()
+	}
+	if n > baselineGoroutines+soakSlack {
+		t.Errorf("goroutine leak: %d at start, %d at end", baselineGoroutines, n)
+	}
+}
@@ -18,6 +18,7 @@ import (
 
 // Throughput1Measurer tracks state for collecting connection measurements.
 type Throughput1Measurer struct {
+	config              memoryless.Config
 	connInfo            netx.ConnInfo
 	startTime           time.Time
 	bytesReadAtStart    int64
@@ -29,9 +30,35 @@ type Throughput1Measurer struct {
 	ReadChan <-chan model.Measurement
 }
 
-// New creates an empty Throughput1Measurer. The measurer must be started with Start.
+// New creates an empty Throughput1Measurer using the default measurement
+// intervals. The measurer must be started with Start.
 func New() *Throughput1Measurer {
-	return &Throughput1Measurer{}
+	return &Throughput1Measurer{
+		config: memoryless.Config{
+			Min:      spec.MinMeasureInterval,
+			Expected: spec.AvgMeasureInterval,
+			Max:      spec.MaxMeasureInterval,
+		},
+	}
+}
+
+// NewWithInterval creates an empty Throughput1Measurer whose average interval
+// between measurements is the provided one. The minimum and maximum intervals
+// are scaled in the same proportions as the default ones.
+func NewWithInterval(avg time.Duration) *Throughput1Measurer {
+	scale := float64(avg) / float64(spec.AvgMeasureInterval)
+	return &Throughput1Measurer{
+		config: memoryless.Config{
+			Min:      time.Duration(float64(spec.MinMeasureInterval) * scale),
+			Expected: avg,
+			Max:      time.Duration(float64(spec.MaxMeasureInterval) * scale),
+		},
+	}
+}
+
+// Config returns the configuration of the intervals between measurements.
+func (m *Throughput1Measurer) Config() memoryless.Config {
+	return m.config
 }
 
 // Start starts a measurer goroutine that periodically reads the tcp_info and
@@ -52,6 +79,7 @@ func (m *Throughput1Measurer) Start(ctx context.Context, conn net.Conn) <-chan m
 	connInfo := netx.ToConnInfo(conn)
 	read, written := connInfo.ByteCounters()
 	*m = Throughput1Measurer{
+		config:    m.config,
 		connInfo:  connInfo,
 		dstChan:   dst,
 		ReadChan:  dst,
@@ -69,15 +97,11 @@ func (m *Throughput1Measurer) Start(ctx context.Context, conn net.Conn) <-chan m
 }
 
 func (m *Throughput1Measurer) loop(ctx context.Context) {
-	log.Debug("Measurer started", "context", ctx)
-	defer log.Debug("Measurer stopped", "context", ctx)
-	t, err := memoryless.NewTicker(ctx, memoryless.Config{
-		Min:      spec.MinMeasureInterval,
-		Expected: spec.AvgMeasureInterval,
-		Max:      spec.MaxMeasureInterval,
-	})
-	// This can only error if min/expected/max above are set to invalid
-	// values. Since they are constants, we panic here.
+	log.Debug("Measurer started", "uuid", m.connInfo.UUID())
+	defer log.Debug("Measurer stopped", "uuid", m.connInfo.UUID())
+	t, err := memoryless.NewTicker(ctx, m.config)
+	// This can only error if min/expected/max are set to invalid values.
+	// Since they are always derived from positive intervals, we panic here.
 	rtx.PanicOnError(err, "ticker creation failed (this should never happen)")
 	defer t.Stop()
 
@@ -105,14 +129,29 @@ func (m *Throughput1Measurer) Measure(ctx context.Context) model.Measurement {
 	// we still want to return a (empty) Measurement.
 	bbrInfo, tcpInfo, err := m.connInfo.Info()
 	if err != nil {
-		log.Warn("GetInfo() failed for context %p: %v", ctx, err)
+		log.Warn("GetInfo() failed", "uuid", m.connInfo.UUID(), "error", err)
 	}
 
 	// Read current bytes counters.
 	totalRead, totalWritten := m.connInfo.ByteCounters()
 
+	var ecn *model.ECN
+	if err == nil {
+		negotiated, seen := netx.ECNState(&tcpInfo)
+		ecn = &model.ECN{
+			Negotiated:  negotiated,
+			Seen:        seen,
+			DeliveredCE: tcpInfo.DeliveredCE,
+		}
+	}
+
+	now := time.Now()
+	sinceStart := now.Sub(m.startTime).Microseconds()
+	sinceAccept := now.Sub(m.connInfo.AcceptTime()).Microseconds()
 	return model.Measurement{
-		ElapsedTime: time.Since(m.startTime).Microseconds(),
+		ElapsedTime:           sinceStart,
+		ElapsedSinceTestStart: sinceStart,
+		ElapsedSinceAccept:    sinceAccept,
 		Network: model.ByteCounters{
 			BytesSent:     int64(totalWritten) - m.bytesWrittenAtStart,
 			BytesReceived: int64(totalRead) - m.bytesReadAtStart,
@@ -120,7 +159,8 @@ func (m *Throughput1Measurer) Measure(ctx context.Context) model.Measurement {
 		BBRInfo: &bbrInfo,
 		TCPInfo: &model.TCPInfo{
 			LinuxTCPInfo: tcpInfo,
-			ElapsedTime:  time.Since(m.connInfo.AcceptTime()).Microseconds(),
+			ElapsedTime:  sinceAccept,
 		},
+		ECN: ecn,
 	}
 }
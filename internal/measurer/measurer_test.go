@@ -39,7 +39,31 @@ func TestNdt8Measurer_Start(t *testing.T) {
 		if m.Network.BytesSent != 4 {
 			t.Errorf("invalid byte counter value")
 		}
+		if m.ElapsedSinceTestStart <= 0 || m.ElapsedTime != m.ElapsedSinceTestStart ||
+			m.ElapsedSinceAccept < m.ElapsedSinceTestStart {
+			t.Errorf("invalid elapsed times: %d/%d/%d", m.ElapsedTime,
+				m.ElapsedSinceTestStart, m.ElapsedSinceAccept)
+		}
 	case <-time.After(1 * time.Second):
 		t.Fatalf("did not receive any measurement")
 	}
 }
+
+func TestNdt8Measurer_NewWithInterval(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	serverConn := &netx.Conn{
+		Conn: server,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// With a 5s average interval, the minimum interval is 2s. No measurement
+	// should be received within the first second.
+	m := measurer.NewWithInterval(5 * time.Second)
+	mchan := m.Start(ctx, serverConn)
+	select {
+	case <-mchan:
+		t.Fatalf("received measurement before the minimum interval")
+	case <-time.After(1 * time.Second):
+	}
+}
@@ -0,0 +1,21 @@
+package netx
+
+import (
+	"os"
+	"strings"
+)
+
+// allowedCCPath is the file listing the congestion control algorithms that
+// unprivileged processes are allowed to select.
+var allowedCCPath = "/proc/sys/net/ipv4/tcp_allowed_congestion_control"
+
+// AllowedCC returns the congestion control algorithms that can be set on a
+// socket without additional privileges, as reported by the kernel. It
+// returns an error on systems where this information is not available.
+func AllowedCC() ([]string, error) {
+	b, err := os.ReadFile(allowedCCPath)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(b)), nil
+}
@@ -0,0 +1,30 @@
+package netx
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAllowedCC(t *testing.T) {
+	oldPath := allowedCCPath
+	defer func() { allowedCCPath = oldPath }()
+
+	allowedCCPath = filepath.Join(t.TempDir(), "tcp_allowed_congestion_control")
+	if _, err := AllowedCC(); err == nil {
+		t.Errorf("AllowedCC() did not return an error for a missing file")
+	}
+
+	err := os.WriteFile(allowedCCPath, []byte("reno cubic bbr2\n"), 0644)
+	if err != nil {
+		t.Fatalf("cannot write test file: %v", err)
+	}
+	got, err := AllowedCC()
+	if err != nil {
+		t.Fatalf("AllowedCC() returned error: %v", err)
+	}
+	if want := []string{"reno", "cubic", "bbr2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("AllowedCC() = %v, want %v", got, want)
+	}
+}
@@ -3,10 +3,12 @@ package netx
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	guuid "github.com/google/uuid"
@@ -22,6 +24,16 @@ type contextKey string
 
 const uuidCtxKey = "netx-uuid"
 
+// TCP_INFO option flags related to ECN, from include/uapi/linux/tcp.h.
+const (
+	tcpiOptECN     = 8
+	tcpiOptECNSeen = 16
+)
+
+// ErrNoSupport is returned by socket option getters and setters on platforms
+// where they are not supported.
+var ErrNoSupport = errors.New("socket option not supported on this platform")
+
 // ConnInfo provides operations on a net.Conn's underlying file descriptor.
 type ConnInfo interface {
 	ByteCounters() (uint64, uint64)
@@ -30,6 +42,9 @@ type ConnInfo interface {
 	UUID() string
 	GetCC() (string, error)
 	SetCC(string) error
+	SocketBuffers() (int, int, error)
+	SetSocketBuffers(int, int) error
+	SetNotSentLowat(int) error
 	SaveUUID(context.Context) context.Context
 }
 
@@ -48,6 +63,9 @@ func ToConnInfo(netConn net.Conn) ConnInfo {
 		return t
 	case *tls.Conn:
 		return t.NetConn().(*Conn)
+	case interface{ NetConn() net.Conn }:
+		// Wrappers of a Conn, e.g. recording the WebSocket handshake.
+		return ToConnInfo(t.NetConn())
 	default:
 		panic(fmt.Sprintf("unsupported connection type: %T", t))
 	}
@@ -105,6 +123,49 @@ func (c *Conn) GetCC() (string, error) {
 	return congestion.Get(c.fp)
 }
 
+// SocketBuffers returns the effective size of the socket's send and receive
+// buffers (SO_SNDBUF and SO_RCVBUF), in this order. Note that Linux reports
+// twice the size that was set, to account for bookkeeping overhead.
+func (c *Conn) SocketBuffers() (int, int, error) {
+	sndbuf, err := getsockoptInt(c.fp, syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	if err != nil {
+		return 0, 0, err
+	}
+	rcvbuf, err := getsockoptInt(c.fp, syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	if err != nil {
+		return 0, 0, err
+	}
+	return sndbuf, rcvbuf, nil
+}
+
+// SetSocketBuffers sets the size of the socket's send and receive buffers
+// (SO_SNDBUF and SO_RCVBUF). A zero value leaves the corresponding buffer
+// unchanged. Setting a buffer size disables the kernel's autotuning for that
+// buffer.
+func (c *Conn) SetSocketBuffers(sndbuf, rcvbuf int) error {
+	if sndbuf > 0 {
+		err := setsockoptInt(c.fp, syscall.SOL_SOCKET, syscall.SO_SNDBUF, sndbuf)
+		if err != nil {
+			return err
+		}
+	}
+	if rcvbuf > 0 {
+		err := setsockoptInt(c.fp, syscall.SOL_SOCKET, syscall.SO_RCVBUF, rcvbuf)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetNotSentLowat sets TCP_NOTSENT_LOWAT on the underlying socket, limiting
+// the amount of unsent data in the socket's write queue to the given number of
+// bytes. This keeps application-level byte counters close to the bytes
+// actually sent on the wire. It returns ErrNoSupport on non-Linux systems.
+func (c *Conn) SetNotSentLowat(bytes int) error {
+	return setNotSentLowat(c.fp, bytes)
+}
+
 // Info returns the BBRInfo and TCPInfo structs associated with the underlying
 // socket. It returns an error if TCPInfo cannot be read.
 func (c *Conn) Info() (inetdiag.BBRInfo, tcp.LinuxTCPInfo, error) {
@@ -150,3 +211,23 @@ func LoadUUID(ctx context.Context) string {
 	}
 	return uuid
 }
+
+// ECNState returns whether ECN was negotiated during the TCP handshake and
+// whether at least one ECT packet has been received, according to the
+// provided TCP_INFO.
+func ECNState(info *tcp.LinuxTCPInfo) (negotiated bool, seen bool) {
+	return info.Options&tcpiOptECN != 0, info.Options&tcpiOptECNSeen != 0
+}
+
+// ECN returns whether ECN was negotiated on the connection, whether at least
+// one ECT packet has been received and the number of packets delivered with
+// CE marks, as reported by the receiver's ECE feedback. It returns an error if
+// TCP_INFO cannot be read, e.g. on non-Linux systems.
+func (c *Conn) ECN() (negotiated, seen bool, deliveredCE uint32, err error) {
+	_, tcpInfo, err := c.Info()
+	if err != nil {
+		return false, false, 0, err
+	}
+	negotiated, seen = ECNState(&tcpInfo)
+	return negotiated, seen, tcpInfo.DeliveredCE, nil
+}
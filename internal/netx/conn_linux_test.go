@@ -0,0 +1,27 @@
+package netx_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/msak/internal/netx"
+)
+
+func TestConn_ECN(t *testing.T) {
+	tcpl, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	rtx.Must(err, "failed to create listener")
+	defer tcpl.Close()
+	dialAsync(t, tcpl.Addr().String())
+	tcpConn, err := tcpl.AcceptTCP()
+	rtx.Must(err, "failed to accept connection")
+	conn, err := netx.FromTCPLikeConn(tcpConn)
+	rtx.Must(err, "failed to create netx.Conn")
+	defer conn.Close()
+
+	// Whether ECN is negotiated depends on the kernel's configuration, but
+	// TCP_INFO is always available on Linux.
+	if _, _, _, err := conn.ECN(); err != nil {
+		t.Errorf("ECN() error = %v", err)
+	}
+}
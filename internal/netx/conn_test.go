@@ -0,0 +1,41 @@
+package netx_test
+
+import (
+	"testing"
+
+	"github.com/m-lab/msak/internal/netx"
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+func TestECNState(t *testing.T) {
+	tests := []struct {
+		name           string
+		options        uint8
+		wantNegotiated bool
+		wantSeen       bool
+	}{
+		{
+			name: "no-ecn",
+		},
+		{
+			name:           "negotiated",
+			options:        8,
+			wantNegotiated: true,
+		},
+		{
+			name:           "negotiated-and-seen",
+			options:        8 | 16 | 1,
+			wantNegotiated: true,
+			wantSeen:       true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			negotiated, seen := netx.ECNState(&tcp.LinuxTCPInfo{Options: tt.options})
+			if negotiated != tt.wantNegotiated || seen != tt.wantSeen {
+				t.Errorf("ECNState() = %v, %v, want %v, %v", negotiated, seen,
+					tt.wantNegotiated, tt.wantSeen)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package netx
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// IP families accepted by ListenNetwork and returned by AddressFamily.
+const (
+	FamilyDual = "dual"
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+// ListenNetwork returns the network to listen on for the provided protocol
+// ("tcp" or "udp") and IP family. FamilyIPv6 listeners do not accept
+// IPv4 connections, while FamilyDual listeners on a wildcard address accept
+// both, with IPv4 peers reported as IPv4 addresses.
+func ListenNetwork(protocol, family string) (string, error) {
+	switch family {
+	case FamilyDual:
+		return protocol, nil
+	case FamilyIPv4:
+		return protocol + "4", nil
+	case FamilyIPv6:
+		return protocol + "6", nil
+	}
+	return "", fmt.Errorf("invalid IP family: %q", family)
+}
+
+// CheckFamily returns an error if the socket c, e.g. one passed by systemd
+// socket activation, does not have the IP family a listener created by
+// ListenNetwork for family would have. Every socket matches FamilyDual.
+func CheckFamily(c syscall.Conn, family string) error {
+	if family == FamilyDual {
+		return nil
+	}
+	got, err := SocketFamily(c)
+	if err != nil {
+		return err
+	}
+	if got != family {
+		return fmt.Errorf("socket IP family is %s, not %s", got, family)
+	}
+	return nil
+}
+
+// AddressFamily returns the IP family of addr, either FamilyIPv4 or
+// FamilyIPv6. IPv4-mapped IPv6 addresses, as seen by dual-stack sockets, are
+// reported as FamilyIPv4. It returns an empty string if addr is not an IP
+// address.
+func AddressFamily(addr net.Addr) string {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		if addr == nil {
+			return ""
+		}
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return ""
+		}
+		ip = net.ParseIP(host)
+	}
+	switch {
+	case ip.To4() != nil:
+		return FamilyIPv4
+	case ip.To16() != nil:
+		return FamilyIPv6
+	}
+	return ""
+}
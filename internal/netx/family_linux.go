@@ -0,0 +1,41 @@
+package netx
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// SocketFamily returns the IP family of the socket c: FamilyIPv4 for IPv4
+// sockets, FamilyIPv6 for IPv6-only sockets and FamilyDual for IPv6 sockets
+// also accepting IPv4 peers.
+func SocketFamily(c syscall.Conn) (string, error) {
+	rawconn, err := c.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	var domain, v6only int
+	var syscallErr error
+	err = rawconn.Control(func(fd uintptr) {
+		domain, syscallErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET,
+			syscall.SO_DOMAIN)
+		if syscallErr == nil && domain == syscall.AF_INET6 {
+			v6only, syscallErr = syscall.GetsockoptInt(int(fd),
+				syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY)
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	if syscallErr != nil {
+		return "", syscallErr
+	}
+	switch {
+	case domain == syscall.AF_INET:
+		return FamilyIPv4, nil
+	case domain == syscall.AF_INET6 && v6only != 0:
+		return FamilyIPv6, nil
+	case domain == syscall.AF_INET6:
+		return FamilyDual, nil
+	}
+	return "", fmt.Errorf("not an IP socket: domain %d", domain)
+}
@@ -0,0 +1,45 @@
+package netx_test
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/m-lab/msak/internal/netx"
+)
+
+func TestSocketFamily(t *testing.T) {
+	tests := []struct {
+		network string
+		addr    string
+		want    string
+	}{
+		{network: "tcp4", addr: "127.0.0.1:0", want: netx.FamilyIPv4},
+		{network: "tcp6", addr: "[::1]:0", want: netx.FamilyIPv6},
+		{network: "tcp", addr: ":0", want: netx.FamilyDual},
+	}
+	for _, tt := range tests {
+		t.Run(tt.network, func(t *testing.T) {
+			l, err := net.Listen(tt.network, tt.addr)
+			if err != nil {
+				t.Skipf("cannot listen on %s: %v", tt.network, err)
+			}
+			defer l.Close()
+			got, err := netx.SocketFamily(l.(syscall.Conn))
+			if err != nil {
+				t.Fatalf("SocketFamily() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("SocketFamily() = %q, want %q", got, tt.want)
+			}
+			for _, family := range []string{netx.FamilyDual, netx.FamilyIPv4,
+				netx.FamilyIPv6} {
+				err := netx.CheckFamily(l.(syscall.Conn), family)
+				if wantErr := family != netx.FamilyDual && family != tt.want; (err != nil) != wantErr {
+					t.Errorf("CheckFamily(%q) error = %v, wantErr %v", family, err,
+						wantErr)
+				}
+			}
+		})
+	}
+}
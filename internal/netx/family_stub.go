@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package netx
+
+import "syscall"
+
+// SocketFamily is not supported on this platform.
+func SocketFamily(syscall.Conn) (string, error) {
+	return "", ErrNoSupport
+}
@@ -0,0 +1,71 @@
+package netx_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/m-lab/msak/internal/netx"
+)
+
+func TestListenNetwork(t *testing.T) {
+	tests := []struct {
+		protocol, family, want string
+		wantErr                bool
+	}{
+		{protocol: "tcp", family: netx.FamilyDual, want: "tcp"},
+		{protocol: "tcp", family: netx.FamilyIPv4, want: "tcp4"},
+		{protocol: "udp", family: netx.FamilyIPv6, want: "udp6"},
+		{protocol: "udp", family: "ipv5", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := netx.ListenNetwork(tt.protocol, tt.family)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ListenNetwork(%q, %q) = %q, %v", tt.protocol, tt.family, got, err)
+		}
+	}
+}
+
+func TestAddressFamily(t *testing.T) {
+	tests := []struct {
+		name string
+		addr net.Addr
+		want string
+	}{
+		{name: "tcp4", addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, want: netx.FamilyIPv4},
+		{name: "v4-mapped", addr: &net.UDPAddr{IP: net.ParseIP("::ffff:192.0.2.1")}, want: netx.FamilyIPv4},
+		{name: "udp6", addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1")}, want: netx.FamilyIPv6},
+		{name: "other", addr: &net.IPAddr{IP: net.ParseIP("2001:db8::1")}, want: ""},
+		{name: "unix", addr: &net.UnixAddr{Name: "/tmp/sock"}, want: ""},
+		{name: "nil", addr: nil, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := netx.AddressFamily(tt.addr); got != tt.want {
+				t.Errorf("AddressFamily() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAddressFamily_dualStack(t *testing.T) {
+	l, err := net.Listen("tcp", "[::]:0")
+	if err != nil {
+		t.Skipf("IPv6 not available: %v", err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	go func() {
+		c, err := net.Dial("tcp4", net.JoinHostPort("127.0.0.1", port))
+		if err == nil {
+			c.Close()
+		}
+	}()
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	defer c.Close()
+	if got := netx.AddressFamily(c.RemoteAddr()); got != netx.FamilyIPv4 {
+		t.Errorf("AddressFamily(%v) = %q, want %q", c.RemoteAddr(), got, netx.FamilyIPv4)
+	}
+}
@@ -0,0 +1,119 @@
+package netx
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// sysClassNet is the directory containing the statistics of each network
+// interface.
+var sysClassNet = "/sys/class/net"
+
+// ErrNoInterface is returned by InterfaceByAddr when no interface has the
+// provided address.
+var ErrNoInterface = errors.New("no interface has this address")
+
+// HostStats are host-level counters for a network interface and its root
+// queueing discipline. Packets dropped or queued here are not visible in
+// TCP_INFO, but affect every connection using the interface.
+type HostStats struct {
+	// RxDropped, TxDropped, RxErrors and TxErrors are the interface
+	// counters from /sys/class/net/<interface>/statistics.
+	RxDropped uint64
+	TxDropped uint64
+	RxErrors  uint64
+	TxErrors  uint64
+	// QdiscDrops is the number of packets dropped by the root qdisc.
+	// QdiscBacklog is the number of bytes queued in the root qdisc.
+	QdiscDrops   uint64
+	QdiscBacklog uint64
+}
+
+// Sub returns the counters in s accumulated since prev. QdiscBacklog is a
+// gauge and is taken from s.
+func (s HostStats) Sub(prev HostStats) HostStats {
+	return HostStats{
+		RxDropped:    delta(s.RxDropped, prev.RxDropped),
+		TxDropped:    delta(s.TxDropped, prev.TxDropped),
+		RxErrors:     delta(s.RxErrors, prev.RxErrors),
+		TxErrors:     delta(s.TxErrors, prev.TxErrors),
+		QdiscDrops:   delta(s.QdiscDrops, prev.QdiscDrops),
+		QdiscBacklog: s.QdiscBacklog,
+	}
+}
+
+// delta returns cur-prev, or zero if the counter was reset.
+func delta(cur, prev uint64) uint64 {
+	if cur < prev {
+		return 0
+	}
+	return cur - prev
+}
+
+// InterfaceByAddr returns the network interface with the IP address of addr,
+// e.g. the local address of a connection.
+func InterfaceByAddr(addr net.Addr) (*net.Interface, error) {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	}
+	if ip == nil {
+		return nil, ErrNoInterface
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for i := range ifaces {
+		addrs, err := ifaces[i].Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+				return &ifaces[i], nil
+			}
+		}
+	}
+	return nil, ErrNoInterface
+}
+
+// ReadHostStats returns the current HostStats of iface. Qdisc statistics are
+// only available on Linux: elsewhere, or if they cannot be read, they are
+// left to zero.
+func ReadHostStats(iface *net.Interface) (HostStats, error) {
+	var s HostStats
+	for _, c := range []struct {
+		name  string
+		value *uint64
+	}{
+		{"rx_dropped", &s.RxDropped},
+		{"tx_dropped", &s.TxDropped},
+		{"rx_errors", &s.RxErrors},
+		{"tx_errors", &s.TxErrors},
+	} {
+		v, err := readCounter(filepath.Join(sysClassNet, iface.Name,
+			"statistics", c.name))
+		if err != nil {
+			return HostStats{}, err
+		}
+		*c.value = v
+	}
+	s.QdiscDrops, s.QdiscBacklog, _ = qdiscStats(iface.Index)
+	return s, nil
+}
+
+func readCounter(path string) (uint64, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+}
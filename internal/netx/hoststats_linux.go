@@ -0,0 +1,208 @@
+package netx
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Netlink constants for queueing disciplines, from linux/rtnetlink.h,
+// linux/pkt_sched.h and linux/gen_stats.h.
+const (
+	sizeofTcMsg     = 20
+	tcaKind         = 1
+	tcaStats2       = 7
+	tcaStatsQueue   = 3
+	tcHandleRoot    = 0xFFFFFFFF
+	sizeofRtAttr    = 4
+	sizeofQueueStat = 20
+)
+
+// nativeEndian is the byte order of netlink messages, i.e. the host's.
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// qdisc describes a queueing discipline from a RTM_NEWQDISC message.
+type qdisc struct {
+	handle uint32
+	parent uint32
+	kind   string
+	// stats is false if the message has no queue statistics.
+	stats   bool
+	drops   uint64
+	backlog uint64
+}
+
+// qdiscStats returns the drops and the backlog in bytes of the root qdisc of
+// the interface with the provided index.
+func qdiscStats(ifindex int) (drops, backlog uint64, err error) {
+	qdiscs, err := dumpQdiscs(ifindex)
+	if err != nil {
+		return 0, 0, err
+	}
+	root, ok := findRoot(qdiscs)
+	if !ok || !root.stats {
+		return 0, 0, errors.New("no root qdisc found")
+	}
+	return root.drops, root.backlog, nil
+}
+
+// rootQdisc returns the kind of the root qdisc of the interface with the
+// provided index, as described by rootKind.
+func rootQdisc(ifindex int) (string, error) {
+	qdiscs, err := dumpQdiscs(ifindex)
+	if err != nil {
+		return "", err
+	}
+	kind, ok := rootKind(qdiscs)
+	if !ok {
+		return "", errors.New("no root qdisc found")
+	}
+	return kind, nil
+}
+
+// findRoot returns the root qdisc in qdiscs.
+func findRoot(qdiscs []qdisc) (qdisc, bool) {
+	for _, q := range qdiscs {
+		if q.parent == tcHandleRoot {
+			return q, true
+		}
+	}
+	return qdisc{}, false
+}
+
+// rootKind returns the kind of the root qdisc in qdiscs. The mq qdisc of
+// multiqueue devices only dispatches packets to a qdisc per transmit queue:
+// if these all have the same kind, e.g. fq, it is returned as "mq/fq".
+func rootKind(qdiscs []qdisc) (string, bool) {
+	root, ok := findRoot(qdiscs)
+	if !ok {
+		return "", false
+	}
+	if root.kind != "mq" {
+		return root.kind, true
+	}
+	child := ""
+	for _, q := range qdiscs {
+		if q.parent == tcHandleRoot || q.parent>>16 != root.handle>>16 {
+			continue
+		}
+		if child != "" && q.kind != child {
+			return root.kind, true
+		}
+		child = q.kind
+	}
+	if child == "" {
+		return root.kind, true
+	}
+	return root.kind + "/" + child, true
+}
+
+// dumpQdiscs returns the qdiscs of the interface with the provided index,
+// using a RTM_GETQDISC netlink dump.
+func dumpQdiscs(ifindex int) ([]qdisc, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK,
+		syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+	sa := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+	if err := syscall.Bind(fd, sa); err != nil {
+		return nil, err
+	}
+
+	// Request: nlmsghdr followed by a zeroed tcmsg with the interface index.
+	req := make([]byte, syscall.NLMSG_HDRLEN+sizeofTcMsg)
+	nativeEndian.PutUint32(req[0:], uint32(len(req)))
+	nativeEndian.PutUint16(req[4:], syscall.RTM_GETQDISC)
+	nativeEndian.PutUint16(req[6:], syscall.NLM_F_REQUEST|syscall.NLM_F_DUMP)
+	nativeEndian.PutUint32(req[8:], 1)
+	nativeEndian.PutUint32(req[syscall.NLMSG_HDRLEN+4:], uint32(ifindex))
+	if err := syscall.Sendto(fd, req, 0, sa); err != nil {
+		return nil, err
+	}
+
+	var qdiscs []qdisc
+	buf := make([]byte, 1<<16)
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return qdiscs, nil
+			case syscall.NLMSG_ERROR:
+				return nil, errors.New("netlink error while dumping qdiscs")
+			case syscall.RTM_NEWQDISC:
+				if q, ok := parseQdisc(m.Data, ifindex); ok {
+					qdiscs = append(qdiscs, q)
+				}
+			}
+		}
+	}
+}
+
+// parseQdisc parses a RTM_NEWQDISC message if it describes a qdisc of
+// ifindex.
+func parseQdisc(data []byte, ifindex int) (qdisc, bool) {
+	if len(data) < sizeofTcMsg {
+		return qdisc{}, false
+	}
+	msgIndex := int32(nativeEndian.Uint32(data[4:]))
+	if int(msgIndex) != ifindex {
+		return qdisc{}, false
+	}
+	q := qdisc{
+		handle: nativeEndian.Uint32(data[8:]),
+		parent: nativeEndian.Uint32(data[12:]),
+	}
+	attrs := data[sizeofTcMsg:]
+	if kind, ok := findAttr(attrs, tcaKind); ok {
+		q.kind = strings.TrimRight(string(kind), "\x00")
+	}
+	if stats, ok := findAttr(attrs, tcaStats2); ok {
+		queue, ok := findAttr(stats, tcaStatsQueue)
+		if ok && len(queue) >= sizeofQueueStat {
+			// struct gnet_stats_queue: qlen, backlog, drops, requeues,
+			// overlimits.
+			q.stats = true
+			q.backlog = uint64(nativeEndian.Uint32(queue[4:]))
+			q.drops = uint64(nativeEndian.Uint32(queue[8:]))
+		}
+	}
+	return q, true
+}
+
+// findAttr returns the payload of the first rtattr of type attrType in b.
+func findAttr(b []byte, attrType uint16) ([]byte, bool) {
+	for len(b) >= sizeofRtAttr {
+		l := int(nativeEndian.Uint16(b[0:]))
+		t := nativeEndian.Uint16(b[2:]) &^ syscall.NLA_F_NESTED
+		if l < sizeofRtAttr || l > len(b) {
+			return nil, false
+		}
+		if t == attrType {
+			return b[sizeofRtAttr:l], true
+		}
+		aligned := (l + syscall.NLMSG_ALIGNTO - 1) &^ (syscall.NLMSG_ALIGNTO - 1)
+		if aligned > len(b) {
+			return nil, false
+		}
+		b = b[aligned:]
+	}
+	return nil, false
+}
@@ -0,0 +1,135 @@
+package netx
+
+import (
+	"net"
+	"testing"
+)
+
+// qdiscMessage builds the payload of a RTM_NEWQDISC message.
+func qdiscMessage(ifindex int32, parent uint32, backlog, drops uint32) []byte {
+	msg := make([]byte, sizeofTcMsg)
+	nativeEndian.PutUint32(msg[4:], uint32(ifindex))
+	nativeEndian.PutUint32(msg[12:], parent)
+	// A TCA_KIND attribute to skip, padded to 4 bytes.
+	kind := []byte{7, 0, 1, 0, 'f', 'q', 0, 0}
+	msg = append(msg, kind...)
+	queue := make([]byte, sizeofRtAttr+sizeofQueueStat)
+	nativeEndian.PutUint16(queue[0:], uint16(len(queue)))
+	nativeEndian.PutUint16(queue[2:], tcaStatsQueue)
+	nativeEndian.PutUint32(queue[sizeofRtAttr+4:], backlog)
+	nativeEndian.PutUint32(queue[sizeofRtAttr+8:], drops)
+	stats := make([]byte, sizeofRtAttr)
+	nativeEndian.PutUint16(stats[0:], uint16(sizeofRtAttr+len(queue)))
+	nativeEndian.PutUint16(stats[2:], tcaStats2)
+	return append(append(msg, stats...), queue...)
+}
+
+func Test_parseQdisc(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want qdisc
+		ok   bool
+	}{
+		{
+			name: "root",
+			data: qdiscMessage(2, tcHandleRoot, 1500, 3),
+			want: qdisc{parent: tcHandleRoot, kind: "fq", stats: true,
+				drops: 3, backlog: 1500},
+			ok: true,
+		},
+		{
+			name: "child",
+			data: qdiscMessage(2, 0x10001, 1500, 3),
+			want: qdisc{parent: 0x10001, kind: "fq", stats: true, drops: 3,
+				backlog: 1500},
+			ok: true,
+		},
+		{
+			name: "other-interface",
+			data: qdiscMessage(3, tcHandleRoot, 1500, 3),
+		},
+		{
+			name: "truncated",
+			data: qdiscMessage(2, tcHandleRoot, 1500, 3)[:sizeofTcMsg+10],
+			want: qdisc{parent: tcHandleRoot, kind: "fq"},
+			ok:   true,
+		},
+		{
+			name: "too-short",
+			data: qdiscMessage(2, tcHandleRoot, 1500, 3)[:sizeofTcMsg-1],
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseQdisc(tt.data, 2)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("parseQdisc() = %+v, %v, want %+v, %v", got, ok,
+					tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func Test_rootKind(t *testing.T) {
+	mq := qdisc{handle: 0x80010000, parent: tcHandleRoot, kind: "mq"}
+	tests := []struct {
+		name   string
+		qdiscs []qdisc
+		want   string
+		ok     bool
+	}{
+		{
+			name:   "fq",
+			qdiscs: []qdisc{{parent: tcHandleRoot, kind: "fq"}},
+			want:   "fq",
+			ok:     true,
+		},
+		{
+			name: "mq-fq",
+			qdiscs: []qdisc{mq, {parent: 0x80010001, kind: "fq"},
+				{parent: 0x80010002, kind: "fq"}},
+			want: "mq/fq",
+			ok:   true,
+		},
+		{
+			name: "mq-mixed",
+			qdiscs: []qdisc{mq, {parent: 0x80010001, kind: "fq"},
+				{parent: 0x80010002, kind: "fq_codel"}},
+			want: "mq",
+			ok:   true,
+		},
+		{
+			name:   "mq-without-children",
+			qdiscs: []qdisc{mq},
+			want:   "mq",
+			ok:     true,
+		},
+		{
+			name:   "no-root",
+			qdiscs: []qdisc{{parent: 0x10001, kind: "fq"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := rootKind(tt.qdiscs)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("rootKind() = %q, %v, want %q, %v", got, ok, tt.want, tt.ok)
+			}
+			if FQPacing(got) != (tt.want == "fq" || tt.want == "mq/fq") {
+				t.Errorf("FQPacing(%q) = %v", got, FQPacing(got))
+			}
+		})
+	}
+}
+
+func TestInterfaceQdisc(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skipf("no loopback interface: %v", err)
+	}
+	// The loopback interface has a root qdisc, usually noqueue.
+	if q, err := InterfaceQdisc(lo); err != nil || q == "" {
+		t.Errorf("InterfaceQdisc(lo) = %q, %v", q, err)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package netx
+
+import "errors"
+
+// qdiscStats is not supported on this platform.
+func qdiscStats(ifindex int) (drops, backlog uint64, err error) {
+	return 0, 0, errors.New("qdisc statistics are not supported on this platform")
+}
+
+// rootQdisc is not supported on this platform.
+func rootQdisc(ifindex int) (string, error) {
+	return "", errors.New("qdiscs are not supported on this platform")
+}
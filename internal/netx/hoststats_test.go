@@ -0,0 +1,74 @@
+package netx
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadHostStats(t *testing.T) {
+	oldPath := sysClassNet
+	defer func() { sysClassNet = oldPath }()
+	sysClassNet = t.TempDir()
+
+	iface := &net.Interface{Index: -1, Name: "eth0"}
+	if _, err := ReadHostStats(iface); err == nil {
+		t.Errorf("ReadHostStats() did not return an error for missing files")
+	}
+
+	dir := filepath.Join(sysClassNet, "eth0", "statistics")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("cannot create test dir: %v", err)
+	}
+	for name, value := range map[string]string{
+		"rx_dropped": "1\n",
+		"tx_dropped": "2\n",
+		"rx_errors":  "3\n",
+		"tx_errors":  "4\n",
+	} {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(value), 0644)
+		if err != nil {
+			t.Fatalf("cannot write test file: %v", err)
+		}
+	}
+	got, err := ReadHostStats(iface)
+	if err != nil {
+		t.Fatalf("ReadHostStats() returned error: %v", err)
+	}
+	want := HostStats{RxDropped: 1, TxDropped: 2, RxErrors: 3, TxErrors: 4}
+	if got != want {
+		t.Errorf("ReadHostStats() = %+v, want %+v", got, want)
+	}
+}
+
+func TestHostStats_Sub(t *testing.T) {
+	prev := HostStats{RxDropped: 10, TxDropped: 5, QdiscDrops: 7, QdiscBacklog: 100}
+	cur := HostStats{RxDropped: 12, TxDropped: 1, QdiscDrops: 9, QdiscBacklog: 50}
+	want := HostStats{RxDropped: 2, QdiscDrops: 2, QdiscBacklog: 50}
+	if got := cur.Sub(prev); got != want {
+		t.Errorf("Sub() = %+v, want %+v", got, want)
+	}
+}
+
+func TestInterfaceByAddr(t *testing.T) {
+	if _, err := InterfaceByAddr(&net.UnixAddr{Name: "sock"}); err != ErrNoInterface {
+		t.Errorf("InterfaceByAddr(unix) returned %v, want ErrNoInterface", err)
+	}
+	if _, err := InterfaceByAddr(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}); err != ErrNoInterface {
+		t.Errorf("InterfaceByAddr(192.0.2.1) returned %v, want ErrNoInterface", err)
+	}
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %v", err)
+	}
+	defer ln.Close()
+	iface, err := InterfaceByAddr(ln.Addr())
+	if err != nil {
+		t.Fatalf("InterfaceByAddr(%v) returned error: %v", ln.Addr(), err)
+	}
+	if iface.Flags&net.FlagLoopback == 0 {
+		t.Errorf("InterfaceByAddr(%v) = %s, want a loopback interface",
+			ln.Addr(), iface.Name)
+	}
+}
@@ -237,3 +237,44 @@ func TestSaveAndLoadCtx(t *testing.T) {
 			expected, actual)
 	}
 }
+
+func TestConn_SocketBuffers(t *testing.T) {
+	tcpl, err := net.ListenTCP("tcp", &net.TCPAddr{})
+	rtx.Must(err, "failed to create listener")
+	l := netx.NewListener(tcpl)
+	defer l.Close()
+	dialAsync(t, tcpl.Addr().String())
+
+	got, err := l.Accept()
+	rtx.Must(err, "failed to accept")
+	defer got.Close()
+	c := got.(netx.ConnInfo)
+
+	if err := c.SetSocketBuffers(64<<10, 32<<10); err != nil {
+		t.Fatalf("SetSocketBuffers() error = %v", err)
+	}
+	sndbuf, rcvbuf, err := c.SocketBuffers()
+	if err != nil {
+		t.Fatalf("SocketBuffers() error = %v", err)
+	}
+	// Linux doubles the requested values.
+	if sndbuf != 128<<10 || rcvbuf != 64<<10 {
+		t.Errorf("SocketBuffers() = %d, %d, want %d, %d", sndbuf, rcvbuf,
+			128<<10, 64<<10)
+	}
+}
+
+func TestConn_SetNotSentLowat(t *testing.T) {
+	tcpl, err := net.ListenTCP("tcp", &net.TCPAddr{})
+	rtx.Must(err, "failed to create listener")
+	l := netx.NewListener(tcpl)
+	defer l.Close()
+	dialAsync(t, tcpl.Addr().String())
+
+	got, err := l.Accept()
+	rtx.Must(err, "failed to accept")
+	defer got.Close()
+	if err := got.(netx.ConnInfo).SetNotSentLowat(16 << 10); err != nil {
+		t.Errorf("SetNotSentLowat() error = %v", err)
+	}
+}
@@ -0,0 +1,38 @@
+package netx
+
+import (
+	"net"
+	"os"
+	"strings"
+)
+
+// defaultQdiscPath is the file containing the default queueing discipline
+// attached to network interfaces.
+var defaultQdiscPath = "/proc/sys/net/core/default_qdisc"
+
+// DefaultQdisc returns the default queueing discipline used by the kernel for
+// network interfaces (e.g. "fq" or "fq_codel"). It returns an error on
+// systems where this information is not available.
+func DefaultQdisc() (string, error) {
+	b, err := os.ReadFile(defaultQdiscPath)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// InterfaceQdisc returns the root queueing discipline of iface, e.g. "fq" or
+// "noqueue". On multiqueue devices whose transmit queues all use the same
+// qdisc, it is returned after the mq root, e.g. "mq/fq". It returns an error
+// on systems where this information is not available.
+func InterfaceQdisc(iface *net.Interface) (string, error) {
+	return rootQdisc(iface.Index)
+}
+
+// FQPacing returns true if qdisc provides packet pacing, i.e. if it is the fq
+// queueing discipline, possibly on every queue of a multiqueue device.
+// Without fq, BBR falls back to the TCP stack's internal pacing, which
+// behaves differently under load.
+func FQPacing(qdisc string) bool {
+	return qdisc == "fq" || qdisc == "mq/fq"
+}
@@ -0,0 +1,32 @@
+package netx
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDefaultQdisc(t *testing.T) {
+	oldPath := defaultQdiscPath
+	defer func() { defaultQdiscPath = oldPath }()
+
+	defaultQdiscPath = filepath.Join(t.TempDir(), "default_qdisc")
+	if _, err := DefaultQdisc(); err == nil {
+		t.Errorf("DefaultQdisc() did not return an error for a missing file")
+	}
+
+	err := os.WriteFile(defaultQdiscPath, []byte("fq\n"), 0644)
+	if err != nil {
+		t.Fatalf("cannot write test file: %v", err)
+	}
+	got, err := DefaultQdisc()
+	if err != nil {
+		t.Fatalf("DefaultQdisc() returned error: %v", err)
+	}
+	if got != "fq" || !FQPacing(got) {
+		t.Errorf("DefaultQdisc() = %q, want fq with pacing", got)
+	}
+	if FQPacing("fq_codel") {
+		t.Errorf("FQPacing(fq_codel) = true, want false")
+	}
+}
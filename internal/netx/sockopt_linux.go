@@ -0,0 +1,45 @@
+package netx
+
+import (
+	"os"
+	"syscall"
+)
+
+// tcpNotSentLowat is the TCP_NOTSENT_LOWAT socket option, from
+// include/uapi/linux/tcp.h. It is not defined in the syscall package.
+const tcpNotSentLowat = 25
+
+func setNotSentLowat(fp *os.File, bytes int) error {
+	return setsockoptInt(fp, syscall.IPPROTO_TCP, tcpNotSentLowat, bytes)
+}
+
+func getsockoptInt(fp *os.File, level, opt int) (int, error) {
+	rawconn, err := fp.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var value int
+	var syscallErr error
+	err = rawconn.Control(func(fd uintptr) {
+		value, syscallErr = syscall.GetsockoptInt(int(fd), level, opt)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return value, syscallErr
+}
+
+func setsockoptInt(fp *os.File, level, opt, value int) error {
+	rawconn, err := fp.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var syscallErr error
+	err = rawconn.Control(func(fd uintptr) {
+		syscallErr = syscall.SetsockoptInt(int(fd), level, opt, value)
+	})
+	if err != nil {
+		return err
+	}
+	return syscallErr
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package netx
+
+import (
+	"os"
+)
+
+func setNotSentLowat(*os.File, int) error {
+	return ErrNoSupport
+}
+
+func getsockoptInt(*os.File, int, int) (int, error) {
+	return 0, ErrNoSupport
+}
+
+func setsockoptInt(*os.File, int, int, int) error {
+	return ErrNoSupport
+}
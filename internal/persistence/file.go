@@ -1,6 +1,8 @@
 package persistence
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"os"
 	"path"
@@ -31,14 +33,11 @@ type DataFile struct {
 // The path is determined by the provided prefix, datatype, subtest and uuid.
 func WriteDataFile(prefix, datatype, subtest, uuid string,
 	data interface{}) (*DataFile, error) {
-	timestamp := time.Now()
-	dir := path.Join(prefix, datatype, timestamp.Format("2006/01/02"))
-	err := os.MkdirAll(dir, 0755)
+	filepath := path.Join(prefix, dataFileName(datatype, subtest, uuid, time.Now()))
+	err := os.MkdirAll(path.Dir(filepath), 0755)
 	if err != nil {
 		return nil, err
 	}
-	filepath := path.Join(dir, datatype+"-"+subtest+"-"+
-		timestamp.Format("20060102T150405.000000000Z")+"."+uuid+".json")
 	fp, err := os.OpenFile(filepath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
 	if err != nil {
 		return nil, err
@@ -62,3 +61,32 @@ func WriteDataFile(prefix, datatype, subtest, uuid string,
 		Size:     n,
 	}, nil
 }
+
+// dataFileName returns the path of a data file relative to the output prefix,
+// according to the provided datatype, subtest, uuid and timestamp.
+func dataFileName(datatype, subtest, uuid string, timestamp time.Time) string {
+	return path.Join(datatype, timestamp.Format("2006/01/02"), datatype+"-"+
+		subtest+"-"+timestamp.Format("20060102T150405.000000000Z")+"."+uuid+".json")
+}
+
+// MIDHashLength is the length of the hashes returned by MIDHash.
+const MIDHashLength = 8
+
+// MIDHash returns a short, non-reversible hash of a measurement ID, suitable
+// to be included in file names. It can be computed from a known mid to find
+// the corresponding files without opening them.
+func MIDHash(mid string) string {
+	sum := sha256.Sum256([]byte(mid))
+	return hex.EncodeToString(sum[:])[:MIDHashLength]
+}
+
+// ArchiveID returns the identifier to pass as uuid to WriteDataFile or to a
+// Writer for a measurement with the given mid and uuid. If mid is not empty,
+// the identifier is the mid's hash followed by the uuid, so that file names
+// end with "<midhash>.<uuid>.json".
+func ArchiveID(mid, uuid string) string {
+	if mid == "" {
+		return uuid
+	}
+	return MIDHash(mid) + "." + uuid
+}
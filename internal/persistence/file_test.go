@@ -56,3 +56,16 @@ func TestWriteDataFile(t *testing.T) {
 		t.Fatalf("expected error, got nil")
 	}
 }
+
+func TestArchiveID(t *testing.T) {
+	if got := persistence.ArchiveID("", "uuid"); got != "uuid" {
+		t.Errorf("ArchiveID() = %q, want %q", got, "uuid")
+	}
+	hash := persistence.MIDHash("test-mid")
+	if len(hash) != persistence.MIDHashLength || hash != persistence.MIDHash("test-mid") {
+		t.Errorf("invalid MIDHash: %q", hash)
+	}
+	if got := persistence.ArchiveID("test-mid", "uuid"); got != hash+".uuid" {
+		t.Errorf("ArchiveID() = %q, want %q", got, hash+".uuid")
+	}
+}
@@ -0,0 +1,64 @@
+package persistence
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// Writer delivers archival data to a sink. The datatype, subtest and uuid
+// identify the data the same way they do for WriteDataFile.
+type Writer interface {
+	Write(datatype, subtest, uuid string, data interface{}) error
+}
+
+// FileWriter is a Writer that writes data to JSON files under Dir, using
+// WriteDataFile.
+type FileWriter struct {
+	Dir string
+}
+
+// Write writes data to a new JSON file.
+func (w *FileWriter) Write(datatype, subtest, uuid string, data interface{}) error {
+	_, err := WriteDataFile(w.Dir, datatype, subtest, uuid, data)
+	return err
+}
+
+// WriterFunc is an adapter to use an ordinary function as a Writer.
+type WriterFunc func(datatype, subtest, uuid string, data interface{}) error
+
+// Write calls f(datatype, subtest, uuid, data).
+func (f WriterFunc) Write(datatype, subtest, uuid string, data interface{}) error {
+	return f(datatype, subtest, uuid, data)
+}
+
+// ObjectWriter is a Writer that writes data as JSON to objects opened by the
+// Open function, e.g. objects in a GCS bucket. Object names have the same
+// layout as the paths generated by WriteDataFile, relative to the prefix.
+//
+// For example, with a cloud.google.com/go/storage bucket:
+//
+//	&ObjectWriter{Open: func(name string) (io.WriteCloser, error) {
+//		return bucket.Object(name).NewWriter(ctx), nil
+//	}}
+type ObjectWriter struct {
+	Open func(name string) (io.WriteCloser, error)
+}
+
+// Write writes data to a new object. The object is closed even if writing
+// fails, and the first error encountered is returned.
+func (w *ObjectWriter) Write(datatype, subtest, uuid string, data interface{}) error {
+	jsonResult, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	obj, err := w.Open(dataFileName(datatype, subtest, uuid, time.Now()))
+	if err != nil {
+		return err
+	}
+	_, err = obj.Write(jsonResult)
+	if closeErr := obj.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
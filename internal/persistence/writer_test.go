@@ -0,0 +1,76 @@
+package persistence_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/msak/internal/persistence"
+)
+
+// memObject is an in-memory io.WriteCloser.
+type memObject struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (o *memObject) Close() error {
+	o.closed = true
+	return nil
+}
+
+func TestObjectWriter_Write(t *testing.T) {
+	objects := map[string]*memObject{}
+	w := &persistence.ObjectWriter{
+		Open: func(name string) (io.WriteCloser, error) {
+			objects[name] = &memObject{}
+			return objects[name], nil
+		},
+	}
+	err := w.Write("type", "subtest", "fake-uuid", Marshallable{Test: "foo"})
+	if err != nil {
+		t.Fatalf("Write() returned error: %v", err)
+	}
+	if len(objects) != 1 {
+		t.Fatalf("invalid number of objects: %d", len(objects))
+	}
+	for name, obj := range objects {
+		if !strings.HasPrefix(name, "type/") ||
+			!strings.HasSuffix(name, "fake-uuid.json") {
+			t.Errorf("invalid object name: %s", name)
+		}
+		if obj.String() != `{"Test":"foo"}` {
+			t.Errorf("unexpected object content: %s", obj.String())
+		}
+		if !obj.closed {
+			t.Errorf("object not closed")
+		}
+	}
+
+	// Unmarshallable data must not create an object.
+	err = w.Write("type", "subtest", "uuid2", Unmarshallable{Invalid: make(chan byte)})
+	if err == nil || len(objects) != 1 {
+		t.Errorf("expected error and no new objects, got %v", err)
+	}
+
+	// Open errors are returned.
+	w.Open = func(string) (io.WriteCloser, error) {
+		return nil, errors.New("open failed")
+	}
+	if err := w.Write("type", "subtest", "uuid3", Marshallable{}); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
+
+func TestWriterFunc_Write(t *testing.T) {
+	var got string
+	w := persistence.WriterFunc(func(datatype, subtest, uuid string, data interface{}) error {
+		got = datatype + "/" + subtest + "/" + uuid
+		return nil
+	})
+	if err := w.Write("type", "subtest", "uuid", nil); err != nil || got != "type/subtest/uuid" {
+		t.Errorf("WriterFunc did not call the function: %q, %v", got, err)
+	}
+}
@@ -0,0 +1,136 @@
+// Package protocol defines the interface measurement protocols implement to
+// be served by msak-server, and the registry they are added to. A protocol
+// registers itself, usually from an init function next to its flags, and the
+// server starts every enabled protocol and serves its routes on the shared
+// listeners or on the protocol's dedicated ones.
+package protocol
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/m-lab/msak/internal/activation"
+	"github.com/m-lab/msak/internal/admin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Route is an HTTP endpoint of a protocol.
+type Route struct {
+	// Path is the pattern Handler is registered with.
+	Path string
+	// Handler serves the requests to Path.
+	Handler http.Handler
+	// Authorized is true if the access tokens and the transaction
+	// controller are enforced on Path.
+	Authorized bool
+	// StartsTest is true if requests to Path start new tests, so they are
+	// rejected in maintenance mode and subject to per-client rate limits.
+	StartsTest bool
+}
+
+// Env is the server's configuration and the services it provides to
+// protocols when they are started.
+type Env struct {
+	// DataDir is the directory where results are archived. Each protocol
+	// writes its results under DataDir/<Datatype>.
+	DataDir string
+	// IPFamily is the IP family of the listeners, as accepted by
+	// netx.ListenNetwork.
+	IPFamily string
+	// AdvertisedHost is the server's public host name or address, if
+	// configured.
+	AdvertisedHost string
+	// TokenVerify is true if access tokens are verified. TokenMachine is
+	// the machine name they are verified against.
+	TokenVerify  bool
+	TokenMachine string
+	// AdminToken is the bearer token protecting administrative routes. If
+	// empty, protocols must not serve administrative routes.
+	AdminToken string
+	// Sockets are the sockets passed by systemd, for protocols opening
+	// listeners other than HTTP ones.
+	Sockets *activation.Sockets
+	// Health is where protocols register the health checks of their
+	// subsystems.
+	Health *admin.Health
+	// Registerer is where protocols register their metrics.
+	Registerer prometheus.Registerer
+}
+
+// Protocol is a measurement protocol served by msak-server.
+type Protocol interface {
+	// Name identifies the protocol in logs and listener names, e.g.
+	// "throughput1".
+	Name() string
+	// Datatype is the archival datatype of the protocol's results.
+	Datatype() string
+	// Enabled reports whether the protocol is enabled by its flags.
+	Enabled() bool
+	// Validate returns an error if the protocol's flags are inconsistent. It
+	// is called for enabled protocols before any is started, with an Env
+	// whose Sockets and Health are not set yet.
+	Validate(env Env) error
+	// Addrs returns the dedicated cleartext and TLS listen addresses of the
+	// protocol's routes. Routes without a dedicated address are served on
+	// the server's shared listeners.
+	Addrs() (addr, tlsAddr string)
+	// Start starts the protocol and returns its HTTP routes.
+	Start(env Env) ([]Route, error)
+	// Drain rejects new tests and waits for the in-flight ones to end, or
+	// for ctx to expire. Results must be archived when it returns.
+	Drain(ctx context.Context) error
+	// Close releases the resources opened by Start, such as non-HTTP
+	// listeners. It is called once the HTTP servers are stopped.
+	Close() error
+}
+
+// Reloader is implemented by protocols whose configuration can be changed
+// while they are serving tests. On SIGHUP, the server re-reads the flags
+// named by ReloadableFlags from its configuration file and, if they are
+// valid, calls Reload.
+type Reloader interface {
+	// ReloadableFlags returns the names of the flags Reload applies.
+	ReloadableFlags() []string
+	// Reload applies the current values of the reloadable flags to the
+	// started protocol. Tests already running are not affected.
+	Reload(env Env) error
+}
+
+var (
+	mu         sync.Mutex
+	registered []Protocol
+)
+
+// Register adds p to the protocols served by msak-server. It panics if a
+// protocol with the same name is already registered.
+func Register(p Protocol) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, r := range registered {
+		if r.Name() == p.Name() {
+			panic(fmt.Sprintf("protocol %s registered twice", p.Name()))
+		}
+	}
+	registered = append(registered, p)
+}
+
+// Registered returns the registered protocols, in registration order.
+func Registered() []Protocol {
+	mu.Lock()
+	defer mu.Unlock()
+	return append([]Protocol(nil), registered...)
+}
+
+// Enabled returns the registered protocols that are enabled, in
+// registration order.
+func Enabled() []Protocol {
+	var enabled []Protocol
+	for _, p := range Registered() {
+		if p.Enabled() {
+			enabled = append(enabled, p)
+		}
+	}
+	return enabled
+}
@@ -0,0 +1,45 @@
+package protocol
+
+import (
+	"context"
+	"testing"
+)
+
+type fakeProtocol struct {
+	name    string
+	enabled bool
+}
+
+func (p *fakeProtocol) Name() string                    { return p.name }
+func (p *fakeProtocol) Datatype() string                { return p.name }
+func (p *fakeProtocol) Enabled() bool                   { return p.enabled }
+func (p *fakeProtocol) Validate(env Env) error          { return nil }
+func (p *fakeProtocol) Addrs() (string, string)         { return "", "" }
+func (p *fakeProtocol) Start(env Env) ([]Route, error)  { return nil, nil }
+func (p *fakeProtocol) Drain(ctx context.Context) error { return nil }
+func (p *fakeProtocol) Close() error                    { return nil }
+
+func TestRegister(t *testing.T) {
+	defer func() { registered = nil }()
+
+	Register(&fakeProtocol{name: "b", enabled: true})
+	Register(&fakeProtocol{name: "a"})
+	Register(&fakeProtocol{name: "c", enabled: true})
+
+	got := Registered()
+	if len(got) != 3 || got[0].Name() != "b" || got[1].Name() != "a" ||
+		got[2].Name() != "c" {
+		t.Errorf("Registered() did not return the protocols in registration order")
+	}
+	enabled := Enabled()
+	if len(enabled) != 2 || enabled[0].Name() != "b" || enabled[1].Name() != "c" {
+		t.Errorf("Enabled() returned unexpected protocols: %v", enabled)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Register() did not panic for a duplicate name")
+		}
+	}()
+	Register(&fakeProtocol{name: "a"})
+}
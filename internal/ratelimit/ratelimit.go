@@ -0,0 +1,165 @@
+// Package ratelimit provides a per-client-IP token bucket rate limiter for
+// HTTP handlers, so that a single client cannot monopolize a server.
+package ratelimit
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/time/rate"
+)
+
+// IPv6PrefixLength is the length of the prefix IPv6 addresses are aggregated
+// to, since a single client usually controls a whole /64.
+const IPv6PrefixLength = 64
+
+var throttledRequests = promauto.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "msak",
+		Subsystem: "ratelimit",
+		Name:      "throttled_requests_total",
+		Help:      "Number of requests rejected because the client exceeded its rate limit.",
+	},
+	[]string{"path"},
+)
+
+// Limiter limits the rate of requests from each client IP address (or IPv6
+// /64 prefix) with a token bucket.
+type Limiter struct {
+	limit rate.Limit
+	burst int
+
+	// buckets maps a client key to its token bucket. Buckets for clients
+	// that have not sent requests for a while expire, since a full bucket is
+	// equivalent to a new one.
+	buckets *ttlcache.Cache[string, *rate.Limiter]
+	mu      sync.Mutex
+}
+
+// New returns a Limiter allowing each client perSecond requests per second on
+// average, with bursts of up to burst requests. A rate of zero allows every
+// request.
+func New(perSecond float64, burst int) *Limiter {
+	buckets := ttlcache.New(
+		ttlcache.WithTTL[string, *rate.Limiter](bucketTTL(perSecond, burst)),
+	)
+	go buckets.Start()
+	return &Limiter{
+		limit:   rate.Limit(perSecond),
+		burst:   burst,
+		buckets: buckets,
+	}
+}
+
+// bucketTTL returns how long to keep the bucket of an idle client: at least
+// the time a bucket takes to refill completely, burst/perSecond seconds.
+func bucketTTL(perSecond float64, burst int) time.Duration {
+	ttl := time.Minute
+	if perSecond <= 0 {
+		return ttl
+	}
+	if refill := time.Duration(float64(burst) / perSecond * float64(time.Second)); refill > ttl {
+		ttl = refill
+	}
+	return ttl
+}
+
+// SetLimit changes the rate and burst allowed to each client, as accepted by
+// New. Existing buckets are discarded, so every client starts over with a
+// full bucket.
+func (l *Limiter) SetLimit(perSecond float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = rate.Limit(perSecond)
+	l.burst = burst
+	l.buckets.DeleteAll()
+}
+
+// Stop stops the goroutine removing expired buckets.
+func (l *Limiter) Stop() {
+	l.buckets.Stop()
+}
+
+// Allow consumes a token from the bucket of the client with the given
+// address. If no token is available, it returns false and how long the client
+// should wait before retrying.
+func (l *Limiter) Allow(remoteAddr string, now time.Time) (bool, time.Duration) {
+	key := clientKey(remoteAddr)
+	l.mu.Lock()
+	if l.limit == 0 {
+		l.mu.Unlock()
+		return true, 0
+	}
+	var bucket *rate.Limiter
+	if item := l.buckets.Get(key); item != nil {
+		bucket = item.Value()
+	} else {
+		bucket = rate.NewLimiter(l.limit, l.burst)
+		l.buckets.Set(key, bucket, ttlcache.DefaultTTL)
+	}
+	l.mu.Unlock()
+
+	r := bucket.ReserveN(now, 1)
+	if !r.OK() {
+		return false, time.Duration(math.MaxInt64)
+	}
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// Middleware returns a handler that rejects requests from clients exceeding
+// their rate limit with a 429 Too Many Requests status and a Retry-After
+// header, and calls next otherwise.
+func (l *Limiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ok, delay := l.Allow(req.RemoteAddr, time.Now())
+		if !ok {
+			throttledRequests.WithLabelValues(req.URL.Path).Inc()
+			log.Info("Request throttled", "source", req.RemoteAddr,
+				"path", req.URL.Path, "retry-after", delay)
+			rw.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(delay)))
+			rw.Header().Set("Connection", "Close")
+			rw.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// retryAfterSeconds returns delay rounded up to whole seconds, as required
+// by the Retry-After header.
+func retryAfterSeconds(delay time.Duration) int {
+	if delay > 24*time.Hour {
+		delay = 24 * time.Hour
+	}
+	return int((delay + time.Second - 1) / time.Second)
+}
+
+// clientKey returns the key identifying the client with the given address:
+// the IP address for IPv4 clients and the /64 prefix for IPv6 clients.
+func clientKey(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	return ip.Mask(net.CIDRMask(IPv6PrefixLength, 128)).String() + "/" +
+		strconv.Itoa(IPv6PrefixLength)
+}
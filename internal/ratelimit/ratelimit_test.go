@@ -0,0 +1,111 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimiter_Allow(t *testing.T) {
+	l := New(1, 2)
+	defer l.Stop()
+	now := time.Now()
+
+	// The burst is allowed, then the client must wait for a new token.
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("192.0.2.1:1234", now); !ok {
+			t.Fatalf("request %d not allowed", i)
+		}
+	}
+	ok, delay := l.Allow("192.0.2.1:4321", now)
+	if ok || delay <= 0 || delay > time.Second {
+		t.Errorf("Allow() = %v, %v, want false, <= 1s", ok, delay)
+	}
+	// Other clients are not affected.
+	if ok, _ := l.Allow("192.0.2.2:1234", now); !ok {
+		t.Errorf("unrelated client throttled")
+	}
+	// Tokens are refilled over time.
+	if ok, _ := l.Allow("192.0.2.1:1234", now.Add(time.Second)); !ok {
+		t.Errorf("request not allowed after refill")
+	}
+}
+
+func TestLimiter_SetLimit(t *testing.T) {
+	l := New(0, 0)
+	defer l.Stop()
+	now := time.Now()
+
+	// A rate of zero allows every request.
+	for i := 0; i < 10; i++ {
+		if ok, _ := l.Allow("192.0.2.1:1234", now); !ok {
+			t.Fatalf("request %d not allowed without a limit", i)
+		}
+	}
+	l.SetLimit(1, 1)
+	if ok, _ := l.Allow("192.0.2.1:1234", now); !ok {
+		t.Errorf("first request not allowed after SetLimit")
+	}
+	if ok, _ := l.Allow("192.0.2.1:1234", now); ok {
+		t.Errorf("request beyond the burst allowed after SetLimit")
+	}
+	// Changing the limit resets the buckets.
+	l.SetLimit(1, 2)
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("192.0.2.1:1234", now); !ok {
+			t.Errorf("request %d not allowed after raising the burst", i)
+		}
+	}
+}
+
+func TestLimiter_IPv6Aggregation(t *testing.T) {
+	l := New(1, 1)
+	defer l.Stop()
+	now := time.Now()
+	if ok, _ := l.Allow("[2001:db8:1:2::1]:1234", now); !ok {
+		t.Fatalf("first request not allowed")
+	}
+	// Addresses in the same /64 share a bucket.
+	if ok, _ := l.Allow("[2001:db8:1:2:ffff::1]:1234", now); ok {
+		t.Errorf("request from the same /64 allowed")
+	}
+	if ok, _ := l.Allow("[2001:db8:1:3::1]:1234", now); !ok {
+		t.Errorf("request from a different /64 throttled")
+	}
+}
+
+func TestLimiter_Middleware(t *testing.T) {
+	l := New(0.5, 1)
+	defer l.Stop()
+	h := l.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	codes := []int{http.StatusOK, http.StatusTooManyRequests}
+	for _, want := range codes {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		h.ServeHTTP(rw, req)
+		if rw.Code != want {
+			t.Errorf("unexpected status code %d, want %d", rw.Code, want)
+		}
+		if want == http.StatusTooManyRequests && rw.Header().Get("Retry-After") != "2" {
+			t.Errorf("unexpected Retry-After: %q", rw.Header().Get("Retry-After"))
+		}
+	}
+}
+
+func Test_clientKey(t *testing.T) {
+	tests := map[string]string{
+		"192.0.2.1:1234":         "192.0.2.1",
+		"[::ffff:192.0.2.1]:80":  "192.0.2.1",
+		"[2001:db8::1]:1234":     "2001:db8::/64",
+		"not an address":         "not an address",
+		"[2001:db8:0:0:1::]:443": "2001:db8::/64",
+	}
+	for addr, want := range tests {
+		if got := clientKey(addr); got != want {
+			t.Errorf("clientKey(%q) = %q, want %q", addr, got, want)
+		}
+	}
+}
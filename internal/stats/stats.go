@@ -0,0 +1,92 @@
+// Package stats writes snapshots of the server's Prometheus counters to disk,
+// so that aggregate accounting survives even if metrics scrapes were missed.
+package stats
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/m-lab/msak/internal/persistence"
+	"github.com/m-lab/msak/pkg/version"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// metricPrefix is the prefix of the metrics included in a Snapshot.
+const metricPrefix = "msak_"
+
+// Snapshot is the JSON representation of the server's counters at a given
+// point in time.
+type Snapshot struct {
+	// GitShortCommit is the Git commit (short form) of the running server code.
+	GitShortCommit string
+	// Version is the symbolic version (if any) of the running server code.
+	Version string
+	// Build describes the running server binary, including its full Git
+	// commit, build date and Go version. GitShortCommit and Version are
+	// copies of the corresponding fields.
+	Build version.Info
+	// StartTime is the time when the server started.
+	StartTime time.Time
+	// EndTime is the time when the snapshot was taken.
+	EndTime time.Time
+	// Counters maps each counter, in Prometheus text format (e.g.
+	// msak_throughput1_tests_total{direction="download",status="ok"}), to its
+	// value.
+	Counters map[string]float64
+}
+
+// Collect returns the current value of every msak counter known to g.
+func Collect(g prometheus.Gatherer) (map[string]float64, error) {
+	families, err := g.Gather()
+	if err != nil {
+		return nil, err
+	}
+	counters := map[string]float64{}
+	for _, mf := range families {
+		if mf.GetType() != dto.MetricType_COUNTER ||
+			!strings.HasPrefix(mf.GetName(), metricPrefix) {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			counters[counterName(mf.GetName(), m.GetLabel())] =
+				m.GetCounter().GetValue()
+		}
+	}
+	return counters, nil
+}
+
+// WriteSnapshot collects the current counters from g and writes them as a
+// Snapshot to the provided data directory.
+func WriteSnapshot(dir string, startTime time.Time,
+	g prometheus.Gatherer) (*persistence.DataFile, error) {
+	counters, err := Collect(g)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &Snapshot{
+		GitShortCommit: version.Get().GitShortCommit,
+		Version:        version.Get().Version,
+		Build:          version.Get(),
+		StartTime:      startTime,
+		EndTime:        time.Now(),
+		Counters:       counters,
+	}
+	return persistence.WriteDataFile(dir, "stats", "snapshot",
+		uuid.NewString(), snapshot)
+}
+
+// counterName formats a metric name and its labels in Prometheus text format.
+func counterName(name string, labels []*dto.LabelPair) string {
+	if len(labels) == 0 {
+		return name
+	}
+	pairs := make([]string, 0, len(labels))
+	for _, l := range labels {
+		pairs = append(pairs, l.GetName()+"=\""+l.GetValue()+"\"")
+	}
+	sort.Strings(pairs)
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
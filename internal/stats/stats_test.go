@@ -0,0 +1,50 @@
+package stats_test
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/m-lab/msak/internal/stats"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestWriteSnapshot(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	tests := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "msak_test_tests_total",
+	}, []string{"direction"})
+	other := prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "other_total",
+	})
+	reg.MustRegister(tests, other)
+	tests.WithLabelValues("download").Add(3)
+	other.Inc()
+
+	dir := t.TempDir()
+	start := time.Now()
+	df, err := stats.WriteSnapshot(dir, start, reg)
+	if err != nil {
+		t.Fatalf("WriteSnapshot() error = %v", err)
+	}
+
+	b, err := os.ReadFile(df.Path)
+	if err != nil {
+		t.Fatalf("cannot read snapshot: %v", err)
+	}
+	var snapshot stats.Snapshot
+	if err := json.Unmarshal(b, &snapshot); err != nil {
+		t.Fatalf("cannot unmarshal snapshot: %v", err)
+	}
+	if len(snapshot.Counters) != 1 {
+		t.Errorf("expected 1 counter, got %v", snapshot.Counters)
+	}
+	if v := snapshot.Counters[`msak_test_tests_total{direction="download"}`]; v != 3 {
+		t.Errorf("invalid counter value: %f", v)
+	}
+	if !snapshot.StartTime.Equal(start) || snapshot.EndTime.Before(start) {
+		t.Errorf("invalid snapshot times: %v - %v", snapshot.StartTime,
+			snapshot.EndTime)
+	}
+}
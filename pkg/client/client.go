@@ -9,16 +9,20 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/m-lab/locate/api/locate"
 	v2 "github.com/m-lab/locate/api/v2"
 	"github.com/m-lab/msak/internal/netx"
+	"github.com/m-lab/msak/pkg/options"
 	"github.com/m-lab/msak/pkg/throughput1"
+	"github.com/m-lab/msak/pkg/throughput1/capture"
 	"github.com/m-lab/msak/pkg/throughput1/model"
 	"github.com/m-lab/msak/pkg/throughput1/spec"
 	"github.com/m-lab/msak/pkg/version"
@@ -39,13 +43,20 @@ const (
 	DefaultScheme = "wss"
 
 	libraryName = "msak-client"
+
+	// maxRuntimeGracePeriod is added to the test length to obtain the maximum
+	// runtime of a stream.
+	maxRuntimeGracePeriod = time.Second
 )
 
 var (
 	// ErrNoTargets is returned if all Locate targets have been tried.
 	ErrNoTargets = errors.New("no targets available")
+	// ErrUnsupportedSubprotocol is returned when the server selects a
+	// subprotocol the client did not offer.
+	ErrUnsupportedSubprotocol = errors.New("server selected an unsupported subprotocol")
 
-	libraryVersion = version.Version
+	libraryVersion = version.Get().Version
 )
 
 // defaultDialer is the default websocket.Dialer used by the client.
@@ -79,6 +90,13 @@ type Throughput1Client struct {
 	dialer  *websocket.Dialer
 	locator Locator
 
+	// networkContext is the client's network context, if enabled and
+	// successfully detected.
+	networkContext *NetworkContext
+
+	// diagnostics collects the diagnostics bundle, if enabled.
+	diagnostics *Diagnostics
+
 	// targets and tIndex cache the results from the Locate API.
 	targets []v2.Target
 	tIndex  map[string]int
@@ -99,10 +117,33 @@ type Throughput1Client struct {
 	// minRTT is the lowest RTT value observed across all streams.
 	minRTT atomic.Uint32
 
+	// subprotocol is the WebSocket subprotocol negotiated by the last
+	// connected stream.
+	subprotocol atomic.Value
+
+	// serverStaggers is true if the server staggers the start of the streams
+	// according to Config.Delay, as advertised by the last connected stream.
+	serverStaggers atomic.Bool
+
+	// generatedMID is the measurement ID generated by the server for the
+	// current test, if any. It is provided to the server for the streams
+	// connecting after the first one.
+	generatedMID atomic.Value
+
 	// lastResultForSubtest contains the last recorded measurement for the
 	// corresponding subtest (download/upload).
 	lastResultForSubtest      map[spec.SubtestKind]Result
 	lastResultForSubtestMutex sync.Mutex
+
+	// testMutex serializes Download and Upload, since they share the targets
+	// cache and the counters above.
+	testMutex sync.Mutex
+
+	// abortCh is closed by Abort to stop the test in progress. A new channel
+	// is created at the start of every test.
+	abortCh    chan struct{}
+	aborted    bool
+	abortMutex sync.Mutex
 }
 
 // Result contains the aggregate metrics collected during the test.
@@ -129,11 +170,24 @@ type Result struct {
 	Length time.Duration
 	// CongestionControl is the congestion control used in the test.
 	CongestionControl string
+	// Subprotocol is the WebSocket subprotocol negotiated with the server.
+	Subprotocol string
 }
 
-// makeUserAgent creates the user agent string.
+// makeUserAgent creates the user agent string. The library's Go version and
+// Git commit, if known, are included as a comment.
 func makeUserAgent(clientName, clientVersion string) string {
-	return clientName + "/" + clientVersion + " " + libraryName + "/" + libraryVersion
+	return clientName + "/" + clientVersion + " " + libraryName + "/" +
+		libraryVersion + " (" + buildComment(version.Get()) + ")"
+}
+
+// buildComment returns the Go version and the short Git commit of a build,
+// separated by a semicolon.
+func buildComment(info version.Info) string {
+	if info.GitShortCommit == "" {
+		return info.GoVersion
+	}
+	return info.GoVersion + "; " + info.GitShortCommit
 }
 
 // New returns a new Throughput1Client with the provided client name, version and config.
@@ -143,14 +197,30 @@ func New(clientName, clientVersion string, config Config) *Throughput1Client {
 		panic("client name and version must be non-empty")
 	}
 	defaultDialer.TLSClientConfig.InsecureSkipVerify = config.NoVerify
+	var networkContext *NetworkContext
+	if config.ReportNetworkContext {
+		var err error
+		networkContext, err = DetectNetworkContext()
+		if err != nil {
+			log.Printf("cannot detect network context: %v", err)
+		}
+	}
+	var diagnostics *Diagnostics
+	if config.CollectDiagnostics {
+		diagnostics = newDiagnostics(makeUserAgent(clientName, clientVersion),
+			config)
+	}
 	return &Throughput1Client{
 		ClientName:    clientName,
 		ClientVersion: clientVersion,
+		diagnostics:   diagnostics,
 
 		config: config,
 		dialer: defaultDialer,
 
-		locator: locate.NewClient(makeUserAgent(clientName, clientVersion)),
+		networkContext: networkContext,
+
+		locator: newLocator(makeUserAgent(clientName, clientVersion), config),
 
 		tIndex:           map[string]int{},
 		recvByteCounters: map[int][]int64{},
@@ -161,22 +231,72 @@ func New(clientName, clientVersion string, config Config) *Throughput1Client {
 
 func (c *Throughput1Client) connect(ctx context.Context, serviceURL *url.URL) (*websocket.Conn, error) {
 	q := serviceURL.Query()
-	q.Set("streams", fmt.Sprint(c.config.NumStreams))
-	q.Set("cc", c.config.CongestionControl)
-	q.Set(spec.ByteLimitParameterName, fmt.Sprint(c.config.ByteLimit))
-	q.Set("duration", fmt.Sprintf("%d", c.config.Length.Milliseconds()))
+	opts := &options.Options{
+		Streams:         c.config.NumStreams,
+		Duration:        c.config.Length,
+		NoDurationLimit: c.config.Length == 0,
+		Delay:           c.config.Delay,
+		ByteLimit:       c.config.ByteLimit,
+		TargetRate:      c.config.TargetRate,
+		MeasureInterval: c.config.MeasureInterval,
+		NoCounterflow:   c.config.NoCounterflow,
+	}
+	if c.config.CongestionControl != "" {
+		opts.CC = strings.Split(c.config.CongestionControl, ",")
+	}
+	if err := opts.Encode(q); err != nil {
+		return nil, err
+	}
+	if mid, _ := c.generatedMID.Load().(string); mid != "" &&
+		q.Get(options.MIDParameterName) == "" {
+		q.Set(options.MIDParameterName, mid)
+	}
 	q.Set("client_arch", runtime.GOARCH)
 	q.Set("client_library_name", libraryName)
 	q.Set("client_library_version", libraryVersion)
 	q.Set("client_os", runtime.GOOS)
 	q.Set("client_name", c.ClientName)
 	q.Set("client_version", c.ClientVersion)
-	serviceURL.RawQuery = q.Encode()
+	if c.networkContext != nil {
+		for k, v := range c.networkContext.Metadata() {
+			q.Set(k, v)
+		}
+	}
+	// serviceURL is shared by all the streams, which connect concurrently.
+	u := *serviceURL
+	u.RawQuery = q.Encode()
 	headers := http.Header{}
-	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+	offered := c.subprotocols()
+	headers.Add("Sec-WebSocket-Protocol", strings.Join(offered, ", "))
 	headers.Add("User-Agent", makeUserAgent(c.ClientName, c.ClientVersion))
-	conn, _, err := c.dialer.DialContext(ctx, serviceURL.String(), headers)
-	return conn, err
+	conn, resp, err := c.dialer.DialContext(ctx, u.String(), headers)
+	if err != nil {
+		return nil, err
+	}
+	c.serverStaggers.Store(resp.Header.Get(spec.StreamDelayHeader) != "")
+	if mid := resp.Header.Get(spec.MeasurementIDHeader); mid != "" {
+		c.generatedMID.Store(mid)
+	}
+	// The server must select one of the offered subprotocols, otherwise the
+	// messages it sends cannot be interpreted.
+	negotiated := conn.Subprotocol()
+	for _, s := range offered {
+		if s == negotiated {
+			c.subprotocol.Store(negotiated)
+			return conn, nil
+		}
+	}
+	conn.Close()
+	return nil, fmt.Errorf("%w: %q", ErrUnsupportedSubprotocol, negotiated)
+}
+
+// subprotocols returns the subprotocols offered to the server, in order of
+// preference.
+func (c *Throughput1Client) subprotocols() []string {
+	if c.config.PreferCBOR {
+		return []string{spec.SecWebSocketProtocolCBOR, spec.SecWebSocketProtocol}
+	}
+	return []string{spec.SecWebSocketProtocol}
 }
 
 // nextURLFromLocate returns the next URL to try from the Locate API.
@@ -185,7 +305,9 @@ func (c *Throughput1Client) connect(ctx context.Context, serviceURL *url.URL) (*
 // If there are no more URLs to try, it returns an error.
 func (c *Throughput1Client) nextURLFromLocate(ctx context.Context, p string) (string, error) {
 	if len(c.targets) == 0 {
+		start := time.Now()
 		targets, err := c.locator.Nearest(ctx, "msak/throughput1")
+		c.diagnostics.recordLocate(time.Since(start), targets, err)
 		if err != nil {
 			return "", err
 		}
@@ -204,6 +326,13 @@ func (c *Throughput1Client) nextURLFromLocate(ctx context.Context, p string) (st
 }
 
 func (c *Throughput1Client) start(ctx context.Context, subtest spec.SubtestKind) error {
+	c.testMutex.Lock()
+	defer c.testMutex.Unlock()
+	if err := c.config.Validate(); err != nil {
+		return err
+	}
+	diag := c.diagnostics.startSubtest(subtest)
+
 	// Find the URL to use for this measurement.
 	var mURL *url.URL
 	// If the server has been provided, use it and use default paths based on
@@ -217,7 +346,7 @@ func (c *Throughput1Client) start(ctx context.Context, subtest spec.SubtestKind)
 			Path:   path,
 		}
 		q := mURL.Query()
-		q.Set("mid", c.config.MeasurementID)
+		q.Set(options.MIDParameterName, c.config.MeasurementID)
 		mURL.RawQuery = q.Encode()
 	}
 
@@ -226,27 +355,37 @@ func (c *Throughput1Client) start(ctx context.Context, subtest spec.SubtestKind)
 		c.config.Emitter.OnDebug("using locate")
 		urlStr, err := c.nextURLFromLocate(ctx, getPathForSubtest(subtest))
 		if err != nil {
+			diag.setError(err)
 			return err
 		}
 		mURL, err = url.Parse(urlStr)
 		if err != nil {
+			diag.setError(err)
 			return err
 		}
 		log.Print("URL: ", mURL.String())
 	}
 
+	diag.setTarget(mURL)
+
 	wg := &sync.WaitGroup{}
 
 	// Reset the counters.
 	c.recvByteCounters = map[int][]int64{}
 	c.rtt.Store(0)
+	c.serverStaggers.Store(false)
+	c.generatedMID.Store("")
 
 	startTimeCh := make(chan time.Time, 1)
+	connectedCh := make(chan struct{}, c.config.NumStreams)
+	abortCh := c.resetAbort()
 
 	testCtx, cancelTest := context.WithCancel(ctx)
 	defer cancelTest()
 
+	startDone := make(chan struct{})
 	go func() {
+		defer close(startDone)
 		// Wait for the start signal to come from any of the streams.
 		// Returns early if the context is cancelled.
 
@@ -256,10 +395,20 @@ func (c *Throughput1Client) start(ctx context.Context, subtest spec.SubtestKind)
 		}
 
 		// Once at least one of the streams has started, start a timer to cancel
-		// the context after the configured test duration.
-		time.AfterFunc(c.config.Length, cancelTest)
+		// the context after the configured test duration. Without a
+		// duration, the server ends the test, at the latest after its
+		// maximum runtime.
+		length := c.config.Length
+		if length == 0 {
+			length = spec.MaxRuntime
+		}
+		time.AfterFunc(length, cancelTest)
 	}()
 
+	q := mURL.Query()
+	hasMID := q.Get(options.MIDParameterName) != "" ||
+		q.Get(options.AccessTokenParameterName) != ""
+
 	// Main client loop. Spawns one goroutine per stream.
 	for i := 0; i < c.config.NumStreams; i++ {
 		streamID := i
@@ -269,19 +418,49 @@ func (c *Throughput1Client) start(ctx context.Context, subtest spec.SubtestKind)
 			defer wg.Done()
 
 			// Run a single stream.
-			err := c.runStream(testCtx, streamID, mURL, subtest, startTimeCh)
+			streamDiag := diag.startStream(streamID)
+			err := c.runStream(testCtx, streamID, mURL, subtest, startTimeCh,
+				connectedCh, abortCh, streamDiag)
 			if err != nil {
+				streamDiag.setError(err)
 				c.config.Emitter.OnError(err)
 			}
 		}()
 
-		time.Sleep(c.config.Delay)
+		// Without a mid, the server may generate one for the first stream,
+		// which the other streams must provide.
+		if i == 0 && (c.config.Delay > 0 || !hasMID) {
+			select {
+			case <-connectedCh:
+			case <-testCtx.Done():
+			}
+		}
+		// Servers advertising that they stagger the streams do so according
+		// to the delay, otherwise the client staggers them by delaying their
+		// connection. This is only known after the first stream's handshake.
+		if c.config.Delay > 0 && !c.serverStaggers.Load() {
+			time.Sleep(c.config.Delay)
+		}
 	}
 
 	wg.Wait()
+	// Wait for the start goroutine too, so that it cannot overwrite the
+	// state of the next test.
+	cancelTest()
+	<-startDone
 	return nil
 }
 
+// maxRuntime returns the maximum runtime of a stream. Tests are canceled once
+// their length has elapsed, so the protocol's deadline is only a safeguard and
+// must not expire before that. Without a length, the server ends the test.
+func (c *Throughput1Client) maxRuntime() time.Duration {
+	if c.config.Length == 0 {
+		return spec.MaxRuntime
+	}
+	return c.config.Length + maxRuntimeGracePeriod
+}
+
 func (c *Throughput1Client) waitStart(ctx context.Context, startTimeCh chan time.Time) bool {
 	select {
 	case startTime := <-startTimeCh:
@@ -293,19 +472,43 @@ func (c *Throughput1Client) waitStart(ctx context.Context, startTimeCh chan time
 	return true
 }
 
+// writeCapture writes the messages recorded for a stream to the capture
+// directory.
+func (c *Throughput1Client) writeCapture(recorder *capture.Recorder,
+	subtest spec.SubtestKind, streamID int) {
+	rec := recorder.Recording()
+	name := fmt.Sprintf("%s-%d-%s.json", subtest, streamID,
+		rec.StartTime.UTC().Format("20060102T150405"))
+	path := filepath.Join(c.config.CaptureDir, name)
+	err := os.MkdirAll(c.config.CaptureDir, 0755)
+	if err == nil {
+		err = rec.WriteFile(path)
+	}
+	if err != nil {
+		c.config.Emitter.OnError(fmt.Errorf("cannot write capture: %w", err))
+		return
+	}
+	c.config.Emitter.OnDebug("capture written to " + path)
+}
+
 func (c *Throughput1Client) runStream(ctx context.Context, streamID int, mURL *url.URL,
-	subtest spec.SubtestKind, startTimeCh chan time.Time) error {
+	subtest spec.SubtestKind, startTimeCh chan time.Time, connectedCh chan<- struct{},
+	abortCh <-chan struct{}, diag *StreamDiagnostics) error {
 
 	measurements := make(chan model.WireMeasurement)
 
 	c.config.Emitter.OnStart(mURL.Host, subtest)
+	handshakeStart := time.Now()
 	conn, err := c.connect(ctx, mURL)
+	// connectedCh has room for every stream, so this never blocks.
+	connectedCh <- struct{}{}
 	if err != nil {
 		c.config.Emitter.OnError(err)
 		close(measurements)
 		return err
 	}
 	defer conn.Close()
+	diag.connected(time.Since(handshakeStart), conn.Subprotocol())
 
 	// Send the start time to the channel. This is a non-blocking send since the
 	// receiver only reads one value
@@ -318,6 +521,18 @@ func (c *Throughput1Client) runStream(ctx context.Context, streamID int, mURL *u
 	c.config.Emitter.OnConnect(mURL.String())
 
 	proto := throughput1.New(conn)
+	if c.config.CaptureDir != "" {
+		recorder := capture.NewRecorder(capture.RoleClient, subtest,
+			conn.Subprotocol())
+		proto.SetRecorder(recorder)
+		defer c.writeCapture(recorder, subtest, streamID)
+	}
+	proto.SetMaxRuntime(c.maxRuntime())
+	proto.SetTargetRate(c.config.TargetRate)
+	proto.SetAcceptControlUpdates(true)
+	if c.config.MeasureInterval != 0 {
+		proto.SetMeasureInterval(c.config.MeasureInterval)
+	}
 
 	var clientCh, serverCh <-chan model.WireMeasurement
 	var errCh <-chan error
@@ -347,6 +562,26 @@ func (c *Throughput1Client) runStream(ctx context.Context, streamID int, mURL *u
 			}
 		case err := <-errCh:
 			return err
+		case <-abortCh:
+			// Tell the server this test was aborted, then close the
+			// connection to terminate the protocol's goroutines.
+			if err := proto.Abort("aborted by the client"); err != nil {
+				c.config.Emitter.OnDebug(fmt.Sprintf(
+					"Stream #%d - failed to send abort: %v", streamID, err))
+			}
+			c.config.Emitter.OnStreamComplete(streamID, mURL.Host)
+			return nil
+		case msg := <-proto.Control():
+			if ce, ok := c.config.Emitter.(ControlEmitter); ok {
+				ce.OnControl(streamID, msg)
+			}
+			// If the server asked to stop, end this stream now. Closing the
+			// connection terminates the protocol's goroutines.
+			if msg.Action == model.ControlAbort {
+				c.config.Emitter.OnStreamComplete(streamID, mURL.Host)
+				return nil
+			}
+			continue
 		}
 
 		c.config.Emitter.OnMeasurement(streamID, m)
@@ -354,6 +589,7 @@ func (c *Throughput1Client) runStream(ctx context.Context, streamID int, mURL *u
 			streamID, m.Application.BytesReceived, m.Application.BytesSent,
 			m.Network.BytesReceived, m.Network.BytesSent))
 		c.storeMeasurement(streamID, m)
+		diag.measurement(m)
 		if c.started.Load() {
 			res := c.computeResult(subtest)
 			c.config.Emitter.OnResult(res)
@@ -399,6 +635,7 @@ func (c *Throughput1Client) computeResult(subtest spec.SubtestKind) Result {
 	applicationBytes := c.applicationBytes()
 	elapsed := time.Since(c.sharedStartTime)
 	goodput := float64(applicationBytes) / float64(elapsed.Seconds()) * 8 // bps
+	subprotocol, _ := c.subprotocol.Load().(string)
 	return Result{
 		Subtest:           subtest,
 		Elapsed:           elapsed,
@@ -410,10 +647,12 @@ func (c *Throughput1Client) computeResult(subtest spec.SubtestKind) Result {
 		ByteLimit:         c.config.ByteLimit,
 		Length:            c.config.Length,
 		CongestionControl: c.config.CongestionControl,
+		Subprotocol:       subprotocol,
 	}
 }
 
 // Download runs a download test using the settings configured for this client.
+// Concurrent calls to Download and Upload run one after the other.
 func (c *Throughput1Client) Download(ctx context.Context) {
 	err := c.start(ctx, spec.SubtestDownload)
 	if err != nil {
@@ -422,6 +661,7 @@ func (c *Throughput1Client) Download(ctx context.Context) {
 }
 
 // Upload runs an upload test using the settings configured for this client.
+// Concurrent calls to Download and Upload run one after the other.
 func (c *Throughput1Client) Upload(ctx context.Context) {
 	err := c.start(ctx, spec.SubtestUpload)
 	if err != nil {
@@ -429,8 +669,39 @@ func (c *Throughput1Client) Upload(ctx context.Context) {
 	}
 }
 
+// Abort stops the test in progress, if any. Each stream notifies the server
+// that the test was aborted by the client before closing the connection, so
+// that the server does not record the test as failed. It is safe to call
+// Abort concurrently with Download and Upload.
+func (c *Throughput1Client) Abort() {
+	c.abortMutex.Lock()
+	defer c.abortMutex.Unlock()
+	if c.abortCh != nil && !c.aborted {
+		close(c.abortCh)
+		c.aborted = true
+	}
+}
+
+// resetAbort creates a new abort channel for the test about to start and
+// returns it.
+func (c *Throughput1Client) resetAbort() chan struct{} {
+	c.abortMutex.Lock()
+	defer c.abortMutex.Unlock()
+	c.abortCh = make(chan struct{})
+	c.aborted = false
+	return c.abortCh
+}
+
+// Diagnostics returns the diagnostics bundle collected so far, or nil if
+// Config.CollectDiagnostics is not set.
+func (c *Throughput1Client) Diagnostics() *Diagnostics {
+	return c.diagnostics
+}
+
 // PrintSummary emits a summary via the configured emitter
 func (c *Throughput1Client) PrintSummary() {
+	c.lastResultForSubtestMutex.Lock()
+	defer c.lastResultForSubtestMutex.Unlock()
 	c.config.Emitter.OnSummary(c.lastResultForSubtest)
 }
 
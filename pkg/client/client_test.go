@@ -2,18 +2,23 @@ package client
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/m-lab/go/testingx"
 	"github.com/m-lab/msak/pkg/throughput1/spec"
+	"github.com/m-lab/msak/pkg/version"
 )
 
 func TestNew(t *testing.T) {
@@ -38,14 +43,24 @@ func TestNew(t *testing.T) {
 func Test_makeUserAgent(t *testing.T) {
 	t.Run("generate requested user agent", func(t *testing.T) {
 		got := makeUserAgent("clientname", "clientversion")
-		expected := fmt.Sprintf("%s/%s %s/%s", "clientname", "clientversion",
-			libraryName, libraryVersion)
+		expected := fmt.Sprintf("%s/%s %s/%s (%s)", "clientname", "clientversion",
+			libraryName, libraryVersion, buildComment(version.Get()))
 		if got != expected {
 			t.Errorf("makeUserAgent() = %s, want %s", got, expected)
 		}
 	})
 }
 
+func Test_buildComment(t *testing.T) {
+	if got := buildComment(version.Info{GoVersion: "go1.20.4"}); got != "go1.20.4" {
+		t.Errorf("buildComment() = %q, want %q", got, "go1.20.4")
+	}
+	got := buildComment(version.Info{GoVersion: "go1.20.4", GitShortCommit: "c8a8cea"})
+	if got != "go1.20.4; c8a8cea" {
+		t.Errorf("buildComment() = %q, want %q", got, "go1.20.4; c8a8cea")
+	}
+}
+
 func setupTestServer(handler http.Handler) *httptest.Server {
 	return httptest.NewServer(handler)
 }
@@ -59,7 +74,9 @@ func TestNDT8Client_connect(t *testing.T) {
 	})
 
 	t.Run("connect sends qs parameters and headers", func(t *testing.T) {
-		upgrader := websocket.Upgrader{}
+		upgrader := websocket.Upgrader{
+			Subprotocols: []string{spec.SecWebSocketProtocol},
+		}
 
 		// Set up a test server with a handler that verifies querystring parameters
 		// and headers.
@@ -113,5 +130,231 @@ func TestNDT8Client_connect(t *testing.T) {
 			t.Errorf("NDT8Client.connect() error: %v", err)
 			return
 		}
+		if got := c.computeResult(spec.SubtestDownload).Subprotocol; got != spec.SecWebSocketProtocol {
+			t.Errorf("unexpected negotiated subprotocol: %q", got)
+		}
+	})
+
+	t.Run("connect rejects unsupported subprotocols", func(t *testing.T) {
+		upgrader := websocket.Upgrader{}
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Select a subprotocol the client did not offer.
+			h := http.Header{}
+			h.Set("Sec-WebSocket-Protocol", "net.measurementlab.throughput.v2")
+			wsConn, err := upgrader.Upgrade(w, r, h)
+			if err != nil {
+				return
+			}
+			wsConn.Close()
+		})
+		s := setupTestServer(handler)
+		defer s.Close()
+
+		u, err := url.Parse("ws" + strings.TrimPrefix(s.URL, "http"))
+		testingx.Must(t, err, "cannot parse server URL")
+
+		_, err = c.connect(context.Background(), u)
+		if !errors.Is(err, ErrUnsupportedSubprotocol) {
+			t.Errorf("NDT8Client.connect() error = %v, want %v", err,
+				ErrUnsupportedSubprotocol)
+		}
+	})
+}
+
+func TestConfig_Validate(t *testing.T) {
+	valid := Config{
+		Server:     "localhost:8080",
+		Scheme:     "ws",
+		NumStreams: 2,
+		Length:     5 * time.Second,
+	}
+	tests := []struct {
+		name    string
+		modify  func(c *Config)
+		wantErr bool
+	}{
+		{name: "valid", modify: func(c *Config) {}},
+		{name: "zero streams", modify: func(c *Config) { c.NumStreams = 0 }, wantErr: true},
+		{name: "too many streams", modify: func(c *Config) { c.NumStreams = spec.MaxStreams + 1 }, wantErr: true},
+		{name: "length in wrong unit", modify: func(c *Config) { c.Length = 5000 }, wantErr: true},
+		{name: "negative delay", modify: func(c *Config) { c.Delay = -time.Second }, wantErr: true},
+		{name: "interval in wrong unit", modify: func(c *Config) { c.MeasureInterval = 250 }, wantErr: true},
+		{name: "negative byte limit", modify: func(c *Config) { c.ByteLimit = -1 }, wantErr: true},
+		{name: "invalid scheme", modify: func(c *Config) { c.Scheme = "http" }, wantErr: true},
+		{name: "no scheme with locate", modify: func(c *Config) { c.Server = ""; c.Scheme = "" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid
+			tt.modify(&c)
+			if err := c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Config.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestThroughput1Client_maxRuntime(t *testing.T) {
+	tests := []struct {
+		name   string
+		length time.Duration
+		want   time.Duration
+	}{
+		{name: "no length", length: 0, want: spec.MaxRuntime},
+		{name: "short", length: 5 * time.Second, want: 6 * time.Second},
+		{name: "longer than spec.MaxRuntime", length: 30 * time.Second, want: 31 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Throughput1Client{config: Config{Length: tt.length}}
+			if got := c.maxRuntime(); got != tt.want {
+				t.Errorf("maxRuntime() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestThroughput1Client_concurrentTests(t *testing.T) {
+	var running, maxRunning atomic.Int32
+	upgrader := websocket.Upgrader{
+		Subprotocols: []string{spec.SecWebSocketProtocol},
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		wsConn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer wsConn.Close()
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			m := maxRunning.Load()
+			if n <= m || maxRunning.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	})
+	s := setupTestServer(handler)
+	defer s.Close()
+
+	c := New("test", "version", Config{
+		Server:     strings.TrimPrefix(s.URL, "http://"),
+		Scheme:     "ws",
+		NumStreams: 1,
+		Length:     time.Second,
+		Emitter:    HumanReadable{},
+	})
+	// Tests started at the same time must not share the client's state.
+	wg := sync.WaitGroup{}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Download(context.Background())
+		}()
+	}
+	wg.Wait()
+	if got := maxRunning.Load(); got != 1 {
+		t.Errorf("concurrent tests ran %d streams at once, want 1", got)
+	}
+}
+
+func TestThroughput1Client_delay(t *testing.T) {
+	const delay = 300 * time.Millisecond
+	tests := []struct {
+		name          string
+		serverStagger bool
+		wantStagger   bool
+	}{
+		{name: "server staggers streams", serverStagger: true, wantStagger: false},
+		{name: "old server", serverStagger: false, wantStagger: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upgrader := websocket.Upgrader{
+				Subprotocols: []string{spec.SecWebSocketProtocol},
+			}
+			mu := sync.Mutex{}
+			connected := []time.Time{}
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				connected = append(connected, time.Now())
+				mu.Unlock()
+				header := http.Header{}
+				if tt.serverStagger {
+					header.Set(spec.StreamDelayHeader, "0")
+				}
+				wsConn, err := upgrader.Upgrade(w, r, header)
+				if err != nil {
+					return
+				}
+				defer wsConn.Close()
+				time.Sleep(100 * time.Millisecond)
+			})
+			s := setupTestServer(handler)
+			defer s.Close()
+
+			c := New("test", "version", Config{
+				Server:     strings.TrimPrefix(s.URL, "http://"),
+				Scheme:     "ws",
+				NumStreams: 2,
+				Length:     time.Second,
+				Delay:      delay,
+				Emitter:    HumanReadable{},
+			})
+			c.Download(context.Background())
+			mu.Lock()
+			defer mu.Unlock()
+			if len(connected) != 2 {
+				t.Fatalf("%d streams connected, want 2", len(connected))
+			}
+			if staggered := connected[1].Sub(connected[0]) >= delay; staggered != tt.wantStagger {
+				t.Errorf("streams connected %v apart, want staggered = %v",
+					connected[1].Sub(connected[0]), tt.wantStagger)
+			}
+		})
+	}
+}
+
+func TestThroughput1Client_generatedMID(t *testing.T) {
+	upgrader := websocket.Upgrader{
+		Subprotocols: []string{spec.SecWebSocketProtocol},
+	}
+	mu := sync.Mutex{}
+	mids := []string{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mid := r.URL.Query().Get("mid")
+		mu.Lock()
+		mids = append(mids, mid)
+		mu.Unlock()
+		header := http.Header{}
+		if mid == "" {
+			header.Set(spec.MeasurementIDHeader, "generated-mid")
+		}
+		wsConn, err := upgrader.Upgrade(w, r, header)
+		if err != nil {
+			return
+		}
+		defer wsConn.Close()
+		time.Sleep(100 * time.Millisecond)
+	})
+	s := setupTestServer(handler)
+	defer s.Close()
+
+	c := New("test", "version", Config{
+		Server:     strings.TrimPrefix(s.URL, "http://"),
+		Scheme:     "ws",
+		NumStreams: 3,
+		Length:     time.Second,
+		Emitter:    HumanReadable{},
 	})
+	c.Download(context.Background())
+	mu.Lock()
+	defer mu.Unlock()
+	// The streams after the first one provide the mid generated by the server.
+	want := []string{"", "generated-mid", "generated-mid"}
+	if !reflect.DeepEqual(mids, want) {
+		t.Errorf("streams connected with mids %q, want %q", mids, want)
+	}
 }
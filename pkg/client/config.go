@@ -1,7 +1,12 @@
 package client
 
 import (
+	"errors"
+	"fmt"
+	"net/http"
 	"time"
+
+	"github.com/m-lab/msak/pkg/throughput1/spec"
 )
 
 // Config is the configuration for a Client.
@@ -10,6 +15,18 @@ type Config struct {
 	// querying the configured Locator.
 	Server string
 
+	// Locator is used to find the servers to connect to when Server is
+	// empty. If nil, the M-Lab Locate API is used.
+	Locator Locator
+
+	// LocateAPIKey is the API key sent to the Locate API, for deployments
+	// requiring authentication. It is ignored if Locator is set.
+	LocateAPIKey string
+
+	// LocateHeaders are additional HTTP headers sent to the Locate API. They
+	// are ignored if Locator is set.
+	LocateHeaders http.Header
+
 	// Scheme is the WebSocket scheme used to connect to the server (ws or wss).
 	Scheme string
 
@@ -17,13 +34,19 @@ type Config struct {
 	// download or an upload test.
 	NumStreams int
 
-	// Length is the duration of the test.
+	// Length is the duration of the test. Zero means the test is only
+	// bounded by ByteLimit and the server's maximum runtime.
 	Length time.Duration
 
-	// Delay is the delay between each stream.
+	// Delay is the delay between each stream. It is sent to the server, which
+	// staggers the start of data transmission on each stream accordingly.
+	// Against servers that do not advertise doing so, the client waits Delay
+	// between connecting each stream instead.
 	Delay time.Duration
 
 	// CongestionControl is the congestion control algorithm to request from the server.
+	// It can be a comma-separated list (e.g. "bbr,cubic") to request a different
+	// algorithm for each stream, in the order the streams connect.
 	CongestionControl string
 
 	// MeasurementID is the manually configured Measurement ID ("mid") to pass to the server.
@@ -39,4 +62,77 @@ type Config struct {
 	// ByteLimit is the maximum number of bytes to download or upload. If set to 0, the
 	// limit is disabled.
 	ByteLimit int
+
+	// MeasureInterval is the average interval between measurements to request
+	// from the server. If set to 0, the server's default is used.
+	MeasureInterval time.Duration
+
+	// NoCounterflow asks the server not to send measurements during uploads,
+	// except for the final one. Upload results are then only reported once
+	// each stream ends.
+	NoCounterflow bool
+
+	// TargetRate is the rate (in bits per second) the sender should pace its
+	// writes at. If set to 0, the sender saturates the link.
+	TargetRate int64
+
+	// PreferCBOR requests CBOR-encoded Measurement messages. If the server
+	// does not support them, JSON-encoded messages are used.
+	PreferCBOR bool
+
+	// ReportNetworkContext enables sending the client's network context
+	// (interface type, VPN detection and MTU of the default route) to the
+	// server as metadata.
+	ReportNetworkContext bool
+
+	// CollectDiagnostics enables collecting a diagnostics bundle, available
+	// via the client's Diagnostics method.
+	CollectDiagnostics bool
+
+	// CaptureDir, if not empty, is the directory where the sequence of
+	// WebSocket messages of every stream is recorded, for replay with
+	// cmd/msak-replay.
+	CaptureDir string
+}
+
+// Validate returns an error if the configuration cannot produce a valid
+// request. Durations are sent to the server in milliseconds, so non-zero
+// durations shorter than a millisecond are rejected: they are usually the
+// result of passing a number of milliseconds where a time.Duration is
+// expected, and would otherwise silently result in the server's defaults.
+func (c Config) Validate() error {
+	if c.NumStreams < 1 || c.NumStreams > spec.MaxStreams {
+		return fmt.Errorf("NumStreams must be between 1 and %d, got %d",
+			spec.MaxStreams, c.NumStreams)
+	}
+	if err := validateMillis("Length", c.Length); err != nil {
+		return err
+	}
+	if err := validateMillis("Delay", c.Delay); err != nil {
+		return err
+	}
+	if err := validateMillis("MeasureInterval", c.MeasureInterval); err != nil {
+		return err
+	}
+	if c.ByteLimit < 0 {
+		return errors.New("ByteLimit must not be negative")
+	}
+	if c.TargetRate < 0 {
+		return errors.New("TargetRate must not be negative")
+	}
+	if c.Server != "" && c.Scheme != "ws" && c.Scheme != "wss" {
+		return fmt.Errorf("Scheme must be ws or wss, got %q", c.Scheme)
+	}
+	return nil
+}
+
+func validateMillis(name string, d time.Duration) error {
+	if d < 0 {
+		return fmt.Errorf("%s must not be negative", name)
+	}
+	if d > 0 && d < time.Millisecond {
+		return fmt.Errorf("%s must be at least 1ms, got %v (was a number of "+
+			"milliseconds used as a time.Duration?)", name, d)
+	}
+	return nil
 }
@@ -0,0 +1,233 @@
+package client
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/m-lab/locate/api/locate"
+	v2 "github.com/m-lab/locate/api/v2"
+	"github.com/m-lab/msak/pkg/options"
+	"github.com/m-lab/msak/pkg/throughput1/model"
+	"github.com/m-lab/msak/pkg/throughput1/spec"
+)
+
+// Diagnostics is a bundle of information about the client's runs, meant to
+// be attached to bug reports against servers or clients. Access tokens are
+// redacted from every URL. All durations are in microseconds.
+type Diagnostics struct {
+	// UserAgent is the user agent sent to the Locate API and the servers.
+	UserAgent string
+	// LocateURL is the base URL of the Locate API, if used.
+	LocateURL string `json:",omitempty"`
+	// Proxy is the proxy configured in the environment for requests to the
+	// Locate API, if any.
+	Proxy string `json:",omitempty"`
+	// StartTime is when the client was created.
+	StartTime time.Time
+
+	// Locate describes the request to the Locate API, if any.
+	Locate *LocateDiagnostics `json:",omitempty"`
+	// Subtests describes every subtest run by the client, in order.
+	Subtests []*SubtestDiagnostics
+
+	mu sync.Mutex
+}
+
+// LocateDiagnostics describes a request to the Locate API.
+type LocateDiagnostics struct {
+	// Duration is how long the request took.
+	Duration int64
+	// Targets are the targets returned by the Locate API.
+	Targets []v2.Target `json:",omitempty"`
+	// Error is the request's error, if any.
+	Error string `json:",omitempty"`
+}
+
+// SubtestDiagnostics describes a single subtest.
+type SubtestDiagnostics struct {
+	// Subtest is the subtest kind.
+	Subtest spec.SubtestKind
+	// URL is the chosen target's URL.
+	URL string `json:",omitempty"`
+	// Streams describes every stream of the subtest, in order of start.
+	Streams []*StreamDiagnostics
+	// Error is the error that prevented the subtest from starting, if any.
+	Error string `json:",omitempty"`
+
+	d *Diagnostics
+}
+
+// StreamDiagnostics describes a single stream.
+type StreamDiagnostics struct {
+	// ID is the stream's ID.
+	ID int
+	// HandshakeTime is how long the TCP connection setup, TLS handshake and
+	// WebSocket upgrade took.
+	HandshakeTime int64
+	// Subprotocol is the negotiated WebSocket subprotocol.
+	Subprotocol string `json:",omitempty"`
+	// Measurements is the number of measurements received or taken.
+	Measurements int
+	// FirstMeasurement and LastMeasurement are the first and last of the
+	// measurements used for the results.
+	FirstMeasurement *model.WireMeasurement `json:",omitempty"`
+	LastMeasurement  *model.WireMeasurement `json:",omitempty"`
+	// Error is the error that terminated the stream, if any.
+	Error string `json:",omitempty"`
+
+	d *Diagnostics
+}
+
+// newDiagnostics returns a new Diagnostics for a client with the provided
+// user agent and config.
+func newDiagnostics(userAgent string, config Config) *Diagnostics {
+	d := &Diagnostics{
+		UserAgent: userAgent,
+		StartTime: time.Now(),
+	}
+	if config.Server == "" && config.Locator == nil {
+		base := locate.NewClient(userAgent).BaseURL
+		d.LocateURL = base.String()
+		proxy, err := http.ProxyFromEnvironment(&http.Request{URL: base})
+		if err == nil && proxy != nil {
+			d.Proxy = proxy.Redacted()
+		}
+	}
+	return d
+}
+
+// MarshalJSON marshals d to JSON. It can be called while tests are running.
+func (d *Diagnostics) MarshalJSON() ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// The alias type has no methods, which avoids calling MarshalJSON
+	// recursively.
+	type diagnostics Diagnostics
+	return json.Marshal((*diagnostics)(d))
+}
+
+// recordLocate records the result of a request to the Locate API. It does
+// nothing if d is nil.
+func (d *Diagnostics) recordLocate(duration time.Duration, targets []v2.Target,
+	err error) {
+	if d == nil {
+		return
+	}
+	ld := &LocateDiagnostics{Duration: duration.Microseconds()}
+	for _, t := range targets {
+		redacted := t
+		redacted.URLs = map[string]string{}
+		for k, v := range t.URLs {
+			redacted.URLs[k] = redactURL(v)
+		}
+		ld.Targets = append(ld.Targets, redacted)
+	}
+	if err != nil {
+		ld.Error = err.Error()
+	}
+	d.mu.Lock()
+	d.Locate = ld
+	d.mu.Unlock()
+}
+
+// startSubtest records the start of a subtest and returns its diagnostics. It
+// returns nil if d is nil.
+func (d *Diagnostics) startSubtest(subtest spec.SubtestKind) *SubtestDiagnostics {
+	if d == nil {
+		return nil
+	}
+	sd := &SubtestDiagnostics{Subtest: subtest, d: d}
+	d.mu.Lock()
+	d.Subtests = append(d.Subtests, sd)
+	d.mu.Unlock()
+	return sd
+}
+
+// setTarget records the subtest's target URL. It does nothing if sd is nil.
+func (sd *SubtestDiagnostics) setTarget(u *url.URL) {
+	if sd == nil {
+		return
+	}
+	sd.d.mu.Lock()
+	sd.URL = redactURL(u.String())
+	sd.d.mu.Unlock()
+}
+
+// setError records the error that prevented the subtest from starting. It
+// does nothing if sd is nil.
+func (sd *SubtestDiagnostics) setError(err error) {
+	if sd == nil || err == nil {
+		return
+	}
+	sd.d.mu.Lock()
+	sd.Error = err.Error()
+	sd.d.mu.Unlock()
+}
+
+// startStream records the start of a stream and returns its diagnostics. It
+// returns nil if sd is nil.
+func (sd *SubtestDiagnostics) startStream(id int) *StreamDiagnostics {
+	if sd == nil {
+		return nil
+	}
+	st := &StreamDiagnostics{ID: id, d: sd.d}
+	sd.d.mu.Lock()
+	sd.Streams = append(sd.Streams, st)
+	sd.d.mu.Unlock()
+	return st
+}
+
+// connected records the stream's handshake time and negotiated subprotocol.
+// It does nothing if st is nil.
+func (st *StreamDiagnostics) connected(handshake time.Duration, subprotocol string) {
+	if st == nil {
+		return
+	}
+	st.d.mu.Lock()
+	st.HandshakeTime = handshake.Microseconds()
+	st.Subprotocol = subprotocol
+	st.d.mu.Unlock()
+}
+
+// measurement records a measurement used for the results. It does nothing if
+// st is nil.
+func (st *StreamDiagnostics) measurement(m model.WireMeasurement) {
+	if st == nil {
+		return
+	}
+	st.d.mu.Lock()
+	if st.FirstMeasurement == nil {
+		st.FirstMeasurement = &m
+	}
+	st.LastMeasurement = &m
+	st.Measurements++
+	st.d.mu.Unlock()
+}
+
+// setError records the error that terminated the stream. It does nothing if
+// st is nil.
+func (st *StreamDiagnostics) setError(err error) {
+	if st == nil || err == nil {
+		return
+	}
+	st.d.mu.Lock()
+	st.Error = err.Error()
+	st.d.mu.Unlock()
+}
+
+// redactURL returns rawURL without the access token, if any.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	q := u.Query()
+	if q.Has(options.AccessTokenParameterName) {
+		q.Set(options.AccessTokenParameterName, "REDACTED")
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
@@ -0,0 +1,92 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/testingx"
+	v2 "github.com/m-lab/locate/api/v2"
+	"github.com/m-lab/msak/pkg/throughput1/model"
+	"github.com/m-lab/msak/pkg/throughput1/spec"
+)
+
+type staticLocator []v2.Target
+
+func (l staticLocator) Nearest(ctx context.Context, service string) ([]v2.Target, error) {
+	return l, nil
+}
+
+func TestDiagnostics(t *testing.T) {
+	locator := staticLocator{{
+		Machine: "mlab1-lga0t.mlab-sandbox.measurement-lab.org",
+		URLs: map[string]string{
+			"wss:///throughput/v1/download": "wss://mlab1-lga0t/throughput/v1/download?access_token=secret",
+		},
+	}}
+	c := New("test", "version", Config{
+		Scheme:             "wss",
+		Locator:            locator,
+		CollectDiagnostics: true,
+	})
+	d := c.Diagnostics()
+	if d == nil || d.UserAgent != makeUserAgent("test", "version") {
+		t.Fatalf("unexpected diagnostics: %+v", d)
+	}
+
+	urlStr, err := c.nextURLFromLocate(context.Background(), "/throughput/v1/download")
+	testingx.Must(t, err, "cannot get URL from locate")
+	u, err := url.Parse(urlStr)
+	testingx.Must(t, err, "cannot parse URL")
+
+	sd := d.startSubtest(spec.SubtestDownload)
+	sd.setTarget(u)
+	st := sd.startStream(0)
+	st.connected(10*time.Millisecond, spec.SecWebSocketProtocol)
+	for i := int64(1); i <= 3; i++ {
+		st.measurement(model.WireMeasurement{
+			Measurement: model.Measurement{ElapsedSinceTestStart: i},
+		})
+	}
+	st.setError(errors.New("test error"))
+
+	b, err := json.Marshal(d)
+	testingx.Must(t, err, "cannot marshal diagnostics")
+	if strings.Contains(string(b), "secret") {
+		t.Errorf("access token not redacted: %s", b)
+	}
+	var got Diagnostics
+	testingx.Must(t, json.Unmarshal(b, &got), "cannot unmarshal diagnostics")
+	if got.Locate == nil || len(got.Locate.Targets) != 1 || len(got.Subtests) != 1 {
+		t.Fatalf("unexpected diagnostics: %s", b)
+	}
+	streams := got.Subtests[0].Streams
+	if len(streams) != 1 || streams[0].HandshakeTime != 10000 ||
+		streams[0].Measurements != 3 ||
+		streams[0].FirstMeasurement.ElapsedSinceTestStart != 1 ||
+		streams[0].LastMeasurement.ElapsedSinceTestStart != 3 ||
+		streams[0].Error != "test error" {
+		t.Errorf("unexpected stream diagnostics: %s", b)
+	}
+}
+
+func TestDiagnostics_disabled(t *testing.T) {
+	c := New("test", "version", Config{})
+	d := c.Diagnostics()
+	if d != nil {
+		t.Fatalf("diagnostics collected without CollectDiagnostics")
+	}
+	// Recording on nil diagnostics must be a no-op.
+	d.recordLocate(time.Second, nil, nil)
+	sd := d.startSubtest(spec.SubtestUpload)
+	sd.setTarget(&url.URL{})
+	sd.setError(errors.New("test error"))
+	st := sd.startStream(0)
+	st.connected(time.Second, "")
+	st.measurement(model.WireMeasurement{})
+	st.setError(errors.New("test error"))
+}
@@ -28,6 +28,13 @@ type Emitter interface {
 	OnSummary(results map[spec.SubtestKind]Result)
 }
 
+// ControlEmitter is an optional interface implemented by Emitters that handle
+// the control messages received from the server.
+type ControlEmitter interface {
+	// OnControl is called on control messages received from the server.
+	OnControl(id int, msg model.ControlMessage)
+}
+
 // HumanReadable prints human-readable output to stdout.
 // It can be configured to include debug output, too.
 type HumanReadable struct {
@@ -55,6 +62,15 @@ func (HumanReadable) OnMeasurement(id int, m model.WireMeasurement) {
 	// NOTHING - don't print individual measurement objects in this Emitter.
 }
 
+// OnControl prints control messages received from the server.
+func (HumanReadable) OnControl(id int, msg model.ControlMessage) {
+	if msg.Reason != "" {
+		fmt.Printf("Stream %d: server requested %s (%s)\n", id, msg.Action, msg.Reason)
+		return
+	}
+	fmt.Printf("Stream %d: server requested %s\n", id, msg.Action)
+}
+
 // OnError is called on errors.
 func (HumanReadable) OnError(err error) {
 	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
@@ -85,5 +101,8 @@ func (e HumanReadable) OnDebug(msg string) {
 	}
 }
 
-// Checks that HumanReadable implements Emitter.
-var _ Emitter = &HumanReadable{}
+// Checks that HumanReadable implements Emitter and ControlEmitter.
+var (
+	_ Emitter        = &HumanReadable{}
+	_ ControlEmitter = &HumanReadable{}
+)
@@ -0,0 +1,237 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m-lab/msak/pkg/throughput1/model"
+	"github.com/m-lab/msak/pkg/throughput1/spec"
+)
+
+// DefaultInfluxDBBatchSize is the default number of points buffered by the
+// InfluxDB emitter before they are written to the server.
+const DefaultInfluxDBBatchSize = 100
+
+// errInfluxDBRejected is returned when the server rejects the points written
+// as invalid.
+var errInfluxDBRejected = errors.New("influxdb rejected the points")
+
+// tagEscaper escapes tag keys and values according to InfluxDB's line
+// protocol.
+var tagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// InfluxDB is an Emitter that writes per-measurement and aggregate points to
+// an InfluxDB server using the line protocol. Points are buffered and written
+// at the end of each stream, at the end of the test or when BatchSize points
+// have been buffered.
+//
+// If SpoolDir is set, points that cannot be written are persisted there and
+// written again, before any new points, by the next flush of this or of a
+// later run, so that clients with intermittent connectivity do not lose
+// measurements.
+type InfluxDB struct {
+	// Endpoint is the complete write URL, including the database or
+	// org/bucket parameters, e.g.:
+	// http://localhost:8086/api/v2/write?org=myorg&bucket=msak&precision=ns
+	Endpoint string
+	// Token is the (optional) token used to authenticate to the server.
+	Token string
+	// BatchSize is the number of points to buffer before writing them. If
+	// zero, DefaultInfluxDBBatchSize is used.
+	BatchSize int
+	// Client is the HTTP client used to write points. If nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+	// OnWriteError, if not nil, is called when writing points fails.
+	OnWriteError func(error)
+	// SpoolDir, if not empty, is the directory where points that cannot be
+	// written are kept until they can. At most MaxSpooledBatches batches are
+	// kept.
+	SpoolDir string
+
+	mu      sync.Mutex
+	server  string
+	subtest spec.SubtestKind
+	points  []string
+	spool   *spool
+}
+
+// OnStart records the server and subtest to use as tags for new points.
+func (e *InfluxDB) OnStart(server string, kind spec.SubtestKind) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.server = server
+	e.subtest = kind
+}
+
+// OnConnect is called when the connection to the server is established.
+func (e *InfluxDB) OnConnect(server string) {
+	// NOTHING
+}
+
+// OnMeasurement adds a point for the received Measurement.
+func (e *InfluxDB) OnMeasurement(id int, m model.WireMeasurement) {
+	fields := fmt.Sprintf("application_bytes_sent=%di,application_bytes_received=%di,"+
+		"network_bytes_sent=%di,network_bytes_received=%di,elapsed=%di",
+		m.Application.BytesSent, m.Application.BytesReceived,
+		m.Network.BytesSent, m.Network.BytesReceived, m.ElapsedTime)
+	if m.TCPInfo != nil {
+		fields += fmt.Sprintf(",rtt=%di,min_rtt=%di,bytes_acked=%di,bytes_received=%di",
+			m.TCPInfo.RTT, m.TCPInfo.MinRTT, m.TCPInfo.BytesAcked,
+			m.TCPInfo.BytesReceived)
+	}
+	e.add("msak_measurement", fmt.Sprintf("stream=%d", id), fields)
+}
+
+// OnResult adds a point for the aggregate result.
+func (e *InfluxDB) OnResult(r Result) {
+	e.add("msak_result", "", fmt.Sprintf("goodput=%f,rtt=%di,min_rtt=%di,elapsed=%di",
+		r.Goodput, r.RTT, r.MinRTT, r.Elapsed.Microseconds()))
+}
+
+// OnControl is called on control messages received from the server.
+func (e *InfluxDB) OnControl(id int, msg model.ControlMessage) {
+	// NOTHING
+}
+
+// OnError is called on errors.
+func (e *InfluxDB) OnError(err error) {
+	// NOTHING
+}
+
+// OnStreamComplete writes any buffered points.
+func (e *InfluxDB) OnStreamComplete(streamID int, server string) {
+	e.flush()
+}
+
+// OnDebug is called to print debug information.
+func (e *InfluxDB) OnDebug(msg string) {
+	// NOTHING
+}
+
+// OnSummary writes any buffered points.
+func (e *InfluxDB) OnSummary(results map[spec.SubtestKind]Result) {
+	e.flush()
+}
+
+// add buffers a new point with the provided measurement name, extra tags and
+// fields. If the buffer is full, points are written to the server.
+func (e *InfluxDB) add(name, tags, fields string) {
+	e.mu.Lock()
+	line := name + ",server=" + tagEscaper.Replace(e.server) +
+		",subtest=" + tagEscaper.Replace(string(e.subtest))
+	if tags != "" {
+		line += "," + tags
+	}
+	line += " " + fields + " " + fmt.Sprint(time.Now().UnixNano())
+	e.points = append(e.points, line)
+	batchSize := e.BatchSize
+	if batchSize == 0 {
+		batchSize = DefaultInfluxDBBatchSize
+	}
+	full := len(e.points) >= batchSize
+	e.mu.Unlock()
+
+	if full {
+		e.flush()
+	}
+}
+
+// flush writes the buffered points to the server. If spooling is enabled,
+// the spooled points are written first and the buffered points are spooled
+// if they cannot be written.
+func (e *InfluxDB) flush() {
+	e.mu.Lock()
+	points := e.points
+	e.points = nil
+	if e.spool == nil && e.SpoolDir != "" {
+		e.spool = &spool{dir: e.SpoolDir, max: MaxSpooledBatches}
+	}
+	sp := e.spool
+	e.mu.Unlock()
+
+	if sp != nil {
+		if err := sp.forward(e.writeOrDrop); err != nil {
+			// The server is likely still unreachable.
+			e.writeError(err)
+			e.save(sp, points)
+			return
+		}
+	}
+	if len(points) == 0 {
+		return
+	}
+	if err := e.writeOrDrop(points); err != nil {
+		e.writeError(err)
+		if sp != nil {
+			e.save(sp, points)
+		}
+	}
+}
+
+// writeOrDrop writes points to the server. Points the server rejects as
+// invalid are dropped, since writing them again would fail as well.
+func (e *InfluxDB) writeOrDrop(points []string) error {
+	err := e.write(points)
+	if errors.Is(err, errInfluxDBRejected) {
+		e.writeError(err)
+		return nil
+	}
+	return err
+}
+
+// save spools points, if any.
+func (e *InfluxDB) save(sp *spool, points []string) {
+	if len(points) == 0 {
+		return
+	}
+	if err := sp.save(points); err != nil {
+		e.writeError(fmt.Errorf("cannot spool points: %w", err))
+	}
+}
+
+// writeError reports a write error via OnWriteError, if set.
+func (e *InfluxDB) writeError(err error) {
+	if e.OnWriteError != nil {
+		e.OnWriteError(err)
+	}
+}
+
+func (e *InfluxDB) write(points []string) error {
+	body := bytes.NewBufferString(strings.Join(points, "\n"))
+	req, err := http.NewRequest(http.MethodPost, e.Endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if e.Token != "" {
+		req.Header.Set("Authorization", "Token "+e.Token)
+	}
+	client := e.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusBadRequest {
+		return fmt.Errorf("%w: %s", errInfluxDBRejected, resp.Status)
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("influxdb write failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// Checks that InfluxDB implements Emitter and ControlEmitter.
+var (
+	_ Emitter        = &InfluxDB{}
+	_ ControlEmitter = &InfluxDB{}
+)
@@ -0,0 +1,135 @@
+package client
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/m-lab/msak/pkg/throughput1/model"
+	"github.com/m-lab/msak/pkg/throughput1/spec"
+)
+
+func TestInfluxDB(t *testing.T) {
+	var body, auth string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		auth = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer s.Close()
+
+	e := &InfluxDB{
+		Endpoint: s.URL,
+		Token:    "secret",
+	}
+	e.OnStart("host with space", spec.SubtestDownload)
+	e.OnMeasurement(1, model.WireMeasurement{
+		Measurement: model.Measurement{
+			Application: model.ByteCounters{BytesReceived: 100},
+			TCPInfo:     &model.TCPInfo{},
+		},
+	})
+	e.OnResult(Result{Goodput: 10})
+	e.OnStreamComplete(1, "host with space")
+
+	lines := strings.Split(body, "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 points, got %d: %q", len(lines), body)
+	}
+	if !strings.HasPrefix(lines[0],
+		`msak_measurement,server=host\ with\ space,subtest=download,stream=1 `) ||
+		!strings.Contains(lines[0], "application_bytes_received=100i") ||
+		!strings.Contains(lines[0], "min_rtt=0i") {
+		t.Errorf("invalid measurement point: %s", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "msak_result,server=host\\ with\\ space,subtest=download goodput=10.000000") {
+		t.Errorf("invalid result point: %s", lines[1])
+	}
+	if auth != "Token secret" {
+		t.Errorf("invalid Authorization header: %s", auth)
+	}
+
+	// Write errors are reported via OnWriteError.
+	var writeErr error
+	e.Endpoint = s.URL + "\x00"
+	e.OnWriteError = func(err error) { writeErr = err }
+	e.OnResult(Result{})
+	e.OnSummary(nil)
+	if writeErr == nil {
+		t.Errorf("expected write error, got nil")
+	}
+}
+
+func TestInfluxDB_SpoolDir(t *testing.T) {
+	var mu sync.Mutex
+	status := http.StatusServiceUnavailable
+	var bodies []string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		if status == http.StatusNoContent {
+			bodies = append(bodies, string(b))
+		}
+		w.WriteHeader(status)
+	}))
+	defer s.Close()
+	setStatus := func(code int) {
+		mu.Lock()
+		defer mu.Unlock()
+		status = code
+	}
+
+	dir := filepath.Join(t.TempDir(), "spool")
+	var writeErrs int
+	newEmitter := func() *InfluxDB {
+		return &InfluxDB{
+			Endpoint:     s.URL,
+			SpoolDir:     dir,
+			OnWriteError: func(error) { writeErrs++ },
+		}
+	}
+
+	// While the server is unavailable, points are spooled.
+	e := newEmitter()
+	e.OnStart("server", spec.SubtestDownload)
+	e.OnResult(Result{Goodput: 1})
+	e.OnSummary(nil)
+	e.OnResult(Result{Goodput: 2})
+	e.OnSummary(nil)
+	files, _ := filepath.Glob(filepath.Join(dir, "*"+spoolExt))
+	if len(files) != 2 || writeErrs == 0 {
+		t.Fatalf("got %d spooled batches and %d errors, want 2 and >0", len(files), writeErrs)
+	}
+
+	// A later run forwards the spooled points, oldest first, then its own.
+	setStatus(http.StatusNoContent)
+	e = newEmitter()
+	e.OnStart("server", spec.SubtestUpload)
+	e.OnResult(Result{Goodput: 3})
+	e.OnSummary(nil)
+	if len(bodies) != 3 {
+		t.Fatalf("got %d writes, want 3", len(bodies))
+	}
+	for i, want := range []string{"goodput=1.", "goodput=2.", "goodput=3."} {
+		if !strings.Contains(bodies[i], want) {
+			t.Errorf("write %d = %q, want %q", i, bodies[i], want)
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+		t.Errorf("spool not empty after forwarding: %v", files)
+	}
+
+	// Points rejected as invalid are not spooled.
+	setStatus(http.StatusBadRequest)
+	e.OnResult(Result{})
+	e.OnSummary(nil)
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+		t.Errorf("rejected points were spooled: %v", files)
+	}
+}
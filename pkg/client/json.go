@@ -0,0 +1,110 @@
+package client
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/m-lab/msak/pkg/throughput1/model"
+	"github.com/m-lab/msak/pkg/throughput1/spec"
+)
+
+// Types of the events written by the JSON emitter.
+const (
+	JSONEventStart          = "start"
+	JSONEventConnect        = "connect"
+	JSONEventMeasurement    = "measurement"
+	JSONEventControl        = "control"
+	JSONEventResult         = "result"
+	JSONEventError          = "error"
+	JSONEventStreamComplete = "stream_complete"
+	JSONEventSummary        = "summary"
+)
+
+// JSONEvent is a line written by the JSON emitter. Only the fields relevant
+// to its Type are set.
+type JSONEvent struct {
+	// Type is one of the JSONEvent* constants.
+	Type        string
+	Server      string                      `json:",omitempty"`
+	Subtest     spec.SubtestKind            `json:",omitempty"`
+	StreamID    *int                        `json:",omitempty"`
+	Measurement *model.WireMeasurement      `json:",omitempty"`
+	Control     *model.ControlMessage       `json:",omitempty"`
+	Result      *Result                     `json:",omitempty"`
+	Results     map[spec.SubtestKind]Result `json:",omitempty"`
+	Error       string                      `json:",omitempty"`
+}
+
+// JSON is an Emitter writing one JSONEvent per line to Writer, to be
+// consumed by other programs. Debug messages are not written.
+type JSON struct {
+	// Writer is where events are written to.
+	Writer io.Writer
+
+	mu sync.Mutex
+}
+
+// OnStart writes a start event.
+func (e *JSON) OnStart(server string, kind spec.SubtestKind) {
+	e.write(JSONEvent{Type: JSONEventStart, Server: server, Subtest: kind})
+}
+
+// OnConnect writes a connect event.
+func (e *JSON) OnConnect(server string) {
+	e.write(JSONEvent{Type: JSONEventConnect, Server: server})
+}
+
+// OnMeasurement writes a measurement event.
+func (e *JSON) OnMeasurement(id int, m model.WireMeasurement) {
+	e.write(JSONEvent{Type: JSONEventMeasurement, StreamID: &id, Measurement: &m})
+}
+
+// OnControl writes a control event.
+func (e *JSON) OnControl(id int, msg model.ControlMessage) {
+	e.write(JSONEvent{Type: JSONEventControl, StreamID: &id, Control: &msg})
+}
+
+// OnResult writes a result event.
+func (e *JSON) OnResult(r Result) {
+	e.write(JSONEvent{Type: JSONEventResult, Subtest: r.Subtest, Result: &r})
+}
+
+// OnError writes an error event.
+func (e *JSON) OnError(err error) {
+	e.write(JSONEvent{Type: JSONEventError, Error: err.Error()})
+}
+
+// OnStreamComplete writes a stream_complete event.
+func (e *JSON) OnStreamComplete(streamID int, server string) {
+	e.write(JSONEvent{Type: JSONEventStreamComplete, StreamID: &streamID,
+		Server: server})
+}
+
+// OnDebug is called to print debug information.
+func (e *JSON) OnDebug(msg string) {
+	// NOTHING
+}
+
+// OnSummary writes a summary event.
+func (e *JSON) OnSummary(results map[spec.SubtestKind]Result) {
+	e.write(JSONEvent{Type: JSONEventSummary, Results: results})
+}
+
+// write marshals ev and writes it as a single line. Events that cannot be
+// marshaled or written are dropped.
+func (e *JSON) write(ev JSONEvent) {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.Writer.Write(append(b, '\n'))
+}
+
+// Checks that JSON implements Emitter and ControlEmitter.
+var (
+	_ Emitter        = &JSON{}
+	_ ControlEmitter = &JSON{}
+)
@@ -0,0 +1,49 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/m-lab/msak/pkg/throughput1/model"
+	"github.com/m-lab/msak/pkg/throughput1/spec"
+)
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	e := &JSON{Writer: &buf}
+	e.OnStart("example.com", spec.SubtestDownload)
+	e.OnMeasurement(0, model.WireMeasurement{
+		Measurement: model.Measurement{
+			Application: model.ByteCounters{BytesReceived: 100},
+		},
+	})
+	e.OnDebug("not written")
+	e.OnResult(Result{Subtest: spec.SubtestDownload, Goodput: 10})
+
+	var events []JSONEvent
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var ev JSONEvent
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatalf("cannot decode event: %v", err)
+		}
+		events = append(events, ev)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(events))
+	}
+	if events[0].Type != JSONEventStart || events[0].Server != "example.com" ||
+		events[0].Subtest != spec.SubtestDownload {
+		t.Errorf("invalid start event: %+v", events[0])
+	}
+	if events[1].Type != JSONEventMeasurement || events[1].StreamID == nil ||
+		*events[1].StreamID != 0 || events[1].Measurement == nil ||
+		events[1].Measurement.Application.BytesReceived != 100 {
+		t.Errorf("invalid measurement event: %+v", events[1])
+	}
+	if events[2].Type != JSONEventResult || events[2].Result == nil ||
+		events[2].Result.Goodput != 10 {
+		t.Errorf("invalid result event: %+v", events[2])
+	}
+}
@@ -0,0 +1,55 @@
+package client
+
+import (
+	"net/http"
+
+	"github.com/m-lab/locate/api/locate"
+)
+
+// locateAPIKeyParameter is the name of the querystring parameter carrying
+// the API key in requests to the Locate API.
+const locateAPIKeyParameter = "key"
+
+// locateTransport is an http.RoundTripper that adds an API key and custom
+// headers to every request sent to the Locate API.
+type locateTransport struct {
+	base    http.RoundTripper
+	apiKey  string
+	headers http.Header
+}
+
+// RoundTrip adds the API key and the headers to a copy of req and sends it
+// using the base RoundTripper.
+func (t *locateTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for k, values := range t.headers {
+		for _, v := range values {
+			req.Header.Add(k, v)
+		}
+	}
+	if t.apiKey != "" {
+		q := req.URL.Query()
+		q.Set(locateAPIKeyParameter, t.apiKey)
+		req.URL.RawQuery = q.Encode()
+	}
+	return t.base.RoundTrip(req)
+}
+
+// newLocator returns the Locator to use with the provided config: the
+// configured Locator if set, or a Locate API client otherwise.
+func newLocator(userAgent string, config Config) Locator {
+	if config.Locator != nil {
+		return config.Locator
+	}
+	locator := locate.NewClient(userAgent)
+	if config.LocateAPIKey != "" || len(config.LocateHeaders) > 0 {
+		locator.HTTPClient = &http.Client{
+			Transport: &locateTransport{
+				base:    http.DefaultTransport,
+				apiKey:  config.LocateAPIKey,
+				headers: config.LocateHeaders,
+			},
+		}
+	}
+	return locator
+}
@@ -0,0 +1,60 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/m-lab/go/testingx"
+	"github.com/m-lab/locate/api/locate"
+	v2 "github.com/m-lab/locate/api/v2"
+)
+
+type fakeLocator struct{}
+
+func (fakeLocator) Nearest(ctx context.Context, service string) ([]v2.Target, error) {
+	return nil, nil
+}
+
+func Test_newLocator(t *testing.T) {
+	t.Run("custom locator is used", func(t *testing.T) {
+		l := newLocator("test/v1", Config{Locator: fakeLocator{}})
+		if _, ok := l.(fakeLocator); !ok {
+			t.Errorf("newLocator() did not return the configured Locator")
+		}
+	})
+
+	t.Run("api key and headers are sent to the locate api", func(t *testing.T) {
+		var got *http.Request
+		srv := httptest.NewServer(http.HandlerFunc(
+			func(rw http.ResponseWriter, req *http.Request) {
+				got = req
+				rw.Write([]byte(`{"results":[{"machine":"test"}]}`))
+			}))
+		defer srv.Close()
+
+		l := newLocator("test/v1", Config{
+			LocateAPIKey:  "secret",
+			LocateHeaders: http.Header{"X-Test": []string{"value"}},
+		})
+		u, err := url.Parse(srv.URL)
+		testingx.Must(t, err, "cannot parse server URL")
+		l.(*locate.Client).BaseURL = u
+		_, err = l.Nearest(context.Background(), "msak/throughput1")
+		testingx.Must(t, err, "Nearest() failed")
+		if got == nil {
+			t.Fatalf("no request received")
+		}
+		if key := got.URL.Query().Get("key"); key != "secret" {
+			t.Errorf("invalid api key: %q", key)
+		}
+		if h := got.Header.Get("X-Test"); h != "value" {
+			t.Errorf("invalid custom header: %q", h)
+		}
+		if ua := got.Header.Get("User-Agent"); ua != "test/v1" {
+			t.Errorf("invalid user agent: %q", ua)
+		}
+	})
+}
@@ -0,0 +1,82 @@
+package client
+
+import (
+	"github.com/m-lab/msak/pkg/throughput1/model"
+	"github.com/m-lab/msak/pkg/throughput1/spec"
+)
+
+// MultiEmitter is an Emitter that forwards every event to each of its
+// Emitters, in order, e.g. to print human-readable output while exporting
+// measurements to a file or a database.
+type MultiEmitter []Emitter
+
+// OnStart calls OnStart on every Emitter.
+func (m MultiEmitter) OnStart(server string, kind spec.SubtestKind) {
+	for _, e := range m {
+		e.OnStart(server, kind)
+	}
+}
+
+// OnConnect calls OnConnect on every Emitter.
+func (m MultiEmitter) OnConnect(server string) {
+	for _, e := range m {
+		e.OnConnect(server)
+	}
+}
+
+// OnMeasurement calls OnMeasurement on every Emitter.
+func (m MultiEmitter) OnMeasurement(id int, wm model.WireMeasurement) {
+	for _, e := range m {
+		e.OnMeasurement(id, wm)
+	}
+}
+
+// OnControl calls OnControl on every Emitter implementing ControlEmitter.
+func (m MultiEmitter) OnControl(id int, msg model.ControlMessage) {
+	for _, e := range m {
+		if ce, ok := e.(ControlEmitter); ok {
+			ce.OnControl(id, msg)
+		}
+	}
+}
+
+// OnResult calls OnResult on every Emitter.
+func (m MultiEmitter) OnResult(r Result) {
+	for _, e := range m {
+		e.OnResult(r)
+	}
+}
+
+// OnError calls OnError on every Emitter.
+func (m MultiEmitter) OnError(err error) {
+	for _, e := range m {
+		e.OnError(err)
+	}
+}
+
+// OnStreamComplete calls OnStreamComplete on every Emitter.
+func (m MultiEmitter) OnStreamComplete(streamID int, server string) {
+	for _, e := range m {
+		e.OnStreamComplete(streamID, server)
+	}
+}
+
+// OnDebug calls OnDebug on every Emitter.
+func (m MultiEmitter) OnDebug(msg string) {
+	for _, e := range m {
+		e.OnDebug(msg)
+	}
+}
+
+// OnSummary calls OnSummary on every Emitter.
+func (m MultiEmitter) OnSummary(results map[spec.SubtestKind]Result) {
+	for _, e := range m {
+		e.OnSummary(results)
+	}
+}
+
+// Checks that MultiEmitter implements Emitter and ControlEmitter.
+var (
+	_ Emitter        = MultiEmitter{}
+	_ ControlEmitter = MultiEmitter{}
+)
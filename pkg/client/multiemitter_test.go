@@ -0,0 +1,35 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/m-lab/msak/pkg/throughput1/model"
+	"github.com/m-lab/msak/pkg/throughput1/spec"
+)
+
+func TestMultiEmitter(t *testing.T) {
+	var a, b bytes.Buffer
+	// Emitters without OnControl are supported.
+	var basic struct{ Emitter }
+	basic.Emitter = HumanReadable{}
+	e := MultiEmitter{&JSON{Writer: &a}, &JSON{Writer: &b}, HumanReadable{}, basic}
+	e.OnStart("example.com", spec.SubtestUpload)
+	e.OnConnect("wss://example.com/throughput/v1/upload")
+	e.OnMeasurement(0, model.WireMeasurement{})
+	e.OnControl(0, model.ControlMessage{Action: "abort"})
+	e.OnResult(Result{Subtest: spec.SubtestUpload, Goodput: 10})
+	e.OnError(errors.New("test error"))
+	e.OnStreamComplete(0, "example.com")
+	e.OnDebug("debug")
+	e.OnSummary(map[spec.SubtestKind]Result{spec.SubtestUpload: {}})
+
+	if a.String() != b.String() {
+		t.Errorf("emitters received different events:\n%s\n%s", a.String(), b.String())
+	}
+	if n := strings.Count(a.String(), "\n"); n != 8 {
+		t.Errorf("expected 8 events, got %d: %s", n, a.String())
+	}
+}
@@ -0,0 +1,125 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Interface types reported in NetworkContext.InterfaceType.
+const (
+	InterfaceTypeEthernet = "ethernet"
+	InterfaceTypeWiFi     = "wifi"
+	InterfaceTypeCellular = "cellular"
+	InterfaceTypeUnknown  = "unknown"
+)
+
+// routeProbeAddrs are the addresses used to determine the interface of the
+// default route. Connecting a UDP socket does not send any packets.
+var routeProbeAddrs = []string{"8.8.8.8:53", "[2001:4860:4860::8888]:53"}
+
+// interfacePrefixes maps interface name prefixes to interface types. This is
+// only a guess: interface naming differs across operating systems and
+// configurations.
+var interfacePrefixes = []struct {
+	prefix string
+	kind   string
+}{
+	{"wlan", InterfaceTypeWiFi},
+	{"wl", InterfaceTypeWiFi},
+	{"wifi", InterfaceTypeWiFi},
+	{"ath", InterfaceTypeWiFi},
+	{"rmnet", InterfaceTypeCellular},
+	{"ccmni", InterfaceTypeCellular},
+	{"pdp_ip", InterfaceTypeCellular},
+	{"wwan", InterfaceTypeCellular},
+	{"ww", InterfaceTypeCellular},
+	{"eth", InterfaceTypeEthernet},
+	{"en", InterfaceTypeEthernet},
+}
+
+// vpnPrefixes are interface name prefixes commonly used by VPN software.
+var vpnPrefixes = []string{"tun", "tap", "utun", "wg", "ppp", "ipsec", "zt",
+	"tailscale", "nordlynx", "proton"}
+
+// NetworkContext describes the client's network context, as seen from the
+// interface used by the default route.
+type NetworkContext struct {
+	// Interface is the name of the interface used by the default route.
+	Interface string
+	// InterfaceType is a guess of the access technology of Interface, based
+	// on its name.
+	InterfaceType string
+	// VPN is true if Interface looks like a VPN tunnel.
+	VPN bool
+	// MTU is the MTU of Interface.
+	MTU int
+}
+
+// Metadata returns the network context as querystring metadata keys.
+func (nc *NetworkContext) Metadata() map[string]string {
+	return map[string]string{
+		"client_interface_type": nc.InterfaceType,
+		"client_vpn":            strconv.FormatBool(nc.VPN),
+		"client_mtu":            strconv.Itoa(nc.MTU),
+	}
+}
+
+// DetectNetworkContext returns the NetworkContext for the interface used by
+// the default route.
+func DetectNetworkContext() (*NetworkContext, error) {
+	var localIP net.IP
+	for _, addr := range routeProbeAddrs {
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			continue
+		}
+		localIP = conn.LocalAddr().(*net.UDPAddr).IP
+		conn.Close()
+		break
+	}
+	if localIP == nil {
+		return nil, errors.New("cannot determine the default route")
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(localIP) {
+				kind, vpn := classifyInterface(iface.Name)
+				return &NetworkContext{
+					Interface:     iface.Name,
+					InterfaceType: kind,
+					VPN:           vpn,
+					MTU:           iface.MTU,
+				}, nil
+			}
+		}
+	}
+	return nil, errors.New("cannot find the default route's interface")
+}
+
+// classifyInterface guesses the interface type from its name and whether it
+// is a VPN tunnel.
+func classifyInterface(name string) (string, bool) {
+	name = strings.ToLower(name)
+	for _, p := range vpnPrefixes {
+		if strings.HasPrefix(name, p) {
+			return InterfaceTypeUnknown, true
+		}
+	}
+	for _, p := range interfacePrefixes {
+		if strings.HasPrefix(name, p.prefix) {
+			return p.kind, false
+		}
+	}
+	return InterfaceTypeUnknown, false
+}
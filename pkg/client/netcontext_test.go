@@ -0,0 +1,28 @@
+package client
+
+import "testing"
+
+func Test_classifyInterface(t *testing.T) {
+	tests := []struct {
+		name     string
+		wantType string
+		wantVPN  bool
+	}{
+		{name: "eth0", wantType: InterfaceTypeEthernet},
+		{name: "enp3s0", wantType: InterfaceTypeEthernet},
+		{name: "wlp2s0", wantType: InterfaceTypeWiFi},
+		{name: "rmnet_data0", wantType: InterfaceTypeCellular},
+		{name: "utun3", wantType: InterfaceTypeUnknown, wantVPN: true},
+		{name: "wg0", wantType: InterfaceTypeUnknown, wantVPN: true},
+		{name: "br-1234", wantType: InterfaceTypeUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotType, gotVPN := classifyInterface(tt.name)
+			if gotType != tt.wantType || gotVPN != tt.wantVPN {
+				t.Errorf("classifyInterface() = %v, %v, want %v, %v",
+					gotType, gotVPN, tt.wantType, tt.wantVPN)
+			}
+		})
+	}
+}
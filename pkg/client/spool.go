@@ -0,0 +1,110 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxSpooledBatches is the maximum number of batches kept in a spool
+// directory. When it is exceeded, the oldest batches are dropped.
+const MaxSpooledBatches = 1000
+
+// spoolExt is the extension of the files holding spooled batches.
+const spoolExt = ".lp"
+
+// spool persists batches of points that could not be written, so that they
+// can be forwarded later, possibly by a different process.
+type spool struct {
+	dir string
+	// max is the maximum number of batches kept.
+	max int
+	// mu serializes forwarding, so that each batch is forwarded once.
+	mu sync.Mutex
+}
+
+// save writes a batch of points to a new file in the spool directory.
+func (s *spool) save(points []string) error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	// Write to a temporary file first, so that a partially written batch is
+	// never forwarded.
+	f, err := os.CreateTemp(s.dir, "batch-*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(strings.Join(points, "\n"))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	// File names sort in the order batches are saved. The random part of the
+	// temporary name makes them unique.
+	random := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(f.Name()), "batch-"), ".tmp")
+	name := filepath.Join(s.dir, fmt.Sprintf("%020d-%s%s", time.Now().UnixNano(), random, spoolExt))
+	if err := os.Rename(f.Name(), name); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return s.trim()
+}
+
+// forward writes the spooled batches with write, oldest first, removing each
+// batch once it is written. It stops at the first error.
+func (s *spool) forward(write func(points []string) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		if len(b) > 0 {
+			if err := write(strings.Split(string(b), "\n")); err != nil {
+				return err
+			}
+		}
+		if err := os.Remove(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// files returns the spooled batches, oldest first. A missing spool directory
+// holds no batches.
+func (s *spool) files() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*"+spoolExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// trim removes the oldest batches beyond max.
+func (s *spool) trim() error {
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+	for len(files) > s.max {
+		if err := os.Remove(files[0]); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package client
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSpool(t *testing.T) {
+	s := &spool{dir: filepath.Join(t.TempDir(), "spool"), max: 10}
+
+	// A missing directory holds no batches.
+	if err := s.forward(func([]string) error {
+		t.Fatalf("forward() called write on an empty spool")
+		return nil
+	}); err != nil {
+		t.Fatalf("forward() error = %v", err)
+	}
+
+	for _, b := range [][]string{{"a", "b"}, {"c"}} {
+		if err := s.save(b); err != nil {
+			t.Fatalf("save() error = %v", err)
+		}
+	}
+
+	// Forwarding stops at the first error and keeps the failed batch.
+	var got [][]string
+	failing := errors.New("unreachable")
+	err := s.forward(func(points []string) error {
+		got = append(got, points)
+		return failing
+	})
+	if err != failing || len(got) != 1 {
+		t.Fatalf("forward() = %v after %d writes, want %v after 1", err, len(got), failing)
+	}
+
+	got = nil
+	err = s.forward(func(points []string) error {
+		got = append(got, points)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("forward() error = %v", err)
+	}
+	if want := [][]string{{"a", "b"}, {"c"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("forward() wrote %v, want %v", got, want)
+	}
+	if files, _ := os.ReadDir(s.dir); len(files) != 0 {
+		t.Errorf("spool not empty after forwarding: %v", files)
+	}
+}
+
+func TestSpool_trim(t *testing.T) {
+	s := &spool{dir: t.TempDir(), max: 3}
+	for i := 0; i < 5; i++ {
+		if err := s.save([]string{"x"}); err != nil {
+			t.Fatalf("save() error = %v", err)
+		}
+	}
+	files, err := s.files()
+	if err != nil || len(files) != 3 {
+		t.Errorf("files() = %d files, %v, want 3", len(files), err)
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/m-lab/go/prometheusx"
 	"github.com/m-lab/msak/pkg/version"
 )
 
@@ -23,6 +22,46 @@ type LatencyPacket struct {
 	// LastRTT is the previous RTT (if any) measured by the party sending this
 	// message. When there is no previous RTT, this will be zero.
 	LastRTT int `json:",omitempty"`
+
+	// Final is true for the last s2c message of a session, sent by the
+	// server once its send loop is over. It tells the client that the
+	// session is complete and must not be echoed back.
+	Final bool `json:",omitempty"`
+	// PacketsSent and PacketsReceived are the numbers of s2c messages sent
+	// and of replies received by the server. They are only set in the final
+	// message.
+	PacketsSent     int `json:",omitempty"`
+	PacketsReceived int `json:",omitempty"`
+
+	// Nonce is a random value carried by s2c pings when the server verifies
+	// echoes. Clients must echo it verbatim, like the rest of the packet.
+	Nonce string `json:",omitempty"`
+}
+
+// ClientInfo describes the client software, as reported by the client in the
+// querystring of the Authorize request.
+type ClientInfo struct {
+	// Name is the client's name.
+	Name string `json:",omitempty"`
+	// OS is the client's operating system.
+	OS string `json:",omitempty"`
+	// Version is the client's version.
+	Version string `json:",omitempty"`
+}
+
+// AccessToken holds the claims of the access token a measurement was
+// authorized with, so changes in the access policy can be correlated with
+// changes in the data.
+type AccessToken struct {
+	// Issuer is the token's issuer.
+	Issuer string
+	// Audience lists the token's intended recipients.
+	Audience []string `json:",omitempty"`
+	// Expiry is the token's expiration time.
+	Expiry time.Time
+	// Machine is the machine name the server verified the token's audience
+	// against, if configured.
+	Machine string `json:",omitempty"`
 }
 
 // ArchivalData is the archival data format for latency1 measurements.
@@ -31,6 +70,10 @@ type ArchivalData struct {
 	GitShortCommit string
 	// Version is the symbolic version (if any) of the running server code.
 	Version string
+	// Build describes the running server binary, including its full Git
+	// commit, build date and Go version. GitShortCommit and Version are
+	// copies of the corresponding fields.
+	Build version.Info
 	// ID is the unique identifier for this latency measurement.
 	ID string
 
@@ -42,6 +85,21 @@ type ArchivalData struct {
 	Client string
 	// Server is the server's ip:port pair.
 	Server string
+	// AdvertisedServer is the host name or IP address the server is publicly
+	// reachable at, if configured. It is useful when Server is a wildcard
+	// address or the machine has multiple interfaces.
+	AdvertisedServer string `json:",omitempty"`
+
+	// AddressFamily is the IP family of the UDP packets, "ipv4" or "ipv6".
+	// IPv4 clients of dual-stack sockets are reported as "ipv4".
+	AddressFamily string `json:",omitempty"`
+
+	// ClientInfo describes the client software, if reported by the client.
+	ClientInfo *ClientInfo `json:",omitempty"`
+
+	// AccessToken describes the access token this measurement was
+	// authorized with. It is only set if access tokens are verified.
+	AccessToken *AccessToken `json:",omitempty"`
 
 	// StartTime is the test's start time.
 	StartTime time.Time
@@ -58,6 +116,17 @@ type ArchivalData struct {
 	// PacketsReceived is the number of packets received during this
 	// measurement.
 	PacketsReceived int
+
+	// InFlight summarizes the in-flight window over the measurement.
+	InFlight *InFlightSummary `json:",omitempty"`
+
+	// EchoVerification is true if pings carried a nonce that replies were
+	// required to echo.
+	EchoVerification bool `json:",omitempty"`
+	// EchoMismatches is the number of replies whose nonce did not match the
+	// one sent with the ping, e.g. because a middlebox regenerated or
+	// spoofed them. These replies are not counted as received.
+	EchoMismatches int `json:",omitempty"`
 }
 
 // RoundTrip is a roundtrip. If the reply was lost, Lost will be true.
@@ -67,6 +136,20 @@ type RoundTrip struct {
 	RTT int
 	// Lost says if the packet was lost.
 	Lost bool `json:",omitempty"`
+	// InFlight is the number of previous pings that were still unanswered
+	// when this ping was sent, i.e. the in-flight window. Pings sent more
+	// than spec.InFlightTimeout earlier are not counted.
+	InFlight int `json:",omitempty"`
+}
+
+// InFlightSummary summarizes the in-flight window over a measurement. A
+// growing window while RTTs stay stable hints at queueing on the path or
+// processing delays in the client.
+type InFlightSummary struct {
+	// Max is the largest in-flight window.
+	Max int
+	// Mean is the mean in-flight window.
+	Mean float64
 }
 
 // Session is the in-memory structure holding information about a UDP latency
@@ -85,6 +168,15 @@ type Session struct {
 	Client string
 	// Server is the server's ip:port pair.
 	Server string
+	// AddressFamily is the IP family of the UDP packets.
+	AddressFamily string
+
+	// ClientInfo describes the client software, if reported by the client.
+	ClientInfo *ClientInfo
+
+	// AccessToken describes the access token this session was authorized
+	// with, if any.
+	AccessToken *AccessToken
 
 	// Started is true if this session's send loop has been started already.
 	Started bool
@@ -92,8 +184,10 @@ type Session struct {
 	StartedMu sync.Mutex
 
 	// SendTimes is a slice of send times. The slice's index is the packet's
-	// sequence number.
-	SendTimes []time.Time
+	// sequence number. Send times are monotonic clock readings relative to
+	// an arbitrary fixed point, so that RTTs computed from them are not
+	// affected by wall clock adjustments.
+	SendTimes []time.Duration
 	// SendTimesMu is a mutex to synchronize access to SendTimes.
 	SendTimesMu sync.Mutex
 
@@ -102,6 +196,45 @@ type Session struct {
 
 	// LastRTT contains the last observed RTT.
 	LastRTT *atomic.Int64
+
+	// EchoVerification is true if pings carry a nonce that replies must
+	// echo. Nonces holds the nonce of each ping, indexed like SendTimes.
+	// EchoMismatches is the number of replies with a wrong nonce. Nonces
+	// and EchoMismatches are protected by SendTimesMu.
+	EchoVerification bool
+	Nonces           []string
+	EchoMismatches   int
+}
+
+// InFlight returns the number of pings sent at most timeout before now that
+// are still unanswered. now must be a reading of the same monotonic clock as
+// SendTimes. The caller must hold SendTimesMu.
+func (s *Session) InFlight(now, timeout time.Duration) int {
+	n := 0
+	for i := len(s.SendTimes) - 1; i >= 0 && now-s.SendTimes[i] <= timeout; i-- {
+		if s.RoundTrips[i].Lost {
+			n++
+		}
+	}
+	return n
+}
+
+// inFlightSummary returns the summary of the in-flight window recorded in
+// RoundTrips, or nil if there are none.
+func (s *Session) inFlightSummary() *InFlightSummary {
+	if len(s.RoundTrips) == 0 {
+		return nil
+	}
+	summary := &InFlightSummary{}
+	total := 0
+	for _, rt := range s.RoundTrips {
+		if rt.InFlight > summary.Max {
+			summary.Max = rt.InFlight
+		}
+		total += rt.InFlight
+	}
+	summary.Mean = float64(total) / float64(len(s.RoundTrips))
+	return summary
 }
 
 // PacketsReceived returns the number of received packets for this session.
@@ -121,6 +254,8 @@ type Summary struct {
 	ID string
 	// StartTime is the test's start time.
 	StartTime time.Time
+	// ClientInfo describes the client software, if reported by the client.
+	ClientInfo *ClientInfo `json:",omitempty"`
 	// RoundTrips is a list of roundtrips.
 	RoundTrips []RoundTrip
 
@@ -129,6 +264,13 @@ type Summary struct {
 	// PacketsReceived is the number of packets received during this
 	// measurement.
 	PacketsReceived int
+
+	// InFlight summarizes the in-flight window over the measurement.
+	InFlight *InFlightSummary `json:",omitempty"`
+
+	// EchoMismatches is the number of replies whose nonce did not match the
+	// one sent with the ping.
+	EchoMismatches int `json:",omitempty"`
 }
 
 // NewSession returns an empty Session with all the fields initialized.
@@ -143,22 +285,29 @@ func NewSession(uuid string) *Session {
 
 		LastRTT: &atomic.Int64{},
 
-		SendTimes: []time.Time{},
+		SendTimes: []time.Duration{},
 	}
 }
 
 // Archive converts this Session to ArchivalData.
 func (s *Session) Archive() *ArchivalData {
 	return &ArchivalData{
-		ID:              s.UUID,
-		GitShortCommit:  prometheusx.GitShortCommit,
-		Version:         version.Version,
-		Client:          s.Client,
-		Server:          s.Server,
-		StartTime:       s.StartTime,
-		RoundTrips:      s.RoundTrips,
-		PacketsSent:     len(s.SendTimes),
-		PacketsReceived: s.PacketsReceived(),
+		ID:               s.UUID,
+		GitShortCommit:   version.Get().GitShortCommit,
+		Version:          version.Get().Version,
+		Build:            version.Get(),
+		Client:           s.Client,
+		Server:           s.Server,
+		AddressFamily:    s.AddressFamily,
+		ClientInfo:       s.ClientInfo,
+		AccessToken:      s.AccessToken,
+		StartTime:        s.StartTime,
+		RoundTrips:       s.RoundTrips,
+		PacketsSent:      len(s.SendTimes),
+		PacketsReceived:  s.PacketsReceived(),
+		InFlight:         s.inFlightSummary(),
+		EchoVerification: s.EchoVerification,
+		EchoMismatches:   s.EchoMismatches,
 	}
 }
 
@@ -167,8 +316,11 @@ func (s *Session) Summarize() *Summary {
 	return &Summary{
 		ID:              s.UUID,
 		StartTime:       s.StartTime,
+		ClientInfo:      s.ClientInfo,
 		PacketsSent:     len(s.SendTimes),
 		PacketsReceived: s.PacketsReceived(),
 		RoundTrips:      s.RoundTrips,
+		InFlight:        s.inFlightSummary(),
+		EchoMismatches:  s.EchoMismatches,
 	}
 }
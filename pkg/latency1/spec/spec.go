@@ -10,7 +10,49 @@ const (
 	AuthorizeV1 = "/latency/v1/authorize"
 	// ResultV1 is the v1 /result endpoint.
 	ResultV1 = "/latency/v1/result"
+	// IssueV1 is the v1 /issue endpoint, which generates a mid and returns
+	// the corresponding kickoff packet without requiring authorization.
+	IssueV1 = "/latency/v1/issue"
+
+	// ClientNameParameterName, ClientOSParameterName and
+	// ClientVersionParameterName are the querystring parameters of the
+	// Authorize request describing the client software.
+	ClientNameParameterName    = "client_name"
+	ClientOSParameterName      = "client_os"
+	ClientVersionParameterName = "client_version"
 
 	// DefaultSessionCacheTTL is the default session cache TTL.
 	DefaultSessionCacheTTL = 1 * time.Minute
+
+	// DefaultMaxPacketSize is the default maximum size of a latency packet
+	// accepted by the server. Larger packets are discarded.
+	DefaultMaxPacketSize = 1024
+
+	// MaxJSONDepth is the maximum nesting depth of a JSON latency packet.
+	MaxJSONDepth = 4
+
+	// MaxMalformedPackets is the number of malformed packets a session can
+	// send within MalformedPacketWindow before being blocklisted.
+	MaxMalformedPackets = 20
+
+	// MalformedPacketWindow is the time window used to count malformed
+	// packets for the same session.
+	MalformedPacketWindow = 1 * time.Minute
+
+	// BlocklistDuration is how long a session sending malformed packets is
+	// blocklisted for.
+	BlocklistDuration = 5 * time.Minute
+
+	// InFlightTimeout is how long a ping can stay unanswered before it is no
+	// longer counted in the in-flight window, since it was likely lost.
+	InFlightTimeout = 1 * time.Second
+)
+
+var (
+	// DefaultClientNames and DefaultClientOSes are the client names and
+	// operating systems used as metric labels by default. Other values are
+	// reported as "other".
+	DefaultClientNames = []string{"msak-latency"}
+	DefaultClientOSes  = []string{"android", "darwin", "freebsd", "ios",
+		"linux", "windows"}
 )
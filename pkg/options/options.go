@@ -0,0 +1,376 @@
+// Package options defines the querystring options accepted by the
+// throughput1 protocol. It is used both by the server, to parse and validate
+// incoming requests, and by clients, to construct them, so that the two sides
+// always agree on parameter names, units and limits.
+package options
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/m-lab/msak/pkg/throughput1/model"
+	"github.com/m-lab/msak/pkg/throughput1/spec"
+)
+
+// Names of the known querystring parameters.
+const (
+	StreamsParameterName         = "streams"
+	DurationParameterName        = "duration"
+	DelayParameterName           = "delay"
+	CCParameterName              = "cc"
+	AccessTokenParameterName     = "access_token"
+	MIDParameterName             = "mid"
+	ByteLimitParameterName       = spec.ByteLimitParameterName
+	TargetRateParameterName      = spec.TargetRateParameterName
+	MeasureIntervalParameterName = spec.MeasureIntervalParameterName
+	CounterflowParameterName     = spec.CounterflowParameterName
+)
+
+const (
+	// DefaultDuration is the test duration used by default when the client
+	// does not provide one.
+	DefaultDuration = 5 * time.Second
+
+	// MaxMetadataKeyLength is the default maximum length of a metadata key.
+	MaxMetadataKeyLength = 50
+	// MaxMetadataValueLength is the default maximum length of a metadata
+	// value.
+	MaxMetadataValueLength = 512
+)
+
+// Reasons for rejecting or dropping metadata, as reported in Error.Reason and
+// in MetadataPolicy.Parse's dropped keys.
+const (
+	ReasonMetadataKeyTooLong   = "metadata-key-too-long"
+	ReasonMetadataValueTooLong = "metadata-value-too-long"
+	ReasonTooManyMetadata      = "too-many-metadata"
+	ReasonMetadataNotAllowed   = "metadata-not-allowed"
+)
+
+// MetadataPolicy configures which client metadata is accepted.
+type MetadataPolicy struct {
+	// MaxKeyLength and MaxValueLength are the maximum lengths of a metadata
+	// key and value. Requests exceeding them are rejected.
+	MaxKeyLength   int
+	MaxValueLength int
+	// MaxCount is the maximum number of metadata parameters. Requests
+	// exceeding it are rejected. Zero means no limit.
+	MaxCount int
+	// Allowed, if not empty, is the list of accepted metadata keys. Other
+	// keys are dropped rather than rejected, so that clients sending extra
+	// metadata can still run tests.
+	Allowed []string
+}
+
+// DefaultMetadataPolicy is the policy used by Parse and ParseMetadata.
+var DefaultMetadataPolicy = MetadataPolicy{
+	MaxKeyLength:   MaxMetadataKeyLength,
+	MaxValueLength: MaxMetadataValueLength,
+}
+
+// knownOptions are the parameters that are not considered metadata.
+var knownOptions = map[string]struct{}{
+	StreamsParameterName:         {},
+	DurationParameterName:        {},
+	DelayParameterName:           {},
+	CCParameterName:              {},
+	AccessTokenParameterName:     {},
+	MIDParameterName:             {},
+	ByteLimitParameterName:       {},
+	TargetRateParameterName:      {},
+	MeasureIntervalParameterName: {},
+	CounterflowParameterName:     {},
+}
+
+// IsKnown returns true if name is a known option, i.e. not metadata.
+func IsKnown(name string) bool {
+	_, ok := knownOptions[name]
+	return ok
+}
+
+// Error is returned by Parse when an option is missing or invalid.
+type Error struct {
+	// Param is the name of the offending parameter.
+	Param string
+	// Value is the value received for Param, if any.
+	Value string
+	// Reason is a short, metric-friendly description of the error, e.g.
+	// "invalid-duration".
+	Reason string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s=%q", e.Reason, e.Param, e.Value)
+}
+
+// Options are the throughput1 options for a single stream.
+//
+// All durations are sent on the wire as integer milliseconds. Duration and
+// Delay are also accepted as Go duration strings, e.g. "5s".
+type Options struct {
+	// Streams is the number of streams in the measurement. It is required
+	// and must be between 1 and spec.MaxStreams.
+	Streams int
+	// Duration is the test duration. If zero, DefaultDuration is used by the
+	// server, unless NoDurationLimit is set.
+	Duration time.Duration
+	// NoDurationLimit is true if the client requested a duration of zero,
+	// i.e. a test only bounded by ByteLimit and the server's maximum runtime.
+	NoDurationLimit bool
+	// Delay is the delay between the start of consecutive streams.
+	Delay time.Duration
+	// CC is the list of congestion control algorithms to use. Each stream of
+	// a measurement uses the next algorithm in the list, wrapping around.
+	CC []string
+	// ByteLimit is the maximum number of bytes to transfer, or zero for no
+	// limit.
+	ByteLimit int
+	// TargetRate is the target sending rate in bits per second, or zero for
+	// no rate limiting.
+	TargetRate int64
+	// MeasureInterval is the requested interval between measurements, or
+	// zero for the server's default.
+	MeasureInterval time.Duration
+	// NoCounterflow is true if the client asked the server not to send
+	// measurements during uploads, except for the final one.
+	NoCounterflow bool
+	// Metadata contains every parameter that is not a known option.
+	Metadata []model.NameValue
+	// Raw contains the known options as received, for archival purposes.
+	Raw []model.NameValue
+	// DroppedMetadata contains the metadata keys dropped because they are
+	// not allowed by the MetadataPolicy.
+	DroppedMetadata []string
+}
+
+// Parse parses and validates the options contained in query, using the
+// DefaultMetadataPolicy. If the duration is not provided, Duration is zero.
+// The returned error, if any, is an *Error.
+func Parse(query url.Values) (*Options, error) {
+	return ParseWithPolicy(query, DefaultMetadataPolicy)
+}
+
+// ParseWithPolicy is like Parse, but accepts client metadata according to
+// the provided MetadataPolicy.
+func ParseWithPolicy(query url.Values, policy MetadataPolicy) (*Options, error) {
+	opts := &Options{
+		Raw: []model.NameValue{},
+	}
+	raw := func(name string) string {
+		v := query.Get(name)
+		if v != "" {
+			opts.Raw = append(opts.Raw, model.NameValue{Name: name, Value: v})
+		}
+		return v
+	}
+
+	v := raw(StreamsParameterName)
+	if v == "" {
+		return nil, &Error{Param: StreamsParameterName, Reason: "missing-streams"}
+	}
+	streams, err := strconv.Atoi(v)
+	if err != nil || streams < 1 || streams > spec.MaxStreams {
+		return nil, &Error{Param: StreamsParameterName, Value: v,
+			Reason: "invalid-streams"}
+	}
+	opts.Streams = streams
+
+	if v := raw(DurationParameterName); v != "" {
+		d, err := ParseDuration(v)
+		if err != nil {
+			return nil, &Error{Param: DurationParameterName, Value: v,
+				Reason: "invalid-duration"}
+		}
+		opts.Duration = d
+		opts.NoDurationLimit = d == 0
+	}
+
+	if v := raw(CCParameterName); v != "" {
+		opts.CC = strings.Split(v, ",")
+	}
+
+	if v := raw(DelayParameterName); v != "" {
+		d, err := ParseDuration(v)
+		if err != nil {
+			return nil, &Error{Param: DelayParameterName, Value: v,
+				Reason: "invalid-delay"}
+		}
+		opts.Delay = d
+	}
+
+	if v := raw(ByteLimitParameterName); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, &Error{Param: ByteLimitParameterName, Value: v,
+				Reason: "invalid-byte-limit"}
+		}
+		opts.ByteLimit = n
+	}
+
+	if v := raw(TargetRateParameterName); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 || n > spec.MaxTargetRate {
+			return nil, &Error{Param: TargetRateParameterName, Value: v,
+				Reason: "invalid-target-rate"}
+		}
+		opts.TargetRate = n
+	}
+
+	if v := raw(MeasureIntervalParameterName); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, &Error{Param: MeasureIntervalParameterName, Value: v,
+				Reason: "invalid-measure-interval"}
+		}
+		opts.MeasureInterval = time.Duration(ms) * time.Millisecond
+	}
+
+	if v := raw(CounterflowParameterName); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, &Error{Param: CounterflowParameterName, Value: v,
+				Reason: "invalid-counterflow"}
+		}
+		opts.NoCounterflow = !enabled
+	}
+
+	metadata, dropped, err := policy.Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	opts.Metadata = metadata
+	opts.DroppedMetadata = dropped
+	return opts, nil
+}
+
+// ParseDuration parses a duration expressed either as an integer number of
+// milliseconds (e.g. "5000") or as a Go duration string (e.g. "5s"). Negative
+// durations are rejected.
+func ParseDuration(v string) (time.Duration, error) {
+	v = strings.TrimSpace(v)
+	var d time.Duration
+	if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if ms > int64(math.MaxInt64/time.Millisecond) {
+			return 0, errors.New("duration out of range: " + v)
+		}
+		d = time.Duration(ms) * time.Millisecond
+	} else {
+		d, err = time.ParseDuration(v)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if d < 0 {
+		return 0, errors.New("negative duration: " + v)
+	}
+	return d, nil
+}
+
+// ParseMetadata returns every parameter in query that is not a known option,
+// according to the DefaultMetadataPolicy.
+func ParseMetadata(query url.Values) ([]model.NameValue, error) {
+	metadata, _, err := DefaultMetadataPolicy.Parse(query)
+	return metadata, err
+}
+
+// Parse returns every parameter in query that is not a known option and is
+// allowed by the policy, and the keys that were dropped because they are not
+// allowed. Only the first value of each parameter is kept. The returned
+// error, if any, is an *Error.
+func (p MetadataPolicy) Parse(query url.Values) ([]model.NameValue, []string, error) {
+	metadata := []model.NameValue{}
+	var dropped []string
+	count := 0
+	for k, v := range query {
+		if IsKnown(k) {
+			continue
+		}
+		count++
+		// These limits are meant to limit abuse.
+		if p.MaxCount > 0 && count > p.MaxCount {
+			return nil, nil, &Error{Param: k, Reason: ReasonTooManyMetadata}
+		}
+		if len(k) > p.MaxKeyLength {
+			return nil, nil, &Error{Param: k, Reason: ReasonMetadataKeyTooLong}
+		}
+		if len(v[0]) > p.MaxValueLength {
+			return nil, nil, &Error{Param: k, Value: v[0][:p.MaxValueLength],
+				Reason: ReasonMetadataValueTooLong}
+		}
+		if !p.allowed(k) {
+			dropped = append(dropped, k)
+			continue
+		}
+		metadata = append(metadata, model.NameValue{Name: k, Value: v[0]})
+	}
+	return metadata, dropped, nil
+}
+
+// allowed returns true if the metadata key k is allowed by the policy.
+func (p MetadataPolicy) allowed(k string) bool {
+	if len(p.Allowed) == 0 {
+		return true
+	}
+	for _, a := range p.Allowed {
+		if a == k {
+			return true
+		}
+	}
+	return false
+}
+
+// ClampMeasureInterval returns d bounded to the measurement interval range
+// allowed by the spec.
+func ClampMeasureInterval(d time.Duration) time.Duration {
+	if d < spec.MinRequestedMeasureInterval {
+		return spec.MinRequestedMeasureInterval
+	}
+	if d > spec.MaxRequestedMeasureInterval {
+		return spec.MaxRequestedMeasureInterval
+	}
+	return d
+}
+
+// Encode sets the options in q. Zero-valued options are omitted, except for
+// Streams. Metadata is set as-is and must not use the name of a
+// known option.
+func (o *Options) Encode(q url.Values) error {
+	q.Set(StreamsParameterName, strconv.Itoa(o.Streams))
+	if o.Duration != 0 || o.NoDurationLimit {
+		q.Set(DurationParameterName, strconv.FormatInt(o.Duration.Milliseconds(), 10))
+	}
+	if len(o.CC) > 0 {
+		q.Set(CCParameterName, strings.Join(o.CC, ","))
+	}
+	if o.Delay != 0 {
+		q.Set(DelayParameterName, strconv.FormatInt(o.Delay.Milliseconds(), 10))
+	}
+	if o.ByteLimit != 0 {
+		q.Set(ByteLimitParameterName, strconv.Itoa(o.ByteLimit))
+	}
+	if o.TargetRate != 0 {
+		q.Set(TargetRateParameterName, strconv.FormatInt(o.TargetRate, 10))
+	}
+	if o.MeasureInterval != 0 {
+		q.Set(MeasureIntervalParameterName,
+			strconv.FormatInt(o.MeasureInterval.Milliseconds(), 10))
+	}
+	if o.NoCounterflow {
+		q.Set(CounterflowParameterName, "false")
+	}
+	for _, nv := range o.Metadata {
+		if IsKnown(nv.Name) {
+			return errors.New("metadata uses a reserved name: " + nv.Name)
+		}
+		if len(nv.Name) > MaxMetadataKeyLength || len(nv.Value) > MaxMetadataValueLength {
+			return errors.New("maximum key or value length exceeded: " + nv.Name)
+		}
+		q.Set(nv.Name, nv.Value)
+	}
+	return nil
+}
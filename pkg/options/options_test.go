@@ -0,0 +1,272 @@
+package options
+
+import (
+	"errors"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/m-lab/msak/pkg/throughput1/model"
+	"github.com/m-lab/msak/pkg/throughput1/spec"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		want       *Options
+		wantReason string
+	}{
+		{
+			name:  "defaults",
+			query: "streams=2",
+			want: &Options{
+				Streams:  2,
+				Metadata: []model.NameValue{},
+				Raw:      []model.NameValue{{Name: "streams", Value: "2"}},
+			},
+		},
+		{
+			name: "all options",
+			query: "streams=3&duration=1000&delay=10&cc=bbr,cubic&bytes=100" +
+				"&target_rate=2000&measure_interval_ms=250&access_token=x&mid=y&foo=bar",
+			want: &Options{
+				Streams:         3,
+				Duration:        time.Second,
+				Delay:           10 * time.Millisecond,
+				CC:              []string{"bbr", "cubic"},
+				ByteLimit:       100,
+				TargetRate:      2000,
+				MeasureInterval: 250 * time.Millisecond,
+				Metadata:        []model.NameValue{{Name: "foo", Value: "bar"}},
+				Raw: []model.NameValue{
+					{Name: "streams", Value: "3"},
+					{Name: "duration", Value: "1000"},
+					{Name: "cc", Value: "bbr,cubic"},
+					{Name: "delay", Value: "10"},
+					{Name: "bytes", Value: "100"},
+					{Name: "target_rate", Value: "2000"},
+					{Name: "measure_interval_ms", Value: "250"},
+				},
+			},
+		},
+		{
+			name:  "no duration limit",
+			query: "streams=1&duration=0&bytes=1000000",
+			want: &Options{
+				Streams:         1,
+				NoDurationLimit: true,
+				ByteLimit:       1000000,
+				Metadata:        []model.NameValue{},
+				Raw: []model.NameValue{
+					{Name: "streams", Value: "1"},
+					{Name: "duration", Value: "0"},
+					{Name: "bytes", Value: "1000000"},
+				},
+			},
+		},
+		{
+			name:  "counterflow disabled",
+			query: "streams=1&counterflow=false",
+			want: &Options{
+				Streams:       1,
+				NoCounterflow: true,
+				Metadata:      []model.NameValue{},
+				Raw: []model.NameValue{
+					{Name: "streams", Value: "1"},
+					{Name: "counterflow", Value: "false"},
+				},
+			},
+		},
+		{
+			name:       "invalid counterflow",
+			query:      "streams=1&counterflow=sometimes",
+			wantReason: "invalid-counterflow",
+		},
+		{
+			name:       "missing streams",
+			query:      "duration=1000",
+			wantReason: "missing-streams",
+		},
+		{
+			name:       "non-numeric streams",
+			query:      "streams=abc",
+			wantReason: "invalid-streams",
+		},
+		{
+			name:       "zero streams",
+			query:      "streams=0",
+			wantReason: "invalid-streams",
+		},
+		{
+			name:       "too many streams",
+			query:      "streams=10000",
+			wantReason: "invalid-streams",
+		},
+		{
+			name:       "invalid duration",
+			query:      "streams=2&duration=foo",
+			wantReason: "invalid-duration",
+		},
+		{
+			name:       "negative delay",
+			query:      "streams=2&delay=-1",
+			wantReason: "invalid-delay",
+		},
+		{
+			name:       "invalid byte limit",
+			query:      "streams=2&bytes=foo",
+			wantReason: "invalid-byte-limit",
+		},
+		{
+			name:       "negative target rate",
+			query:      "streams=2&target_rate=-1",
+			wantReason: "invalid-target-rate",
+		},
+		{
+			name:       "target rate over the maximum",
+			query:      "streams=2&target_rate=1000000000001",
+			wantReason: "invalid-target-rate",
+		},
+		{
+			name:       "invalid measure interval",
+			query:      "streams=2&measure_interval_ms=foo",
+			wantReason: "invalid-measure-interval",
+		},
+		{
+			name:       "metadata value too long",
+			query:      "streams=2&foo=" + strings.Repeat("a", MaxMetadataValueLength+1),
+			wantReason: ReasonMetadataValueTooLong,
+		},
+		{
+			name:       "metadata key too long",
+			query:      "streams=2&" + strings.Repeat("a", MaxMetadataKeyLength+1) + "=x",
+			wantReason: ReasonMetadataKeyTooLong,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := Parse(q)
+			if tt.wantReason != "" {
+				var optErr *Error
+				if !errors.As(err, &optErr) || optErr.Reason != tt.wantReason {
+					t.Fatalf("Parse() error = %v, want reason %s", err, tt.wantReason)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse() unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOptions_EncodeRoundTrip(t *testing.T) {
+	opts := &Options{
+		Streams:         4,
+		Duration:        2 * time.Second,
+		Delay:           50 * time.Millisecond,
+		CC:              []string{"bbr", "cubic"},
+		ByteLimit:       1000,
+		TargetRate:      1e6,
+		MeasureInterval: 100 * time.Millisecond,
+		NoCounterflow:   true,
+		Metadata:        []model.NameValue{{Name: "client_name", Value: "test"}},
+	}
+	q := url.Values{}
+	if err := opts.Encode(q); err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	got, err := Parse(q)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	got.Raw = nil
+	if !reflect.DeepEqual(got, opts) {
+		t.Errorf("round trip = %+v, want %+v", got, opts)
+	}
+
+	// Metadata cannot shadow a known option.
+	opts.Metadata = []model.NameValue{{Name: DurationParameterName, Value: "1"}}
+	if err := opts.Encode(url.Values{}); err == nil {
+		t.Errorf("Encode() did not fail with reserved metadata name")
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		v       string
+		want    time.Duration
+		wantErr bool
+	}{
+		{v: "5000", want: 5 * time.Second},
+		{v: "5s", want: 5 * time.Second},
+		{v: "1m30s", want: 90 * time.Second},
+		{v: "250ms", want: 250 * time.Millisecond},
+		{v: "0", want: 0},
+		{v: "-1", wantErr: true},
+		{v: "-5s", wantErr: true},
+		{v: "5", want: 5 * time.Millisecond},
+		{v: "five", wantErr: true},
+		{v: "99999999999999999", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseDuration(tt.v)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseDuration(%q) error = %v, wantErr %v", tt.v, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseDuration(%q) = %v, want %v", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestClampMeasureInterval(t *testing.T) {
+	if got := ClampMeasureInterval(time.Nanosecond); got != spec.MinRequestedMeasureInterval {
+		t.Errorf("ClampMeasureInterval() = %v, want %v", got, spec.MinRequestedMeasureInterval)
+	}
+	if got := ClampMeasureInterval(time.Hour); got != spec.MaxRequestedMeasureInterval {
+		t.Errorf("ClampMeasureInterval() = %v, want %v", got, spec.MaxRequestedMeasureInterval)
+	}
+}
+
+func TestMetadataPolicy_Parse(t *testing.T) {
+	q, err := url.ParseQuery("streams=1&client_name=test&client_os=linux&other=x")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy := MetadataPolicy{MaxKeyLength: 50, MaxValueLength: 5,
+		Allowed: []string{"client_name", "client_os"}}
+	metadata, dropped, err := policy.Parse(q)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if len(metadata) != 2 || !reflect.DeepEqual(dropped, []string{"other"}) {
+		t.Errorf("Parse() = %v, %v", metadata, dropped)
+	}
+
+	// The lengths are checked even for keys that are not allowed.
+	policy.MaxValueLength = 4
+	var optErr *Error
+	_, _, err = policy.Parse(q)
+	if !errors.As(err, &optErr) || optErr.Reason != ReasonMetadataValueTooLong {
+		t.Errorf("Parse() error = %v, want %s", err, ReasonMetadataValueTooLong)
+	}
+
+	policy = MetadataPolicy{MaxKeyLength: 50, MaxValueLength: 50, MaxCount: 2}
+	_, _, err = policy.Parse(q)
+	if !errors.As(err, &optErr) || optErr.Reason != ReasonTooManyMetadata {
+		t.Errorf("Parse() error = %v, want %s", err, ReasonTooManyMetadata)
+	}
+}
@@ -0,0 +1,228 @@
+// Package quota enforces daily test and byte quotas per access token subject.
+// Usage is kept in memory and, optionally, persisted to a small JSON file so
+// that quotas survive restarts.
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// FlushInterval is the recommended interval for Run.
+const FlushInterval = time.Minute
+
+// Names of the limits, as reported in ExceededError.
+const (
+	LimitTests = "tests"
+	LimitBytes = "bytes"
+)
+
+// ExceededError is returned by Store.Allow when a subject has exhausted one of
+// its daily quotas.
+type ExceededError struct {
+	// Subject is the access token subject that exceeded the quota.
+	Subject string `json:"subject"`
+	// Limit is the name of the exceeded limit (LimitTests or LimitBytes).
+	Limit string `json:"limit"`
+	// Max is the configured daily value of Limit.
+	Max int64 `json:"max"`
+	// Reset is when the subject's usage will be reset.
+	Reset time.Time `json:"reset"`
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("daily %s quota exceeded for subject %q (max %d)",
+		e.Limit, e.Subject, e.Max)
+}
+
+// Usage is a subject's usage during a single day.
+type Usage struct {
+	// Day is the UTC day this usage refers to, formatted as YYYY-MM-DD.
+	Day   string
+	Tests int64
+	Bytes int64
+}
+
+// Store tracks per-subject usage and enforces the configured daily limits.
+type Store struct {
+	// path is the file usage is persisted to. If empty, usage is only kept
+	// in memory.
+	path string
+
+	// maxTests and maxBytes are the daily limits. Zero means no limit.
+	maxTests int64
+	maxBytes int64
+
+	mu    sync.Mutex
+	usage map[string]*Usage
+	// dirty is true if usage changed since it was last persisted.
+	dirty bool
+
+	// saveMu serializes writes to path.
+	saveMu sync.Mutex
+}
+
+// NewStore returns a Store enforcing the provided daily limits. A zero limit
+// is not enforced. If path is not empty, usage is loaded from this file and
+// persisted to it by Flush.
+func NewStore(path string, maxTests, maxBytes int64) (*Store, error) {
+	s := &Store{
+		path:     path,
+		maxTests: maxTests,
+		maxBytes: maxBytes,
+		usage:    map[string]*Usage{},
+	}
+	if path == "" {
+		return s, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &s.usage); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// day returns the UTC day of t, in the format used by Usage.
+func day(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// nextReset returns when the usage for the day of t is reset.
+func nextReset(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+}
+
+// current returns the usage of subject for the day of now, resetting it if it
+// refers to a previous day. It must be called with s.mu held.
+func (s *Store) current(subject string, now time.Time) *Usage {
+	u, ok := s.usage[subject]
+	if !ok || u.Day != day(now) {
+		u = &Usage{Day: day(now)}
+		s.usage[subject] = u
+	}
+	return u
+}
+
+// Allow records a new test for subject and returns nil if the subject has
+// not exhausted its daily quotas. Otherwise, it returns an *ExceededError and
+// the test is not recorded.
+func (s *Store) Allow(subject string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.current(subject, now)
+	if s.maxTests > 0 && u.Tests >= s.maxTests {
+		return &ExceededError{Subject: subject, Limit: LimitTests,
+			Max: s.maxTests, Reset: nextReset(now)}
+	}
+	if s.maxBytes > 0 && u.Bytes >= s.maxBytes {
+		return &ExceededError{Subject: subject, Limit: LimitBytes,
+			Max: s.maxBytes, Reset: nextReset(now)}
+	}
+	u.Tests++
+	s.dirty = true
+	return nil
+}
+
+// AddBytes adds n transferred bytes to the usage of subject.
+func (s *Store) AddBytes(subject string, n int64, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.current(subject, now).Bytes += n
+	s.dirty = true
+}
+
+// Usage returns the usage of subject for the day of now.
+func (s *Store) Usage(subject string, now time.Time) Usage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.usage[subject]
+	if !ok || u.Day != day(now) {
+		return Usage{Day: day(now)}
+	}
+	return *u
+}
+
+// Flush drops the usage entries of days before now and, if a path is
+// configured and the usage changed since the last call, persists it.
+func (s *Store) Flush(now time.Time) error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	s.mu.Lock()
+	today := day(now)
+	for k, u := range s.usage {
+		if u.Day < today {
+			delete(s.usage, k)
+		}
+	}
+	if s.path == "" || !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(s.usage)
+	s.dirty = false
+	s.mu.Unlock()
+	if err == nil {
+		err = s.save(b)
+	}
+	if err != nil {
+		// Try again on the next call.
+		s.mu.Lock()
+		s.dirty = true
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// Run calls Flush every interval until ctx is done, and a last time before
+// returning.
+func (s *Store) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := s.Flush(time.Now()); err != nil {
+				log.Error("Failed to save quota usage", "path", s.path, "error", err)
+			}
+			return
+		case <-ticker.C:
+			if err := s.Flush(time.Now()); err != nil {
+				log.Warn("Failed to save quota usage", "path", s.path, "error", err)
+			}
+		}
+	}
+}
+
+// save writes b to s.path. It must be called with s.saveMu held.
+func (s *Store) save(b []byte) error {
+	// Write to a temporary file and rename it, so that the store is never
+	// left truncated.
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".quota-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,118 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStore_Allow(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	s, err := NewStore("", 2, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.Allow("a", now); err != nil {
+			t.Fatalf("Allow() unexpected error: %v", err)
+		}
+	}
+	var exceeded *ExceededError
+	err = s.Allow("a", now)
+	if !errors.As(err, &exceeded) || exceeded.Limit != LimitTests {
+		t.Fatalf("Allow() error = %v, want tests quota exceeded", err)
+	}
+	if !exceeded.Reset.Equal(time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("invalid reset time: %v", exceeded.Reset)
+	}
+	// Other subjects are not affected.
+	if err := s.Allow("b", now); err != nil {
+		t.Errorf("Allow() unexpected error: %v", err)
+	}
+	// The bytes quota is checked too.
+	s.AddBytes("b", 100, now)
+	err = s.Allow("b", now)
+	if !errors.As(err, &exceeded) || exceeded.Limit != LimitBytes {
+		t.Errorf("Allow() error = %v, want bytes quota exceeded", err)
+	}
+	// Usage is reset the next day.
+	if err := s.Allow("a", now.Add(24*time.Hour)); err != nil {
+		t.Errorf("Allow() unexpected error after reset: %v", err)
+	}
+}
+
+func TestStore_Persistence(t *testing.T) {
+	now := time.Now()
+	path := filepath.Join(t.TempDir(), "quota.json")
+	s, err := NewStore(path, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Allow("a", now); err != nil {
+		t.Fatal(err)
+	}
+	s.AddBytes("a", 42, now)
+
+	// Usage is only persisted by Flush.
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("usage persisted before Flush(): %v", err)
+	}
+	if err := s.Flush(now); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new store reads the persisted usage.
+	s, err = NewStore(path, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := s.Usage("a", now); u.Tests != 1 || u.Bytes != 42 {
+		t.Errorf("unexpected usage: %+v", u)
+	}
+	if err := s.Allow("a", now); err == nil {
+		t.Errorf("Allow() did not fail after restart")
+	}
+}
+
+func TestStore_Flush(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	s, err := NewStore("", 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Allow("a", now); err != nil {
+		t.Fatal(err)
+	}
+	// Entries from previous days expire even without a path.
+	if err := s.Flush(now.Add(24 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.usage) != 0 {
+		t.Errorf("expired usage not dropped: %+v", s.usage)
+	}
+}
+
+func TestStore_Run(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "quota.json")
+	s, err := NewStore(path, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Allow("a", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	// Usage is persisted when Run returns.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.Run(ctx, time.Hour)
+	s, err = NewStore(path, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := s.Usage("a", time.Now()); u.Tests != 1 {
+		t.Errorf("unexpected usage: %+v", u)
+	}
+}
@@ -0,0 +1,59 @@
+// Package random provides a fast, concurrency-safe source of random bytes for
+// payload generation.
+//
+// Bytes are copied from a shared pool generated once from crypto/rand, at
+// pseudo-random offsets. The output is NOT suitable for cryptographic use:
+// it is only meant to make payloads incompressible while keeping their
+// generation far cheaper than the network transfer itself.
+package random
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync/atomic"
+)
+
+// PoolSize is the size of the shared pool of random bytes.
+const PoolSize = 4 << 20
+
+var (
+	pool = newPool()
+
+	// state is the state of the splitmix64 generator used to pick offsets
+	// within pool.
+	state atomic.Uint64
+)
+
+func newPool() []byte {
+	p := make([]byte, PoolSize)
+	if _, err := rand.Read(p); err != nil {
+		panic("cannot read random bytes: " + err.Error())
+	}
+	state.Store(binary.LittleEndian.Uint64(p))
+	return p
+}
+
+// next returns the next value of a splitmix64 sequence. It is safe for
+// concurrent use.
+func next() uint64 {
+	z := state.Add(0x9e3779b97f4a7c15)
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// Fill fills b with random bytes. It is safe for concurrent use.
+func Fill(b []byte) {
+	for len(b) > 0 {
+		off := int(next() % PoolSize)
+		n := copy(b, pool[off:])
+		b = b[n:]
+	}
+}
+
+// Bytes returns a new slice of n random bytes.
+func Bytes(n int) []byte {
+	b := make([]byte, n)
+	Fill(b)
+	return b
+}
@@ -0,0 +1,36 @@
+package random_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/m-lab/msak/pkg/random"
+)
+
+func TestFill(t *testing.T) {
+	for _, size := range []int{0, 1, 1 << 10, random.PoolSize + 1} {
+		b := random.Bytes(size)
+		if len(b) != size {
+			t.Fatalf("Bytes(%d) returned %d bytes", size, len(b))
+		}
+		if size >= 1<<10 && bytes.Equal(b, make([]byte, size)) {
+			t.Errorf("Bytes(%d) returned only zeroes", size)
+		}
+	}
+	a, b := random.Bytes(1<<10), random.Bytes(1<<10)
+	if bytes.Equal(a, b) {
+		t.Errorf("consecutive calls returned the same bytes")
+	}
+}
+
+// BenchmarkFill measures the throughput of Fill with the maximum message
+// size. This must be much faster than the target link speed (10+ Gb/s).
+func BenchmarkFill(b *testing.B) {
+	b.SetBytes(1 << 20)
+	b.RunParallel(func(pb *testing.PB) {
+		buf := make([]byte, 1<<20)
+		for pb.Next() {
+			random.Fill(buf)
+		}
+	})
+}
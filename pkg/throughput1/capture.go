@@ -0,0 +1,32 @@
+package throughput1
+
+import (
+	"io"
+
+	"github.com/m-lab/msak/pkg/throughput1/capture"
+)
+
+// SetRecorder sets the Recorder every message sent or received is recorded
+// with. It must be called before starting the sender or receiver loops.
+// Pings received are answered by the WebSocket library and not recorded.
+func (p *Protocol) SetRecorder(r *capture.Recorder) {
+	p.recorder = r
+}
+
+// recordingReader is an io.Reader that counts the bytes read and, if keep
+// is true, keeps a copy of them.
+type recordingReader struct {
+	io.Reader
+	keep bool
+	n    int
+	data []byte
+}
+
+func (r *recordingReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	r.n += n
+	if r.keep {
+		r.data = append(r.data, b[:n]...)
+	}
+	return n, err
+}
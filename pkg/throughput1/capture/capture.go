@@ -0,0 +1,173 @@
+// Package capture records the sequence of WebSocket messages exchanged
+// during a throughput1 test, as seen by one side of the connection. The
+// recordings can be replayed against a third-party client or server with
+// Replay, and the messages it sent validated with Validate, to debug
+// interoperability between implementations.
+//
+// Only the sizes of binary messages are recorded, not their content.
+package capture
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/m-lab/msak/pkg/throughput1/spec"
+)
+
+// Role is the side of the connection a Recording was made from.
+type Role string
+
+const (
+	RoleClient = Role("client")
+	RoleServer = Role("server")
+)
+
+// Direction is the direction of a message, relative to the recording side.
+type Direction string
+
+const (
+	Sent     = Direction("sent")
+	Received = Direction("received")
+)
+
+// MessageType is the type of a WebSocket message.
+type MessageType string
+
+const (
+	Text   = MessageType("text")
+	Binary = MessageType("binary")
+	Close  = MessageType("close")
+	Ping   = MessageType("ping")
+	Pong   = MessageType("pong")
+)
+
+// messageTypes maps the gorilla/websocket message types to MessageTypes.
+var messageTypes = map[int]MessageType{
+	websocket.TextMessage:   Text,
+	websocket.BinaryMessage: Binary,
+	websocket.CloseMessage:  Close,
+	websocket.PingMessage:   Ping,
+	websocket.PongMessage:   Pong,
+}
+
+// Event is a single WebSocket message.
+type Event struct {
+	// Elapsed is the time since the start of the recording, in
+	// microseconds.
+	Elapsed   int64
+	Direction Direction
+	Type      MessageType
+	// Size is the size of the message's payload in bytes.
+	Size int
+	// Payload is the content of text messages.
+	Payload string `json:",omitempty"`
+	// CloseCode and CloseReason are the status code and reason of close
+	// messages.
+	CloseCode   int    `json:",omitempty"`
+	CloseReason string `json:",omitempty"`
+}
+
+// Recording is the sequence of messages exchanged during a test.
+type Recording struct {
+	// Role is the side of the connection the recording was made from.
+	Role Role
+	// Subtest is the subtest kind.
+	Subtest spec.SubtestKind
+	// Subprotocol is the negotiated WebSocket subprotocol.
+	Subprotocol string
+	// StartTime is when the recording started.
+	StartTime time.Time
+	// Events are the messages exchanged, in the order they were sent or
+	// received.
+	Events []Event
+}
+
+// ReadFile reads a Recording from the JSON file at path.
+func ReadFile(path string) (*Recording, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rec := &Recording{}
+	if err := json.Unmarshal(b, rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// WriteFile writes rec to the file at path as JSON.
+func (rec *Recording) WriteFile(path string) error {
+	b, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0644)
+}
+
+// Recorder records the messages sent and received on a connection. It is
+// safe for concurrent use. Recording on a nil Recorder does nothing.
+type Recorder struct {
+	mu    sync.Mutex
+	start time.Time
+	rec   Recording
+}
+
+// NewRecorder returns a Recorder for a connection seen from role, starting
+// now.
+func NewRecorder(role Role, subtest spec.SubtestKind, subprotocol string) *Recorder {
+	start := time.Now()
+	return &Recorder{
+		start: start,
+		rec: Recording{
+			Role:        role,
+			Subtest:     subtest,
+			Subprotocol: subprotocol,
+			StartTime:   start,
+		},
+	}
+}
+
+// Record records a message of the given gorilla/websocket type. size is the
+// size of the message's payload. payload is only read for text messages and
+// for close messages, where it must be the formatted close message.
+func (r *Recorder) Record(dir Direction, messageType int, size int, payload []byte) {
+	if r == nil {
+		return
+	}
+	e := Event{
+		Direction: dir,
+		Type:      messageTypes[messageType],
+		Size:      size,
+	}
+	switch messageType {
+	case websocket.TextMessage:
+		e.Payload = string(payload)
+	case websocket.CloseMessage:
+		e.CloseCode, e.CloseReason = parseClose(payload)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e.Elapsed = time.Since(r.start).Microseconds()
+	r.rec.Events = append(r.rec.Events, e)
+}
+
+// Recording returns a copy of the recording so far.
+func (r *Recorder) Recording() *Recording {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec := r.rec
+	rec.Events = append([]Event(nil), r.rec.Events...)
+	return &rec
+}
+
+// parseClose returns the status code and reason of a formatted close
+// message.
+func parseClose(payload []byte) (int, string) {
+	if len(payload) < 2 {
+		return websocket.CloseNoStatusReceived, ""
+	}
+	return int(payload[0])<<8 | int(payload[1]), string(payload[2:])
+}
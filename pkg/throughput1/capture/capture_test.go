@@ -0,0 +1,209 @@
+package capture_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/go/testingx"
+	"github.com/m-lab/msak/internal/netx"
+	"github.com/m-lab/msak/pkg/throughput1"
+	"github.com/m-lab/msak/pkg/throughput1/capture"
+	"github.com/m-lab/msak/pkg/throughput1/spec"
+)
+
+// startDownloadServer starts a server running 300ms throughput1 downloads.
+func startDownloadServer(t *testing.T) *url.URL {
+	tcpl, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	rtx.Must(err, "failed to create listener")
+	handler := func(rw http.ResponseWriter, req *http.Request) {
+		wsConn, err := throughput1.Upgrade(rw, req)
+		rtx.Must(err, "failed to upgrade to WS")
+		proto := throughput1.New(wsConn)
+		proto.SetMeasureInterval(50 * time.Millisecond)
+		ctx, cancel := context.WithTimeout(req.Context(), 300*time.Millisecond)
+		defer cancel()
+		_, _, errCh := proto.SenderLoop(ctx)
+		<-proto.SenderDone()
+		select {
+		case <-errCh:
+		case <-time.After(time.Second):
+		}
+	}
+	srv := &httptest.Server{
+		Listener: netx.NewListener(tcpl),
+		Config:   &http.Server{Handler: http.HandlerFunc(handler)},
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	rtx.Must(err, "cannot get server URL")
+	u.Scheme = "ws"
+	return u
+}
+
+func dial(t *testing.T, u *url.URL) *websocket.Conn {
+	headers := http.Header{}
+	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+	d := websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := net.Dial("tcp", u.Host)
+			if err != nil {
+				return nil, err
+			}
+			return netx.FromTCPLikeConn(conn.(*net.TCPConn))
+		},
+	}
+	conn, _, err := d.Dial(u.String(), headers)
+	rtx.Must(err, "cannot dial server")
+	return conn
+}
+
+func TestRecordReplayValidate(t *testing.T) {
+	u := startDownloadServer(t)
+
+	// Record a download from the client side.
+	conn := dial(t, u)
+	recorder := capture.NewRecorder(capture.RoleClient, spec.SubtestDownload,
+		conn.Subprotocol())
+	proto := throughput1.New(conn)
+	proto.SetRecorder(recorder)
+	proto.SetMeasureInterval(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, _, errCh := proto.ReceiverLoop(ctx)
+	select {
+	case <-errCh:
+	case <-ctx.Done():
+		t.Fatalf("download did not terminate")
+	}
+	<-proto.SenderDone()
+	ref := recorder.Recording()
+
+	var sent, received, binary int
+	for _, e := range ref.Events {
+		switch e.Direction {
+		case capture.Sent:
+			sent++
+		case capture.Received:
+			received++
+		}
+		if e.Type == capture.Binary {
+			binary++
+		}
+	}
+	if sent == 0 || received == 0 || binary == 0 {
+		t.Fatalf("incomplete recording: %d sent, %d received, %d binary",
+			sent, received, binary)
+	}
+
+	// The recording survives a round trip to disk.
+	path := filepath.Join(t.TempDir(), "recording.json")
+	testingx.Must(t, ref.WriteFile(path), "cannot write recording")
+	loaded, err := capture.ReadFile(path)
+	testingx.Must(t, err, "cannot read recording")
+	if !reflect.DeepEqual(loaded.Events, ref.Events) {
+		t.Errorf("recording changed after a round trip to disk")
+	}
+
+	// Replaying the client's messages against the same server gives a
+	// session compatible with the recorded one.
+	actual, err := capture.Replay(ctx, dial(t, u), loaded)
+	testingx.Must(t, err, "replay failed")
+	if errs := capture.Validate(loaded, actual); len(errs) != 0 {
+		t.Errorf("Validate() = %v", errs)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	measurement := func(elapsed int64, payload string) capture.Event {
+		return capture.Event{Elapsed: elapsed, Direction: capture.Received,
+			Type: capture.Text, Size: len(payload), Payload: payload}
+	}
+	ref := &capture.Recording{
+		Role:        capture.RoleClient,
+		Subprotocol: spec.SecWebSocketProtocol,
+		Events: []capture.Event{
+			measurement(0, `{"CC":"bbr","ElapsedTime":1}`),
+			{Direction: capture.Received, Type: capture.Binary, Size: 1024},
+			measurement(500000, `{"ElapsedTime":2}`),
+			{Direction: capture.Received, Type: capture.Close, CloseCode: 1000},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		events []capture.Event
+		want   []string
+	}{
+		{
+			name:   "compatible",
+			events: ref.Events,
+		},
+		{
+			name: "incompatible",
+			events: []capture.Event{
+				measurement(0, `{"Elapsed":1}`),
+				measurement(1000, `not json`),
+				{Direction: capture.Received, Type: capture.Binary,
+					Size: spec.MaxScaledMessageSize + 1},
+				{Direction: capture.Received, Type: capture.Close, CloseCode: 1011},
+			},
+			want: []string{
+				"not a JSON object",
+				"missing fields ElapsedTime",
+				"exceeds",
+				"close code: got 1011, want 1000",
+			},
+		},
+		{
+			name: "no measurements or binary messages",
+			events: []capture.Event{
+				{Direction: capture.Received, Type: capture.Close, CloseCode: 1000},
+			},
+			want: []string{
+				"no Measurement messages",
+				"no binary messages",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := &capture.Recording{
+				Role:        capture.RoleClient,
+				Subprotocol: spec.SecWebSocketProtocol,
+				Events:      tt.events,
+			}
+			errs := capture.Validate(ref, actual)
+			if len(errs) != len(tt.want) {
+				t.Fatalf("Validate() = %v, want %d errors", errs, len(tt.want))
+			}
+			for i, want := range tt.want {
+				if !strings.Contains(errs[i].Error(), want) {
+					t.Errorf("error %d = %v, want %q", i, errs[i], want)
+				}
+			}
+		})
+	}
+
+	// Measurements sent too often are detected.
+	var fast []capture.Event
+	for i := 0; i <= spec.MaxMeasurementMessageRate; i++ {
+		fast = append(fast, measurement(int64(i*1000), `{"ElapsedTime":1}`))
+	}
+	fast = append(fast, ref.Events[1], ref.Events[3])
+	errs := capture.Validate(ref, &capture.Recording{Role: capture.RoleClient,
+		Subprotocol: spec.SecWebSocketProtocol, Events: fast})
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "per second") {
+		t.Errorf("Validate() = %v, want a rate error", errs)
+	}
+}
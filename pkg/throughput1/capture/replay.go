@@ -0,0 +1,151 @@
+package capture
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// writeTimeout is the deadline for writing control messages.
+const writeTimeout = time.Second
+
+// Replay sends the messages sent in ref over conn, at the times they were
+// recorded, while recording every message received from the other party.
+// Binary messages are replayed with the recorded size and zeroed content.
+//
+// Replay returns the recording of the replayed session once the connection
+// has been closed, or ctx is done. conn must be connected to the other party
+// of ref's role, i.e. to a server if ref was recorded by a client.
+func Replay(ctx context.Context, conn *websocket.Conn, ref *Recording) (*Recording, error) {
+	r := NewRecorder(ref.Role, ref.Subtest, conn.Subprotocol())
+	conn.SetPingHandler(func(data string) error {
+		r.Record(Received, websocket.PingMessage, len(data), nil)
+		err := conn.WriteControl(websocket.PongMessage, []byte(data),
+			time.Now().Add(writeTimeout))
+		if err == nil {
+			r.Record(Sent, websocket.PongMessage, len(data), nil)
+		}
+		return err
+	})
+	conn.SetPongHandler(func(data string) error {
+		r.Record(Received, websocket.PongMessage, len(data), nil)
+		return nil
+	})
+
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		receive(conn, r)
+	}()
+
+	var buf []byte
+	for _, e := range ref.Events {
+		if e.Direction != Sent || e.Type == Pong {
+			// Pongs are sent in reply to the other party's pings.
+			continue
+		}
+		wait := time.Until(r.start.Add(time.Duration(e.Elapsed) * time.Microsecond))
+		if wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+			case <-readDone:
+			}
+			t.Stop()
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-readDone:
+			// The other party closed the connection.
+			return r.Recording(), nil
+		default:
+		}
+		if e.Size > len(buf) {
+			buf = make([]byte, e.Size)
+		}
+		err := send(conn, r, e, buf[:e.Size])
+		if err != nil {
+			conn.Close()
+			<-readDone
+			return r.Recording(), err
+		}
+	}
+
+	select {
+	case <-readDone:
+	case <-ctx.Done():
+		conn.Close()
+		<-readDone
+	}
+	return r.Recording(), nil
+}
+
+// send sends the message described by e over conn and records it. Binary
+// and ping messages are sent with the content of buf.
+func send(conn *websocket.Conn, r *Recorder, e Event, buf []byte) error {
+	var (
+		kind    int
+		payload []byte
+	)
+	switch e.Type {
+	case Text:
+		kind, payload = websocket.TextMessage, []byte(e.Payload)
+	case Binary:
+		kind, payload = websocket.BinaryMessage, buf
+	case Ping:
+		kind, payload = websocket.PingMessage, buf
+	case Close:
+		kind, payload = websocket.CloseMessage,
+			websocket.FormatCloseMessage(e.CloseCode, e.CloseReason)
+	default:
+		return errors.New("unknown message type: " + string(e.Type))
+	}
+
+	var err error
+	if kind == websocket.TextMessage || kind == websocket.BinaryMessage {
+		err = conn.WriteMessage(kind, payload)
+	} else {
+		err = conn.WriteControl(kind, payload, time.Now().Add(writeTimeout))
+	}
+	if err != nil {
+		return err
+	}
+	r.Record(Sent, kind, len(payload), payload)
+	return nil
+}
+
+// receive reads and records messages from conn until reading fails. A close
+// message from the other party is recorded before returning.
+func receive(conn *websocket.Conn, r *Recorder) {
+	for {
+		kind, reader, err := conn.NextReader()
+		if err != nil {
+			var ce *websocket.CloseError
+			if errors.As(err, &ce) {
+				msg := websocket.FormatCloseMessage(ce.Code, ce.Text)
+				r.Record(Received, websocket.CloseMessage, len(msg), msg)
+			}
+			return
+		}
+		var (
+			size    int64
+			payload []byte
+		)
+		if kind == websocket.TextMessage {
+			payload, err = io.ReadAll(reader)
+			size = int64(len(payload))
+		} else {
+			size, err = io.Copy(io.Discard, reader)
+		}
+		if err != nil {
+			return
+		}
+		r.Record(Received, kind, int(size), payload)
+	}
+}
@@ -0,0 +1,167 @@
+package capture
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/m-lab/msak/pkg/throughput1/spec"
+)
+
+// Validate checks the messages the other party sent in actual against the
+// ones it sent in ref, and returns the problems found. ref and actual must
+// be recorded from the same side of the connection, typically with actual
+// being the result of replaying ref with Replay.
+//
+// Timings and binary message contents are not compared, since they depend
+// on the network. Instead, Validate checks that:
+//   - the same subprotocol was negotiated;
+//   - every Measurement message is a JSON object with at least the fields
+//     present in all the Measurement messages in ref;
+//   - Measurement messages are sent at most at spec.MaxMeasurementMessageRate;
+//   - binary messages are sent if and only if they were sent in ref, and are
+//     not larger than spec.MaxScaledMessageSize;
+//   - the connection is closed with the same status code as in ref.
+func Validate(ref, actual *Recording) []error {
+	var errs []error
+	if ref.Role != actual.Role {
+		return []error{fmt.Errorf("recordings made by different roles: %s and %s",
+			ref.Role, actual.Role)}
+	}
+	if ref.Subprotocol != actual.Subprotocol {
+		errs = append(errs, fmt.Errorf("subprotocol: got %q, want %q",
+			actual.Subprotocol, ref.Subprotocol))
+	}
+
+	want := summarize(ref)
+	got := summarize(actual)
+	for _, i := range got.invalid {
+		errs = append(errs, fmt.Errorf("event %d: text message is not a JSON object: %q",
+			i, actual.Events[i].Payload))
+	}
+	if len(want.measurements) > 0 && len(got.measurements) == 0 {
+		errs = append(errs, fmt.Errorf("no Measurement messages received, want %d",
+			len(want.measurements)))
+	}
+	required := want.requiredFields()
+	for _, m := range got.measurements {
+		var missing []string
+		for f := range required {
+			if _, ok := m.fields[f]; !ok {
+				missing = append(missing, f)
+			}
+		}
+		if len(missing) > 0 {
+			sort.Strings(missing)
+			errs = append(errs, fmt.Errorf("event %d: Measurement message missing fields %s",
+				m.index, strings.Join(missing, ", ")))
+		}
+	}
+	if i, ok := got.rateExceeded(); ok {
+		errs = append(errs, fmt.Errorf("event %d: more than %d Measurement messages per second",
+			i, spec.MaxMeasurementMessageRate))
+	}
+
+	switch {
+	case want.binary > 0 && got.binary == 0:
+		errs = append(errs, fmt.Errorf("no binary messages received, want %d", want.binary))
+	case want.binary == 0 && got.binary > 0:
+		errs = append(errs, fmt.Errorf("%d unexpected binary messages received", got.binary))
+	}
+	for _, i := range got.oversized {
+		errs = append(errs, fmt.Errorf("event %d: binary message of %d bytes exceeds %d",
+			i, actual.Events[i].Size, spec.MaxScaledMessageSize))
+	}
+
+	if want.closeCode != got.closeCode {
+		errs = append(errs, fmt.Errorf("close code: got %d, want %d",
+			got.closeCode, want.closeCode))
+	}
+	return errs
+}
+
+// measurement is a Measurement message received from the other party.
+type measurement struct {
+	index   int
+	elapsed time.Duration
+	fields  map[string]json.RawMessage
+}
+
+// summary describes the messages received from the other party.
+type summary struct {
+	measurements []measurement
+	// invalid and oversized are the indices of the text messages that are
+	// not JSON objects and of the binary messages that are too large.
+	invalid   []int
+	oversized []int
+	binary    int
+	// closeCode is the status code of the close message received, or zero.
+	closeCode int
+}
+
+// summarize returns the summary of the messages received in rec.
+func summarize(rec *Recording) *summary {
+	s := &summary{}
+	for i, e := range rec.Events {
+		if e.Direction != Received {
+			continue
+		}
+		switch e.Type {
+		case Text:
+			if strings.HasPrefix(e.Payload, spec.ControlMessagePrefix) {
+				continue
+			}
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal([]byte(e.Payload), &fields); err != nil {
+				s.invalid = append(s.invalid, i)
+				continue
+			}
+			s.measurements = append(s.measurements, measurement{
+				index:   i,
+				elapsed: time.Duration(e.Elapsed) * time.Microsecond,
+				fields:  fields,
+			})
+		case Binary:
+			s.binary++
+			if e.Size > spec.MaxScaledMessageSize {
+				s.oversized = append(s.oversized, i)
+			}
+		case Close:
+			s.closeCode = e.CloseCode
+		}
+	}
+	return s
+}
+
+// requiredFields returns the fields present in every Measurement message.
+func (s *summary) requiredFields() map[string]struct{} {
+	required := map[string]struct{}{}
+	for i, m := range s.measurements {
+		for f := range m.fields {
+			if i == 0 {
+				required[f] = struct{}{}
+			}
+		}
+		for f := range required {
+			if _, ok := m.fields[f]; !ok {
+				delete(required, f)
+			}
+		}
+	}
+	return required
+}
+
+// rateExceeded returns the index of the first Measurement message that makes
+// more than spec.MaxMeasurementMessageRate messages received within one
+// second.
+func (s *summary) rateExceeded() (int, bool) {
+	for i := spec.MaxMeasurementMessageRate; i < len(s.measurements); i++ {
+		first := s.measurements[i-spec.MaxMeasurementMessageRate]
+		if s.measurements[i].elapsed-first.elapsed < time.Second {
+			return s.measurements[i].index, true
+		}
+	}
+	return 0, false
+}
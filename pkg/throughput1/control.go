@@ -0,0 +1,98 @@
+package throughput1
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/gorilla/websocket"
+	"github.com/m-lab/msak/pkg/throughput1/capture"
+	"github.com/m-lab/msak/pkg/throughput1/model"
+	"github.com/m-lab/msak/pkg/throughput1/spec"
+)
+
+// controlQueueSize is the number of control messages that can be queued for
+// sending or buffered for the caller before new ones are discarded.
+const controlQueueSize = 8
+
+// ErrControlQueueFull is returned by SendControl when too many control
+// messages are waiting to be sent.
+var ErrControlQueueFull = errors.New("control message queue full")
+
+// SendControl queues a control message to be sent to the other party by the
+// sending goroutine. It does not block, and returns ErrControlQueueFull if
+// the message cannot be queued.
+func (p *Protocol) SendControl(msg model.ControlMessage) error {
+	select {
+	case p.controlOut <- msg:
+		return nil
+	default:
+		return ErrControlQueueFull
+	}
+}
+
+// SetAcceptControlUpdates sets whether ControlUpdate messages received from
+// the other party are applied. Only clients should accept them: the server's
+// parameters are validated against the client's options, and must not be
+// changed by the client. Updates are not applied by default. It must be
+// called before starting the sender or receiver loop.
+func (p *Protocol) SetAcceptControlUpdates(accept bool) {
+	p.acceptControlUpdates = accept
+}
+
+// Control returns a channel where control messages received from the other
+// party are published. ControlUpdate messages are applied by the Protocol
+// before being published, if accepted with SetAcceptControlUpdates. Messages
+// are discarded if the channel's buffer is full, so reading from it is
+// optional.
+func (p *Protocol) Control() <-chan model.ControlMessage {
+	return p.controlIn
+}
+
+// writeControlMessage sends a control message to the other party. It must
+// only be called by the sending goroutine.
+func (p *Protocol) writeControlMessage(msg model.ControlMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	data = append([]byte(spec.ControlMessagePrefix), data...)
+	if err := p.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		return err
+	}
+	p.recorder.Record(capture.Sent, websocket.TextMessage, len(data), data)
+	p.applicationBytesSent.Add(int64(len(data)))
+	return nil
+}
+
+// flushControl sends the queued control messages without waiting for new
+// ones. Errors are ignored. It must only be called by the sending goroutine.
+func (p *Protocol) flushControl() {
+	for {
+		select {
+		case msg := <-p.controlOut:
+			if p.writeControlMessage(msg) != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// handleControlMessage parses a control message, without its prefix, applies
+// it and publishes it on the Control channel.
+func (p *Protocol) handleControlMessage(data []byte) error {
+	var msg model.ControlMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return err
+	}
+	if p.acceptControlUpdates && msg.Action == model.ControlUpdate &&
+		msg.TargetRate > 0 {
+		p.targetRate.Store(msg.TargetRate)
+	}
+	select {
+	case p.controlIn <- msg:
+	default:
+	}
+	return nil
+}
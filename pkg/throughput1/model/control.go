@@ -0,0 +1,30 @@
+package model
+
+// ControlAction is the action requested by a ControlMessage.
+type ControlAction string
+
+const (
+	// ControlAbort asks the other party to stop the test immediately.
+	ControlAbort = ControlAction("abort")
+	// ControlUpdate asks the other party to apply the parameters included
+	// in the ControlMessage for the rest of the test.
+	ControlUpdate = ControlAction("update")
+)
+
+// AbortReasonServerDrained is the Reason of the ControlAbort message sent when
+// the server stops a test because it is shutting down. The server archives
+// such tests with ServerDrained set.
+const AbortReasonServerDrained = "server-drained"
+
+// ControlMessage is a message sent by the server to instruct the client to
+// stop early or to change its behavior during a test. It is sent as a text
+// message prefixed by spec.ControlMessagePrefix.
+type ControlMessage struct {
+	// Action is the requested action.
+	Action ControlAction
+	// Reason is an optional human-readable explanation.
+	Reason string `json:",omitempty"`
+	// TargetRate is the new target sending rate in bits per second, for
+	// ControlUpdate messages. Zero leaves the current rate unchanged.
+	TargetRate int64 `json:",omitempty"`
+}
@@ -31,8 +31,22 @@ type Measurement struct {
 
 	// ElapsedTime is the time elapsed since the start of the measurement
 	// according to the party sending this Measurement.
+	//
+	// Deprecated: use ElapsedSinceTestStart, which has the same value and
+	// unambiguous semantics.
 	ElapsedTime int64 `json:",omitempty"`
 
+	// ElapsedSinceTestStart is the time elapsed, in microseconds, since the
+	// party sending this Measurement started its sender or receiver loop,
+	// i.e. since the start of data transfer on this stream.
+	ElapsedSinceTestStart int64 `json:",omitempty"`
+
+	// ElapsedSinceAccept is the time elapsed, in microseconds, since the
+	// TCP connection was accepted (on the server) or established (on the
+	// client). It includes the WebSocket handshake and any stream delay,
+	// and is the reference for TCPInfo's counters.
+	ElapsedSinceAccept int64 `json:",omitempty"`
+
 	// BBRInfo is an optional struct containing BBR metrics. Only applicable
 	// when the congestion control algorithm used by the party sending this
 	// Measurement is BBR.
@@ -42,6 +56,16 @@ type Measurement struct {
 	// metrics for this TCP stream. Only applicable when the party sending this
 	// Measurement has access to it.
 	TCPInfo *TCPInfo `json:",omitempty"`
+
+	// PingRTTs contains the RTT samples, in microseconds, of WebSocket
+	// ping/pong exchanges completed since the previous Measurement. Unlike
+	// TCPInfo, these are available regardless of the platform.
+	PingRTTs []int64 `json:",omitempty"`
+
+	// ECN is an optional struct containing the ECN state of this TCP stream.
+	// Only applicable when the party sending this Measurement has access to
+	// TCP_INFO.
+	ECN *ECN `json:",omitempty"`
 }
 
 type ByteCounters struct {
@@ -52,6 +76,17 @@ type ByteCounters struct {
 	BytesReceived int64 `json:",omitempty"`
 }
 
+// ECN contains the ECN state of a TCP stream.
+type ECN struct {
+	// Negotiated is true if ECN was negotiated during the TCP handshake.
+	Negotiated bool
+	// Seen is true if at least one ECT packet has been received.
+	Seen bool
+	// DeliveredCE is the number of packets delivered with CE marks, as
+	// reported by TCP_INFO's tcpi_delivered_ce.
+	DeliveredCE uint32
+}
+
 // TCPInfo is an extension to Linux's TCPInfo struct that includes the time
 // elapsed since the connection was accepted.
 type TCPInfo struct {
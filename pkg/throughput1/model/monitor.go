@@ -0,0 +1,22 @@
+package model
+
+// Origins of a MonitorEvent's measurement.
+const (
+	MonitorOriginServer = "server"
+	MonitorOriginClient = "client"
+)
+
+// MonitorEvent is the data of a server-sent event streamed by the monitor
+// endpoint for every measurement of an ongoing test.
+type MonitorEvent struct {
+	// UUID is the unique identifier of the TCP stream this measurement
+	// belongs to.
+	UUID string
+	// Direction is the direction of the test (download or upload).
+	Direction string
+	// Origin is the party that took this measurement (MonitorOriginServer or
+	// MonitorOriginClient).
+	Origin string
+	// Measurement is the measurement as sent on the wire.
+	Measurement WireMeasurement
+}
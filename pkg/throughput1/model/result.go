@@ -2,6 +2,8 @@ package model
 
 import (
 	"time"
+
+	"github.com/m-lab/msak/pkg/version"
 )
 
 // Throughput1Result is the struct that is serialized as JSON to disk as the archival
@@ -11,20 +13,70 @@ type Throughput1Result struct {
 	GitShortCommit string
 	// Version is the symbolic version (if any) of the running server code.
 	Version string
+	// Build describes the running server binary, including its full Git
+	// commit, build date and Go version. GitShortCommit and Version are
+	// copies of the corresponding fields.
+	Build version.Info
 	// Direction is the test direction (download or upload).
 	Direction string
 	// MeasurementID is the unique identifier for multiple TCP streams belonging
 	// to the same measurement.
 	MeasurementID string
+	// MIDSource indicates how MeasurementID was obtained. It is empty if the
+	// client provided the measurement ID (via querystring or access token) and
+	// MIDSourceServerGenerated if the server generated it.
+	MIDSource string `json:",omitempty"`
+	// AccessToken describes the access token this stream was authorized
+	// with. It is only set if access tokens are verified.
+	AccessToken *AccessToken `json:",omitempty"`
 	// UUID is the unique identifier for this TCP stream.
 	UUID string
+	// StreamIndex is the order in which this stream connected among the
+	// streams sharing its MeasurementID, starting from zero.
+	StreamIndex int
+	// TotalStreams is the number of streams the client declared for this
+	// measurement.
+	TotalStreams int
+	// MeasurementStartTime is when the server accepted the first stream
+	// sharing this stream's MeasurementID. It is the same for all the
+	// streams of a measurement.
+	MeasurementStartTime time.Time
 	// Server is the server's TCP endpoint (ip:port).
 	Server string
+	// AdvertisedServer is the host name or IP address the server is publicly
+	// reachable at, if configured. On multi-homed machines or behind NAT it
+	// can differ from the address in Server.
+	AdvertisedServer string `json:",omitempty"`
 	// Client is the client's TCP endpoint (ip:port).
 	Client string
+	// AddressFamily is the IP family of the connection, "ipv4" or "ipv6".
+	// IPv4 clients of dual-stack listeners are reported as "ipv4".
+	AddressFamily string `json:",omitempty"`
 	// CCAlgorithm is the Congestion control algorithm used by the sender in
 	// this stream.
 	CCAlgorithm string
+	// RequestedCC is the congestion control algorithm requested by the
+	// client for this stream, if any. When the client requests a list of
+	// algorithms, this is the one assigned to this stream.
+	RequestedCC string `json:",omitempty"`
+	// ActualCC is the congestion control algorithm of the server's socket,
+	// read right after attempting to set RequestedCC. It differs from
+	// RequestedCC if setting it failed.
+	ActualCC string `json:",omitempty"`
+	// SendBuffer and ReceiveBuffer are the effective sizes in bytes of the
+	// server socket's send and receive buffers (SO_SNDBUF and SO_RCVBUF),
+	// read at the start of the stream.
+	SendBuffer    int `json:",omitempty"`
+	ReceiveBuffer int `json:",omitempty"`
+	// Qdisc is the root queueing discipline of the serving interface, e.g.
+	// "fq" or "mq/fq" for a multiqueue device using fq on every queue, or
+	// the server's default one if it cannot be read. FQPacing is true if it
+	// is fq, which provides the packet pacing BBR is designed to run with.
+	Qdisc    string `json:",omitempty"`
+	FQPacing bool
+	// NotSentLowat is the TCP_NOTSENT_LOWAT value set on the server socket,
+	// in bytes. It is only set for download streams, if configured.
+	NotSentLowat int `json:",omitempty"`
 	// StartTime is the time when the stream started. It does not include the
 	// connection setup time.
 	StartTime time.Time
@@ -35,6 +87,11 @@ type Throughput1Result struct {
 	ServerMeasurements []Measurement
 	// ClientMeasurements is a list of measurements taken by the client.
 	ClientMeasurements []Measurement
+	// DownsamplingFactor is set if only one every DownsamplingFactor
+	// measurements was archived in ServerMeasurements and
+	// ClientMeasurements, plus the first, last and those with the lowest and
+	// highest RTT. Zero means every measurement was archived.
+	DownsamplingFactor int `json:",omitempty"`
 
 	// ClientOptions is a name/value pair containing the standard querystring
 	// parameters sent by the client and recognized by the server as options.
@@ -43,8 +100,209 @@ type Throughput1Result struct {
 	// ClientMetadata is a name/value pair containing every non-standard
 	// querystring parameter sent by the client.
 	ClientMetadata []NameValue
+
+	// Parameters are the effective protocol parameters used by the server
+	// for this stream.
+	Parameters *ProtocolParameters `json:",omitempty"`
+
+	// Compression is true if permessage-deflate WebSocket compression was
+	// negotiated on this stream. If true, application-level byte counters
+	// are not representative of the network-level throughput.
+	Compression bool `json:",omitempty"`
+
+	// DroppedClientMeasurements is the number of Measurement messages sent
+	// by the client that the server dropped without parsing because they
+	// exceeded the maximum allowed message rate.
+	DroppedClientMeasurements int64 `json:",omitempty"`
+
+	// DroppedServerMeasurements is the number of Measurement messages sent
+	// by the server that are missing from ServerMeasurements because the
+	// server could not keep up with archiving them.
+	DroppedServerMeasurements int64 `json:",omitempty"`
+
+	// ClientAborted is true if the client aborted the test before its end by
+	// closing the connection with spec.CloseCodeAborted.
+	ClientAborted bool `json:",omitempty"`
+
+	// ServerDrained is true if the server stopped the test before its end
+	// because it was shutting down, after sending a ControlAbort message.
+	ServerDrained bool `json:",omitempty"`
+
+	// StreamSkew describes the skew between the streams sharing this
+	// MeasurementID, as observed by the server when this stream ended.
+	StreamSkew *StreamSkew `json:",omitempty"`
+
+	// ECN is the ECN state of this TCP stream according to the last server
+	// measurement including it. It is only set if the server has access to
+	// TCP_INFO.
+	ECN *ECN `json:",omitempty"`
+
+	// Events are the congestion control events detected from the sender's
+	// successive TCPInfo snapshots, in chronological order.
+	Events []Event `json:",omitempty"`
+
+	// HostStats are the drops and errors counted by the server's network
+	// interface and root qdisc while this stream was running. They are
+	// shared by every connection using the interface. Only set if host
+	// statistics are enabled on the server.
+	HostStats *HostStats `json:",omitempty"`
+
+	// ConcurrentTests describes the other throughput1 tests the server was
+	// running during this stream's lifetime. Their traffic competes with this
+	// stream's on the server's interface. Tests are identified by their mid,
+	// so the other streams of the same measurement are not counted.
+	ConcurrentTests *ConcurrentTests `json:",omitempty"`
+
+	// ValidationFlags lists the sanity checks this result failed, if any.
+	// Possible values are the Validation* constants. Results with a non-empty
+	// ValidationFlags should not be trusted.
+	ValidationFlags []string `json:",omitempty"`
+}
+
+// AccessToken holds the claims of the access token a stream was authorized
+// with, so changes in the access policy can be correlated with changes in
+// the data.
+type AccessToken struct {
+	// Issuer is the token's issuer.
+	Issuer string
+	// Audience lists the token's intended recipients.
+	Audience []string `json:",omitempty"`
+	// Expiry is the token's expiration time.
+	Expiry time.Time
+	// Machine is the machine name the server verified the token's audience
+	// against, if configured.
+	Machine string `json:",omitempty"`
+	// DurationClamped is true if the stream's duration was shortened so
+	// that the stream ends when the token expires.
+	DurationClamped bool `json:",omitempty"`
+}
+
+// ProtocolParameters are the effective throughput1 protocol parameters used
+// for a stream. Recording them keeps results interpretable when the defaults
+// change across server versions. All durations are in microseconds.
+type ProtocolParameters struct {
+	// MinMeasureInterval is the minimum interval between measurements.
+	MinMeasureInterval int64
+	// AvgMeasureInterval is the average interval between measurements.
+	AvgMeasureInterval int64
+	// MaxMeasureInterval is the maximum interval between measurements.
+	MaxMeasureInterval int64
+	// MinMessageSize is the initial size of binary messages.
+	MinMessageSize int
+	// MaxMessageSize is the maximum size of binary messages.
+	MaxMessageSize int
+	// ScalingFraction is the fraction of the bytes sent so far used as the
+	// threshold for scaling binary messages.
+	ScalingFraction int
+	// MaxRuntime is the maximum runtime of a stream.
+	MaxRuntime int64
+	// Duration is the duration of the stream.
+	Duration int64 `json:",omitempty"`
+	// DefaultDuration is the duration used by the server when the client
+	// does not request one.
+	DefaultDuration int64 `json:",omitempty"`
+	// ByteLimit is the number of bytes after which the stream ends, if any.
+	ByteLimit int `json:",omitempty"`
+	// TargetRate is the sending rate in bits per second, if any.
+	TargetRate int64 `json:",omitempty"`
+	// NoCounterflow is true if no measurements but the final one were sent
+	// to the client during an upload.
+	NoCounterflow bool `json:",omitempty"`
 }
 
+// Event is a congestion control event detected from successive TCPInfo
+// snapshots. It helps explaining dips in the sending rate.
+type Event struct {
+	// Type is the event type. Possible values are the Event* constants.
+	Type string
+	// ElapsedTime is the TCPInfo elapsed time, in microseconds, of the first
+	// snapshot where the event was observed.
+	ElapsedTime int64
+}
+
+// Event types that can be reported in Throughput1Result.Events.
+const (
+	// EventSlowStartRestart means the congestion window was reset to the
+	// initial window without any loss, as happens after an idle period.
+	EventSlowStartRestart = "slow-start-restart"
+	// EventProbeRTT means BBR reduced its congestion window to probe for
+	// the minimum RTT.
+	EventProbeRTT = "probe-rtt"
+)
+
+// StreamSkew describes how much the start and end of the streams belonging
+// to the same measurement were spread apart. Heavily skewed streams make
+// aggregate rates computed over all streams unreliable.
+type StreamSkew struct {
+	// Streams is the number of streams with the same MeasurementID that
+	// started transmitting data so far.
+	Streams int
+	// StartSpread is the time between the first and the last stream start,
+	// in microseconds.
+	StartSpread int64
+	// EndSpread is the time between the first and the last stream end, in
+	// microseconds.
+	EndSpread int64
+	// Complete is true if this was the last running stream for this
+	// MeasurementID, i.e. the values above are final.
+	Complete bool
+}
+
+// ConcurrentTests describes the number of other tests, i.e. distinct mids,
+// running on the server while a stream was running.
+type ConcurrentTests struct {
+	// Max is the largest number of other tests running at the same time.
+	Max int
+	// Mean is the time-weighted mean number of other tests running.
+	Mean float64
+}
+
+// HostStats are host-level counters for the network interface serving a
+// stream, accumulated between the start and the end of the stream.
+type HostStats struct {
+	// Interface is the name of the network interface.
+	Interface string
+	// RxDropped, TxDropped, RxErrors and TxErrors are the interface's
+	// packet drop and error counters.
+	RxDropped int64
+	TxDropped int64
+	RxErrors  int64
+	TxErrors  int64
+	// QdiscDrops is the number of packets dropped by the interface's root
+	// qdisc. QdiscBacklog is the number of bytes queued in the root qdisc
+	// when the stream ended.
+	QdiscDrops   int64
+	QdiscBacklog int64
+}
+
+// Drops returns the total number of packets dropped or errored on the host.
+func (s *HostStats) Drops() int64 {
+	return s.RxDropped + s.TxDropped + s.RxErrors + s.TxErrors + s.QdiscDrops
+}
+
+// Sanity checks that can be reported in Throughput1Result.ValidationFlags.
+const (
+	// ValidationNoMeasurements means the server did not take any measurement.
+	ValidationNoMeasurements = "no-measurements"
+	// ValidationNegativeElapsedTime means the result contains negative
+	// elapsed times or an EndTime preceding StartTime.
+	ValidationNegativeElapsedTime = "negative-elapsed-time"
+	// ValidationInconsistentByteCounters means byte counters decrease over
+	// time or are inconsistent with each other or with TCPInfo.
+	ValidationInconsistentByteCounters = "inconsistent-byte-counters"
+	// ValidationTruncated means the test terminated with an error or lasted
+	// less than half of the requested duration.
+	ValidationTruncated = "truncated"
+	// ValidationHostDrops means the server's network interface or qdisc
+	// dropped packets or reported errors while the test was running, so the
+	// result may not reflect the network path.
+	ValidationHostDrops = "host-drops"
+)
+
+// MIDSourceServerGenerated is the MIDSource of measurement IDs generated by
+// the server because the client did not provide one.
+const MIDSourceServerGenerated = "server-generated"
+
 // TestDirection indicates the direction of the test.
 type TestDirection string
 
@@ -0,0 +1,101 @@
+package throughput1
+
+import (
+	"encoding/json"
+
+	"github.com/m-lab/msak/pkg/throughput1/model"
+	"github.com/m-lab/msak/pkg/throughput1/spec"
+	"github.com/m-lab/tcp-info/inetdiag"
+)
+
+// ndt7Measurement is a Measurement message in the ndt7 format.
+type ndt7Measurement struct {
+	AppInfo        *ndt7AppInfo        `json:",omitempty"`
+	ConnectionInfo *ndt7ConnectionInfo `json:",omitempty"`
+	BBRInfo        *ndt7BBRInfo        `json:",omitempty"`
+	Origin         string              `json:",omitempty"`
+	Test           string              `json:",omitempty"`
+	TCPInfo        *model.TCPInfo      `json:",omitempty"`
+}
+
+// ndt7AppInfo contains the application-level counters of an ndt7
+// measurement. NumBytes is the number of bytes sent by the sender or
+// received by the receiver, and ElapsedTime is in microseconds.
+type ndt7AppInfo struct {
+	NumBytes    int64
+	ElapsedTime int64
+}
+
+// ndt7ConnectionInfo describes the connection. It is only sent once.
+type ndt7ConnectionInfo struct {
+	Client string
+	Server string
+	UUID   string `json:",omitempty"`
+}
+
+// ndt7BBRInfo is BBRInfo with the time it was read, in microseconds.
+type ndt7BBRInfo struct {
+	inetdiag.BBRInfo
+	ElapsedTime int64
+}
+
+// toNDT7 converts a WireMeasurement sent by the server during the ndt7
+// subtest test to the ndt7 format.
+func toNDT7(wm model.WireMeasurement, test string) *ndt7Measurement {
+	elapsed := wm.ElapsedSinceTestStart
+	if elapsed == 0 {
+		elapsed = wm.ElapsedTime
+	}
+	m := &ndt7Measurement{
+		AppInfo: &ndt7AppInfo{
+			NumBytes:    wm.Application.BytesSent,
+			ElapsedTime: elapsed,
+		},
+		Origin:  "server",
+		Test:    test,
+		TCPInfo: wm.TCPInfo,
+	}
+	if test == string(spec.SubtestUpload) {
+		m.AppInfo.NumBytes = wm.Application.BytesReceived
+	}
+	if wm.UUID != "" {
+		m.ConnectionInfo = &ndt7ConnectionInfo{
+			Client: wm.RemoteAddr,
+			Server: wm.LocalAddr,
+			UUID:   wm.UUID,
+		}
+	}
+	if wm.BBRInfo != nil {
+		m.BBRInfo = &ndt7BBRInfo{BBRInfo: *wm.BBRInfo}
+		if wm.TCPInfo != nil {
+			m.BBRInfo.ElapsedTime = wm.TCPInfo.ElapsedTime
+		}
+	}
+	return m
+}
+
+// fromNDT7 parses an ndt7 Measurement message sent by the client during the
+// ndt7 subtest test and converts it to a WireMeasurement.
+func fromNDT7(data []byte, test string) (*model.WireMeasurement, error) {
+	var m ndt7Measurement
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	wm := &model.WireMeasurement{}
+	if m.AppInfo != nil {
+		wm.ElapsedTime = m.AppInfo.ElapsedTime
+		wm.ElapsedSinceTestStart = m.AppInfo.ElapsedTime
+		// The client is the receiver of downloads and the sender of
+		// uploads.
+		if test == string(spec.SubtestDownload) {
+			wm.Application.BytesReceived = m.AppInfo.NumBytes
+		} else {
+			wm.Application.BytesSent = m.AppInfo.NumBytes
+		}
+	}
+	wm.TCPInfo = m.TCPInfo
+	if m.BBRInfo != nil {
+		wm.BBRInfo = &m.BBRInfo.BBRInfo
+	}
+	return wm, nil
+}
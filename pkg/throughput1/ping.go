@@ -0,0 +1,103 @@
+package throughput1
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/m-lab/msak/pkg/throughput1/capture"
+)
+
+const (
+	// maxPingSamples is the maximum number of ping RTT samples buffered
+	// between two measurements. Additional samples are discarded.
+	maxPingSamples = 100
+
+	// pingWriteTimeout is the deadline for sending a ping frame. It is
+	// independent of the ping interval: a ping waits for the write lock held
+	// by the sender, and a frame write timing out breaks the connection.
+	pingWriteTimeout = 5 * time.Second
+)
+
+// SetIdleTimeout sets how long to wait without receiving anything from the
+// other party before failing with a timeout error. Any message or pong
+// received resets the timer, so combined with SetPingInterval this detects
+// dead peers even when no data is expected from them. Set the value to zero
+// to disable the timeout. It must be called before starting the sender or
+// receiver loop.
+func (p *Protocol) SetIdleTimeout(d time.Duration) {
+	p.idleTimeout = d
+}
+
+// SetPingInterval sets the interval between WebSocket ping frames sent to the
+// other party. Pings also keep the connection active when no other message
+// is due, e.g. while receiving during an upload. The RTT of each ping/pong
+// exchange is reported in the PingRTTs field of the following Measurement.
+// Set the value to zero to disable pings. It must be called before starting
+// the sender or receiver loop.
+func (p *Protocol) SetPingInterval(d time.Duration) {
+	p.pingInterval = d
+}
+
+// pinger sends a ping frame carrying the time elapsed since pingStart every
+// pingInterval until the context expires. A ping that cannot be sent in time
+// is skipped. Pongs are handled by handlePong, which must be installed before
+// the receiver starts reading.
+func (p *Protocol) pinger(ctx context.Context) {
+	ticker := time.NewTicker(p.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			var payload [8]byte
+			binary.BigEndian.PutUint64(payload[:], uint64(time.Since(p.pingStart)))
+			err := p.conn.WriteControl(websocket.PingMessage, payload[:],
+				time.Now().Add(pingWriteTimeout))
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			if err != nil {
+				return
+			}
+			p.recorder.Record(capture.Sent, websocket.PingMessage, len(payload), nil)
+		}
+	}
+}
+
+// handlePong computes the RTT from the offset echoed back in a pong frame and
+// stores it until the next measurement. Pongs that do not carry a valid
+// offset are ignored.
+func (p *Protocol) handlePong(data string) error {
+	// Any pong is proof that the other party is alive.
+	p.extendReadDeadline()
+	p.recorder.Record(capture.Received, websocket.PongMessage, len(data), nil)
+	if len(data) != 8 {
+		return nil
+	}
+	sent := time.Duration(binary.BigEndian.Uint64([]byte(data)))
+	rtt := time.Since(p.pingStart) - sent
+	if sent < 0 || rtt < 0 || rtt > p.maxRuntime {
+		return nil
+	}
+	p.pingMu.Lock()
+	defer p.pingMu.Unlock()
+	if len(p.pingRTTs) < maxPingSamples {
+		p.pingRTTs = append(p.pingRTTs, rtt.Microseconds())
+	}
+	return nil
+}
+
+// takePingRTTs returns the ping RTT samples collected since the last call.
+func (p *Protocol) takePingRTTs() []int64 {
+	p.pingMu.Lock()
+	defer p.pingMu.Unlock()
+	rtts := p.pingRTTs
+	p.pingRTTs = nil
+	return rtts
+}
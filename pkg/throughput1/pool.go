@@ -0,0 +1,73 @@
+package throughput1
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/m-lab/msak/pkg/random"
+	"github.com/m-lab/msak/pkg/throughput1/spec"
+)
+
+// messagePoolTTL is how long a pooled message is reused before its payload
+// is re-randomized.
+const messagePoolTTL = time.Minute
+
+// defaultMessagePool is the message pool shared by every Protocol.
+var defaultMessagePool = newMessagePool(messagePoolTTL)
+
+type pooledMessage struct {
+	msg     *websocket.PreparedMessage
+	created time.Time
+}
+
+// messagePool is a size-indexed pool of random PreparedMessages that can be
+// shared across connections. Only sizes that are powers of two between
+// spec.MinMessageSize and spec.MaxScaledMessageSize, i.e. the sizes used by
+// the sender when scaling messages, are pooled.
+type messagePool struct {
+	ttl time.Duration
+
+	mu       sync.Mutex
+	messages map[int]pooledMessage
+}
+
+func newMessagePool(ttl time.Duration) *messagePool {
+	return &messagePool{
+		ttl:      ttl,
+		messages: map[int]pooledMessage{},
+	}
+}
+
+// poolable returns true if messages of the given size are pooled.
+func poolable(size int) bool {
+	return size >= spec.MinMessageSize && size <= spec.MaxScaledMessageSize &&
+		size&(size-1) == 0
+}
+
+// Get returns a PreparedMessage of the requested size from the pool,
+// creating or re-randomizing it if needed. The size must be poolable.
+func (mp *messagePool) Get(size int) (*websocket.PreparedMessage, error) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	if pm, ok := mp.messages[size]; ok && time.Since(pm.created) < mp.ttl {
+		return pm.msg, nil
+	}
+	msg, err := newRandomMessage(size)
+	if err != nil {
+		return nil, err
+	}
+	mp.messages[size] = pooledMessage{msg: msg, created: time.Now()}
+	return msg, nil
+}
+
+// newRandomMessage returns a new binary PreparedMessage of the requested size
+// filled with random bytes.
+func newRandomMessage(size int) (*websocket.PreparedMessage, error) {
+	data := random.Bytes(size)
+	// Make sure the payload cannot be mistaken for a CBOR-encoded Measurement.
+	if size > 0 && data[0] == spec.CBORMeasurementPrefix[0] {
+		data[0] = 0
+	}
+	return websocket.NewPreparedMessage(websocket.BinaryMessage, data)
+}
@@ -0,0 +1,60 @@
+package throughput1
+
+import (
+	"testing"
+	"time"
+
+	"github.com/m-lab/msak/pkg/throughput1/spec"
+)
+
+func Test_poolable(t *testing.T) {
+	tests := []struct {
+		size int
+		want bool
+	}{
+		{size: 0, want: false},
+		{size: spec.MinMessageSize / 2, want: false},
+		{size: spec.MinMessageSize, want: true},
+		{size: spec.MinMessageSize * 4, want: true},
+		{size: spec.MinMessageSize + 1, want: false},
+		{size: spec.MaxScaledMessageSize, want: true},
+		{size: spec.MaxScaledMessageSize * 2, want: false},
+	}
+	for _, tt := range tests {
+		if got := poolable(tt.size); got != tt.want {
+			t.Errorf("poolable(%d) = %v, want %v", tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestMessagePool_Get(t *testing.T) {
+	mp := newMessagePool(100 * time.Millisecond)
+	first, err := mp.Get(spec.MinMessageSize)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	second, err := mp.Get(spec.MinMessageSize)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if first != second {
+		t.Errorf("Get() did not reuse the pooled message")
+	}
+	other, err := mp.Get(spec.MinMessageSize * 2)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if other == first {
+		t.Errorf("Get() returned the same message for different sizes")
+	}
+
+	// After the TTL, the message is re-randomized.
+	time.Sleep(150 * time.Millisecond)
+	third, err := mp.Get(spec.MinMessageSize)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if third == first {
+		t.Errorf("Get() did not re-randomize an expired message")
+	}
+}
@@ -1,27 +1,35 @@
 package throughput1
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"io"
-	"log"
-	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
+	"path"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/charmbracelet/log"
+	"github.com/fxamacker/cbor/v2"
 	"github.com/gorilla/websocket"
+	"github.com/m-lab/go/memoryless"
 	"github.com/m-lab/msak/internal/measurer"
 	"github.com/m-lab/msak/internal/netx"
+	"github.com/m-lab/msak/pkg/throughput1/capture"
 	"github.com/m-lab/msak/pkg/throughput1/model"
 	"github.com/m-lab/msak/pkg/throughput1/spec"
+	"golang.org/x/time/rate"
 )
 
 type senderFunc func(ctx context.Context,
-	measurerCh <-chan model.Measurement, results chan<- model.WireMeasurement,
+	measurerCh <-chan model.Measurement, results chan model.WireMeasurement,
 	errCh chan<- error)
 
 // Measurer is an interface for collecting connection metrics.
@@ -34,14 +42,77 @@ type Measurer interface {
 type Protocol struct {
 	conn     *websocket.Conn
 	connInfo netx.ConnInfo
-	rnd      *rand.Rand
 	measurer Measurer
 	once     sync.Once
 
+	// useCBOR is true if Measurement messages are CBOR-encoded.
+	useCBOR bool
+	// useNDT7 is true if the ndt7 subprotocol was negotiated, i.e.
+	// Measurement messages use the ndt7 format. ndt7Test is the ndt7
+	// subtest, set when the send or receive loop starts.
+	useNDT7  bool
+	ndt7Test string
+
 	applicationBytesReceived atomic.Int64
 	applicationBytesSent     atomic.Int64
 
-	byteLimit int
+	// measurementLimiter limits the rate of Measurement messages received
+	// from the other party that are parsed. Excess messages are dropped and
+	// counted in droppedMeasurements.
+	measurementLimiter  *rate.Limiter
+	droppedMeasurements atomic.Int64
+
+	// unpublishedMeasurements counts the measurements sent to the other
+	// party that were not published on the sender's results channel because
+	// it was full.
+	unpublishedMeasurements atomic.Int64
+
+	byteLimit  int
+	targetRate atomic.Int64
+	// noCounterflow disables sending measurements from the receiving side,
+	// except for the final one.
+	noCounterflow bool
+
+	// controlOut holds the control messages waiting to be sent by the
+	// sending goroutine. controlIn holds the control messages received from
+	// the other party.
+	controlOut chan model.ControlMessage
+	controlIn  chan model.ControlMessage
+
+	// acceptControlUpdates is true if ControlUpdate messages received from
+	// the other party are applied.
+	acceptControlUpdates bool
+
+	// pingInterval is the interval between WebSocket pings. Zero disables
+	// pings. Ping payloads carry the time elapsed since pingStart, so that
+	// RTTs use the monotonic clock. Ping RTT samples are stored in pingRTTs
+	// until the next measurement is sent.
+	pingInterval time.Duration
+	pingStart    time.Time
+	pingRTTs     []int64
+	pingMu       sync.Mutex
+
+	// idleTimeout is how long to wait for data from the other party before
+	// failing with a timeout. Zero means no timeout other than deadline.
+	// deadline is the absolute deadline for the whole test.
+	idleTimeout time.Duration
+	deadline    time.Time
+
+	// maxRuntime is the maximum runtime of a test, regardless of the
+	// caller's context.
+	maxRuntime time.Duration
+
+	// finalFlushTimeout is the write deadline for the final measurement,
+	// counted from the moment it is taken. The connection is kept readable
+	// for this long after deadline, so the final message can still be
+	// delivered when the test ends because deadline expired.
+	finalFlushTimeout time.Duration
+
+	// senderDone is closed when the sending goroutine returns.
+	senderDone chan struct{}
+
+	// recorder, if not nil, records every message sent and received.
+	recorder *capture.Recorder
 }
 
 // New returns a new Protocol with the specified connection and every other
@@ -50,49 +121,305 @@ func New(conn *websocket.Conn) *Protocol {
 	return &Protocol{
 		conn:     conn,
 		connInfo: netx.ToConnInfo(conn.UnderlyingConn()),
-		// Seed randomness source with the current time.
-		rnd:      rand.New(rand.NewSource(time.Now().UnixMilli())),
 		measurer: measurer.New(),
+		useCBOR:  conn.Subprotocol() == spec.SecWebSocketProtocolCBOR,
+		useNDT7:  conn.Subprotocol() == spec.SecWebSocketProtocolNDT7,
+
+		maxRuntime:        spec.MaxRuntime,
+		finalFlushTimeout: spec.FinalFlushTimeout,
+
+		measurementLimiter: rate.NewLimiter(spec.MaxMeasurementMessageRate,
+			spec.MaxMeasurementMessageRate),
+		senderDone: make(chan struct{}),
+		controlOut: make(chan model.ControlMessage, controlQueueSize),
+		controlIn:  make(chan model.ControlMessage, controlQueueSize),
 	}
 }
 
+// DroppedMeasurements returns the number of Measurement messages received
+// from the other party that were dropped without being parsed because they
+// exceeded spec.MaxMeasurementMessageRate.
+func (p *Protocol) DroppedMeasurements() int64 {
+	return p.droppedMeasurements.Load()
+}
+
+// UnpublishedMeasurements returns the number of Measurement messages sent
+// to the other party that were dropped instead of being published on the
+// sender's results channel, because the channel was full. It is only final
+// once SenderDone is closed.
+func (p *Protocol) UnpublishedMeasurements() int64 {
+	return p.unpublishedMeasurements.Load()
+}
+
 // SetByteLimit sets the number of bytes sent after which a test (either download or upload) will stop.
 // Set the value to zero to disable the byte limit.
 func (p *Protocol) SetByteLimit(value int) {
 	p.byteLimit = value
 }
 
+// SetTargetRate sets the rate (in bits per second) at which the sender writes
+// binary messages. Set the value to zero to send as fast as possible.
+func (p *Protocol) SetTargetRate(bps int64) {
+	p.targetRate.Store(bps)
+}
+
+// SetCounterflow enables or disables the Measurement messages sent by the
+// receiving side during the test. When disabled, measurements are still taken
+// and published locally, and the final one is sent. The default is enabled.
+// It must be called before starting the receiver loop.
+func (p *Protocol) SetCounterflow(enabled bool) {
+	p.noCounterflow = !enabled
+}
+
+// SetMaxRuntime sets the maximum runtime of a test. The default is
+// spec.MaxRuntime. It must be called before starting the sender or receiver
+// loop.
+func (p *Protocol) SetMaxRuntime(d time.Duration) {
+	p.maxRuntime = d
+}
+
+// SetFinalFlushTimeout sets how long the sender may take to write the final
+// measurement once the test is over. The default is spec.FinalFlushTimeout.
+// A value of zero makes the final measurement share the deadline of the whole
+// test. It must be called before starting the sender or receiver loop.
+func (p *Protocol) SetFinalFlushTimeout(d time.Duration) {
+	p.finalFlushTimeout = d
+}
+
+// SetMeasureInterval sets the average interval between measurements sent to
+// the other party. It must be called before starting the sender or receiver
+// loop.
+func (p *Protocol) SetMeasureInterval(avg time.Duration) {
+	p.measurer = measurer.NewWithInterval(avg)
+}
+
+// Parameters returns the effective protocol parameters used by this
+// Protocol. The Duration field is not set, since it is determined by the
+// caller's context.
+func (p *Protocol) Parameters() model.ProtocolParameters {
+	params := model.ProtocolParameters{
+		MinMessageSize:  spec.MinMessageSize,
+		MaxMessageSize:  p.maxMessageSize(),
+		ScalingFraction: spec.ScalingFraction,
+		MaxRuntime:      p.maxRuntime.Microseconds(),
+		ByteLimit:       p.byteLimit,
+		TargetRate:      p.targetRate.Load(),
+		NoCounterflow:   p.noCounterflow,
+	}
+	if m, ok := p.measurer.(interface{ Config() memoryless.Config }); ok {
+		config := m.Config()
+		params.MinMeasureInterval = config.Min.Microseconds()
+		params.AvgMeasureInterval = config.Expected.Microseconds()
+		params.MaxMeasureInterval = config.Max.Microseconds()
+	}
+	return params
+}
+
+// SenderDone returns a channel that is closed once the sending goroutine
+// started by SenderLoop or ReceiverLoop has returned. When this happens, the
+// final measurement taken by this side of the connection has been published
+// on the sender-side measurements channel.
+func (p *Protocol) SenderDone() <-chan struct{} {
+	return p.senderDone
+}
+
 // Upgrade takes a HTTP request and upgrades the connection to WebSocket.
 // Returns a websocket Conn if the upgrade succeeded, and an error otherwise.
+// WebSocket compression is always refused.
 func Upgrade(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
-	// We expect WebSocket's subprotocol to be throughput1's. The same subprotocol is
-	// added as a header on the response.
-	if r.Header.Get("Sec-WebSocket-Protocol") != spec.SecWebSocketProtocol {
+	return UpgradeWithOptions(w, r, UpgradeOptions{})
+}
+
+// ConnBufferSize is the memory committed to the read and write buffers of
+// each connection upgraded by UpgradeWithOptions.
+const ConnBufferSize = 2 * spec.MaxScaledMessageSize
+
+// UpgradeOptions are the optional parameters of UpgradeWithOptions.
+type UpgradeOptions struct {
+	// ResponseHeader contains additional headers to include in the handshake
+	// response.
+	ResponseHeader http.Header
+
+	// EnableCompression allows negotiating permessage-deflate compression if
+	// requested by the client. Compression makes application-level byte
+	// counters meaningless as a measure of network throughput, so it should
+	// only be enabled for experiments.
+	EnableCompression bool
+
+	// AllowedOrigins, if not empty, are the origins allowed to upgrade, as
+	// accepted by OriginAllowed. If empty, every origin is allowed.
+	AllowedOrigins []string
+
+	// Subprotocols, if not empty, replaces the supported throughput1
+	// subprotocols, e.g. with spec.SecWebSocketProtocolNDT7 to serve ndt7
+	// clients.
+	Subprotocols []string
+}
+
+// OriginAllowed returns true if the request's Origin header matches one of
+// the allowed patterns, or if the request has no Origin header, as is the
+// case for non-browser clients. Patterns are matched case-insensitively with
+// path.Match against the origin's host (e.g. "*.example.com") or, if they
+// include a scheme, against the whole origin (e.g. "https://*.example.com").
+// If allowed is empty, every origin is allowed.
+func OriginAllowed(r *http.Request, allowed []string) bool {
+	origin := r.Header.Get("Origin")
+	if len(allowed) == 0 || origin == "" {
+		return true
+	}
+	u, err := url.Parse(strings.ToLower(origin))
+	if err != nil || u.Host == "" {
+		return false
+	}
+	for _, pattern := range allowed {
+		pattern = strings.ToLower(pattern)
+		name := u.Host
+		if strings.Contains(pattern, "://") {
+			name = u.Scheme + "://" + u.Host
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// UpgradeWithOptions is like Upgrade, but accepts additional options.
+func UpgradeWithOptions(w http.ResponseWriter, r *http.Request,
+	opts UpgradeOptions) (*websocket.Conn, error) {
+	// We expect WebSocket's subprotocol to be one of throughput1's. The
+	// selected subprotocol is added as a header on the response.
+	supported := subprotocols
+	if len(opts.Subprotocols) > 0 {
+		supported = opts.Subprotocols
+	}
+	if !hasSupportedSubprotocol(r, supported) {
 		w.WriteHeader(http.StatusBadRequest)
 		return nil, errors.New("missing Sec-WebSocket-Protocol header")
 	}
-	h := http.Header{}
-	h.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
 	u := websocket.Upgrader{
-		// Allow cross-origin resource sharing.
+		// Allow cross-origin resource sharing from the allowed origins.
 		CheckOrigin: func(r *http.Request) bool {
-			return true
+			return OriginAllowed(r, opts.AllowedOrigins)
 		},
 		// Set r/w buffers to the maximum expected message size.
 		ReadBufferSize:  spec.MaxScaledMessageSize,
 		WriteBufferSize: spec.MaxScaledMessageSize,
+		// Supported subprotocols in order of preference.
+		Subprotocols:      supported,
+		EnableCompression: opts.EnableCompression,
+	}
+	if opts.EnableCompression {
+		// Record the outcome of the negotiation from the handshake response.
+		w = &handshakeRecorder{ResponseWriter: w}
+	}
+	return u.Upgrade(w, r, opts.ResponseHeader)
+}
+
+// CompressionRequested returns true if the client offered the
+// permessage-deflate WebSocket extension in its handshake request. Use
+// CompressionNegotiated to know whether compression is in use on the upgraded
+// connection.
+func CompressionRequested(r *http.Request) bool {
+	return hasDeflate(r.Header)
+}
+
+// CompressionNegotiated returns true if the handshake response sent by
+// UpgradeWithOptions when upgrading conn accepted the permessage-deflate
+// WebSocket extension, i.e. if compression is in use on conn.
+func CompressionNegotiated(conn *websocket.Conn) bool {
+	hc, ok := conn.UnderlyingConn().(*handshakeConn)
+	return ok && hc.compression
+}
+
+// hasDeflate returns true if the Sec-WebSocket-Extensions headers in h
+// include permessage-deflate.
+func hasDeflate(h http.Header) bool {
+	for _, v := range h.Values("Sec-WebSocket-Extensions") {
+		for _, ext := range strings.Split(v, ",") {
+			name, _, _ := strings.Cut(ext, ";")
+			if strings.EqualFold(strings.TrimSpace(name), "permessage-deflate") {
+				return true
+			}
+		}
 	}
-	return u.Upgrade(w, r, h)
+	return false
+}
+
+// handshakeRecorder is a http.ResponseWriter whose hijacked connections
+// record the handshake response written by the WebSocket upgrader.
+type handshakeRecorder struct {
+	http.ResponseWriter
+}
+
+// Hijack hijacks the underlying ResponseWriter's connection and wraps it in
+// a handshakeConn.
+func (r *handshakeRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not implement http.Hijacker")
+	}
+	conn, brw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &handshakeConn{Conn: conn}, brw, nil
+}
+
+// handshakeConn is a net.Conn recording whether the handshake response, i.e.
+// the first write, accepted permessage-deflate compression.
+type handshakeConn struct {
+	net.Conn
+	written     bool
+	compression bool
+}
+
+// Write writes b to the underlying connection. The first call parses b as
+// the handshake response.
+func (c *handshakeConn) Write(b []byte) (int, error) {
+	if !c.written {
+		c.written = true
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b)), nil)
+		if err == nil {
+			c.compression = hasDeflate(resp.Header)
+		}
+	}
+	return c.Conn.Write(b)
+}
+
+// NetConn returns the underlying connection.
+func (c *handshakeConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// subprotocols are the supported throughput1 subprotocols, in order of
+// preference.
+var subprotocols = []string{
+	spec.SecWebSocketProtocolCBOR,
+	spec.SecWebSocketProtocol,
+}
+
+// hasSupportedSubprotocol returns true if the client requested at least one
+// of the supported subprotocols.
+func hasSupportedSubprotocol(r *http.Request, supported []string) bool {
+	for _, requested := range websocket.Subprotocols(r) {
+		for _, s := range supported {
+			if requested == s {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // makePreparedMessage returns a websocket.PreparedMessage of the requested
-// size filled with random bytes read from the Protocol's randomness source.
+// size filled with random bytes. Messages of the sizes used when scaling are
+// taken from the shared message pool.
 func (p *Protocol) makePreparedMessage(size int) (*websocket.PreparedMessage, error) {
-	data := make([]byte, size)
-	// Each Protocol has its own instance of Rand, so simultaneous calls to
-	// Read() should never happen.
-	p.rnd.Read(data)
-	return websocket.NewPreparedMessage(websocket.BinaryMessage, data)
+	if poolable(size) {
+		return defaultMessagePool.Get(size)
+	}
+	return newRandomMessage(size)
 }
 
 // SenderLoop starts the send loop of the throughput1 protocol. The context's lifetime
@@ -102,6 +429,9 @@ func (p *Protocol) makePreparedMessage(size int) (*websocket.PreparedMessage, er
 // MUST be drained by the caller.
 func (p *Protocol) SenderLoop(ctx context.Context) (<-chan model.WireMeasurement,
 	<-chan model.WireMeasurement, <-chan error) {
+	if p.useNDT7 {
+		p.ndt7Test = string(spec.SubtestDownload)
+	}
 	return p.senderReceiverLoop(ctx, p.sender)
 }
 
@@ -112,17 +442,20 @@ func (p *Protocol) SenderLoop(ctx context.Context) (<-chan model.WireMeasurement
 // errors channel MUST be drained by the caller.
 func (p *Protocol) ReceiverLoop(ctx context.Context) (<-chan model.WireMeasurement,
 	<-chan model.WireMeasurement, <-chan error) {
+	if p.useNDT7 {
+		p.ndt7Test = string(spec.SubtestUpload)
+	}
 	return p.senderReceiverLoop(ctx, p.sendCounterflow)
 }
 
 func (p *Protocol) senderReceiverLoop(ctx context.Context,
 	send senderFunc) (<-chan model.WireMeasurement,
 	<-chan model.WireMeasurement, <-chan error) {
-	// In no case this method will send for longer than spec.MaxRuntime.
+	// In no case this method will send for longer than maxRuntime.
 	// Context cancelation will normally happen sooner than that.
-	deadline := time.Now().Add(spec.MaxRuntime)
-	p.conn.SetWriteDeadline(deadline)
-	p.conn.SetReadDeadline(deadline)
+	p.deadline = time.Now().Add(p.maxRuntime)
+	p.conn.SetWriteDeadline(p.deadline)
+	p.extendReadDeadline()
 
 	// Start a measurer that will periodically send measurements over
 	// measurerCh. These measurements are passed to the sender or the
@@ -136,123 +469,344 @@ func (p *Protocol) senderReceiverLoop(ctx context.Context,
 	receiverCh := make(chan model.WireMeasurement, 100)
 	errCh := make(chan error, 2)
 
+	if p.pingInterval > 0 {
+		p.pingStart = time.Now()
+		p.conn.SetPongHandler(p.handlePong)
+		go p.pinger(ctx)
+	}
 	go p.receiver(ctx, receiverCh, errCh)
-	go send(ctx, measurerCh, senderCh, errCh)
+	go func() {
+		defer close(p.senderDone)
+		send(ctx, measurerCh, senderCh, errCh)
+	}()
 	return senderCh, receiverCh, errCh
 }
 
 // receiver reads from the connection until NextReader fails. It returns
 // the measurements received over the provided channel and updates the sent and
 // received byte counters as needed.
+//
+// Once reading fails, the connection cannot be used anymore and is closed.
+// This happens at the latest when the read deadline expires. Connections
+// hijacked from an HTTP server are not closed otherwise, and closing them
+// earlier, e.g. when the caller returns, would reset the connection while the
+// peer is still sending.
 func (p *Protocol) receiver(ctx context.Context,
 	results chan<- model.WireMeasurement, errCh chan<- error) {
+	defer p.conn.Close()
 	for {
+		p.extendReadDeadline()
 		kind, reader, err := p.conn.NextReader()
 		if err != nil {
+			var ce *websocket.CloseError
+			if p.recorder != nil && errors.As(err, &ce) {
+				msg := websocket.FormatCloseMessage(ce.Code, ce.Text)
+				p.recorder.Record(capture.Received, websocket.CloseMessage, len(msg), msg)
+			}
 			errCh <- err
 			return
 		}
-		if kind == websocket.BinaryMessage {
-			// Binary messages are discarded after reading their size.
-			size, err := io.Copy(io.Discard, reader)
-			if err != nil {
-				errCh <- err
-				return
-			}
-			p.applicationBytesReceived.Add(size)
+		if p.idleTimeout > 0 {
+			// Large messages can take longer than idleTimeout to receive.
+			reader = &activityReader{Reader: reader, p: p}
 		}
-		if kind == websocket.TextMessage {
-			data, err := io.ReadAll(reader)
-			if err != nil {
-				errCh <- err
-				return
-			}
-			p.applicationBytesReceived.Add(int64(len(data)))
-			var m model.WireMeasurement
-			if err := json.Unmarshal(data, &m); err != nil {
-				errCh <- err
-				return
-			}
-			results <- m
+		var recorded *recordingReader
+		if p.recorder != nil {
+			recorded = &recordingReader{Reader: reader, keep: kind == websocket.TextMessage}
+			reader = recorded
+		}
+		var m *model.WireMeasurement
+		switch kind {
+		case websocket.BinaryMessage:
+			m, err = p.readBinaryMessage(reader)
+		case websocket.TextMessage:
+			m, err = p.readTextMessage(reader)
+		}
+		if recorded != nil {
+			p.recorder.Record(capture.Received, kind, recorded.n, recorded.data)
 		}
+		if err != nil {
+			errCh <- err
+			return
+		}
+		if m != nil {
+			results <- *m
+		}
+	}
+}
+
+// extendReadDeadline sets the read deadline to idleTimeout from now, without
+// exceeding the deadline for the whole test plus the final flush timeout.
+func (p *Protocol) extendReadDeadline() {
+	deadline := p.deadline.Add(p.finalFlushTimeout)
+	if p.idleTimeout > 0 {
+		if idle := time.Now().Add(p.idleTimeout); idle.Before(deadline) {
+			deadline = idle
+		}
+	}
+	p.conn.SetReadDeadline(deadline)
+}
+
+// activityReader is an io.Reader that extends the read deadline every time
+// data is read.
+type activityReader struct {
+	io.Reader
+	p *Protocol
+}
+
+func (r *activityReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		r.p.extendReadDeadline()
 	}
+	return n, err
+}
+
+// readTextMessage reads a JSON-encoded Measurement or control message. If the
+// ndt7 subprotocol was negotiated, Measurement messages use the ndt7 format.
+func (p *Protocol) readTextMessage(reader io.Reader) (*model.WireMeasurement, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	p.applicationBytesReceived.Add(int64(len(data)))
+	// Control messages, e.g. aborts, are never dropped by the measurement
+	// rate limit.
+	if ctl, ok := bytes.CutPrefix(data, []byte(spec.ControlMessagePrefix)); ok {
+		return nil, p.handleControlMessage(ctl)
+	}
+	if !p.allowMeasurement() {
+		return nil, nil
+	}
+	if p.useNDT7 {
+		return fromNDT7(data, p.ndt7Test)
+	}
+	var m model.WireMeasurement
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// readBinaryMessage reads a binary message. Binary messages are discarded
+// after reading their size, unless the CBOR subprotocol has been negotiated
+// and the message starts with spec.CBORMeasurementPrefix.
+func (p *Protocol) readBinaryMessage(reader io.Reader) (*model.WireMeasurement, error) {
+	if !p.useCBOR {
+		size, err := io.Copy(io.Discard, reader)
+		p.applicationBytesReceived.Add(size)
+		return nil, err
+	}
+	var prefix [len(spec.CBORMeasurementPrefix)]byte
+	n, err := io.ReadFull(reader, prefix[:])
+	p.applicationBytesReceived.Add(int64(n))
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// Messages shorter than the prefix can only be payload.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if string(prefix[:]) != spec.CBORMeasurementPrefix {
+		size, err := io.Copy(io.Discard, reader)
+		p.applicationBytesReceived.Add(size)
+		return nil, err
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	p.applicationBytesReceived.Add(int64(len(data)))
+	if !p.allowMeasurement() {
+		return nil, nil
+	}
+	var m model.WireMeasurement
+	if err := cbor.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// allowMeasurement returns true if a Measurement message received now should
+// be parsed, and counts it as dropped otherwise.
+func (p *Protocol) allowMeasurement() bool {
+	if p.measurementLimiter.Allow() {
+		return true
+	}
+	p.droppedMeasurements.Add(1)
+	return false
 }
 
 func (p *Protocol) sendWireMeasurement(ctx context.Context, m model.Measurement) (*model.WireMeasurement, error) {
+	wm := p.wireMeasurement(ctx, m)
+	// Encode separately so we can read the message size before sending.
+	kind, data, err := p.encodeWireMeasurement(wm)
+	if err != nil {
+		return nil, err
+	}
+	err = p.conn.WriteMessage(kind, data)
+	if err != nil {
+		// Return the WireMeasurement anyway, so the caller can still publish
+		// it locally if needed.
+		return &wm, err
+	}
+	p.recorder.Record(capture.Sent, kind, len(data), data)
+	p.applicationBytesSent.Add(int64(len(data)))
+	return &wm, nil
+}
+
+// wireMeasurement returns a WireMeasurement for m, including the ping RTTs
+// collected since the previous one and the application-level counters.
+func (p *Protocol) wireMeasurement(ctx context.Context, m model.Measurement) model.WireMeasurement {
 	wm := model.WireMeasurement{}
 	p.once.Do(func() {
 		wm = p.createWireMeasurement(ctx)
 	})
 	wm.Measurement = m
+	wm.PingRTTs = p.takePingRTTs()
 	wm.Application = model.ByteCounters{
 		BytesSent:     p.applicationBytesSent.Load(),
 		BytesReceived: p.applicationBytesReceived.Load(),
 	}
-	// Encode as JSON separately so we can read the message size before
-	// sending.
-	jsonwm, err := json.Marshal(wm)
-	if err != nil {
-		return nil, err
+	return wm
+}
+
+// encodeWireMeasurement encodes wm according to the negotiated subprotocol. It
+// returns the WebSocket message type to use and the encoded message.
+func (p *Protocol) encodeWireMeasurement(wm model.WireMeasurement) (int, []byte, error) {
+	if p.useNDT7 {
+		data, err := json.Marshal(toNDT7(wm, p.ndt7Test))
+		return websocket.TextMessage, data, err
 	}
-	err = p.conn.WriteMessage(websocket.TextMessage, jsonwm)
+	if !p.useCBOR {
+		data, err := json.Marshal(wm)
+		return websocket.TextMessage, data, err
+	}
+	data, err := cbor.Marshal(wm)
 	if err != nil {
-		return nil, err
+		return 0, nil, err
 	}
-	p.applicationBytesSent.Add(int64(len(jsonwm)))
-	return &wm, nil
+	return websocket.BinaryMessage,
+		append([]byte(spec.CBORMeasurementPrefix), data...), nil
 }
 
 func (p *Protocol) sendCounterflow(ctx context.Context,
-	measurerCh <-chan model.Measurement, results chan<- model.WireMeasurement,
+	measurerCh <-chan model.Measurement, results chan model.WireMeasurement,
 	errCh chan<- error) {
 	byteLimit := int64(p.byteLimit)
 	for {
 		select {
 		case <-ctx.Done():
 			// Attempt to send final write message before close. Ignore errors.
-			p.sendAndPublishWireMeasurement(ctx, p.measurer.Measure(ctx), results)
+			p.sendAndPublishFinalWireMeasurement(ctx, results)
 			p.close(ctx)
 			return
 		case m := <-measurerCh:
+			// End the test once enough bytes have been received.
+			if byteLimit > 0 && m.TCPInfo != nil && m.TCPInfo.BytesReceived >= byteLimit {
+				// This is the final measurement, make sure it's published.
+				wm, err := p.sendWireMeasurement(ctx, m)
+				if wm != nil {
+					p.publishFinal(results, *wm)
+				}
+				if err != nil {
+					errCh <- err
+					return
+				}
+				p.close(ctx)
+				return
+			}
+
+			if p.noCounterflow {
+				p.publish(results, p.wireMeasurement(ctx, m))
+				continue
+			}
 			err := p.sendAndPublishWireMeasurement(ctx, m, results)
 			if err != nil {
 				errCh <- err
 				return
 			}
-
-			// End the test once enough bytes have been received.
-			if byteLimit > 0 && m.TCPInfo != nil && m.TCPInfo.BytesReceived >= byteLimit {
-				// WireMessage was just sent above, so we do not need to send another.
-				p.close(ctx)
+		case msg := <-p.controlOut:
+			if err := p.writeControlMessage(msg); err != nil {
+				errCh <- err
 				return
 			}
 		}
 	}
 }
 
+// sendAndPublishFinalWireMeasurement takes a final measurement, attempts to
+// send it to the other party and publishes it on results. Unlike regular
+// measurements, the final measurement is published even if sending it fails,
+// and the oldest buffered measurement is discarded to make room for it if
+// results is full. This guarantees that the caller always receives the last
+// snapshot of the connection.
+func (p *Protocol) sendAndPublishFinalWireMeasurement(ctx context.Context,
+	results chan model.WireMeasurement) error {
+	// The write deadline may have expired already, e.g. if the test was
+	// terminated by maxRuntime. Give the final message its own deadline.
+	if p.finalFlushTimeout > 0 {
+		p.conn.SetWriteDeadline(time.Now().Add(p.finalFlushTimeout))
+	}
+	// Control messages queued before the end, e.g. an abort, are sent
+	// first.
+	p.flushControl()
+	wm, err := p.sendWireMeasurement(ctx, p.measurer.Measure(ctx))
+	if wm != nil {
+		p.publishFinal(results, *wm)
+	}
+	return err
+}
+
+// publishFinal publishes wm on results, discarding the oldest buffered
+// measurement if results is full. It must only be called by the goroutine
+// writing to results.
+func (p *Protocol) publishFinal(results chan model.WireMeasurement, wm model.WireMeasurement) {
+	select {
+	case results <- wm:
+	default:
+		// The caller is the only writer on results, so after reading one
+		// element the next send cannot block.
+		select {
+		case <-results:
+			p.unpublishedMeasurements.Add(1)
+		default:
+		}
+		results <- wm
+	}
+}
+
 func (p *Protocol) sendAndPublishWireMeasurement(ctx context.Context, m model.Measurement, results chan<- model.WireMeasurement) error {
 	wm, err := p.sendWireMeasurement(ctx, m)
 	if err != nil {
 		return err
 	}
 
+	p.publish(results, *wm)
+	return nil
+}
+
+// publish publishes wm on results without blocking.
+func (p *Protocol) publish(results chan<- model.WireMeasurement, wm model.WireMeasurement) {
 	// This send is non-blocking in case there is no one to read the
 	// Measurement message and the channel's buffer is full.
 	select {
-	case results <- *wm:
+	case results <- wm:
 	default:
+		p.unpublishedMeasurements.Add(1)
 	}
-	return nil
 }
 
 func (p *Protocol) sender(ctx context.Context, measurerCh <-chan model.Measurement,
-	results chan<- model.WireMeasurement, errCh chan<- error) {
+	results chan model.WireMeasurement, errCh chan<- error) {
 	size := p.ScaleMessage(spec.MinMessageSize, 0)
 	message, err := p.makePreparedMessage(size)
 	if err != nil {
 		errCh <- err
 		return
 	}
+	maxSize := p.maxMessageSize()
+	start := time.Now()
 
 	// Prepared (binary) messages and Measurement messages are written to the
 	// same socket. This means the speed at which we can send measurements is
@@ -262,7 +816,7 @@ func (p *Protocol) sender(ctx context.Context, measurerCh <-chan model.Measureme
 		select {
 		case <-ctx.Done():
 			// Attempt to send final write message before close. Ignore errors.
-			p.sendAndPublishWireMeasurement(ctx, p.measurer.Measure(ctx), results)
+			p.sendAndPublishFinalWireMeasurement(ctx, results)
 			p.close(ctx)
 			return
 		case m := <-measurerCh:
@@ -271,17 +825,34 @@ func (p *Protocol) sender(ctx context.Context, measurerCh <-chan model.Measureme
 				errCh <- err
 				return
 			}
+		case msg := <-p.controlOut:
+			if err := p.writeControlMessage(msg); err != nil {
+				errCh <- err
+				return
+			}
 		default:
+			if wait := p.pacingDelay(start); wait > 0 {
+				// Sending now would exceed the target rate. Wait, but return to
+				// the main loop if the context expires in the meantime.
+				t := time.NewTimer(wait)
+				select {
+				case <-ctx.Done():
+				case <-t.C:
+				}
+				t.Stop()
+				continue
+			}
 			err = p.conn.WritePreparedMessage(message)
 			if err != nil {
 				errCh <- err
 				return
 			}
+			p.recorder.Record(capture.Sent, websocket.BinaryMessage, size, nil)
 			p.applicationBytesSent.Add(int64(size))
 
 			bytesSent := int(p.applicationBytesSent.Load())
 			if p.byteLimit > 0 && bytesSent >= p.byteLimit {
-				err := p.sendAndPublishWireMeasurement(ctx, p.measurer.Measure(ctx), results)
+				err := p.sendAndPublishFinalWireMeasurement(ctx, results)
 				if err != nil {
 					errCh <- err
 					return
@@ -292,8 +863,10 @@ func (p *Protocol) sender(ctx context.Context, measurerCh <-chan model.Measureme
 
 			origSize := size
 			// Determine whether it's time to scale the message size.
-			if size >= spec.MaxScaledMessageSize || size > bytesSent/spec.ScalingFraction {
+			if size >= maxSize || size > bytesSent/spec.ScalingFraction {
 				size = p.ScaleMessage(size, bytesSent)
+			} else if size*2 > maxSize {
+				size = p.ScaleMessage(maxSize, bytesSent)
 			} else {
 				size = p.ScaleMessage(size*2, bytesSent)
 			}
@@ -313,6 +886,38 @@ func (p *Protocol) sender(ctx context.Context, measurerCh <-chan model.Measureme
 	}
 }
 
+// maxMessageSize returns the maximum binary message size. When a target rate
+// is set, this is the amount of data to send in one spec.PacingInterval.
+func (p *Protocol) maxMessageSize() int {
+	targetRate := p.targetRate.Load()
+	if targetRate <= 0 {
+		return spec.MaxScaledMessageSize
+	}
+	// The target rate is not bounded when set via SetTargetRate or a control
+	// message, so the size is computed in floating point to avoid overflows.
+	size := float64(targetRate) / 8 * spec.PacingInterval.Seconds()
+	if size < spec.MinMessageSize {
+		return spec.MinMessageSize
+	}
+	if size > spec.MaxScaledMessageSize {
+		return spec.MaxScaledMessageSize
+	}
+	return int(size)
+}
+
+// pacingDelay returns how long the sender must wait before the next write to
+// keep the average sending rate since start under the target rate. It
+// returns zero if no target rate is set.
+func (p *Protocol) pacingDelay(start time.Time) time.Duration {
+	targetRate := p.targetRate.Load()
+	if targetRate <= 0 {
+		return 0
+	}
+	bits := float64(p.applicationBytesSent.Load() * 8)
+	next := start.Add(time.Duration(bits / float64(targetRate) * float64(time.Second)))
+	return time.Until(next)
+}
+
 // ScaleMessage sets the binary message size taking into consideration byte limits.
 func (p *Protocol) ScaleMessage(msgSize int, bytesSent int) int {
 	// Check if the next payload size will push the total number of bytes over the limit.
@@ -329,13 +934,28 @@ func (p *Protocol) close(ctx context.Context) {
 
 	err := p.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
 	if err != nil {
-		log.Printf("WriteControl failed (ctx: %p, err: %v)", ctx, err)
+		log.Warn("WriteControl failed", "uuid", p.connInfo.UUID(), "error", err)
 		return
 	}
+	p.recorder.Record(capture.Sent, websocket.CloseMessage, len(msg), msg)
 	// The closing message is part of the measurement and added to bytesSent.
 	p.applicationBytesSent.Add(int64(len(msg)))
 
-	log.Printf("Close message sent (ctx: %p)", ctx)
+	log.Debug("Close message sent", "uuid", p.connInfo.UUID())
+}
+
+// Abort closes the connection with spec.CloseCodeAborted and the provided
+// reason, telling the other party that the test was aborted before its end.
+// It can be called concurrently with the sender and receiver loops.
+func (p *Protocol) Abort(reason string) error {
+	msg := websocket.FormatCloseMessage(spec.CloseCodeAborted, reason)
+	err := p.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	if err != nil {
+		return err
+	}
+	p.recorder.Record(capture.Sent, websocket.CloseMessage, len(msg), msg)
+	p.applicationBytesSent.Add(int64(len(msg)))
+	return nil
 }
 
 // createWireMeasurement returns an WireMeasurement populated with this
@@ -349,8 +969,7 @@ func (p *Protocol) createWireMeasurement(ctx context.Context) model.WireMeasurem
 	// Windows systems and should not be considered fatal.
 	cc, err := p.connInfo.GetCC()
 	if err != nil {
-		log.Printf("failed to read cc (ctx %p): %v\n",
-			ctx, err)
+		log.Debug("Failed to read cc", "uuid", p.connInfo.UUID(), "error", err)
 	}
 	uuid := p.connInfo.UUID()
 	wm.CC = cc
@@ -0,0 +1,51 @@
+package throughput1
+
+import (
+	"math"
+	"testing"
+
+	"github.com/m-lab/msak/pkg/throughput1/spec"
+)
+
+func TestProtocol_maxMessageSize(t *testing.T) {
+	tests := []struct {
+		name       string
+		targetRate int64
+		want       int
+	}{
+		{
+			name:       "no-target-rate",
+			targetRate: 0,
+			want:       spec.MaxScaledMessageSize,
+		},
+		{
+			name:       "low-rate",
+			targetRate: 1000,
+			want:       spec.MinMessageSize,
+		},
+		{
+			name:       "8mbps",
+			targetRate: 8000000,
+			want:       10000,
+		},
+		{
+			name:       "high-rate",
+			targetRate: spec.MaxTargetRate,
+			want:       spec.MaxScaledMessageSize,
+		},
+		{
+			name:       "max-int64",
+			targetRate: math.MaxInt64,
+			want:       spec.MaxScaledMessageSize,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Protocol{}
+			p.targetRate.Store(tt.targetRate)
+			if got := p.maxMessageSize(); got != tt.want {
+				t.Errorf("maxMessageSize() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package throughput1_test
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -15,6 +16,7 @@ import (
 	"github.com/m-lab/go/rtx"
 	"github.com/m-lab/msak/internal/netx"
 	"github.com/m-lab/msak/pkg/throughput1"
+	"github.com/m-lab/msak/pkg/throughput1/model"
 	"github.com/m-lab/msak/pkg/throughput1/spec"
 )
 
@@ -63,6 +65,71 @@ func TestProtocol_Upgrade(t *testing.T) {
 	})
 }
 
+func TestUpgradeWithOptions_Compression(t *testing.T) {
+	tests := []struct {
+		enable bool
+		offer  bool
+		want   bool
+	}{
+		{enable: false, offer: true, want: false},
+		{enable: true, offer: false, want: false},
+		{enable: true, offer: true, want: true},
+	}
+	for _, tt := range tests {
+		negotiatedCh := make(chan bool, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, err := throughput1.UpgradeWithOptions(w, r, throughput1.UpgradeOptions{
+				EnableCompression: tt.enable,
+			})
+			if err == nil {
+				negotiatedCh <- throughput1.CompressionNegotiated(conn)
+				conn.Close()
+			}
+		}))
+		u, err := url.Parse(server.URL)
+		rtx.Must(err, "cannot parse server URL")
+		u.Scheme = "ws"
+		headers := http.Header{}
+		headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+		d := websocket.Dialer{EnableCompression: tt.offer}
+		conn, resp, err := d.Dial(u.String(), headers)
+		rtx.Must(err, "cannot dial server")
+		conn.Close()
+		server.Close()
+
+		negotiated := resp.Header.Get("Sec-WebSocket-Extensions") != ""
+		if negotiated != tt.want {
+			t.Errorf("enable=%v, offer=%v: compression negotiated = %v, want %v",
+				tt.enable, tt.offer, negotiated, tt.want)
+		}
+		if got := <-negotiatedCh; got != tt.want {
+			t.Errorf("enable=%v, offer=%v: CompressionNegotiated() = %v, want %v",
+				tt.enable, tt.offer, got, tt.want)
+		}
+	}
+}
+
+func TestCompressionRequested(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{header: "", want: false},
+		{header: "permessage-deflate", want: true},
+		{header: "x-webkit-deflate-frame, permessage-deflate; client_max_window_bits", want: true},
+		{header: "x-webkit-deflate-frame", want: false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.header != "" {
+			r.Header.Set("Sec-WebSocket-Extensions", tt.header)
+		}
+		if got := throughput1.CompressionRequested(r); got != tt.want {
+			t.Errorf("CompressionRequested(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
 func downloadHandler(rw http.ResponseWriter, req *http.Request) {
 	wsConn, err := throughput1.Upgrade(rw, req)
 	rtx.Must(err, "failed to upgrade to WS")
@@ -84,6 +151,35 @@ func downloadHandler(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func TestOriginAllowed(t *testing.T) {
+	tests := []struct {
+		origin  string
+		allowed []string
+		want    bool
+	}{
+		{origin: "https://evil.com", want: true},
+		{origin: "", allowed: []string{"example.com"}, want: true},
+		{origin: "https://example.com", allowed: []string{"example.com"}, want: true},
+		{origin: "https://EXAMPLE.com", allowed: []string{"example.com"}, want: true},
+		{origin: "https://a.example.com", allowed: []string{"*.example.com"}, want: true},
+		{origin: "https://example.com", allowed: []string{"*.example.com"}, want: false},
+		{origin: "https://a.example.com.evil.com", allowed: []string{"*.example.com"}, want: false},
+		{origin: "http://a.example.com", allowed: []string{"https://*.example.com"}, want: false},
+		{origin: "https://a.example.com", allowed: []string{"https://*.example.com"}, want: true},
+		{origin: "null", allowed: []string{"*"}, want: false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if got := throughput1.OriginAllowed(r, tt.allowed); got != tt.want {
+			t.Errorf("OriginAllowed(%q, %v) = %v, want %v", tt.origin, tt.allowed,
+				got, tt.want)
+		}
+	}
+}
+
 func TestProtocol_Download(t *testing.T) {
 	tcpl, err := net.ListenTCP("tcp", &net.TCPAddr{})
 	rtx.Must(err, "failed to create listener")
@@ -138,6 +234,709 @@ func TestProtocol_Download(t *testing.T) {
 	}
 }
 
+func TestProtocol_ReceiverClosesConn(t *testing.T) {
+	closeErr := make(chan error, 1)
+	handler := func(rw http.ResponseWriter, req *http.Request) {
+		wsConn, err := throughput1.Upgrade(rw, req)
+		rtx.Must(err, "failed to upgrade to WS")
+		proto := throughput1.New(wsConn)
+		ctx, cancel := context.WithTimeout(req.Context(), 5*time.Second)
+		defer cancel()
+		_, _, errCh := proto.ReceiverLoop(ctx)
+		<-errCh
+		// The hijacked connection is not closed by the HTTP server, so the
+		// receiver must close it once the peer has gone away.
+		var err2 error
+		for start := time.Now(); time.Since(start) < time.Second; {
+			_, err2 = wsConn.UnderlyingConn().Write(nil)
+			if err2 != nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		closeErr <- err2
+	}
+
+	tcpl, err := net.ListenTCP("tcp", &net.TCPAddr{})
+	rtx.Must(err, "failed to create listener")
+	srv := &httptest.Server{
+		Listener: netx.NewListener(tcpl),
+		Config:   &http.Server{Handler: http.HandlerFunc(handler)},
+	}
+	srv.Start()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	rtx.Must(err, "cannot get server URL")
+	u.Scheme = "ws"
+	headers := http.Header{}
+	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+	conn, _, err := websocket.DefaultDialer.Dial(u.String(), headers)
+	rtx.Must(err, "cannot dial server")
+	defer conn.Close()
+
+	err = conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(time.Second))
+	rtx.Must(err, "cannot send close message")
+
+	select {
+	case err := <-closeErr:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("connection not closed by the receiver: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("receiver did not return")
+	}
+}
+
+func TestProtocol_DownloadCBOR(t *testing.T) {
+	tcpl, err := net.ListenTCP("tcp", &net.TCPAddr{})
+	rtx.Must(err, "failed to create listener")
+
+	srv := &httptest.Server{
+		Listener: netx.NewListener(tcpl),
+		Config:   &http.Server{Handler: http.HandlerFunc(downloadHandler)},
+	}
+	srv.Start()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	rtx.Must(err, "cannot get server URL")
+	u.Scheme = "ws"
+
+	d := websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := net.Dial("tcp", u.Host)
+			if err != nil {
+				return nil, err
+			}
+			return netx.FromTCPLikeConn(conn.(*net.TCPConn))
+		},
+		Subprotocols: []string{spec.SecWebSocketProtocolCBOR,
+			spec.SecWebSocketProtocol},
+	}
+
+	conn, _, err := d.Dial(u.String(), nil)
+	rtx.Must(err, "cannot dial server")
+	if conn.Subprotocol() != spec.SecWebSocketProtocolCBOR {
+		t.Fatalf("wrong subprotocol negotiated: %s", conn.Subprotocol())
+	}
+	proto := throughput1.New(conn)
+	_, receiverCh, errCh := proto.ReceiverLoop(context.Background())
+	select {
+	case m := <-receiverCh:
+		// The first measurement must include the connection's metadata.
+		if m.UUID == "" {
+			t.Errorf("received measurement without UUID")
+		}
+	case err := <-errCh:
+		t.Fatalf("unexpected error: %v", err)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("did not receive any measurement")
+	}
+}
+
+func TestProtocol_TargetRate(t *testing.T) {
+	tcpl, err := net.ListenTCP("tcp", &net.TCPAddr{})
+	rtx.Must(err, "failed to create listener")
+
+	// Send at 8Mb/s (1MB/s) for one second.
+	handler := func(rw http.ResponseWriter, req *http.Request) {
+		wsConn, err := throughput1.Upgrade(rw, req)
+		rtx.Must(err, "failed to upgrade to WS")
+		proto := throughput1.New(wsConn)
+		proto.SetTargetRate(8000000)
+		ctx, cancel := context.WithTimeout(req.Context(), 1*time.Second)
+		defer cancel()
+		_, _, errCh := proto.SenderLoop(ctx)
+		select {
+		case <-ctx.Done():
+		case <-errCh:
+		}
+	}
+	srv := &httptest.Server{
+		Listener: netx.NewListener(tcpl),
+		Config:   &http.Server{Handler: http.HandlerFunc(handler)},
+	}
+	srv.Start()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	rtx.Must(err, "cannot get server URL")
+	u.Scheme = "ws"
+	headers := http.Header{}
+	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+	d := websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := net.Dial("tcp", u.Host)
+			if err != nil {
+				return nil, err
+			}
+			return netx.FromTCPLikeConn(conn.(*net.TCPConn))
+		},
+	}
+	conn, _, err := d.Dial(u.String(), headers)
+	rtx.Must(err, "cannot dial server")
+	proto := throughput1.New(conn)
+	timeout, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, receiverCh, errCh := proto.ReceiverLoop(timeout)
+	var sent int64
+	for done := false; !done; {
+		select {
+		case <-timeout.Done():
+			done = true
+		case m := <-receiverCh:
+			sent = m.Application.BytesSent
+		case <-errCh:
+			done = true
+		}
+	}
+	// Allow some slack for the measurement messages and timing jitter.
+	if sent == 0 || sent > 1500000 {
+		t.Errorf("unexpected number of bytes sent at the target rate: %d", sent)
+	}
+}
+
+func TestProtocol_FinalMeasurement(t *testing.T) {
+	tcpl, err := net.ListenTCP("tcp", &net.TCPAddr{})
+	rtx.Must(err, "failed to create listener")
+
+	// Run a 1s download without reading measurements until the sender is
+	// done, then check the last published measurement is the final one.
+	lastElapsed := make(chan int64, 1)
+	handler := func(rw http.ResponseWriter, req *http.Request) {
+		wsConn, err := throughput1.Upgrade(rw, req)
+		rtx.Must(err, "failed to upgrade to WS")
+		proto := throughput1.New(wsConn)
+		ctx, cancel := context.WithTimeout(req.Context(), 1*time.Second)
+		defer cancel()
+		senderCh, _, _ := proto.SenderLoop(ctx)
+		<-proto.SenderDone()
+		var last int64
+		for done := false; !done; {
+			select {
+			case m := <-senderCh:
+				last = m.ElapsedTime
+			default:
+				done = true
+			}
+		}
+		lastElapsed <- last
+	}
+	srv := &httptest.Server{
+		Listener: netx.NewListener(tcpl),
+		Config:   &http.Server{Handler: http.HandlerFunc(handler)},
+	}
+	srv.Start()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	rtx.Must(err, "cannot get server URL")
+	u.Scheme = "ws"
+	headers := http.Header{}
+	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+	d := websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := net.Dial("tcp", u.Host)
+			if err != nil {
+				return nil, err
+			}
+			return netx.FromTCPLikeConn(conn.(*net.TCPConn))
+		},
+	}
+	conn, _, err := d.Dial(u.String(), headers)
+	rtx.Must(err, "cannot dial server")
+	proto := throughput1.New(conn)
+	timeout, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, _, errCh := proto.ReceiverLoop(timeout)
+
+	select {
+	case elapsed := <-lastElapsed:
+		// The final measurement is taken when the context expires.
+		if elapsed < (900 * time.Millisecond).Microseconds() {
+			t.Errorf("final measurement missing, last ElapsedTime: %d", elapsed)
+		}
+	case <-timeout.Done():
+		t.Fatalf("sender did not terminate")
+	}
+	<-errCh
+}
+
+func TestProtocol_NoCounterflow(t *testing.T) {
+	tcpl, err := net.ListenTCP("tcp", &net.TCPAddr{})
+	rtx.Must(err, "failed to create listener")
+
+	// Run a 1s upload with counterflow disabled on the receiving side. Its
+	// measurements are published locally, but only the final one is sent.
+	published := make(chan int, 1)
+	handler := func(rw http.ResponseWriter, req *http.Request) {
+		wsConn, err := throughput1.Upgrade(rw, req)
+		rtx.Must(err, "failed to upgrade to WS")
+		proto := throughput1.New(wsConn)
+		proto.SetCounterflow(false)
+		proto.SetMeasureInterval(50 * time.Millisecond)
+		if !proto.Parameters().NoCounterflow {
+			t.Errorf("NoCounterflow not reported in the parameters")
+		}
+		ctx, cancel := context.WithTimeout(req.Context(), 1*time.Second)
+		defer cancel()
+		senderCh, _, _ := proto.ReceiverLoop(ctx)
+		n := 0
+		for {
+			select {
+			case <-senderCh:
+				n++
+			case <-proto.SenderDone():
+				for len(senderCh) > 0 {
+					<-senderCh
+					n++
+				}
+				published <- n
+				return
+			}
+		}
+	}
+	srv := &httptest.Server{
+		Listener: netx.NewListener(tcpl),
+		Config:   &http.Server{Handler: http.HandlerFunc(handler)},
+	}
+	srv.Start()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	rtx.Must(err, "cannot get server URL")
+	u.Scheme = "ws"
+	headers := http.Header{}
+	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+	d := websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := net.Dial("tcp", u.Host)
+			if err != nil {
+				return nil, err
+			}
+			return netx.FromTCPLikeConn(conn.(*net.TCPConn))
+		},
+	}
+	conn, _, err := d.Dial(u.String(), headers)
+	rtx.Must(err, "cannot dial server")
+	proto := throughput1.New(conn)
+	timeout, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, receiverCh, errCh := proto.SenderLoop(timeout)
+
+	received := 0
+	for done := false; !done; {
+		select {
+		case <-receiverCh:
+			received++
+		case <-errCh:
+			done = true
+		case <-timeout.Done():
+			done = true
+		}
+	}
+	for len(receiverCh) > 0 {
+		<-receiverCh
+		received++
+	}
+	if n := <-published; n < 2 {
+		t.Errorf("too few measurements published by the receiver: %d", n)
+	}
+	if received != 1 {
+		t.Errorf("received %d measurements, want only the final one", received)
+	}
+}
+
+func TestProtocol_FinalFlushTimeout(t *testing.T) {
+	tcpl, err := net.ListenTCP("tcp", &net.TCPAddr{})
+	rtx.Must(err, "failed to create listener")
+
+	// Terminate a download after its hard deadline has expired. No message
+	// is due in the meantime, so the final measurement is the only one sent
+	// and it can only get through thanks to the final flush timeout.
+	handler := func(rw http.ResponseWriter, req *http.Request) {
+		wsConn, err := throughput1.Upgrade(rw, req)
+		rtx.Must(err, "failed to upgrade to WS")
+		proto := throughput1.New(wsConn)
+		proto.SetMaxRuntime(300 * time.Millisecond)
+		proto.SetFinalFlushTimeout(time.Second)
+		proto.SetMeasureInterval(10 * time.Second)
+		// A single 1 KiB message per second.
+		proto.SetTargetRate(8 * spec.MinMessageSize)
+		ctx, cancel := context.WithCancel(req.Context())
+		proto.SenderLoop(ctx)
+		time.Sleep(500 * time.Millisecond)
+		cancel()
+		<-proto.SenderDone()
+	}
+	srv := &httptest.Server{
+		Listener: netx.NewListener(tcpl),
+		Config:   &http.Server{Handler: http.HandlerFunc(handler)},
+	}
+	srv.Start()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	rtx.Must(err, "cannot get server URL")
+	u.Scheme = "ws"
+	headers := http.Header{}
+	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+	d := websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := net.Dial("tcp", u.Host)
+			if err != nil {
+				return nil, err
+			}
+			return netx.FromTCPLikeConn(conn.(*net.TCPConn))
+		},
+	}
+	conn, _, err := d.Dial(u.String(), headers)
+	rtx.Must(err, "cannot dial server")
+	proto := throughput1.New(conn)
+	timeout, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, receiverCh, _ := proto.ReceiverLoop(timeout)
+
+	select {
+	case m := <-receiverCh:
+		if m.ElapsedTime < (400 * time.Millisecond).Microseconds() {
+			t.Errorf("unexpected measurement before the final one: %d", m.ElapsedTime)
+		}
+	case <-timeout.Done():
+		t.Fatalf("final measurement not received")
+	}
+}
+
+func TestProtocol_UnpublishedMeasurements(t *testing.T) {
+	tcpl, err := net.ListenTCP("tcp", &net.TCPAddr{})
+	rtx.Must(err, "failed to create listener")
+
+	// The server never reads its sender's results, so measurements beyond
+	// the channel's capacity cannot be published.
+	unpublished := make(chan int64, 1)
+	handler := func(rw http.ResponseWriter, req *http.Request) {
+		wsConn, err := throughput1.Upgrade(rw, req)
+		rtx.Must(err, "failed to upgrade to WS")
+		proto := throughput1.New(wsConn)
+		proto.SetMeasureInterval(time.Millisecond)
+		ctx, cancel := context.WithTimeout(req.Context(), time.Second)
+		defer cancel()
+		proto.SenderLoop(ctx)
+		<-proto.SenderDone()
+		unpublished <- proto.UnpublishedMeasurements()
+	}
+	srv := &httptest.Server{
+		Listener: netx.NewListener(tcpl),
+		Config:   &http.Server{Handler: http.HandlerFunc(handler)},
+	}
+	srv.Start()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	rtx.Must(err, "cannot get server URL")
+	u.Scheme = "ws"
+	headers := http.Header{}
+	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+	d := websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := net.Dial("tcp", u.Host)
+			if err != nil {
+				return nil, err
+			}
+			return netx.FromTCPLikeConn(conn.(*net.TCPConn))
+		},
+	}
+	conn, _, err := d.Dial(u.String(), headers)
+	rtx.Must(err, "cannot dial server")
+	proto := throughput1.New(conn)
+	timeout, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, _, errCh := proto.ReceiverLoop(timeout)
+	go func() {
+		for {
+			select {
+			case <-errCh:
+			case <-timeout.Done():
+				return
+			}
+		}
+	}()
+
+	select {
+	case n := <-unpublished:
+		if n == 0 {
+			t.Errorf("UnpublishedMeasurements() = 0, want > 0")
+		}
+	case <-timeout.Done():
+		t.Fatalf("sender did not terminate")
+	}
+}
+
+func TestProtocol_PingRTT(t *testing.T) {
+	tcpl, err := net.ListenTCP("tcp", &net.TCPAddr{})
+	rtx.Must(err, "failed to create listener")
+
+	// Run a 1s download with pings enabled and count the RTT samples
+	// reported in the sender's measurements.
+	samples := make(chan int, 1)
+	handler := func(rw http.ResponseWriter, req *http.Request) {
+		wsConn, err := throughput1.Upgrade(rw, req)
+		rtx.Must(err, "failed to upgrade to WS")
+		proto := throughput1.New(wsConn)
+		proto.SetPingInterval(50 * time.Millisecond)
+		ctx, cancel := context.WithTimeout(req.Context(), 1*time.Second)
+		defer cancel()
+		senderCh, _, _ := proto.SenderLoop(ctx)
+		count := 0
+		for {
+			select {
+			case m := <-senderCh:
+				for _, rtt := range m.PingRTTs {
+					if rtt < 0 {
+						t.Errorf("invalid ping RTT: %d", rtt)
+					}
+				}
+				count += len(m.PingRTTs)
+			case <-proto.SenderDone():
+				samples <- count
+				return
+			}
+		}
+	}
+	srv := &httptest.Server{
+		Listener: netx.NewListener(tcpl),
+		Config:   &http.Server{Handler: http.HandlerFunc(handler)},
+	}
+	srv.Start()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	rtx.Must(err, "cannot get server URL")
+	u.Scheme = "ws"
+	headers := http.Header{}
+	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+	d := websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := net.Dial("tcp", u.Host)
+			if err != nil {
+				return nil, err
+			}
+			return netx.FromTCPLikeConn(conn.(*net.TCPConn))
+		},
+	}
+	conn, _, err := d.Dial(u.String(), headers)
+	rtx.Must(err, "cannot dial server")
+	proto := throughput1.New(conn)
+	timeout, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	_, _, errCh := proto.ReceiverLoop(timeout)
+
+	select {
+	case count := <-samples:
+		if count == 0 {
+			t.Errorf("no ping RTT samples in measurements")
+		}
+	case <-timeout.Done():
+		t.Fatalf("sender did not terminate")
+	}
+	<-errCh
+}
+
+func TestProtocol_Control(t *testing.T) {
+	tcpl, err := net.ListenTCP("tcp", &net.TCPAddr{})
+	rtx.Must(err, "failed to create listener")
+
+	// Start a download and send an update and an abort message to the client.
+	handler := func(rw http.ResponseWriter, req *http.Request) {
+		wsConn, err := throughput1.Upgrade(rw, req)
+		rtx.Must(err, "failed to upgrade to WS")
+		proto := throughput1.New(wsConn)
+		ctx, cancel := context.WithTimeout(req.Context(), 2*time.Second)
+		defer cancel()
+		_, _, errCh := proto.SenderLoop(ctx)
+		rtx.Must(proto.SendControl(model.ControlMessage{
+			Action:     model.ControlUpdate,
+			TargetRate: 1000000,
+		}), "failed to queue update message")
+		rtx.Must(proto.SendControl(model.ControlMessage{
+			Action: model.ControlAbort,
+			Reason: "test",
+		}), "failed to queue abort message")
+		select {
+		case <-ctx.Done():
+		case <-errCh:
+		}
+	}
+	srv := &httptest.Server{
+		Listener: netx.NewListener(tcpl),
+		Config:   &http.Server{Handler: http.HandlerFunc(handler)},
+	}
+	srv.Start()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	rtx.Must(err, "cannot get server URL")
+	u.Scheme = "ws"
+	headers := http.Header{}
+	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+	d := websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := net.Dial("tcp", u.Host)
+			if err != nil {
+				return nil, err
+			}
+			return netx.FromTCPLikeConn(conn.(*net.TCPConn))
+		},
+	}
+	// Updates are only applied by clients accepting them.
+	for _, accept := range []bool{true, false} {
+		conn, _, err := d.Dial(u.String(), headers)
+		rtx.Must(err, "cannot dial server")
+		defer conn.Close()
+		proto := throughput1.New(conn)
+		proto.SetAcceptControlUpdates(accept)
+		timeout, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		proto.ReceiverLoop(timeout)
+
+		want := []model.ControlAction{model.ControlUpdate, model.ControlAbort}
+		for _, action := range want {
+			select {
+			case msg := <-proto.Control():
+				if msg.Action != action {
+					t.Fatalf("unexpected control action: got %q, want %q",
+						msg.Action, action)
+				}
+			case <-timeout.Done():
+				t.Fatalf("control message %q not received", action)
+			}
+		}
+		rate := proto.Parameters().TargetRate
+		if accept && rate != 1000000 {
+			t.Errorf("update not applied: TargetRate = %d", rate)
+		}
+		if !accept && rate != 0 {
+			t.Errorf("update applied without being accepted: TargetRate = %d", rate)
+		}
+	}
+}
+
+func TestProtocol_IdleTimeout(t *testing.T) {
+	tcpl, err := net.ListenTCP("tcp", &net.TCPAddr{})
+	rtx.Must(err, "failed to create listener")
+
+	// The server receives from a client that never sends anything nor reads
+	// (so it never replies to pings), and must detect it as dead.
+	errs := make(chan error, 1)
+	handler := func(rw http.ResponseWriter, req *http.Request) {
+		wsConn, err := throughput1.Upgrade(rw, req)
+		rtx.Must(err, "failed to upgrade to WS")
+		proto := throughput1.New(wsConn)
+		proto.SetPingInterval(50 * time.Millisecond)
+		proto.SetIdleTimeout(200 * time.Millisecond)
+		ctx, cancel := context.WithTimeout(req.Context(), 5*time.Second)
+		defer cancel()
+		_, _, errCh := proto.ReceiverLoop(ctx)
+		select {
+		case err := <-errCh:
+			errs <- err
+		case <-ctx.Done():
+			errs <- ctx.Err()
+		}
+	}
+	srv := &httptest.Server{
+		Listener: netx.NewListener(tcpl),
+		Config:   &http.Server{Handler: http.HandlerFunc(handler)},
+	}
+	srv.Start()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	rtx.Must(err, "cannot get server URL")
+	u.Scheme = "ws"
+	headers := http.Header{}
+	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+	conn, _, err := websocket.DefaultDialer.Dial(u.String(), headers)
+	rtx.Must(err, "cannot dial server")
+	defer conn.Close()
+
+	start := time.Now()
+	err = <-errs
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("expected a timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("dead peer detected too late: %v", elapsed)
+	}
+}
+
+func TestProtocol_MeasurementRateLimit(t *testing.T) {
+	tcpl, err := net.ListenTCP("tcp", &net.TCPAddr{})
+	rtx.Must(err, "failed to create listener")
+
+	type counts struct{ received, dropped, controls int64 }
+	result := make(chan counts, 1)
+	handler := func(rw http.ResponseWriter, req *http.Request) {
+		wsConn, err := throughput1.Upgrade(rw, req)
+		rtx.Must(err, "failed to upgrade to WS")
+		proto := throughput1.New(wsConn)
+		ctx, cancel := context.WithTimeout(req.Context(), 500*time.Millisecond)
+		defer cancel()
+		_, receiverCh, _ := proto.ReceiverLoop(ctx)
+		var received int64
+		for done := false; !done; {
+			select {
+			case <-ctx.Done():
+				done = true
+			case <-receiverCh:
+				received++
+			}
+		}
+		result <- counts{received, proto.DroppedMeasurements(),
+			int64(len(proto.Control()))}
+	}
+	srv := &httptest.Server{
+		Listener: netx.NewListener(tcpl),
+		Config:   &http.Server{Handler: http.HandlerFunc(handler)},
+	}
+	srv.Start()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	rtx.Must(err, "cannot get server URL")
+	u.Scheme = "ws"
+	headers := http.Header{}
+	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+	conn, _, err := websocket.DefaultDialer.Dial(u.String(), headers)
+	rtx.Must(err, "cannot dial server")
+	defer conn.Close()
+
+	// Flood the server with measurement messages, then send a control
+	// message, which must not be rate limited.
+	for i := 0; i < 200; i++ {
+		err := conn.WriteMessage(websocket.TextMessage, []byte(`{"ElapsedTime":1}`))
+		rtx.Must(err, "cannot write message")
+	}
+	err = conn.WriteMessage(websocket.TextMessage,
+		[]byte(spec.ControlMessagePrefix+`{"Action":"abort"}`))
+	rtx.Must(err, "cannot write control message")
+
+	c := <-result
+	// Allow the initial burst plus the messages allowed during the test.
+	if c.received > 2*spec.MaxMeasurementMessageRate || c.dropped == 0 ||
+		c.received+c.dropped != 200 {
+		t.Errorf("rate limit not enforced: received %d, dropped %d",
+			c.received, c.dropped)
+	}
+	if c.controls != 1 {
+		t.Errorf("control message dropped by the rate limit")
+	}
+}
+
 func TestProtocol_ScaleMessage(t *testing.T) {
 	tests := []struct {
 		name      string
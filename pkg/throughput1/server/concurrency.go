@@ -0,0 +1,90 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/m-lab/msak/pkg/throughput1/model"
+)
+
+// concurrency tracks the tests running on the server, so that each stream can
+// report how many other tests were running during its lifetime. Streams with
+// the same mid belong to the same test. Its zero value is ready to use.
+type concurrency struct {
+	mu sync.Mutex
+	// running maps the mid of each running test to its running streams.
+	running map[string]map[*testWindow]struct{}
+	// area is the integral of the number of running tests over time, in
+	// test-seconds, up to last.
+	area float64
+	last time.Time
+}
+
+// testWindow tracks the lifetime of a single stream.
+type testWindow struct {
+	mid       string
+	start     time.Time
+	startArea float64
+	// max is the largest number of other tests running so far.
+	max int
+}
+
+// advance updates the area up to now. The caller must hold c.mu.
+func (c *concurrency) advance(now time.Time) {
+	if !c.last.IsZero() && now.After(c.last) {
+		c.area += float64(len(c.running)) * now.Sub(c.last).Seconds()
+	}
+	if now.After(c.last) {
+		c.last = now
+	}
+}
+
+// testStarted registers a new stream of the test with the given mid, starting
+// at now, and returns its window, to be passed to testEnded when the stream is
+// over.
+func (h *Handler) testStarted(mid string, now time.Time) *testWindow {
+	c := &h.concurrency
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.advance(now)
+	if c.running == nil {
+		c.running = map[string]map[*testWindow]struct{}{}
+	}
+	if c.running[mid] == nil {
+		c.running[mid] = map[*testWindow]struct{}{}
+	}
+	w := &testWindow{mid: mid, start: now, startArea: c.area}
+	c.running[mid][w] = struct{}{}
+	// Every running stream, including the new one, now has len-1 other tests.
+	others := len(c.running) - 1
+	for _, windows := range c.running {
+		for r := range windows {
+			if others > r.max {
+				r.max = others
+			}
+		}
+	}
+	return w
+}
+
+// testEnded unregisters the stream with window w, ending at now, and returns
+// the number of other tests that were running during its lifetime.
+func (h *Handler) testEnded(w *testWindow, now time.Time) *model.ConcurrentTests {
+	c := &h.concurrency
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.advance(now)
+	delete(c.running[w.mid], w)
+	if len(c.running[w.mid]) == 0 {
+		delete(c.running, w.mid)
+	}
+	result := &model.ConcurrentTests{Max: w.max}
+	if elapsed := now.Sub(w.start).Seconds(); elapsed > 0 {
+		// The area includes the stream's own test, which was always running.
+		result.Mean = (c.area-w.startArea)/elapsed - 1
+		if result.Mean < 0 {
+			result.Mean = 0
+		}
+	}
+	return result
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestHandler_concurrentTests(t *testing.T) {
+	h := New(WithDataDir(t.TempDir()))
+	start := time.Now()
+
+	// a runs for 10s. b overlaps with its first 4s, c and d with 2s of its
+	// end, at the same time.
+	a := h.testStarted("a", start)
+	b := h.testStarted("b", start)
+	if got := h.testEnded(b, start.Add(4*time.Second)); got.Max != 1 || got.Mean != 1 {
+		t.Errorf("unexpected concurrency for b: %+v", got)
+	}
+	c := h.testStarted("c", start.Add(8*time.Second))
+	d := h.testStarted("d", start.Add(8*time.Second))
+	h.testEnded(c, start.Add(10*time.Second))
+	h.testEnded(d, start.Add(10*time.Second))
+	got := h.testEnded(a, start.Add(10*time.Second))
+	// (4s * 1 + 2s * 2) / 10s
+	if got.Max != 2 || math.Abs(got.Mean-0.8) > 1e-9 {
+		t.Errorf("unexpected concurrency for a: %+v", got)
+	}
+	if len(h.concurrency.running) != 0 {
+		t.Errorf("tests still running after their end")
+	}
+
+	// Streams of the same measurement are not counted as other tests.
+	f1 := h.testStarted("f", start.Add(12*time.Second))
+	f2 := h.testStarted("f", start.Add(12*time.Second))
+	g := h.testStarted("g", start.Add(14*time.Second))
+	h.testEnded(g, start.Add(16*time.Second))
+	h.testEnded(f2, start.Add(16*time.Second))
+	// 2s * 1 / 4s
+	if got := h.testEnded(f1, start.Add(16*time.Second)); got.Max != 1 ||
+		math.Abs(got.Mean-0.5) > 1e-9 {
+		t.Errorf("unexpected concurrency for f: %+v", got)
+	}
+
+	// A test running alone has no concurrent tests.
+	e := h.testStarted("e", start.Add(20*time.Second))
+	if got := h.testEnded(e, start.Add(25*time.Second)); got.Max != 0 || got.Mean != 0 {
+		t.Errorf("unexpected concurrency for e: %+v", got)
+	}
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"github.com/m-lab/msak/pkg/throughput1/model"
+)
+
+// downsample returns the measurements to archive when keeping one every n.
+// The first and last measurements are always kept, as are the ones with the
+// lowest and highest smoothed RTT, since extremes are what sampling would
+// most likely miss. If n is less than 2, measurements is returned unchanged.
+func downsample(measurements []model.Measurement, n int) []model.Measurement {
+	if n < 2 || len(measurements) <= 2 {
+		return measurements
+	}
+	keep := make([]bool, len(measurements))
+	for i := 0; i < len(measurements); i += n {
+		keep[i] = true
+	}
+	keep[len(measurements)-1] = true
+
+	minRTT, maxRTT := -1, -1
+	for i := range measurements {
+		info := measurements[i].TCPInfo
+		if info == nil {
+			continue
+		}
+		if minRTT == -1 || info.RTT < measurements[minRTT].TCPInfo.RTT {
+			minRTT = i
+		}
+		if maxRTT == -1 || info.RTT > measurements[maxRTT].TCPInfo.RTT {
+			maxRTT = i
+		}
+	}
+	if minRTT != -1 {
+		keep[minRTT] = true
+		keep[maxRTT] = true
+	}
+
+	var result []model.Measurement
+	for i, m := range measurements {
+		if keep[i] {
+			result = append(result, m)
+		}
+	}
+	return result
+}
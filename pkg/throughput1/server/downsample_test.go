@@ -0,0 +1,58 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/m-lab/msak/pkg/throughput1/model"
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+func Test_downsample(t *testing.T) {
+	rtts := []uint32{50, 40, 60, 45, 10, 55, 50, 90, 40, 50}
+	measurements := make([]model.Measurement, len(rtts))
+	for i, rtt := range rtts {
+		measurements[i] = model.Measurement{
+			ElapsedSinceTestStart: int64(i),
+			TCPInfo: &model.TCPInfo{
+				LinuxTCPInfo: tcp.LinuxTCPInfo{RTT: rtt},
+			},
+		}
+	}
+
+	tests := []struct {
+		name string
+		n    int
+		want []int64
+	}{
+		{
+			name: "disabled",
+			n:    1,
+			want: []int64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9},
+		},
+		{
+			name: "every third plus last and extrema",
+			n:    3,
+			want: []int64{0, 3, 4, 6, 7, 9},
+		},
+		{
+			name: "larger than the input",
+			n:    100,
+			want: []int64{0, 4, 7, 9},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := downsample(measurements, tt.n)
+			if len(got) != len(tt.want) {
+				t.Fatalf("downsample() returned %d measurements, want %d",
+					len(got), len(tt.want))
+			}
+			for i := range got {
+				if got[i].ElapsedSinceTestStart != tt.want[i] {
+					t.Errorf("measurement %d: got %d, want %d", i,
+						got[i].ElapsedSinceTestStart, tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"github.com/m-lab/msak/pkg/throughput1/model"
+)
+
+const (
+	// initialCwnd is Linux's initial congestion window, in packets. A
+	// congestion window reset to this value or less without any loss is
+	// a slow start restart.
+	initialCwnd = 10
+	// probeRTTCwnd is the congestion window, in packets, used by BBR while
+	// in PROBE_RTT.
+	probeRTTCwnd = 4
+)
+
+// detectEvents returns the congestion control events observed in the provided
+// sender-side measurements. Only measurements including TCPInfo are used.
+func detectEvents(measurements []model.Measurement) []model.Event {
+	var events []model.Event
+	var prev *model.Measurement
+	for i := range measurements {
+		m := &measurements[i]
+		if m.TCPInfo == nil {
+			continue
+		}
+		if prev != nil {
+			if t, ok := eventType(prev, m); ok {
+				events = append(events, model.Event{
+					Type:        t,
+					ElapsedTime: m.TCPInfo.ElapsedTime,
+				})
+			}
+		}
+		prev = m
+	}
+	return events
+}
+
+// eventType returns the type of the event occurred between prev and curr, if
+// any. A congestion window reduction is only considered an event when no
+// retransmissions happened in between, since loss recovery also reduces it.
+func eventType(prev, curr *model.Measurement) (string, bool) {
+	cwnd, prevCwnd := curr.TCPInfo.SndCwnd, prev.TCPInfo.SndCwnd
+	if cwnd >= prevCwnd || curr.TCPInfo.TotalRetrans != prev.TCPInfo.TotalRetrans {
+		return "", false
+	}
+	if curr.BBRInfo != nil {
+		if cwnd <= probeRTTCwnd && prevCwnd > probeRTTCwnd {
+			return model.EventProbeRTT, true
+		}
+		return "", false
+	}
+	if cwnd <= initialCwnd && prevCwnd > initialCwnd {
+		return model.EventSlowStartRestart, true
+	}
+	return "", false
+}
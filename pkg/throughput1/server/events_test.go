@@ -0,0 +1,75 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/m-lab/msak/pkg/throughput1/model"
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/tcp"
+)
+
+func snapshot(elapsed int64, cwnd, retrans uint32, bbr bool) model.Measurement {
+	m := model.Measurement{
+		TCPInfo: &model.TCPInfo{
+			LinuxTCPInfo: tcp.LinuxTCPInfo{SndCwnd: cwnd, TotalRetrans: retrans},
+			ElapsedTime:  elapsed,
+		},
+	}
+	if bbr {
+		m.BBRInfo = &inetdiag.BBRInfo{}
+	}
+	return m
+}
+
+func Test_detectEvents(t *testing.T) {
+	tests := []struct {
+		name         string
+		measurements []model.Measurement
+		want         []model.Event
+	}{
+		{
+			name: "no events",
+			measurements: []model.Measurement{
+				snapshot(100, 10, 0, false),
+				snapshot(200, 40, 0, false),
+				{}, // measurements without TCPInfo are ignored.
+				snapshot(300, 80, 0, false),
+			},
+		},
+		{
+			name: "slow start restart",
+			measurements: []model.Measurement{
+				snapshot(100, 80, 0, false),
+				{},
+				snapshot(300, 10, 0, false),
+				snapshot(400, 20, 0, false),
+			},
+			want: []model.Event{{Type: model.EventSlowStartRestart, ElapsedTime: 300}},
+		},
+		{
+			name: "loss is not a slow start restart",
+			measurements: []model.Measurement{
+				snapshot(100, 80, 0, false),
+				snapshot(200, 2, 1, false),
+			},
+		},
+		{
+			name: "probe rtt",
+			measurements: []model.Measurement{
+				snapshot(100, 80, 0, true),
+				snapshot(200, 4, 0, true),
+				snapshot(300, 80, 0, true),
+				snapshot(400, 40, 0, true),
+			},
+			want: []model.Event{{Type: model.EventProbeRTT, ElapsedTime: 200}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectEvents(tt.measurements); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("detectEvents() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
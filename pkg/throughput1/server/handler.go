@@ -0,0 +1,1043 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/m-lab/access/controller"
+	"github.com/m-lab/msak/internal/netx"
+	"github.com/m-lab/msak/internal/persistence"
+	"github.com/m-lab/msak/pkg/options"
+	"github.com/m-lab/msak/pkg/quota"
+	"github.com/m-lab/msak/pkg/throughput1"
+	"github.com/m-lab/msak/pkg/throughput1/capture"
+	"github.com/m-lab/msak/pkg/throughput1/model"
+	"github.com/m-lab/msak/pkg/throughput1/spec"
+	"github.com/m-lab/msak/pkg/version"
+)
+
+// finalMeasurementGracePeriod is how long to wait, in addition to the final
+// flush timeout, for the final measurement after a test is over before
+// writing the archival data.
+const finalMeasurementGracePeriod = time.Second
+
+// defaultCCAlgorithms are the congestion control algorithms clients can
+// request when the handler is not configured with WithAllowedCC.
+var defaultCCAlgorithms = []string{"reno", "cubic", "bbr"}
+
+// Handler serves throughput1 download and upload tests. Download and Upload
+// can be registered on any http.ServeMux, as long as the http.Server uses a
+// listener created with NewListener.
+type Handler struct {
+	// dataDir is the directory where results are written when no
+	// ArchivalWriter is provided.
+	dataDir string
+
+	// writer writes the archival data of completed tests.
+	writer ArchivalWriter
+
+	// validators run additional checks on the archival data.
+	validators []Validator
+
+	// metrics are the Prometheus metrics updated by this handler.
+	metrics *metrics
+
+	// maxStreamsPerMID is the maximum number of concurrent streams allowed
+	// for the same mid. Zero means no limit.
+	maxStreamsPerMID int
+
+	// generateMID enables generating a measurement ID for requests that do
+	// not include one.
+	generateMID bool
+
+	// allowCompression allows clients to negotiate WebSocket compression.
+	allowCompression bool
+
+	// allowedOrigins are the origins allowed to upgrade. If empty, every
+	// origin is allowed.
+	allowedOrigins []string
+
+	// allowedCC are the congestion control algorithms clients can request.
+	allowedCC map[string]struct{}
+
+	// metadataPolicy configures the client metadata accepted.
+	metadataPolicy options.MetadataPolicy
+
+	// reloadMu protects allowedOrigins, allowedCC and metadataPolicy, which
+	// can be changed by Reload while tests are running.
+	reloadMu sync.RWMutex
+
+	// maxRuntime is the maximum runtime of a stream. defaultDuration is the
+	// duration used when the client does not request one.
+	maxRuntime      time.Duration
+	defaultDuration time.Duration
+
+	// downsampling, if greater than one, is the factor archived
+	// measurements are downsampled by.
+	downsampling int
+
+	// captureDir, if not empty, is the directory where the sequence of
+	// messages of every test is recorded.
+	captureDir string
+
+	// finalFlushTimeout is how long the final measurement may take to be
+	// sent once a stream is over.
+	finalFlushTimeout time.Duration
+
+	// sndbuf and rcvbuf are the socket buffer sizes to set on throughput1
+	// connections. Zero means the kernel's default.
+	sndbuf, rcvbuf int
+
+	// qdisc is the server's default queueing discipline, if known.
+	qdisc string
+
+	// advertisedServer is the server's public host name or address, if
+	// configured.
+	advertisedServer string
+
+	// hostStats enables recording the host's interface and qdisc counters
+	// in every result.
+	hostStats bool
+
+	// notSentLowat is the TCP_NOTSENT_LOWAT value to set on download
+	// connections. Zero means it is not set.
+	notSentLowat int
+
+	// memoryBudget is the maximum memory committed to WebSocket buffers
+	// across active connections. Zero means no limit. bufferMemory is the
+	// memory currently committed.
+	memoryBudget int64
+	bufferMemory atomic.Int64
+
+	// maxConcurrentTests is the maximum number of concurrent tests, i.e.
+	// throughput1 connections, across all mids. Zero means no limit.
+	// activeTests is the number of tests currently active.
+	maxConcurrentTests int64
+	activeTests        atomic.Int64
+
+	// draining is true once Drain has been called. New tests are rejected
+	// while draining. stop is closed to stop the active tests early.
+	draining atomic.Bool
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	// tokenMachine is the machine name access tokens are verified against.
+	// It is recorded in the archived AccessToken.
+	tokenMachine string
+
+	// tokenExpiryPolicy is what to do with streams that would outlive their
+	// access token.
+	tokenExpiryPolicy TokenExpiryPolicy
+
+	// quota enforces per-subject daily quotas on requests with a verified
+	// access token. If nil, no quotas are enforced.
+	quota *quota.Store
+
+	// monitors tracks the clients of the Monitor endpoint.
+	monitors monitors
+
+	// streamGroups tracks the active streams per mid.
+	streamGroups   map[string]*streamGroup
+	streamGroupsMu sync.Mutex
+
+	// concurrency tracks the tests running on the server.
+	concurrency concurrency
+}
+
+// New returns a new Handler configured with the provided options.
+func New(opts ...Option) *Handler {
+	h := &Handler{
+		streamGroups:      map[string]*streamGroup{},
+		maxRuntime:        spec.MaxRuntime,
+		tokenExpiryPolicy: TokenExpiryClamp,
+		defaultDuration:   options.DefaultDuration,
+		finalFlushTimeout: spec.FinalFlushTimeout,
+		metadataPolicy:    options.DefaultMetadataPolicy,
+		stop:              make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	if h.writer == nil {
+		h.writer = &persistence.FileWriter{Dir: h.dataDir}
+	}
+	if h.metrics == nil {
+		h.metrics = defaultMetrics()
+	}
+	if h.allowedCC == nil {
+		WithAllowedCC(defaultCCAlgorithms...)(h)
+	}
+	if netx.FQPacing(h.qdisc) {
+		h.metrics.fqPacing.Set(1)
+	} else {
+		h.metrics.fqPacing.Set(0)
+	}
+	return h
+}
+
+// writeCapture writes the messages recorded for the connection with the
+// provided UUID to captureDir.
+func (h *Handler) writeCapture(uuid string, recorder *capture.Recorder) {
+	path := filepath.Join(h.captureDir, uuid+".json")
+	err := os.MkdirAll(h.captureDir, 0755)
+	if err == nil {
+		err = recorder.Recording().WriteFile(path)
+	}
+	if err != nil {
+		log.Error("Failed to write capture", "path", path, "error", err)
+	}
+}
+
+func (h *Handler) Download(rw http.ResponseWriter, req *http.Request) {
+	h.upgradeAndRunMeasurement(model.DirectionDownload, false, rw, req)
+}
+
+func (h *Handler) Upload(rw http.ResponseWriter, req *http.Request) {
+	h.upgradeAndRunMeasurement(model.DirectionUpload, false, rw, req)
+}
+
+// upgradeAndRunMeasurement runs a single stream in the given direction. If
+// ndt7 is true, the client speaks the ndt7 protocol and the result is
+// archived as spec.NDT7Datatype.
+//
+// TODO: trace the test's lifecycle (upgrade, first byte, each phase and the
+// archive write) with OpenTelemetry spans exported via OTLP, once the
+// dependency is available to this build.
+func (h *Handler) upgradeAndRunMeasurement(kind model.TestDirection, ndt7 bool,
+	rw http.ResponseWriter, req *http.Request) {
+	var midSource string
+	mid, err := GetMIDFromRequest(req)
+	if err != nil && h.generateMID {
+		mid = uuid.NewString()
+		midSource = model.MIDSourceServerGenerated
+		err = nil
+	} else if err == nil && h.generateMID && h.isGeneratedMID(mid) {
+		// The mid generated for the first stream of a measurement is
+		// returned to the client, which provides it for the other streams.
+		midSource = model.MIDSourceServerGenerated
+	}
+	if err != nil {
+		h.metrics.websocketUpgrades.WithLabelValues(string(kind), "missing-mid").Inc()
+		log.Info("Received request without mid", "source", req.RemoteAddr,
+			"error", err)
+		writeBadRequest(rw)
+		return
+	}
+
+	// Reject cross-origin requests from origins that are not allowed.
+	allowedOrigins, allowedCC, metadataPolicy := h.policy()
+	if !throughput1.OriginAllowed(req, allowedOrigins) {
+		h.metrics.websocketUpgrades.WithLabelValues(string(kind),
+			"origin-not-allowed").Inc()
+		log.Info("Origin not allowed", "source", req.RemoteAddr,
+			"origin", req.Header.Get("Origin"))
+		rw.Header().Set("Connection", "Close")
+		rw.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	// Shed load if the server is running the maximum number of concurrent
+	// tests, so that clients can be steered to another server.
+	if !h.acquireTest() {
+		h.metrics.shedRequests.WithLabelValues(string(kind)).Inc()
+		h.metrics.websocketUpgrades.WithLabelValues(string(kind),
+			"too-many-tests").Inc()
+		log.Info("Maximum number of concurrent tests reached",
+			"source", req.RemoteAddr)
+		rw.Header().Set("Connection", "Close")
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer h.releaseTest()
+
+	// While draining, reject new tests so that clients can retry on another
+	// server. This is checked after acquireTest so that Drain cannot miss a
+	// test starting concurrently.
+	if h.draining.Load() {
+		h.metrics.websocketUpgrades.WithLabelValues(string(kind),
+			"draining").Inc()
+		log.Info("Rejecting test while draining", "source", req.RemoteAddr)
+		rw.Header().Set("Connection", "Close")
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	// Read known protocol options from the querystring and validate them.
+	// ndt7 clients only send metadata.
+	var opts *options.Options
+	if ndt7 {
+		opts, err = ndt7Options(req.URL.Query(), metadataPolicy)
+	} else {
+		opts, err = options.ParseWithPolicy(req.URL.Query(), metadataPolicy)
+	}
+	if err != nil {
+		reason := "invalid-options"
+		var optErr *options.Error
+		if errors.As(err, &optErr) {
+			reason = optErr.Reason
+		}
+		switch reason {
+		case options.ReasonMetadataKeyTooLong, options.ReasonMetadataValueTooLong,
+			options.ReasonTooManyMetadata:
+			h.metrics.metadataRejections.WithLabelValues(reason).Inc()
+		}
+		h.metrics.websocketUpgrades.WithLabelValues(string(kind), reason).Inc()
+		log.Info("Received request with invalid options", "source", req.RemoteAddr,
+			"error", err)
+		writeBadRequest(rw)
+		return
+	}
+	if len(opts.DroppedMetadata) > 0 {
+		h.metrics.metadataRejections.WithLabelValues(
+			options.ReasonMetadataNotAllowed).Add(float64(len(opts.DroppedMetadata)))
+		log.Debug("Dropped metadata not in the allowlist", "source", req.RemoteAddr,
+			"keys", opts.DroppedMetadata)
+	}
+
+	// The cc parameter can be a comma-separated list to select a different
+	// algorithm for each stream of this mid. Check that every requested CC
+	// algorithm is allowed. Note that we cannot set it here since we don't
+	// have a net.Conn yet.
+	for _, cc := range opts.CC {
+		if _, ok := allowedCC[cc]; !ok {
+			log.Info("Requested CC algorithm is not allowed",
+				"source", req.RemoteAddr, "cc", cc)
+			writeBadRequest(rw)
+			return
+		}
+	}
+	// Use the default duration if none was requested, and never run for
+	// longer than the configured maximum runtime. A requested duration of
+	// zero means the test is only bounded by the byte limit and the maximum
+	// runtime.
+	duration := opts.Duration
+	if duration == 0 && !opts.NoDurationLimit {
+		duration = h.defaultDuration
+	}
+	if duration == 0 || duration > h.maxRuntime {
+		duration = h.maxRuntime
+	}
+	// Streams must not outlive their authorization.
+	durationClamped := false
+	if remaining, ok := tokenValidity(req, time.Now()); ok && duration > remaining &&
+		h.tokenExpiryPolicy != TokenExpiryIgnore {
+		if h.tokenExpiryPolicy == TokenExpiryReject || remaining <= 0 {
+			h.metrics.tokenExpiryDecisions.WithLabelValues(string(kind), "rejected").Inc()
+			h.metrics.websocketUpgrades.WithLabelValues(string(kind),
+				"token-expiry").Inc()
+			log.Info("Requested duration exceeds the access token's validity",
+				"source", req.RemoteAddr, "duration", duration, "remaining", remaining)
+			rw.Header().Set("Connection", "Close")
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		h.metrics.tokenExpiryDecisions.WithLabelValues(string(kind), "clamped").Inc()
+		log.Debug("Clamping duration to the access token's validity",
+			"source", req.RemoteAddr, "duration", duration, "remaining", remaining)
+		duration = remaining
+		durationClamped = true
+	}
+	var measureInterval time.Duration
+	if opts.MeasureInterval != 0 {
+		// Clamp the requested interval to the bounds allowed by the server.
+		measureInterval = options.ClampMeasureInterval(opts.MeasureInterval)
+	}
+
+	// Enforce the maximum number of concurrent streams for this mid.
+	streamIndex, measurementStart, ok := h.acquireStream(mid, opts.Streams)
+	if !ok {
+		h.metrics.streamLimitRejections.WithLabelValues(string(kind)).Inc()
+		h.metrics.websocketUpgrades.WithLabelValues(string(kind),
+			"too-many-streams").Inc()
+		log.Info("Maximum number of streams reached", "source", req.RemoteAddr,
+			"mid", mid)
+		rw.Header().Set("Connection", "Close")
+		rw.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	defer h.releaseStream(mid)
+	if midSource == model.MIDSourceServerGenerated {
+		h.markGeneratedMID(mid)
+	}
+
+	// Enforce the daily quotas of the access token's subject. Only the first
+	// stream of a measurement counts as a new test.
+	subject := h.quotaSubject(req)
+	if subject != "" && streamIndex == 0 {
+		var exceeded *quota.ExceededError
+		if err := h.quota.Allow(subject, time.Now()); errors.As(err, &exceeded) {
+			h.metrics.websocketUpgrades.WithLabelValues(string(kind),
+				"quota-exceeded").Inc()
+			log.Info("Quota exceeded", "source", req.RemoteAddr,
+				"subject", subject, "limit", exceeded.Limit)
+			writeQuotaExceeded(rw, exceeded)
+			return
+		}
+	}
+
+	// The n-th concurrent stream for this mid uses the n-th requested CC
+	// algorithm, wrapping around if fewer algorithms than streams are given.
+	var requestCC string
+	if len(opts.CC) > 0 {
+		requestCC = opts.CC[streamIndex%len(opts.CC)]
+	}
+
+	// Reserve memory for this connection's WebSocket buffers.
+	if !h.reserveBufferMemory() {
+		h.metrics.websocketUpgrades.WithLabelValues(string(kind),
+			"memory-budget-exceeded").Inc()
+		log.Info("Memory budget exceeded", "source", req.RemoteAddr,
+			"mid", mid)
+		rw.Header().Set("Connection", "Close")
+		rw.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer h.releaseBufferMemory()
+
+	// Everything looks good, try upgrading the connection to WebSocket.
+	// Once upgraded, the underlying TCP connection is hijacked and the throughput1
+	// protocol code will take care of closing it. Note that for this reason
+	// we cannot call writeBadRequest after attempting an Upgrade.
+	upgradeOpts := throughput1.UpgradeOptions{
+		EnableCompression: h.allowCompression,
+		AllowedOrigins:    allowedOrigins,
+	}
+	if ndt7 {
+		upgradeOpts.Subprotocols = []string{spec.SecWebSocketProtocolNDT7}
+	}
+	upgradeOpts.ResponseHeader = http.Header{}
+	if midSource == model.MIDSourceServerGenerated {
+		upgradeOpts.ResponseHeader.Set(spec.MeasurementIDHeader, mid)
+	}
+	if opts.Delay > 0 {
+		upgradeOpts.ResponseHeader.Set(spec.StreamDelayHeader, strconv.FormatInt(
+			streamDelay(streamIndex, opts.Delay).Milliseconds(), 10))
+	}
+	wsConn, err := throughput1.UpgradeWithOptions(rw, req, upgradeOpts)
+	if err != nil {
+		h.metrics.websocketUpgrades.WithLabelValues(string(kind),
+			"websocket-upgrade-failed").Inc()
+		log.Info("Websocket upgrade failed",
+			"uuid", netx.LoadUUID(req.Context()), "error", err)
+		return
+	}
+
+	// Now that the connection has been upgraded to WebSocket, we get access to
+	// the underlying TCP connection. If this is not a netx.Conn, it means the
+	// server was not initialized correctly and the following line will panic.
+	conn := netx.ToConnInfo(wsConn.UnderlyingConn())
+
+	// If a congestion control algorithm was requested, attempt to set it here.
+	// This can only be done after upgrading the connection.
+	// Errors are not fatal: for example, the client might have requested a
+	// congestion control algorithm that's not available on this system. In
+	// this case, we should still run with the default and record the requested
+	// vs/ actual CC used in the archival data.
+	if requestCC != "" {
+		err = conn.SetCC(requestCC)
+		if err != nil {
+			h.metrics.congestionControlErrors.WithLabelValues(requestCC).Inc()
+			log.Info("Failed to set cc", "uuid", conn.UUID(),
+				"source", wsConn.RemoteAddr(),
+				"cc", requestCC, "error", err)
+		}
+	}
+	// Read the algorithm actually in use. This fails on systems where the
+	// congestion control cannot be read, e.g. on Windows.
+	actualCC, err := conn.GetCC()
+	if err != nil {
+		log.Debug("Failed to read cc", "uuid", conn.UUID(),
+			"error", err)
+	}
+	if requestCC != "" && actualCC != "" && actualCC != requestCC {
+		h.metrics.congestionControlMismatches.WithLabelValues(requestCC,
+			actualCC).Inc()
+	}
+
+	// Set the socket buffer sizes, if configured, and read the effective
+	// values so that buffer-limited results can be identified.
+	if err := conn.SetSocketBuffers(h.sndbuf, h.rcvbuf); err != nil {
+		log.Info("Failed to set socket buffers", "uuid", conn.UUID(),
+			"sndbuf", h.sndbuf, "rcvbuf", h.rcvbuf, "error", err)
+	}
+	sndbuf, rcvbuf, err := conn.SocketBuffers()
+	if err != nil {
+		log.Debug("Failed to read socket buffers", "uuid", conn.UUID(),
+			"error", err)
+	}
+
+	// Limit the unsent data queued in the socket for downloads, if
+	// configured, so that the sender's byte counters stay meaningful.
+	var notSentLowat int
+	if kind == model.DirectionDownload && h.notSentLowat > 0 {
+		if err := conn.SetNotSentLowat(h.notSentLowat); err != nil {
+			log.Info("Failed to set TCP_NOTSENT_LOWAT", "uuid", conn.UUID(),
+				"value", h.notSentLowat, "error", err)
+		} else {
+			notSentLowat = h.notSentLowat
+		}
+	}
+
+	// Record the root qdisc of the serving interface, falling back to the
+	// server's default one if it cannot be read.
+	qdisc := h.qdisc
+	iface, err := netx.InterfaceByAddr(wsConn.UnderlyingConn().LocalAddr())
+	if err == nil {
+		if q, err := netx.InterfaceQdisc(iface); err == nil {
+			qdisc = q
+		} else {
+			log.Debug("Failed to read the interface's qdisc", "uuid", conn.UUID(),
+				"interface", iface.Name, "error", err)
+		}
+	} else {
+		log.Debug("Failed to find the serving interface", "uuid", conn.UUID(),
+			"error", err)
+	}
+
+	// The WS upgrade succeeded, so update the clientConnections metric.
+	h.metrics.websocketUpgrades.WithLabelValues(string(kind),
+		"ok").Inc()
+
+	uuid := conn.UUID()
+	archivalData := model.Throughput1Result{
+		MeasurementID:        mid,
+		MIDSource:            midSource,
+		AccessToken:          h.accessToken(req),
+		UUID:                 uuid,
+		StartTime:            time.Now(),
+		Server:               wsConn.UnderlyingConn().LocalAddr().String(),
+		AdvertisedServer:     h.advertisedServer,
+		Client:               wsConn.UnderlyingConn().RemoteAddr().String(),
+		AddressFamily:        netx.AddressFamily(wsConn.UnderlyingConn().RemoteAddr()),
+		Direction:            string(kind),
+		StreamIndex:          streamIndex,
+		TotalStreams:         opts.Streams,
+		MeasurementStartTime: measurementStart,
+		RequestedCC:          requestCC,
+		ActualCC:             actualCC,
+		SendBuffer:           sndbuf,
+		ReceiveBuffer:        rcvbuf,
+		NotSentLowat:         notSentLowat,
+		Qdisc:                qdisc,
+		FQPacing:             netx.FQPacing(qdisc),
+		GitShortCommit:       version.Get().GitShortCommit,
+		Version:              version.Get().Version,
+		Build:                version.Get(),
+		ClientMetadata:       opts.Metadata,
+		ClientOptions:        opts.Raw,
+		Compression:          throughput1.CompressionNegotiated(wsConn),
+	}
+	if archivalData.AccessToken != nil {
+		archivalData.AccessToken.DurationClamped = durationClamped
+	}
+	window := h.testStarted(mid, archivalData.StartTime)
+	h.metrics.runningTests.WithLabelValues(string(kind)).Inc()
+	// Sample the serving interface's counters so that drops on the host
+	// during the test can be detected.
+	var hostStatsIface *net.Interface
+	var hostStatsStart netx.HostStats
+	if h.hostStats && iface != nil {
+		hostStatsStart, err = netx.ReadHostStats(iface)
+		if err != nil {
+			log.Debug("Failed to read host stats", "uuid", uuid, "error", err)
+		} else {
+			hostStatsIface = iface
+		}
+	}
+	// truncated is set if the test does not terminate normally. status and
+	// testErr describe how it terminated.
+	truncated := false
+	status := "unknown"
+	var testErr error
+	defer func() {
+		archivalData.EndTime = time.Now()
+		archivalData.StreamSkew = h.streamEnded(mid, archivalData.EndTime)
+		archivalData.ConcurrentTests = h.testEnded(window, archivalData.EndTime)
+		h.metrics.runningTests.WithLabelValues(string(kind)).Dec()
+		h.metrics.testDuration.WithLabelValues(string(kind)).Observe(
+			archivalData.EndTime.Sub(archivalData.StartTime).Seconds())
+		archivalData.ECN = lastECN(archivalData.ServerMeasurements)
+		if hostStatsIface != nil {
+			archivalData.HostStats = endHostStats(hostStatsIface, hostStatsStart)
+			if archivalData.HostStats != nil && archivalData.HostStats.Drops() > 0 {
+				h.metrics.hostDropTests.WithLabelValues(string(kind)).Inc()
+			}
+		}
+		// Events are detected from the sender's measurements.
+		if kind == model.DirectionDownload {
+			archivalData.Events = detectEvents(archivalData.ServerMeasurements)
+		} else {
+			archivalData.Events = detectEvents(archivalData.ClientMeasurements)
+		}
+		archivalData.ValidationFlags = validateResult(&archivalData,
+			duration, opts.ByteLimit, truncated)
+		for _, v := range h.validators {
+			archivalData.ValidationFlags = append(archivalData.ValidationFlags,
+				v(&archivalData)...)
+		}
+		// Events and validation use every measurement, only the archive is
+		// downsampled.
+		if h.downsampling > 1 {
+			archivalData.ServerMeasurements = downsample(
+				archivalData.ServerMeasurements, h.downsampling)
+			archivalData.ClientMeasurements = downsample(
+				archivalData.ClientMeasurements, h.downsampling)
+			archivalData.DownsamplingFactor = h.downsampling
+		}
+		datatype := "throughput1"
+		if ndt7 {
+			datatype = spec.NDT7Datatype
+		}
+		h.writeResult(datatype, kind, &archivalData)
+		logSummary(kind, mid, &archivalData, status, testErr)
+		if subject != "" {
+			h.quota.AddBytes(subject, transferredBytes(&archivalData), time.Now())
+		}
+	}()
+
+	// Stagger the start of data transmission: the n-th concurrent stream for
+	// this mid waits n times the requested delay before starting.
+	if wait := streamDelay(streamIndex, opts.Delay); wait > 0 {
+		log.Debug("Delaying stream start", "mid", mid, "index", streamIndex,
+			"delay", wait)
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-req.Context().Done():
+		}
+		t.Stop()
+	}
+
+	h.streamStarted(mid, time.Now())
+
+	// Set the runtime to the requested duration.
+	timeout, cancel := context.WithTimeout(req.Context(), duration)
+	defer cancel()
+	proto := throughput1.New(wsConn)
+	if h.captureDir != "" {
+		recorder := capture.NewRecorder(capture.RoleServer,
+			spec.SubtestKind(kind), wsConn.Subprotocol())
+		proto.SetRecorder(recorder)
+		// This runs after the sending and receiving goroutines are done.
+		defer h.writeCapture(uuid, recorder)
+	}
+	// The hard deadline leaves time for the close handshake after a
+	// duration capped to maxRuntime.
+	proto.SetMaxRuntime(h.maxRuntime + finalMeasurementGracePeriod)
+	proto.SetFinalFlushTimeout(h.finalFlushTimeout)
+	proto.SetByteLimit(opts.ByteLimit)
+	proto.SetTargetRate(opts.TargetRate)
+	proto.SetPingInterval(spec.PingInterval)
+	proto.SetIdleTimeout(spec.IdleTimeout)
+	if measureInterval != 0 {
+		proto.SetMeasureInterval(measureInterval)
+	}
+	if kind == model.DirectionUpload && opts.NoCounterflow {
+		proto.SetCounterflow(false)
+	}
+	// Stop the test early if the handler is stopped while draining, and
+	// tell the client why.
+	var drained atomic.Bool
+	go func() {
+		select {
+		case <-h.stop:
+			drained.Store(true)
+			proto.SendControl(model.ControlMessage{
+				Action: model.ControlAbort,
+				Reason: model.AbortReasonServerDrained,
+			})
+			cancel()
+		case <-timeout.Done():
+		}
+	}()
+	params := proto.Parameters()
+	params.Duration = duration.Microseconds()
+	params.DefaultDuration = h.defaultDuration.Microseconds()
+	params.MaxRuntime = h.maxRuntime.Microseconds()
+	archivalData.Parameters = &params
+	var senderCh, receiverCh <-chan model.WireMeasurement
+	var errCh <-chan error
+	if kind == model.DirectionDownload {
+		senderCh, receiverCh, errCh = proto.SenderLoop(timeout)
+	} else {
+		senderCh, receiverCh, errCh = proto.ReceiverLoop(timeout)
+	}
+
+	onSenderMeasurement := func(m model.WireMeasurement) {
+		// If this is a download test we are the sender, so we can populate
+		// CCAlgorithm as soon as it's sent out at least once.
+		if kind == model.DirectionDownload && m.CC != "" {
+			archivalData.CCAlgorithm = m.CC
+		}
+		archivalData.ServerMeasurements = append(
+			archivalData.ServerMeasurements, m.Measurement)
+		h.monitors.publish(mid, model.MonitorEvent{UUID: uuid,
+			Direction: string(kind), Origin: model.MonitorOriginServer,
+			Measurement: m})
+	}
+	onReceiverMeasurement := func(m model.WireMeasurement) {
+		// Same for upload tests, but in this case the sender is the
+		// client. If the client ever sends the CC it's using, save it.
+		if kind == model.DirectionUpload && m.CC != "" {
+			archivalData.CCAlgorithm = m.CC
+		}
+		archivalData.ClientMeasurements = append(archivalData.ClientMeasurements,
+			m.Measurement)
+		h.monitors.publish(mid, model.MonitorEvent{UUID: uuid,
+			Direction: string(kind), Origin: model.MonitorOriginClient,
+			Measurement: m})
+	}
+
+	// Once the test is over, make sure the final measurement taken by the
+	// sending goroutine is archived. This runs before the result is written.
+	defer func() {
+		cancel()
+		if dropped := proto.DroppedMeasurements(); dropped > 0 {
+			archivalData.DroppedClientMeasurements = dropped
+			h.metrics.droppedMeasurements.WithLabelValues(string(kind)).Add(float64(dropped))
+		}
+		select {
+		case <-proto.SenderDone():
+		case <-time.After(h.finalFlushTimeout + finalMeasurementGracePeriod):
+			log.Info("Timed out waiting for the final measurement",
+				"uuid", uuid)
+		}
+	drain:
+		for {
+			select {
+			case m := <-senderCh:
+				onSenderMeasurement(m)
+			case m := <-receiverCh:
+				onReceiverMeasurement(m)
+			default:
+				break drain
+			}
+		}
+		// The archived ServerMeasurements are incomplete if the sending
+		// goroutine could not publish some of them.
+		if unpublished := proto.UnpublishedMeasurements(); unpublished > 0 {
+			archivalData.DroppedServerMeasurements = unpublished
+			h.metrics.unpublishedMeasurements.WithLabelValues(string(kind)).Add(float64(unpublished))
+		}
+	}()
+
+	for {
+		select {
+		case <-timeout.Done():
+			// If the server stopped the test while draining, the result is
+			// incomplete. The status is the reason sent to the client.
+			if drained.Load() {
+				status = model.AbortReasonServerDrained
+				h.metrics.testsTotal.WithLabelValues(string(kind), status).Inc()
+				archivalData.ServerDrained = true
+				truncated = true
+				return
+			}
+			// If the test has timed out count it as a success and return.
+			status = "ok-timeout"
+			h.metrics.testsTotal.WithLabelValues(string(kind), status).Inc()
+			return
+		case m := <-senderCh:
+			onSenderMeasurement(m)
+		case m := <-receiverCh:
+			onReceiverMeasurement(m)
+		case err := <-errCh:
+			// If the client aborted the test, the result is incomplete but
+			// this is not an error.
+			if websocket.IsCloseError(err, spec.CloseCodeAborted) {
+				status = "client-aborted"
+				h.metrics.testsTotal.WithLabelValues(string(kind), status).Inc()
+				archivalData.ClientAborted = true
+				return
+			}
+			// If this is a normal WS closure, it means the client closed the
+			// connection and the test was successful.
+			// "Abnormal" closures can happen if the client does not send a
+			// closure message before terminating the connection on its end.
+			// These are not counted as errors in the following code.
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure,
+				websocket.CloseAbnormalClosure) {
+				status = "ok"
+				h.metrics.testsTotal.WithLabelValues(string(kind), status).Inc()
+				return
+			}
+
+			// If this is a WS closure with a code different from CloseNormalClosure
+			// or CloseAbnormalClosure, count it as a close error.
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure,
+				websocket.CloseAbnormalClosure) {
+				status, testErr = "close-error", err
+				h.metrics.testsTotal.WithLabelValues(string(kind), status).Inc()
+				truncated = true
+				return
+			}
+
+			// If nothing has been received for too long, the client is
+			// likely gone.
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				status, testErr = "idle-timeout", err
+				h.metrics.testsTotal.WithLabelValues(string(kind), status).Inc()
+				truncated = true
+				return
+			}
+
+			// If the error is not a WS close, it means the test did not complete
+			// successfully.
+			status, testErr = "error", err
+			h.metrics.testsTotal.WithLabelValues(string(kind), status).Inc()
+			truncated = true
+			return
+		}
+	}
+}
+
+// streamDelay returns how long the stream with the given index should wait
+// before starting to transmit data, given the requested delay between streams.
+// The returned value is capped at spec.MaxStreamDelay.
+func streamDelay(index int, delay time.Duration) time.Duration {
+	wait := time.Duration(index) * delay
+	if wait > spec.MaxStreamDelay || (delay > 0 && wait/delay != time.Duration(index)) {
+		return spec.MaxStreamDelay
+	}
+	return wait
+}
+
+// transferredBytes returns the application-level bytes sent and received by
+// the server, according to the last server measurement.
+func transferredBytes(result *model.Throughput1Result) int64 {
+	n := len(result.ServerMeasurements)
+	if n == 0 {
+		return 0
+	}
+	last := result.ServerMeasurements[n-1].Application
+	return last.BytesSent + last.BytesReceived
+}
+
+func (h *Handler) writeResult(datatype string, kind model.TestDirection,
+	result *model.Throughput1Result) {
+	h.observeResult(kind, result)
+	err := h.writer.Write(datatype, string(kind),
+		persistence.ArchiveID(result.MeasurementID, result.UUID), result)
+	if err != nil {
+		log.Error("failed to write throughput1 result", "uuid", result.UUID,
+			"error", err)
+		h.metrics.fileWrites.WithLabelValues(string(kind), "error").Inc()
+		return
+	}
+	h.metrics.fileWrites.WithLabelValues(string(kind), "ok").Inc()
+}
+
+// logSummary logs a single line summarizing a completed stream, meant to be
+// ingested by log pipelines. status is the stream's outcome, as counted in
+// the tests_total metric, and err the error that terminated it, if any.
+func logSummary(kind model.TestDirection, mid string,
+	result *model.Throughput1Result, status string, err error) {
+	keyvals := []interface{}{
+		"protocol", "throughput1",
+		"mid", mid,
+		"uuid", result.UUID,
+		"direction", string(kind),
+		"duration", result.EndTime.Sub(result.StartTime),
+		"bytes", transferredBytes(result),
+		"status", status,
+	}
+	if err != nil {
+		keyvals = append(keyvals, "error", err)
+	}
+	log.Info("Test completed", keyvals...)
+}
+
+// Sources of a measurement ID, as returned by GetMIDAndSource.
+const (
+	// MIDSourceToken means the mid is the ID field of the JWT access token.
+	MIDSourceToken = "token"
+	// MIDSourceQuery means the mid is the "mid" querystring parameter.
+	MIDSourceQuery = "querystring"
+	// MIDSourceHeader means the mid is the X-Measurement-ID header.
+	MIDSourceHeader = "header"
+)
+
+// GetMIDFromRequest extracts the measurement id ("mid") from a given HTTP
+// request, if present. See GetMIDAndSource for the precedence rules.
+func GetMIDFromRequest(req *http.Request) (string, error) {
+	mid, _, err := GetMIDAndSource(req)
+	return mid, err
+}
+
+// GetMIDAndSource extracts the measurement id ("mid") from a given HTTP
+// request and returns it together with its source (one of the MIDSource*
+// constants).
+//
+// A measurement ID can be specified in three ways, in order of precedence:
+//   - via the ID field in the JWT access token (when access tokens are
+//     required, this is the only accepted source)
+//   - via a "mid" querystring parameter
+//   - via an X-Measurement-ID header, for proxies and integrations that
+//     cannot modify the querystring
+func GetMIDAndSource(req *http.Request) (string, string, error) {
+	// If the request includes a valid JWT token, the claim and the ID are in
+	// the request's context already.
+	claims := controller.GetClaim(req.Context())
+	if claims != nil {
+		return claims.ID, MIDSourceToken, nil
+	}
+
+	// Otherwise, try getting the "mid" querystring parameter.
+	if mid := req.URL.Query().Get(options.MIDParameterName); mid != "" {
+		return mid, MIDSourceQuery, nil
+	}
+
+	// Finally, try the X-Measurement-ID header.
+	if mid := req.Header.Get(spec.MeasurementIDHeader); mid != "" {
+		return mid, MIDSourceHeader, nil
+	}
+
+	return "", "", errors.New("no valid token nor mid found in the request")
+}
+
+// lastECN returns the ECN state in the last measurement including it, or nil
+// if no measurement does.
+func lastECN(measurements []model.Measurement) *model.ECN {
+	for i := len(measurements) - 1; i >= 0; i-- {
+		if measurements[i].ECN != nil {
+			return measurements[i].ECN
+		}
+	}
+	return nil
+}
+
+// ecnState returns the label describing the ECN state of a stream in the
+// ecn_streams_total metric.
+func ecnState(ecn *model.ECN) string {
+	switch {
+	case ecn.Seen:
+		return "seen"
+	case ecn.Negotiated:
+		return "negotiated"
+	default:
+		return "not-negotiated"
+	}
+}
+
+// observeResult updates the metrics summarizing the final server measurement
+// of a completed stream.
+func (h *Handler) observeResult(kind model.TestDirection, result *model.Throughput1Result) {
+	if result.ECN != nil {
+		h.metrics.ecnStreams.WithLabelValues(string(kind), ecnState(result.ECN)).Inc()
+		h.metrics.ecnDeliveredCE.WithLabelValues(string(kind)).Add(
+			float64(result.ECN.DeliveredCE))
+	}
+	n := len(result.ServerMeasurements)
+	if n == 0 {
+		return
+	}
+	last := result.ServerMeasurements[n-1]
+	bytes := transferredBytes(result)
+	h.metrics.bytesTransferred.WithLabelValues(string(kind)).Add(float64(bytes))
+	h.metrics.testBytes.WithLabelValues(string(kind)).Observe(float64(bytes))
+	if last.ElapsedSinceTestStart > 0 {
+		seconds := float64(last.ElapsedSinceTestStart) / 1e6
+		h.metrics.goodput.WithLabelValues(string(kind)).Observe(
+			float64(bytes) * 8 / seconds)
+	}
+	if last.TCPInfo != nil && last.TCPInfo.MinRTT > 0 {
+		h.metrics.minRTT.WithLabelValues(string(kind)).Observe(
+			float64(last.TCPInfo.MinRTT) / 1e6)
+	}
+}
+
+// accessToken returns the claims of the request's verified access token to
+// be archived, or nil if the request has no verified access token.
+func (h *Handler) accessToken(req *http.Request) *model.AccessToken {
+	claims := controller.GetClaim(req.Context())
+	if claims == nil {
+		return nil
+	}
+	token := &model.AccessToken{
+		Issuer:   claims.Issuer,
+		Audience: claims.Audience,
+		Machine:  h.tokenMachine,
+	}
+	if claims.Expiry != nil {
+		token.Expiry = claims.Expiry.Time()
+	}
+	return token
+}
+
+// tokenValidity returns the remaining validity of the request's verified
+// access token at now, and false if the request has no verified access token
+// or its token does not expire.
+func tokenValidity(req *http.Request, now time.Time) (time.Duration, bool) {
+	claims := controller.GetClaim(req.Context())
+	if claims == nil || claims.Expiry == nil {
+		return 0, false
+	}
+	return claims.Expiry.Time().Sub(now), true
+}
+
+// quotaSubject returns the subject of the request's access token if quotas
+// are enforced, or an empty string otherwise.
+func (h *Handler) quotaSubject(req *http.Request) string {
+	if h.quota == nil {
+		return ""
+	}
+	claims := controller.GetClaim(req.Context())
+	if claims == nil {
+		return ""
+	}
+	return claims.Subject
+}
+
+// writeQuotaExceeded sends a Too Many Requests response to the client,
+// including the exceeded quota as JSON.
+func writeQuotaExceeded(writer http.ResponseWriter, err *quota.ExceededError) {
+	writer.Header().Set("Connection", "Close")
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Retry-After",
+		strconv.Itoa(int(time.Until(err.Reset).Seconds())+1))
+	writer.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(writer).Encode(struct {
+		Error string `json:"error"`
+		*quota.ExceededError
+	}{Error: "quota-exceeded", ExceededError: err})
+}
+
+// writeBadRequest sends a Bad Request response to the client using writer.
+func writeBadRequest(writer http.ResponseWriter) {
+	writer.WriteHeader(http.StatusBadRequest)
+	writer.Header().Set("Connection", "Close")
+}
+
+// endHostStats returns the counters of iface accumulated since start, or nil
+// if they cannot be read.
+func endHostStats(iface *net.Interface, start netx.HostStats) *model.HostStats {
+	stats, err := netx.ReadHostStats(iface)
+	if err != nil {
+		log.Debug("Failed to read host stats", "interface", iface.Name,
+			"error", err)
+		return nil
+	}
+	d := stats.Sub(start)
+	return &model.HostStats{
+		Interface:    iface.Name,
+		RxDropped:    int64(d.RxDropped),
+		TxDropped:    int64(d.TxDropped),
+		RxErrors:     int64(d.RxErrors),
+		TxErrors:     int64(d.TxErrors),
+		QdiscDrops:   int64(d.QdiscDrops),
+		QdiscBacklog: int64(d.QdiscBacklog),
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/m-lab/msak/pkg/throughput1/model"
+	"github.com/m-lab/msak/pkg/throughput1/spec"
+)
+
+func Test_streamDelay(t *testing.T) {
+	tests := []struct {
+		name  string
+		index int
+		delay time.Duration
+		want  time.Duration
+	}{
+		{name: "first-stream", index: 0, delay: time.Second, want: 0},
+		{name: "no-delay", index: 3, delay: 0, want: 0},
+		{name: "third-stream", index: 2, delay: 500 * time.Millisecond, want: time.Second},
+		{name: "capped", index: 10, delay: time.Second, want: spec.MaxStreamDelay},
+		{name: "overflow", index: 2, delay: math.MaxInt64/2 + 1, want: spec.MaxStreamDelay},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := streamDelay(tt.index, tt.delay); got != tt.want {
+				t.Errorf("streamDelay() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_lastECN(t *testing.T) {
+	first := &model.ECN{Negotiated: true}
+	last := &model.ECN{Negotiated: true, Seen: true, DeliveredCE: 3}
+	measurements := []model.Measurement{{ECN: first}, {ECN: last}, {}}
+	if got := lastECN(measurements); got != last {
+		t.Errorf("lastECN() = %+v, want %+v", got, last)
+	}
+	if got := lastECN([]model.Measurement{{}}); got != nil {
+		t.Errorf("lastECN() = %+v, want nil", got)
+	}
+
+	for _, tt := range []struct {
+		ecn  *model.ECN
+		want string
+	}{
+		{ecn: &model.ECN{}, want: "not-negotiated"},
+		{ecn: first, want: "negotiated"},
+		{ecn: last, want: "seen"},
+	} {
+		if got := ecnState(tt.ecn); got != tt.want {
+			t.Errorf("ecnState(%+v) = %q, want %q", tt.ecn, got, tt.want)
+		}
+	}
+}
+
+func Test_logSummary(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFormatter(log.JSONFormatter)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFormatter(log.TextFormatter)
+	}()
+
+	start := time.Now()
+	result := &model.Throughput1Result{
+		UUID:      "test-uuid",
+		StartTime: start,
+		EndTime:   start.Add(10 * time.Second),
+		ServerMeasurements: []model.Measurement{{
+			Application: model.ByteCounters{BytesSent: 1000, BytesReceived: 10},
+		}},
+	}
+	logSummary(model.DirectionDownload, "test-mid", result, "close-error",
+		errors.New("close 1011"))
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("cannot unmarshal summary %q: %v", buf.String(), err)
+	}
+	want := map[string]interface{}{
+		"protocol":  "throughput1",
+		"mid":       "test-mid",
+		"uuid":      "test-uuid",
+		"direction": "download",
+		"duration":  "10s",
+		"bytes":     float64(1010),
+		"status":    "close-error",
+		"error":     "close 1011",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("summary[%q] = %v, want %v", k, got[k], v)
+		}
+	}
+}
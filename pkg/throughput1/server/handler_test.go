@@ -0,0 +1,1511 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/m-lab/access/controller"
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/msak/internal/netx"
+	"github.com/m-lab/msak/internal/persistence"
+	"github.com/m-lab/msak/pkg/options"
+	"github.com/m-lab/msak/pkg/quota"
+	"github.com/m-lab/msak/pkg/throughput1"
+	"github.com/m-lab/msak/pkg/throughput1/model"
+	"github.com/m-lab/msak/pkg/throughput1/server"
+	"github.com/m-lab/msak/pkg/throughput1/spec"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func TestNew(t *testing.T) {
+	h := server.New(server.WithDataDir("testdata/"))
+	if h == nil {
+		t.Errorf("New returned nil")
+	}
+}
+
+func setupTestServer(datadir string, h http.Handler) *httptest.Server {
+	tcpl, err := net.ListenTCP("tcp", nil)
+	rtx.Must(err, "cannot listen")
+	srv := httptest.NewUnstartedServer(h)
+	srv.Listener = netx.NewListener(tcpl)
+	return srv
+}
+
+func setupTestWSDialer(u *url.URL) *websocket.Dialer {
+	return &websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := net.Dial("tcp", u.Host)
+			if err != nil {
+				return nil, err
+			}
+			return netx.FromTCPLikeConn(conn.(*net.TCPConn))
+		},
+	}
+}
+
+func TestHandler_Upload(t *testing.T) {
+	tempDir := t.TempDir()
+	h := server.New(server.WithDataDir(tempDir))
+
+	srv := setupTestServer(tempDir, http.HandlerFunc(h.Upload))
+	srv.Start()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	rtx.Must(err, "cannot get server URL")
+	u.Scheme = "ws"
+	q := u.Query()
+	q.Add("mid", "test-mid")
+	q.Add("streams", "1")
+	q.Add("duration", "500")
+	u.RawQuery = q.Encode()
+
+	dialer := setupTestWSDialer(u)
+
+	headers := http.Header{}
+	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+
+	conn, _, err := dialer.Dial(u.String(), headers)
+	if err != nil {
+		t.Fatalf("websocket dial failed: %v", err)
+	}
+	if conn == nil {
+		t.Fatalf("websocket dial returned nil")
+	}
+	proto := throughput1.New(conn)
+	timeout, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	senderCh, receiverCh, errCh := proto.SenderLoop(timeout)
+	drain(t, timeout, senderCh, receiverCh, errCh)
+
+	// Check that the output JSON file has been created.
+	files, err := os.ReadDir(tempDir)
+	if err != nil {
+		t.Fatalf("reading output folder failed: %v", err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("invalid number of files in output folder")
+	}
+}
+
+func TestHandler_Download(t *testing.T) {
+	// Server setup.
+	tempDir := t.TempDir()
+	h := server.New(server.WithDataDir(tempDir))
+
+	srv := setupTestServer(tempDir, http.HandlerFunc(h.Download))
+	srv.Start()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	rtx.Must(err, "cannot get server URL")
+	u.Scheme = "ws"
+	q := u.Query()
+	q.Add("mid", "test-mid")
+	q.Add("streams", "1")
+	q.Add("duration", "500")
+	u.RawQuery = q.Encode()
+
+	dialer := setupTestWSDialer(u)
+
+	headers := http.Header{}
+	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+
+	conn, _, err := dialer.Dial(u.String(), headers)
+	if err != nil {
+		t.Fatalf("websocket dial failed: %v", err)
+	}
+	if conn == nil {
+		t.Fatalf("websocket dial returned nil")
+	}
+
+	proto := throughput1.New(conn)
+	timeout, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	senderCh, receiverCh, errCh := proto.ReceiverLoop(timeout)
+	drain(t, timeout, senderCh, receiverCh, errCh)
+
+	// Check that the output JSON file has been created.
+	files, err := os.ReadDir(tempDir)
+	if err != nil {
+		t.Fatalf("reading output folder failed: %v", err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("invalid number of files in output folder")
+	}
+}
+
+// resultRecorder is an ArchivalWriter that stores results in memory.
+type resultRecorder struct {
+	results chan *model.Throughput1Result
+}
+
+func (r *resultRecorder) Write(datatype, subtest, uuid string,
+	data interface{}) error {
+	r.results <- data.(*model.Throughput1Result)
+	return nil
+}
+
+func TestHandler_Options(t *testing.T) {
+	// Server setup.
+	tempDir := t.TempDir()
+	recorder := &resultRecorder{results: make(chan *model.Throughput1Result, 1)}
+	reg := prometheus.NewRegistry()
+	h := server.New(
+		server.WithDataDir(tempDir),
+		server.WithArchivalWriter(recorder),
+		server.WithRegistry(reg),
+		server.WithValidators(func(*model.Throughput1Result) []string {
+			return []string{"custom-check"}
+		}),
+	)
+
+	srv := setupTestServer(tempDir, http.HandlerFunc(h.Download))
+	srv.Start()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	rtx.Must(err, "cannot get server URL")
+	u.Scheme = "ws"
+	q := u.Query()
+	q.Add("mid", "test-mid")
+	q.Add("streams", "1")
+	q.Add("duration", "500")
+	u.RawQuery = q.Encode()
+
+	dialer := setupTestWSDialer(u)
+
+	headers := http.Header{}
+	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+
+	conn, _, err := dialer.Dial(u.String(), headers)
+	if err != nil {
+		t.Fatalf("websocket dial failed: %v", err)
+	}
+
+	proto := throughput1.New(conn)
+	timeout, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	senderCh, receiverCh, errCh := proto.ReceiverLoop(timeout)
+	drain(t, timeout, senderCh, receiverCh, errCh)
+
+	// The result must be written with the provided ArchivalWriter only.
+	var result *model.Throughput1Result
+	select {
+	case result = <-recorder.results:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("result not written to the ArchivalWriter")
+	}
+	if result.MeasurementID != "test-mid" {
+		t.Errorf("invalid mid: %q", result.MeasurementID)
+	}
+	found := false
+	for _, f := range result.ValidationFlags {
+		if f == "custom-check" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("custom validator flag missing: %v", result.ValidationFlags)
+	}
+	files, err := os.ReadDir(tempDir)
+	rtx.Must(err, "reading output folder failed")
+	if len(files) != 0 {
+		t.Errorf("unexpected files in the data directory: %d", len(files))
+	}
+
+	// Metrics must be registered with the provided registry.
+	mfs, err := reg.Gather()
+	rtx.Must(err, "failed to gather metrics")
+	if len(mfs) == 0 {
+		t.Errorf("no metrics registered with the provided registry")
+	}
+	// The completed stream must be observed by the summary histograms.
+	for _, name := range []string{
+		"msak_throughput1_goodput_bits_per_second",
+		"msak_throughput1_stream_bytes",
+		"msak_throughput1_test_duration_seconds",
+	} {
+		found := false
+		for _, mf := range mfs {
+			if mf.GetName() == name {
+				found = mf.GetMetric()[0].GetHistogram().GetSampleCount() == 1
+			}
+		}
+		if !found {
+			t.Errorf("histogram %s not observed", name)
+		}
+	}
+	// The stream is no longer running once its result is written.
+	for _, mf := range mfs {
+		if mf.GetName() == "msak_throughput1_running_tests" {
+			if v := mf.GetMetric()[0].GetGauge().GetValue(); v != 0 {
+				t.Errorf("running tests gauge is %v after the stream's end", v)
+			}
+		}
+	}
+}
+
+func TestHandler_DownloadInvalidCC(t *testing.T) {
+	// Server setup.
+	tempDir := t.TempDir()
+	h := server.New(server.WithDataDir(tempDir))
+
+	srv := setupTestServer(tempDir, http.HandlerFunc(h.Download))
+	srv.Start()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	rtx.Must(err, "cannot get server URL")
+	u.Scheme = "ws"
+	q := u.Query()
+	q.Add("mid", "test-mid")
+	q.Add("streams", "1")
+	q.Add("duration", "500")
+	q.Add("cc", "invalid")
+	u.RawQuery = q.Encode()
+
+	dialer := setupTestWSDialer(u)
+
+	headers := http.Header{}
+	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+
+	_, _, err = dialer.Dial(u.String(), headers)
+	if err == nil {
+		t.Fatalf("expected error on invalid cc, got nil")
+	}
+}
+
+func TestHandler_AllowedCC(t *testing.T) {
+	tempDir := t.TempDir()
+	h := server.New(server.WithDataDir(tempDir), server.WithAllowedCC("reno"))
+
+	srv := setupTestServer(tempDir, http.HandlerFunc(h.Download))
+	srv.Start()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	rtx.Must(err, "cannot get server URL")
+	u.Scheme = "ws"
+	headers := http.Header{}
+	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+
+	for cc, wantOK := range map[string]bool{"reno": true, "cubic": false} {
+		q := url.Values{}
+		q.Add("mid", "test-mid")
+		q.Add("streams", "1")
+		q.Add("duration", "100")
+		q.Add("cc", cc)
+		u.RawQuery = q.Encode()
+		conn, _, err := setupTestWSDialer(u).Dial(u.String(), headers)
+		if (err == nil) != wantOK {
+			t.Errorf("cc %s: unexpected dial result: %v", cc, err)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+func TestHandler_MaxStreamsPerMID(t *testing.T) {
+	tempDir := t.TempDir()
+	h := server.New(server.WithDataDir(tempDir), server.WithMaxStreamsPerMID(1))
+
+	srv := setupTestServer(tempDir, http.HandlerFunc(h.Download))
+	srv.Start()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	rtx.Must(err, "cannot get server URL")
+	u.Scheme = "ws"
+	q := u.Query()
+	q.Add("mid", "test-mid")
+	q.Add("streams", "2")
+	q.Add("duration", "500")
+	u.RawQuery = q.Encode()
+
+	dialer := setupTestWSDialer(u)
+	headers := http.Header{}
+	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+
+	conn, _, err := dialer.Dial(u.String(), headers)
+	if err != nil {
+		t.Fatalf("websocket dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	// A second stream for the same mid must be rejected.
+	_, resp, err := dialer.Dial(u.String(), headers)
+	if err == nil {
+		t.Fatalf("expected error when exceeding max streams, got nil")
+	}
+	if resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 response, got %v", resp)
+	}
+
+	// Once the first stream is done, a new one is accepted.
+	proto := throughput1.New(conn)
+	timeout, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	senderCh, receiverCh, errCh := proto.ReceiverLoop(timeout)
+	drain(t, timeout, senderCh, receiverCh, errCh)
+	time.Sleep(100 * time.Millisecond)
+
+	conn2, _, err := dialer.Dial(u.String(), headers)
+	if err != nil {
+		t.Fatalf("websocket dial after release failed: %v", err)
+	}
+	conn2.Close()
+}
+
+func TestHandler_GenerateMID(t *testing.T) {
+	tempDir := t.TempDir()
+	h := server.New(server.WithDataDir(tempDir), server.WithGenerateMID(true))
+
+	srv := setupTestServer(tempDir, http.HandlerFunc(h.Download))
+	srv.Start()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	rtx.Must(err, "cannot get server URL")
+	u.Scheme = "ws"
+	q := u.Query()
+	q.Add("streams", "1")
+	q.Add("duration", "500")
+	u.RawQuery = q.Encode()
+
+	headers := http.Header{}
+	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+	conn, resp, err := setupTestWSDialer(u).Dial(u.String(), headers)
+	if err != nil {
+		t.Fatalf("websocket dial failed: %v", err)
+	}
+	mid := resp.Header.Get(spec.MeasurementIDHeader)
+	if mid == "" {
+		t.Fatalf("missing %s header in response", spec.MeasurementIDHeader)
+	}
+
+	proto := throughput1.New(conn)
+	timeout, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	senderCh, receiverCh, errCh := proto.ReceiverLoop(timeout)
+	drain(t, timeout, senderCh, receiverCh, errCh)
+
+	// Check that the archived result contains the generated mid.
+	var result model.Throughput1Result
+	readSingleResult(t, tempDir, &result)
+	if result.MeasurementID != mid ||
+		result.MIDSource != model.MIDSourceServerGenerated {
+		t.Errorf("invalid mid in result: %q (%q), expected %q",
+			result.MeasurementID, result.MIDSource, mid)
+	}
+}
+
+func TestHandler_GenerateMIDStreams(t *testing.T) {
+	tempDir := t.TempDir()
+	h := server.New(server.WithDataDir(tempDir), server.WithGenerateMID(true))
+
+	srv := setupTestServer(tempDir, http.HandlerFunc(h.Download))
+	srv.Start()
+	defer srv.Close()
+
+	dial := func(mid string) (*websocket.Conn, string) {
+		u, err := url.Parse(srv.URL)
+		rtx.Must(err, "cannot get server URL")
+		u.Scheme = "ws"
+		q := u.Query()
+		q.Add("streams", "2")
+		q.Add("duration", "500")
+		if mid != "" {
+			q.Add("mid", mid)
+		}
+		u.RawQuery = q.Encode()
+		headers := http.Header{}
+		headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+		conn, resp, err := setupTestWSDialer(u).Dial(u.String(), headers)
+		if err != nil {
+			t.Fatalf("websocket dial failed: %v", err)
+		}
+		return conn, resp.Header.Get(spec.MeasurementIDHeader)
+	}
+
+	// The second stream provides the mid generated for the first one.
+	first, mid := dial("")
+	if mid == "" {
+		t.Fatalf("missing %s header in response", spec.MeasurementIDHeader)
+	}
+	second, _ := dial(mid)
+	wg := sync.WaitGroup{}
+	for _, conn := range []*websocket.Conn{first, second} {
+		wg.Add(1)
+		go func(conn *websocket.Conn) {
+			defer wg.Done()
+			proto := throughput1.New(conn)
+			timeout, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			senderCh, receiverCh, errCh := proto.ReceiverLoop(timeout)
+			drain(t, timeout, senderCh, receiverCh, errCh)
+		}(conn)
+	}
+	wg.Wait()
+
+	// Both streams are archived as part of the same server-generated mid.
+	var files []string
+	for deadline := time.Now().Add(2 * time.Second); len(files) < 2 &&
+		time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		files = nil
+		err := filepath.WalkDir(tempDir, func(path string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				files = append(files, path)
+			}
+			return err
+		})
+		rtx.Must(err, "cannot read output folder")
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected 2 result files, got %d", len(files))
+	}
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		rtx.Must(err, "cannot read result file")
+		var result model.Throughput1Result
+		rtx.Must(json.Unmarshal(b, &result), "cannot unmarshal result")
+		if result.MeasurementID != mid ||
+			result.MIDSource != model.MIDSourceServerGenerated {
+			t.Errorf("invalid mid in result: %q (%q), expected %q",
+				result.MeasurementID, result.MIDSource, mid)
+		}
+	}
+}
+
+func TestHandler_StreamDelayHeader(t *testing.T) {
+	tempDir := t.TempDir()
+	h := server.New(server.WithDataDir(tempDir))
+
+	srv := setupTestServer(tempDir, http.HandlerFunc(h.Download))
+	srv.Start()
+	defer srv.Close()
+
+	dial := func(delay string) *http.Response {
+		u, err := url.Parse(srv.URL)
+		rtx.Must(err, "cannot get server URL")
+		u.Scheme = "ws"
+		q := u.Query()
+		q.Add("mid", "test-mid-"+delay)
+		q.Add("streams", "2")
+		q.Add("duration", "500")
+		if delay != "" {
+			q.Add("delay", delay)
+		}
+		u.RawQuery = q.Encode()
+		headers := http.Header{}
+		headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+		conn, resp, err := setupTestWSDialer(u).Dial(u.String(), headers)
+		if err != nil {
+			t.Fatalf("websocket dial failed: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return resp
+	}
+
+	// The n-th stream of a measurement is told how long its start is delayed.
+	for i, want := range []string{"0", "200"} {
+		resp := dial("200")
+		if got := resp.Header.Get(spec.StreamDelayHeader); got != want {
+			t.Errorf("stream %d: invalid %s header: %q, want %q", i,
+				spec.StreamDelayHeader, got, want)
+		}
+	}
+	// Without a delay, streams are not staggered by the server.
+	resp := dial("")
+	if got := resp.Header.Get(spec.StreamDelayHeader); got != "" {
+		t.Errorf("unexpected %s header without delay: %q",
+			spec.StreamDelayHeader, got)
+	}
+}
+
+func TestHandler_ArchivesParameters(t *testing.T) {
+	tempDir := t.TempDir()
+	h := server.New(server.WithDataDir(tempDir),
+		server.WithSocketBuffers(64<<10, 32<<10), server.WithNotSentLowat(16<<10),
+		server.WithQdisc("fq"), server.WithHostStats(true),
+		server.WithAdvertisedServer("mlab1-lga0t.example.org"))
+
+	srv := setupTestServer(tempDir, http.HandlerFunc(h.Download))
+	srv.Start()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	rtx.Must(err, "cannot get server URL")
+	u.Scheme = "ws"
+	q := u.Query()
+	q.Add("mid", "test-mid")
+	q.Add("streams", "1")
+	q.Add("duration", "500")
+	q.Add(spec.MeasureIntervalParameterName, "200")
+	q.Add(spec.TargetRateParameterName, "1000000")
+	q.Add("cc", "reno")
+	u.RawQuery = q.Encode()
+
+	headers := http.Header{}
+	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+	conn, _, err := setupTestWSDialer(u).Dial(u.String(), headers)
+	if err != nil {
+		t.Fatalf("websocket dial failed: %v", err)
+	}
+	proto := throughput1.New(conn)
+	timeout, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	senderCh, receiverCh, errCh := proto.ReceiverLoop(timeout)
+	drain(t, timeout, senderCh, receiverCh, errCh)
+
+	var result model.Throughput1Result
+	path := readSingleResult(t, tempDir, &result)
+	// The file name includes the mid's hash and the UUID.
+	if !strings.HasSuffix(path, persistence.MIDHash("test-mid")+"."+result.UUID+".json") {
+		t.Errorf("invalid result file name: %s", path)
+	}
+	p := result.Parameters
+	if p == nil {
+		t.Fatalf("missing Parameters in result")
+	}
+	if p.AvgMeasureInterval != 200000 || p.Duration != 500000 ||
+		p.TargetRate != 1000000 || p.MinMessageSize != spec.MinMessageSize ||
+		p.MaxRuntime != spec.MaxRuntime.Microseconds() {
+		t.Errorf("invalid Parameters in result: %+v", p)
+	}
+	if result.RequestedCC != "reno" || result.ActualCC == "" {
+		t.Errorf("invalid RequestedCC/ActualCC: %q/%q", result.RequestedCC,
+			result.ActualCC)
+	}
+	// Linux reports twice the configured socket buffer sizes.
+	if result.SendBuffer != 128<<10 || result.ReceiveBuffer != 64<<10 {
+		t.Errorf("invalid SendBuffer/ReceiveBuffer: %d/%d", result.SendBuffer,
+			result.ReceiveBuffer)
+	}
+	if result.NotSentLowat != 16<<10 {
+		t.Errorf("invalid NotSentLowat: %d", result.NotSentLowat)
+	}
+	// The serving interface's root qdisc takes precedence over the default.
+	wantQdisc := "fq"
+	host, _, err := net.SplitHostPort(result.Server)
+	rtx.Must(err, "cannot parse server address")
+	iface, err := netx.InterfaceByAddr(&net.TCPAddr{IP: net.ParseIP(host)})
+	if err == nil {
+		if q, err := netx.InterfaceQdisc(iface); err == nil {
+			wantQdisc = q
+		}
+	}
+	if result.Qdisc != wantQdisc || result.FQPacing != netx.FQPacing(wantQdisc) {
+		t.Errorf("invalid Qdisc/FQPacing: %q/%v, want %q", result.Qdisc,
+			result.FQPacing, wantQdisc)
+	}
+	wantFamily := "ipv4"
+	if strings.HasPrefix(result.Client, "[") {
+		wantFamily = "ipv6"
+	}
+	if result.AddressFamily != wantFamily {
+		t.Errorf("invalid AddressFamily for %s: %q", result.Client, result.AddressFamily)
+	}
+	if result.AdvertisedServer != "mlab1-lga0t.example.org" {
+		t.Errorf("invalid AdvertisedServer: %q", result.AdvertisedServer)
+	}
+	if result.HostStats == nil || result.HostStats.Interface == "" {
+		t.Errorf("invalid HostStats: %+v", result.HostStats)
+	}
+}
+
+func TestHandler_Compression(t *testing.T) {
+	for _, allow := range []bool{false, true} {
+		tempDir := t.TempDir()
+		h := server.New(server.WithDataDir(tempDir),
+			server.WithAllowCompression(allow))
+		srv := setupTestServer(tempDir, http.HandlerFunc(h.Download))
+		srv.Start()
+
+		u, err := url.Parse(srv.URL)
+		rtx.Must(err, "cannot get server URL")
+		u.Scheme = "ws"
+		q := u.Query()
+		q.Add("mid", "test-mid")
+		q.Add("streams", "1")
+		q.Add("duration", "500")
+		u.RawQuery = q.Encode()
+
+		headers := http.Header{}
+		headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+		dialer := setupTestWSDialer(u)
+		dialer.EnableCompression = true
+		conn, _, err := dialer.Dial(u.String(), headers)
+		if err != nil {
+			t.Fatalf("websocket dial failed: %v", err)
+		}
+		proto := throughput1.New(conn)
+		timeout, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+		senderCh, receiverCh, errCh := proto.ReceiverLoop(timeout)
+		drain(t, timeout, senderCh, receiverCh, errCh)
+		cancel()
+		srv.Close()
+
+		// The archived value is the outcome of the negotiation, not the
+		// client's offer.
+		var result model.Throughput1Result
+		readSingleResult(t, tempDir, &result)
+		if result.Compression != allow {
+			t.Errorf("allow=%v: Compression = %v", allow, result.Compression)
+		}
+	}
+}
+
+func TestHandler_NoCounterflow(t *testing.T) {
+	tempDir := t.TempDir()
+	h := server.New(server.WithDataDir(tempDir))
+
+	srv := setupTestServer(tempDir, http.HandlerFunc(h.Upload))
+	srv.Start()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	rtx.Must(err, "cannot get server URL")
+	u.Scheme = "ws"
+	q := u.Query()
+	q.Add("mid", "test-mid")
+	q.Add("streams", "1")
+	q.Add("duration", "500")
+	q.Add(spec.MeasureIntervalParameterName, "100")
+	q.Add(spec.CounterflowParameterName, "false")
+	u.RawQuery = q.Encode()
+
+	headers := http.Header{}
+	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+	conn, _, err := setupTestWSDialer(u).Dial(u.String(), headers)
+	if err != nil {
+		t.Fatalf("websocket dial failed: %v", err)
+	}
+	proto := throughput1.New(conn)
+	timeout, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, receiverCh, errCh := proto.SenderLoop(timeout)
+	received := 0
+	for done := false; !done; {
+		select {
+		case <-receiverCh:
+			received++
+		case <-errCh:
+			done = true
+		case <-timeout.Done():
+			done = true
+		}
+	}
+	for len(receiverCh) > 0 {
+		<-receiverCh
+		received++
+	}
+	if received != 1 {
+		t.Errorf("received %d measurements, want only the final one", received)
+	}
+
+	var result model.Throughput1Result
+	readSingleResult(t, tempDir, &result)
+	if result.Parameters == nil || !result.Parameters.NoCounterflow {
+		t.Errorf("NoCounterflow not archived: %+v", result.Parameters)
+	}
+	// The server's measurements are archived anyway.
+	if len(result.ServerMeasurements) < 2 {
+		t.Errorf("too few server measurements archived: %d",
+			len(result.ServerMeasurements))
+	}
+}
+
+func TestHandler_DefaultDurationAndMaxRuntime(t *testing.T) {
+	tests := []struct {
+		name         string
+		duration     string
+		wantDuration time.Duration
+	}{
+		{name: "default", wantDuration: 300 * time.Millisecond},
+		{name: "capped", duration: "5000", wantDuration: 500 * time.Millisecond},
+		{name: "no duration limit", duration: "0", wantDuration: 500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			h := server.New(server.WithDataDir(tempDir),
+				server.WithDefaultDuration(300*time.Millisecond),
+				server.WithMaxRuntime(500*time.Millisecond))
+
+			srv := setupTestServer(tempDir, http.HandlerFunc(h.Download))
+			srv.Start()
+			defer srv.Close()
+
+			u, err := url.Parse(srv.URL)
+			rtx.Must(err, "cannot get server URL")
+			u.Scheme = "ws"
+			q := u.Query()
+			q.Add("mid", "test-mid")
+			q.Add("streams", "1")
+			if tt.duration != "" {
+				q.Add("duration", tt.duration)
+			}
+			u.RawQuery = q.Encode()
+
+			headers := http.Header{}
+			headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+			conn, _, err := setupTestWSDialer(u).Dial(u.String(), headers)
+			if err != nil {
+				t.Fatalf("websocket dial failed: %v", err)
+			}
+			proto := throughput1.New(conn)
+			timeout, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			senderCh, receiverCh, errCh := proto.ReceiverLoop(timeout)
+			drain(t, timeout, senderCh, receiverCh, errCh)
+
+			var result model.Throughput1Result
+			readSingleResult(t, tempDir, &result)
+			p := result.Parameters
+			if p == nil {
+				t.Fatalf("missing Parameters in result")
+			}
+			if p.Duration != tt.wantDuration.Microseconds() ||
+				p.DefaultDuration != 300000 || p.MaxRuntime != 500000 {
+				t.Errorf("invalid Parameters in result: %+v", p)
+			}
+		})
+	}
+}
+
+func TestHandler_ClientAbort(t *testing.T) {
+	tempDir := t.TempDir()
+	h := server.New(server.WithDataDir(tempDir))
+
+	srv := setupTestServer(tempDir, http.HandlerFunc(h.Download))
+	srv.Start()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	rtx.Must(err, "cannot get server URL")
+	u.Scheme = "ws"
+	q := u.Query()
+	q.Add("mid", "test-mid")
+	q.Add("streams", "1")
+	q.Add("duration", "5000")
+	u.RawQuery = q.Encode()
+
+	headers := http.Header{}
+	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+	conn, _, err := setupTestWSDialer(u).Dial(u.String(), headers)
+	if err != nil {
+		t.Fatalf("websocket dial failed: %v", err)
+	}
+	proto := throughput1.New(conn)
+	timeout, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	proto.ReceiverLoop(timeout)
+
+	// Abort the test after a short time.
+	time.Sleep(200 * time.Millisecond)
+	rtx.Must(proto.Abort("test"), "failed to abort")
+
+	var result model.Throughput1Result
+	readSingleResult(t, tempDir, &result)
+	if !result.ClientAborted {
+		t.Errorf("ClientAborted not set in result")
+	}
+	if result.EndTime.Sub(result.StartTime) > 2*time.Second {
+		t.Errorf("test did not terminate after abort")
+	}
+}
+
+func TestHandler_PerStreamCC(t *testing.T) {
+	tempDir := t.TempDir()
+	h := server.New(server.WithDataDir(tempDir))
+
+	srv := setupTestServer(tempDir, http.HandlerFunc(h.Download))
+	srv.Start()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	rtx.Must(err, "cannot get server URL")
+	u.Scheme = "ws"
+	q := u.Query()
+	q.Add("mid", "test-mid")
+	q.Add("streams", "2")
+	q.Add("duration", "500")
+	q.Add("cc", "reno,cubic")
+	u.RawQuery = q.Encode()
+
+	headers := http.Header{}
+	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+	timeout, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	// Connect both streams before the first one terminates.
+	var errChs []<-chan error
+	for i := 0; i < 2; i++ {
+		conn, _, err := setupTestWSDialer(u).Dial(u.String(), headers)
+		if err != nil {
+			t.Fatalf("websocket dial failed: %v", err)
+		}
+		_, _, errCh := throughput1.New(conn).ReceiverLoop(timeout)
+		errChs = append(errChs, errCh)
+	}
+	for _, errCh := range errChs {
+		select {
+		case <-errCh:
+		case <-timeout.Done():
+		}
+	}
+
+	var results []model.Throughput1Result
+	deadline := time.Now().Add(2 * time.Second)
+	for len(results) < 2 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		results = nil
+		err := filepath.WalkDir(tempDir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			var r model.Throughput1Result
+			b, err := os.ReadFile(path)
+			rtx.Must(err, "cannot read result file")
+			rtx.Must(json.Unmarshal(b, &r), "cannot unmarshal result")
+			results = append(results, r)
+			return nil
+		})
+		rtx.Must(err, "cannot read output folder")
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(results))
+	}
+	got := map[string]bool{}
+	for _, r := range results {
+		got[r.RequestedCC] = true
+	}
+	if !got["reno"] || !got["cubic"] {
+		t.Errorf("streams did not get distinct cc: %v", got)
+	}
+}
+
+// readSingleResult waits for a single JSON result file to be written to dir,
+// unmarshals it into v and returns its path.
+func readSingleResult(t *testing.T, dir string, v interface{}) string {
+	var files []string
+	deadline := time.Now().Add(2 * time.Second)
+	for len(files) == 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				files = append(files, path)
+			}
+			return err
+		})
+		rtx.Must(err, "cannot read output folder")
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected 1 result file, got %d", len(files))
+	}
+	b, err := os.ReadFile(files[0])
+	rtx.Must(err, "cannot read result file")
+	rtx.Must(json.Unmarshal(b, v), "cannot unmarshal result")
+	return files[0]
+}
+
+// Utility function to drain sender/receiver channels in tests.
+func drain(t *testing.T, timeout context.Context, senderCh,
+	receiverCh <-chan model.WireMeasurement, errCh <-chan error) {
+	for {
+		select {
+		case <-timeout.Done():
+			return
+		case <-senderCh:
+			// nothing
+		case <-receiverCh:
+			// nothing
+		case err := <-errCh:
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure) {
+				t.Fatalf("unexpected close: %v", err)
+			}
+			return
+		}
+	}
+}
+
+func TestHandler_MemoryBudget(t *testing.T) {
+	h := server.New(server.WithDataDir(t.TempDir()),
+		server.WithRegistry(prometheus.NewRegistry()), server.WithMemoryBudget(1))
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/?mid=test&streams=1", nil)
+	h.Download(res, req)
+	if res.Result().StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status code %d", res.Result().StatusCode)
+	}
+}
+
+func TestHandler_Quota(t *testing.T) {
+	store, err := quota.NewStore("", 1, 0)
+	rtx.Must(err, "cannot create quota store")
+	// Exhaust the daily tests quota.
+	rtx.Must(store.Allow("partner", time.Now()), "cannot record test")
+
+	h := server.New(server.WithDataDir(t.TempDir()),
+		server.WithRegistry(prometheus.NewRegistry()), server.WithQuota(store))
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/?streams=1", nil)
+	req = req.WithContext(controller.SetClaim(req.Context(),
+		&jwt.Claims{ID: "test", Subject: "partner"}))
+	h.Download(res, req)
+	if res.Result().StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("unexpected status code %d", res.Result().StatusCode)
+	}
+	var body struct {
+		Error   string
+		Subject string
+		Limit   string
+	}
+	rtx.Must(json.NewDecoder(res.Body).Decode(&body), "cannot decode body")
+	if body.Error != "quota-exceeded" || body.Subject != "partner" ||
+		body.Limit != quota.LimitTests {
+		t.Errorf("unexpected body: %+v", body)
+	}
+}
+
+func TestHandler_AccessToken(t *testing.T) {
+	tempDir := t.TempDir()
+	h := server.New(server.WithDataDir(tempDir),
+		server.WithRegistry(prometheus.NewRegistry()),
+		server.WithTokenMachine("mlab1-lga0t"))
+	expiry := time.Now().Add(time.Minute).Truncate(time.Second)
+	// Simulate the access token verification middleware.
+	handler := func(rw http.ResponseWriter, req *http.Request) {
+		h.Download(rw, req.WithContext(controller.SetClaim(req.Context(),
+			&jwt.Claims{
+				ID:       "token-mid",
+				Issuer:   "locate",
+				Audience: jwt.Audience{"mlab1-lga0t"},
+				Expiry:   jwt.NewNumericDate(expiry),
+			})))
+	}
+	srv := setupTestServer(tempDir, http.HandlerFunc(handler))
+	srv.Start()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL + "?streams=1&duration=500")
+	rtx.Must(err, "cannot get server URL")
+	u.Scheme = "ws"
+	headers := http.Header{}
+	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+	conn, _, err := setupTestWSDialer(u).Dial(u.String(), headers)
+	if err != nil {
+		t.Fatalf("websocket dial failed: %v", err)
+	}
+	timeout, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	senderCh, receiverCh, errCh := throughput1.New(conn).ReceiverLoop(timeout)
+	drain(t, timeout, senderCh, receiverCh, errCh)
+
+	var result model.Throughput1Result
+	readSingleResult(t, tempDir, &result)
+	token := result.AccessToken
+	if token == nil || token.Issuer != "locate" || len(token.Audience) != 1 ||
+		token.Machine != "mlab1-lga0t" || !token.Expiry.Equal(expiry) {
+		t.Errorf("unexpected access token: %+v", token)
+	}
+}
+
+func TestHandler_TokenExpiryPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   server.TokenExpiryPolicy
+		expiry   time.Duration
+		rejected bool
+	}{
+		{name: "reject", policy: server.TokenExpiryReject, expiry: 5 * time.Second, rejected: true},
+		{name: "clamp-expired", policy: server.TokenExpiryClamp, expiry: -time.Minute, rejected: true},
+		{name: "ignore", policy: server.TokenExpiryIgnore, expiry: 5 * time.Second},
+		{name: "within-validity", policy: server.TokenExpiryReject, expiry: time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := server.New(server.WithDataDir(t.TempDir()),
+				server.WithRegistry(prometheus.NewRegistry()),
+				server.WithTokenExpiryPolicy(tt.policy))
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/?streams=1&duration=120000", nil)
+			req = req.WithContext(controller.SetClaim(req.Context(),
+				&jwt.Claims{ID: "test", Expiry: jwt.NewNumericDate(time.Now().Add(tt.expiry))}))
+			h.Download(res, req)
+			// Requests that are not rejected fail the WebSocket upgrade.
+			if rejected := res.Result().StatusCode == http.StatusUnauthorized; rejected != tt.rejected {
+				t.Errorf("status code %d, want rejected = %v", res.Result().StatusCode, tt.rejected)
+			}
+		})
+	}
+}
+
+func TestHandler_TokenExpiryClamp(t *testing.T) {
+	tempDir := t.TempDir()
+	h := server.New(server.WithDataDir(tempDir),
+		server.WithRegistry(prometheus.NewRegistry()))
+	expiry := time.Now().Add(2 * time.Second).Truncate(time.Second)
+	handler := func(rw http.ResponseWriter, req *http.Request) {
+		h.Download(rw, req.WithContext(controller.SetClaim(req.Context(),
+			&jwt.Claims{ID: "token-mid", Expiry: jwt.NewNumericDate(expiry)})))
+	}
+	srv := setupTestServer(tempDir, http.HandlerFunc(handler))
+	srv.Start()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL + "?streams=1&duration=10000")
+	rtx.Must(err, "cannot get server URL")
+	u.Scheme = "ws"
+	headers := http.Header{}
+	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+	conn, _, err := setupTestWSDialer(u).Dial(u.String(), headers)
+	if err != nil {
+		t.Fatalf("websocket dial failed: %v", err)
+	}
+	timeout, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	senderCh, receiverCh, errCh := throughput1.New(conn).ReceiverLoop(timeout)
+	drain(t, timeout, senderCh, receiverCh, errCh)
+
+	var result model.Throughput1Result
+	readSingleResult(t, tempDir, &result)
+	if result.AccessToken == nil || !result.AccessToken.DurationClamped {
+		t.Errorf("unexpected access token: %+v", result.AccessToken)
+	}
+	if d := time.Duration(result.Parameters.Duration) * time.Microsecond; d > 2*time.Second {
+		t.Errorf("duration %v exceeds the token's validity", d)
+	}
+	if !result.EndTime.Before(expiry.Add(time.Second)) {
+		t.Errorf("stream ended at %v, after the token expired at %v", result.EndTime, expiry)
+	}
+}
+
+func TestHandler_AllowedOrigins(t *testing.T) {
+	h := server.New(server.WithDataDir(t.TempDir()),
+		server.WithRegistry(prometheus.NewRegistry()),
+		server.WithAllowedOrigins("https://*.example.com"))
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/?mid=test&streams=1", nil)
+	req.Header.Set("Origin", "https://evil.com")
+	h.Download(res, req)
+	if res.Result().StatusCode != http.StatusForbidden {
+		t.Errorf("unexpected status code %d", res.Result().StatusCode)
+	}
+}
+
+func TestHandler_Reload(t *testing.T) {
+	h := server.New(server.WithDataDir(t.TempDir()),
+		server.WithRegistry(prometheus.NewRegistry()),
+		server.WithAllowedOrigins("https://*.example.com"))
+	download := func() int {
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/?mid=test&streams=1&a=1&b=2", nil)
+		req.Header.Set("Origin", "https://evil.com")
+		h.Download(res, req)
+		return res.Result().StatusCode
+	}
+	if code := download(); code != http.StatusForbidden {
+		t.Errorf("unexpected status code before reload %d", code)
+	}
+	// Every origin is allowed after the reload, but the new metadata policy
+	// rejects the request.
+	h.Reload(server.Reloadable{
+		MetadataPolicy: options.MetadataPolicy{MaxCount: 1},
+	})
+	if code := download(); code != http.StatusBadRequest {
+		t.Errorf("unexpected status code after reload %d", code)
+	}
+}
+
+func TestHandler_MaxConcurrentTests(t *testing.T) {
+	tempDir := t.TempDir()
+	h := server.New(server.WithDataDir(tempDir),
+		server.WithRegistry(prometheus.NewRegistry()),
+		server.WithMaxConcurrentTests(1))
+	srv := setupTestServer(tempDir, http.HandlerFunc(h.Download))
+	srv.Start()
+	defer srv.Close()
+
+	// Start a test, which takes the only slot available.
+	u, err := url.Parse(srv.URL + "?mid=test&streams=1&duration=1000")
+	rtx.Must(err, "cannot get server URL")
+	u.Scheme = "ws"
+	headers := http.Header{}
+	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+	conn, _, err := setupTestWSDialer(u).Dial(u.String(), headers)
+	if err != nil {
+		t.Fatalf("websocket dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/?mid=other&streams=1", nil)
+	h.Download(res, req)
+	if res.Result().StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status code %d", res.Result().StatusCode)
+	}
+}
+
+func TestHandler_Drain(t *testing.T) {
+	tempDir := t.TempDir()
+	h := server.New(server.WithDataDir(tempDir),
+		server.WithRegistry(prometheus.NewRegistry()))
+	srv := setupTestServer(tempDir, http.HandlerFunc(h.Download))
+	srv.Start()
+	defer srv.Close()
+
+	// Start a test that would run much longer than the drain timeout.
+	u, err := url.Parse(srv.URL + "?mid=test&streams=1&duration=5000")
+	rtx.Must(err, "cannot get server URL")
+	u.Scheme = "ws"
+	headers := http.Header{}
+	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+	conn, _, err := setupTestWSDialer(u).Dial(u.String(), headers)
+	if err != nil {
+		t.Fatalf("websocket dial failed: %v", err)
+	}
+	timeout, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	clientProto := throughput1.New(conn)
+	senderCh, receiverCh, errCh := clientProto.ReceiverLoop(timeout)
+	aborted := make(chan model.ControlMessage, 1)
+	go func() {
+		for {
+			select {
+			case <-timeout.Done():
+				return
+			case <-senderCh:
+			case <-receiverCh:
+			case <-errCh:
+			case msg := <-clientProto.Control():
+				aborted <- msg
+			}
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer drainCancel()
+	start := time.Now()
+	if err := h.Drain(drainCtx); err != context.DeadlineExceeded {
+		t.Errorf("Drain() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Drain() took %v, the test was not stopped", elapsed)
+	}
+	// The client is told that the test was stopped.
+	select {
+	case msg := <-aborted:
+		if msg.Action != model.ControlAbort ||
+			msg.Reason != model.AbortReasonServerDrained {
+			t.Errorf("unexpected control message %+v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("client not told that the test was stopped")
+	}
+
+	// The stopped test has been archived.
+	var result model.Throughput1Result
+	readSingleResult(t, tempDir, &result)
+	if len(result.ServerMeasurements) == 0 {
+		t.Errorf("stopped test archived without measurements")
+	}
+	if !result.ServerDrained {
+		t.Errorf("ServerDrained not set in result")
+	}
+	truncated := false
+	for _, flag := range result.ValidationFlags {
+		truncated = truncated || flag == model.ValidationTruncated
+	}
+	if !truncated {
+		t.Errorf("stopped test not flagged as truncated: %v",
+			result.ValidationFlags)
+	}
+
+	// New tests are rejected.
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/?mid=other&streams=1", nil)
+	h.Download(res, req)
+	if res.Result().StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status code %d", res.Result().StatusCode)
+	}
+
+	// Draining an idle handler returns immediately.
+	if err := h.Drain(context.Background()); err != nil {
+		t.Errorf("Drain() error = %v", err)
+	}
+}
+
+func TestHandler_MetadataPolicy(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	h := server.New(server.WithDataDir(t.TempDir()), server.WithRegistry(reg),
+		server.WithMetadataPolicy(options.MetadataPolicy{
+			MaxKeyLength:   10,
+			MaxValueLength: 10,
+			MaxCount:       1,
+		}))
+	res := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/?mid=test&streams=1&a=1&b=2", nil)
+	h.Download(res, req)
+	if res.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("unexpected status code %d", res.Result().StatusCode)
+	}
+	mfs, err := reg.Gather()
+	rtx.Must(err, "failed to gather metrics")
+	found := false
+	for _, mf := range mfs {
+		if mf.GetName() != "msak_throughput1_metadata_rejections_total" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			found = m.GetLabel()[0].GetValue() == options.ReasonTooManyMetadata &&
+				m.GetCounter().GetValue() == 1
+		}
+	}
+	if !found {
+		t.Errorf("metadata rejection not counted")
+	}
+}
+
+func TestHandler_Validation(t *testing.T) {
+	// This string exceeds the maximum metadata key length.
+	longKey := strings.Repeat("longkey", 10)
+	longValue := strings.Repeat("longvalue", 100)
+	h := server.New(server.WithDataDir("testdata/"))
+	tests := []struct {
+		name       string
+		target     string
+		headers    http.Header
+		statusCode int
+	}{
+		{
+			name:       "missing mid",
+			target:     "/",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "missing streams",
+			target:     "/?mid=test",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "non-numeric streams",
+			target:     "/?mid=test&streams=abc",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "too many streams",
+			target:     "/?mid=test&streams=10000",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid duration",
+			target:     "/?mid=test&streams=2&duration=invalid",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid byte limit",
+			target:     "/?mid=test&streams=2&duration=1000&bytes=invalid",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid target rate",
+			target:     "/?mid=test&streams=2&target_rate=-1",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid measure interval",
+			target:     "/?mid=test&streams=2&measure_interval_ms=invalid",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid delay",
+			target:     "/?mid=test&streams=2&delay=-1",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "metadata key too long",
+			target:     "/?mid=test&streams=2&" + longKey,
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "metadata value too long",
+			target:     "/?mid=test&ŝtreams=2&key=" + longValue,
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "missing Upgrade header",
+			target:     "/?mid=test&streams=2&duration=5000",
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "unsupported CC",
+			target:     "/?mid=test&streams=2&cc=invalid",
+			statusCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Test download handler.
+			res := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", tt.target, nil)
+			req.Header = tt.headers
+			h.Download(res, req)
+			if res.Result().StatusCode != tt.statusCode {
+				t.Errorf("unexpected status code %d", res.Result().StatusCode)
+			}
+
+			// Repeat the test for the upload handler.
+			res = httptest.NewRecorder()
+			h.Upload(res, req)
+			if res.Result().StatusCode != tt.statusCode {
+				t.Errorf("unexpected status code %d", res.Result().StatusCode)
+			}
+		})
+	}
+}
+
+func TestGetMIDAndSource(t *testing.T) {
+	tests := []struct {
+		name       string
+		target     string
+		header     string
+		claimID    string
+		wantMID    string
+		wantSource string
+		wantErr    bool
+	}{
+		{
+			name:    "no mid",
+			target:  "/",
+			wantErr: true,
+		},
+		{
+			name:       "header",
+			target:     "/",
+			header:     "header-mid",
+			wantMID:    "header-mid",
+			wantSource: server.MIDSourceHeader,
+		},
+		{
+			name:       "querystring takes precedence over header",
+			target:     "/?mid=query-mid",
+			header:     "header-mid",
+			wantMID:    "query-mid",
+			wantSource: server.MIDSourceQuery,
+		},
+		{
+			name:       "token takes precedence over everything",
+			target:     "/?mid=query-mid",
+			header:     "header-mid",
+			claimID:    "token-mid",
+			wantMID:    "token-mid",
+			wantSource: server.MIDSourceToken,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.header != "" {
+				req.Header.Set(spec.MeasurementIDHeader, tt.header)
+			}
+			if tt.claimID != "" {
+				req = req.WithContext(controller.SetClaim(req.Context(),
+					&jwt.Claims{ID: tt.claimID}))
+			}
+			mid, source, err := server.GetMIDAndSource(req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetMIDAndSource() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if mid != tt.wantMID || source != tt.wantSource {
+				t.Errorf("GetMIDAndSource() = %q, %q, want %q, %q", mid, source,
+					tt.wantMID, tt.wantSource)
+			}
+			mid, _ = server.GetMIDFromRequest(req)
+			if mid != tt.wantMID {
+				t.Errorf("GetMIDFromRequest() = %q, want %q", mid, tt.wantMID)
+			}
+		})
+	}
+}
+
+func TestHandler_Monitor(t *testing.T) {
+	tempDir := t.TempDir()
+	h := server.New(server.WithDataDir(tempDir),
+		server.WithRegistry(prometheus.NewRegistry()))
+	mux := http.NewServeMux()
+	mux.HandleFunc(spec.DownloadPath, h.Download)
+	mux.HandleFunc(spec.MonitorPath, h.Monitor)
+	srv := setupTestServer(tempDir, mux)
+	srv.Start()
+	defer srv.Close()
+
+	// A monitor request without a mid is rejected.
+	resp, err := http.Get(srv.URL + spec.MonitorPath)
+	rtx.Must(err, "monitor request failed")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	// Subscribe before the test starts.
+	resp, err = http.Get(srv.URL + spec.MonitorPath + "?mid=test-mid")
+	rtx.Must(err, "monitor request failed")
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+
+	u, err := url.Parse(srv.URL + spec.DownloadPath + "?mid=test-mid&streams=1&duration=500")
+	rtx.Must(err, "cannot get server URL")
+	u.Scheme = "ws"
+	headers := http.Header{}
+	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+	conn, _, err := setupTestWSDialer(u).Dial(u.String(), headers)
+	if err != nil {
+		t.Fatalf("websocket dial failed: %v", err)
+	}
+	timeout, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go func() {
+		senderCh, receiverCh, errCh := throughput1.New(conn).ReceiverLoop(timeout)
+		drain(t, timeout, senderCh, receiverCh, errCh)
+	}()
+
+	// The first event must be a server measurement for this test. More than
+	// one event may be available already, so read line by line.
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	rtx.Must(err, "cannot read event")
+	if line != "event: measurement\n" {
+		t.Fatalf("unexpected event: %q", line)
+	}
+	line, err = reader.ReadString('\n')
+	rtx.Must(err, "cannot read event data")
+	data, ok := strings.CutPrefix(line, "data: ")
+	if !ok {
+		t.Fatalf("unexpected event data: %q", line)
+	}
+	var ev model.MonitorEvent
+	rtx.Must(json.Unmarshal([]byte(strings.TrimSpace(data)), &ev), "cannot unmarshal event")
+	if ev.Direction != string(model.DirectionDownload) || ev.UUID == "" {
+		t.Errorf("unexpected event: %+v", ev)
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"time"
+)
+
+// drainPollInterval is how often Drain checks whether the active tests are
+// over.
+const drainPollInterval = 100 * time.Millisecond
+
+// acquireTest registers a new active test. It returns false if the maximum
+// number of concurrent tests has been reached.
+func (h *Handler) acquireTest() bool {
+	for {
+		current := h.activeTests.Load()
+		if h.maxConcurrentTests > 0 && current >= h.maxConcurrentTests {
+			return false
+		}
+		if h.activeTests.CompareAndSwap(current, current+1) {
+			h.metrics.activeTests.Inc()
+			return true
+		}
+	}
+}
+
+// releaseTest unregisters an active test registered by acquireTest.
+func (h *Handler) releaseTest() {
+	h.activeTests.Add(-1)
+	h.metrics.activeTests.Dec()
+}
+
+// Drain stops accepting new tests and waits until the active ones are over.
+// If ctx is done first, the active tests are stopped early, as if their
+// duration had expired, so that the measurements collected so far are still
+// archived. Drain then waits for them to be written and returns ctx.Err().
+func (h *Handler) Drain(ctx context.Context) error {
+	h.draining.Store(true)
+	err := h.waitIdle(ctx)
+	if err == nil {
+		return nil
+	}
+	h.stopOnce.Do(func() { close(h.stop) })
+	// Stopped tests still send their final measurement before archiving.
+	timeout, cancel := context.WithTimeout(context.Background(),
+		h.finalFlushTimeout+2*finalMeasurementGracePeriod)
+	defer cancel()
+	h.waitIdle(timeout)
+	return err
+}
+
+// waitIdle waits until there are no active tests. It returns ctx.Err() if
+// ctx is done first.
+func (h *Handler) waitIdle(ctx context.Context) error {
+	t := time.NewTicker(drainPollInterval)
+	defer t.Stop()
+	for h.activeTests.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	return nil
+}
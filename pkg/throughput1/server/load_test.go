@@ -0,0 +1,34 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestHandler_acquireTest(t *testing.T) {
+	h := New(WithDataDir(t.TempDir()), WithRegistry(prometheus.NewRegistry()),
+		WithMaxConcurrentTests(2))
+
+	if !h.acquireTest() || !h.acquireTest() {
+		t.Fatalf("test within the limit rejected")
+	}
+	if h.acquireTest() {
+		t.Fatalf("test over the limit accepted")
+	}
+	h.releaseTest()
+	if !h.acquireTest() {
+		t.Fatalf("test after release rejected")
+	}
+	if got := h.activeTests.Load(); got != 2 {
+		t.Errorf("activeTests = %d, want 2", got)
+	}
+
+	// No limit by default.
+	h = New(WithDataDir(t.TempDir()), WithRegistry(prometheus.NewRegistry()))
+	for i := 0; i < 100; i++ {
+		if !h.acquireTest() {
+			t.Fatalf("test rejected without a limit")
+		}
+	}
+}
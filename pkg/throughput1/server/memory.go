@@ -0,0 +1,25 @@
+package server
+
+import "github.com/m-lab/msak/pkg/throughput1"
+
+// reserveBufferMemory reserves the memory needed by a new connection's
+// WebSocket buffers. It returns false if this would exceed the memory budget.
+func (h *Handler) reserveBufferMemory() bool {
+	for {
+		current := h.bufferMemory.Load()
+		next := current + throughput1.ConnBufferSize
+		if h.memoryBudget > 0 && next > h.memoryBudget {
+			return false
+		}
+		if h.bufferMemory.CompareAndSwap(current, next) {
+			h.metrics.bufferMemory.Add(throughput1.ConnBufferSize)
+			return true
+		}
+	}
+}
+
+// releaseBufferMemory releases the memory reserved by reserveBufferMemory.
+func (h *Handler) releaseBufferMemory() {
+	h.bufferMemory.Add(-throughput1.ConnBufferSize)
+	h.metrics.bufferMemory.Sub(throughput1.ConnBufferSize)
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/m-lab/msak/pkg/throughput1"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestHandler_reserveBufferMemory(t *testing.T) {
+	h := New(WithDataDir(t.TempDir()), WithRegistry(prometheus.NewRegistry()),
+		WithMemoryBudget(2*throughput1.ConnBufferSize+1))
+
+	if !h.reserveBufferMemory() || !h.reserveBufferMemory() {
+		t.Fatalf("reservation within budget rejected")
+	}
+	if h.reserveBufferMemory() {
+		t.Fatalf("reservation over budget accepted")
+	}
+	h.releaseBufferMemory()
+	if !h.reserveBufferMemory() {
+		t.Fatalf("reservation after release rejected")
+	}
+	if got := h.bufferMemory.Load(); got != 2*throughput1.ConnBufferSize {
+		t.Errorf("bufferMemory = %d, want %d", got, 2*throughput1.ConnBufferSize)
+	}
+
+	// No budget means no limit.
+	h = New(WithDataDir(t.TempDir()), WithRegistry(prometheus.NewRegistry()))
+	for i := 0; i < 100; i++ {
+		if !h.reserveBufferMemory() {
+			t.Fatalf("reservation rejected without a budget")
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// metrics are the Prometheus metrics updated by a Handler.
+type metrics struct {
+	websocketUpgrades           *prometheus.CounterVec
+	testsTotal                  *prometheus.CounterVec
+	congestionControlErrors     *prometheus.CounterVec
+	congestionControlMismatches *prometheus.CounterVec
+	fileWrites                  *prometheus.CounterVec
+	bytesTransferred            *prometheus.CounterVec
+	droppedMeasurements         *prometheus.CounterVec
+	unpublishedMeasurements     *prometheus.CounterVec
+	streamLimitRejections       *prometheus.CounterVec
+	ecnStreams                  *prometheus.CounterVec
+	tokenExpiryDecisions        *prometheus.CounterVec
+	ecnDeliveredCE              *prometheus.CounterVec
+	metadataRejections          *prometheus.CounterVec
+	goodput                     *prometheus.HistogramVec
+	minRTT                      *prometheus.HistogramVec
+	testBytes                   *prometheus.HistogramVec
+	bufferMemory                prometheus.Gauge
+	activeTests                 prometheus.Gauge
+	shedRequests                *prometheus.CounterVec
+	fqPacing                    prometheus.Gauge
+	hostDropTests               *prometheus.CounterVec
+	runningTests                *prometheus.GaugeVec
+	testDuration                *prometheus.HistogramVec
+}
+
+var (
+	defaultMetricsOnce sync.Once
+	defaultMetricsVal  *metrics
+)
+
+// defaultMetrics returns the metrics registered with the default Prometheus
+// registerer. They are shared by all the Handlers that are not configured
+// with WithRegistry.
+func defaultMetrics() *metrics {
+	defaultMetricsOnce.Do(func() {
+		defaultMetricsVal = newMetrics(prometheus.DefaultRegisterer)
+	})
+	return defaultMetricsVal
+}
+
+// newMetrics creates the metrics and registers them with reg. If reg is nil,
+// the metrics are not registered.
+func newMetrics(reg prometheus.Registerer) *metrics {
+	factory := promauto.With(reg)
+	return &metrics{
+		websocketUpgrades: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "msak",
+				Subsystem: "throughput1",
+				Name:      "client_websocket_upgrades_total",
+				Help:      "Number of connections that attempted a websocket upgrade.",
+			},
+			[]string{"direction", "status"},
+		),
+		testsTotal: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "msak",
+				Subsystem: "throughput1",
+				Name:      "tests_total",
+				Help:      "Number of tests that successfully upgraded to websocket and started",
+			},
+			[]string{"direction", "status"},
+		),
+		congestionControlErrors: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "msak",
+				Subsystem: "throughput1",
+				Name:      "congestion_control_errors_total",
+				Help:      "Number of attempts to set congestion control algorithm that resulted in an error.",
+			},
+			[]string{"cc"},
+		),
+		congestionControlMismatches: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "msak",
+				Subsystem: "throughput1",
+				Name:      "congestion_control_mismatches_total",
+				Help:      "Number of tests where the congestion control algorithm in use differs from the requested one.",
+			},
+			[]string{"requested", "actual"},
+		),
+		fileWrites: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "msak",
+				Subsystem: "throughput1",
+				Name:      "file_writes_total",
+				Help:      "Number of (successful or failed) file writes.",
+			},
+			[]string{"direction", "status"},
+		),
+		bytesTransferred: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "msak",
+				Subsystem: "throughput1",
+				Name:      "application_bytes_total",
+				Help:      "Number of application-level bytes transferred by completed tests.",
+			},
+			[]string{"direction"},
+		),
+		droppedMeasurements: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "msak",
+				Subsystem: "throughput1",
+				Name:      "dropped_client_measurements_total",
+				Help:      "Number of client measurements dropped because they exceeded the maximum message rate.",
+			},
+			[]string{"direction"},
+		),
+		unpublishedMeasurements: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "msak",
+				Subsystem: "throughput1",
+				Name:      "dropped_server_measurements_total",
+				Help:      "Number of server measurements missing from archived results because the result channel was full.",
+			},
+			[]string{"direction"},
+		),
+		tokenExpiryDecisions: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "msak",
+				Subsystem: "throughput1",
+				Name:      "token_expiry_decisions_total",
+				Help:      "Number of streams whose duration exceeded their access token's validity, by decision (clamped or rejected).",
+			},
+			[]string{"direction", "decision"},
+		),
+		ecnStreams: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "msak",
+				Subsystem: "throughput1",
+				Name:      "ecn_streams_total",
+				Help:      "Number of completed streams by ECN state (not-negotiated, negotiated or seen).",
+			},
+			[]string{"direction", "state"},
+		),
+		ecnDeliveredCE: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "msak",
+				Subsystem: "throughput1",
+				Name:      "ecn_delivered_ce_packets_total",
+				Help:      "Number of packets delivered with CE marks on completed streams.",
+			},
+			[]string{"direction"},
+		),
+		streamLimitRejections: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "msak",
+				Subsystem: "throughput1",
+				Name:      "stream_limit_rejections_total",
+				Help:      "Number of connections rejected because the maximum number of streams per mid was reached.",
+			},
+			[]string{"direction"},
+		),
+		metadataRejections: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "msak",
+				Subsystem: "throughput1",
+				Name:      "metadata_rejections_total",
+				Help:      "Number of requests rejected, or metadata keys dropped, because of the client metadata policy.",
+			},
+			[]string{"reason"},
+		),
+		goodput: factory.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "msak",
+				Subsystem: "throughput1",
+				Name:      "goodput_bits_per_second",
+				Help:      "Application-level goodput of completed streams, as measured by the server.",
+				// 100kb/s to ~100Gb/s.
+				Buckets: prometheus.ExponentialBuckets(1e5, 2, 21),
+			},
+			[]string{"direction"},
+		),
+		minRTT: factory.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "msak",
+				Subsystem: "throughput1",
+				Name:      "min_rtt_seconds",
+				Help:      "Minimum RTT of completed streams, according to the server's TCP_INFO.",
+				// 100us to ~3s.
+				Buckets: prometheus.ExponentialBuckets(0.0001, 2, 15),
+			},
+			[]string{"direction"},
+		),
+		testBytes: factory.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "msak",
+				Subsystem: "throughput1",
+				Name:      "stream_bytes",
+				Help:      "Application-level bytes transferred by completed streams.",
+				// 1KiB to ~64GiB.
+				Buckets: prometheus.ExponentialBuckets(1024, 4, 14),
+			},
+			[]string{"direction"},
+		),
+		bufferMemory: factory.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "msak",
+				Subsystem: "throughput1",
+				Name:      "buffer_memory_bytes",
+				Help:      "Memory committed to WebSocket read/write buffers by active connections.",
+			},
+		),
+		activeTests: factory.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "msak",
+				Subsystem: "throughput1",
+				Name:      "active_tests",
+				Help:      "Number of throughput1 connections currently being served.",
+			},
+		),
+		shedRequests: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "msak",
+				Subsystem: "throughput1",
+				Name:      "shed_requests_total",
+				Help:      "Number of requests rejected because the maximum number of concurrent tests was reached.",
+			},
+			[]string{"direction"},
+		),
+		fqPacing: factory.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "msak",
+				Subsystem: "throughput1",
+				Name:      "fq_pacing_available",
+				Help:      "Whether the server's default qdisc is fq, providing packet pacing (1) or not (0).",
+			},
+		),
+		hostDropTests: factory.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "msak",
+				Subsystem: "throughput1",
+				Name:      "host_drop_tests_total",
+				Help:      "Number of tests during which the server's interface or qdisc dropped packets.",
+			},
+			[]string{"direction"},
+		),
+		runningTests: factory.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "msak",
+				Subsystem: "throughput1",
+				Name:      "running_tests",
+				Help:      "Number of throughput1 streams currently running, by direction.",
+			},
+			[]string{"direction"},
+		),
+		testDuration: factory.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "msak",
+				Subsystem: "throughput1",
+				Name:      "test_duration_seconds",
+				Help:      "Runtime of completed throughput1 streams.",
+				// 100ms to ~51s.
+				Buckets: prometheus.ExponentialBuckets(0.1, 2, 10),
+			},
+			[]string{"direction"},
+		),
+	}
+}
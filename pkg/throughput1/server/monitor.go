@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/charmbracelet/log"
+	"github.com/m-lab/msak/pkg/options"
+	"github.com/m-lab/msak/pkg/throughput1/model"
+)
+
+// monitorBufferSize is the number of events buffered for each monitor
+// subscriber. Events are dropped when a subscriber falls behind, so that
+// monitoring never slows down a test.
+const monitorBufferSize = 64
+
+// monitors tracks the subscribers watching the tests of each mid.
+type monitors struct {
+	mu   sync.Mutex
+	subs map[string]map[chan model.MonitorEvent]struct{}
+}
+
+// subscribe returns a channel receiving the events for mid.
+func (m *monitors) subscribe(mid string) chan model.MonitorEvent {
+	ch := make(chan model.MonitorEvent, monitorBufferSize)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.subs == nil {
+		m.subs = map[string]map[chan model.MonitorEvent]struct{}{}
+	}
+	if m.subs[mid] == nil {
+		m.subs[mid] = map[chan model.MonitorEvent]struct{}{}
+	}
+	m.subs[mid][ch] = struct{}{}
+	return ch
+}
+
+// unsubscribe removes a channel returned by subscribe.
+func (m *monitors) unsubscribe(mid string, ch chan model.MonitorEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.subs[mid], ch)
+	if len(m.subs[mid]) == 0 {
+		delete(m.subs, mid)
+	}
+}
+
+// publish sends ev to every subscriber for mid, without blocking.
+func (m *monitors) publish(mid string, ev model.MonitorEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for ch := range m.subs[mid] {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// Monitor streams the measurements of the ongoing tests for the mid in the
+// querystring as server-sent events, until the client disconnects. Each event
+// is a "measurement" event whose data is a JSON-encoded model.MonitorEvent.
+//
+// This endpoint does not authenticate requests: it must be protected by the
+// caller, e.g. by registering it behind admin.RequireToken.
+func (h *Handler) Monitor(rw http.ResponseWriter, req *http.Request) {
+	mid := req.URL.Query().Get(options.MIDParameterName)
+	if mid == "" {
+		writeBadRequest(rw)
+		return
+	}
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	ch := h.monitors.subscribe(mid)
+	defer h.monitors.unsubscribe(mid, ch)
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case ev := <-ch:
+			b, err := json.Marshal(ev)
+			if err != nil {
+				log.Error("cannot marshal monitor event", "error", err)
+				continue
+			}
+			_, err = fmt.Fprintf(rw, "event: measurement\ndata: %s\n\n", b)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
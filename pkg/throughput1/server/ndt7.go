@@ -0,0 +1,39 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/m-lab/msak/pkg/options"
+	"github.com/m-lab/msak/pkg/throughput1/model"
+	"github.com/m-lab/msak/pkg/throughput1/spec"
+)
+
+// NDT7Download runs an ndt7 download subtest, so that existing ndt7 clients
+// can be measured. It is a single-stream throughput1 download using the ndt7
+// subprotocol and message format, archived as spec.NDT7Datatype.
+func (h *Handler) NDT7Download(rw http.ResponseWriter, req *http.Request) {
+	h.upgradeAndRunMeasurement(model.DirectionDownload, true, rw, req)
+}
+
+// NDT7Upload runs an ndt7 upload subtest. See NDT7Download.
+func (h *Handler) NDT7Upload(rw http.ResponseWriter, req *http.Request) {
+	h.upgradeAndRunMeasurement(model.DirectionUpload, true, rw, req)
+}
+
+// ndt7Options returns the options of an ndt7 subtest: a single stream lasting
+// spec.NDT7Duration. Every parameter in query that is not a known option is
+// read as metadata, according to policy.
+func ndt7Options(query url.Values, policy options.MetadataPolicy) (*options.Options, error) {
+	metadata, dropped, err := policy.Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	return &options.Options{
+		Streams:         1,
+		Duration:        spec.NDT7Duration,
+		Metadata:        metadata,
+		Raw:             []model.NameValue{},
+		DroppedMetadata: dropped,
+	}, nil
+}
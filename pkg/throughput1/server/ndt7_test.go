@@ -0,0 +1,110 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/msak/pkg/throughput1/model"
+	"github.com/m-lab/msak/pkg/throughput1/server"
+	"github.com/m-lab/msak/pkg/throughput1/spec"
+)
+
+// ndt7Measurement is the subset of the ndt7 Measurement message checked by
+// these tests.
+type ndt7Measurement struct {
+	AppInfo *struct {
+		NumBytes    int64
+		ElapsedTime int64
+	}
+	ConnectionInfo *struct {
+		Client, Server, UUID string
+	}
+	Origin string
+	Test   string
+}
+
+func TestHandler_NDT7Download(t *testing.T) {
+	tempDir := t.TempDir()
+	h := server.New(server.WithDataDir(tempDir),
+		server.WithMaxRuntime(500*time.Millisecond))
+	srv := setupTestServer(tempDir, http.HandlerFunc(h.NDT7Download))
+	srv.Start()
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	rtx.Must(err, "cannot get server URL")
+	u.Scheme = "ws"
+	u.RawQuery = url.Values{
+		"mid":         {"test-mid"},
+		"client_name": {"ndt7-client-go"},
+	}.Encode()
+
+	// Clients offering only the throughput1 subprotocol are rejected.
+	headers := http.Header{}
+	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+	if _, _, err := setupTestWSDialer(u).Dial(u.String(), headers); err == nil {
+		t.Fatalf("throughput1 client accepted on the ndt7 endpoint")
+	}
+
+	headers.Set("Sec-WebSocket-Protocol", spec.SecWebSocketProtocolNDT7)
+	conn, _, err := setupTestWSDialer(u).Dial(u.String(), headers)
+	if err != nil {
+		t.Fatalf("websocket dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Read like an ndt7 client until the server closes the connection,
+	// sending a measurement of its own.
+	rtx.Must(conn.WriteMessage(websocket.TextMessage,
+		[]byte(`{"AppInfo":{"NumBytes":1,"ElapsedTime":1000},"Origin":"client","Test":"download"}`)),
+		"cannot send client measurement")
+	var measurements []ndt7Measurement
+	var binaryBytes int64
+	for {
+		kind, data, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		if kind == websocket.BinaryMessage {
+			binaryBytes += int64(len(data))
+			continue
+		}
+		var m ndt7Measurement
+		rtx.Must(json.Unmarshal(data, &m), "cannot unmarshal measurement")
+		measurements = append(measurements, m)
+	}
+	if len(measurements) == 0 || binaryBytes == 0 {
+		t.Fatalf("no measurements or data received")
+	}
+	first, last := measurements[0], measurements[len(measurements)-1]
+	if first.ConnectionInfo == nil || first.ConnectionInfo.UUID == "" {
+		t.Errorf("missing ConnectionInfo in first measurement: %+v", first)
+	}
+	if last.Origin != "server" || last.Test != "download" || last.AppInfo == nil ||
+		last.AppInfo.NumBytes < binaryBytes {
+		t.Errorf("invalid last measurement after %d bytes: %+v", binaryBytes, last)
+	}
+
+	// The result is archived under its own datatype.
+	var result model.Throughput1Result
+	path := readSingleResult(t, tempDir, &result)
+	if !strings.HasPrefix(path, filepath.Join(tempDir, spec.NDT7Datatype)) {
+		t.Errorf("result not archived as %s: %s", spec.NDT7Datatype, path)
+	}
+	if result.TotalStreams != 1 || len(result.ClientOptions) != 0 ||
+		len(result.ClientMetadata) != 1 || result.ClientMetadata[0].Value != "ndt7-client-go" {
+		t.Errorf("invalid options or metadata: %+v, %+v", result.ClientOptions,
+			result.ClientMetadata)
+	}
+	if len(result.ClientMeasurements) != 1 ||
+		result.ClientMeasurements[0].Application.BytesReceived != 1 {
+		t.Errorf("invalid client measurements: %+v", result.ClientMeasurements)
+	}
+}
@@ -0,0 +1,282 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/m-lab/msak/internal/netx"
+	"github.com/m-lab/msak/internal/persistence"
+	"github.com/m-lab/msak/pkg/options"
+	"github.com/m-lab/msak/pkg/quota"
+	"github.com/m-lab/msak/pkg/throughput1/model"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Option configures a Handler.
+type Option func(*Handler)
+
+// ArchivalWriter delivers the archival data of completed tests to a sink.
+// Results are written with datatype "throughput1", the test direction as
+// subtest and, as uuid, the hash of the mid followed by the connection's UUID
+// (see persistence.ArchiveID).
+type ArchivalWriter = persistence.Writer
+
+// Validator runs a sanity check on the archival data of a completed test and
+// returns the names of the failed checks, if any. The returned names are
+// appended to the result's ValidationFlags.
+type Validator func(result *model.Throughput1Result) []string
+
+// WithDataDir sets the directory where results are written as JSON files.
+// It has no effect if an ArchivalWriter is provided via WithArchivalWriter.
+func WithDataDir(dir string) Option {
+	return func(h *Handler) {
+		h.dataDir = dir
+	}
+}
+
+// WithArchivalWriter sets the ArchivalWriter used to write results, in place
+// of the default JSON files in the data directory.
+func WithArchivalWriter(w ArchivalWriter) Option {
+	return func(h *Handler) {
+		h.writer = w
+	}
+}
+
+// WithValidators adds validators that run in addition to the built-in ones.
+func WithValidators(v ...Validator) Option {
+	return func(h *Handler) {
+		h.validators = append(h.validators, v...)
+	}
+}
+
+// WithRegistry registers the handler's metrics with reg instead of the
+// default Prometheus registerer. If reg is nil, metrics are not registered.
+func WithRegistry(reg prometheus.Registerer) Option {
+	return func(h *Handler) {
+		h.metrics = newMetrics(reg)
+	}
+}
+
+// WithMaxStreamsPerMID sets the maximum number of concurrent streams allowed
+// for the same measurement ID. Connections beyond this limit are rejected
+// with a 429 Too Many Requests status. A value of zero disables the limit.
+func WithMaxStreamsPerMID(n int) Option {
+	return func(h *Handler) {
+		h.maxStreamsPerMID = n
+	}
+}
+
+// WithMaxRuntime sets the maximum runtime of a stream. Requested durations
+// longer than this are capped. The default is spec.MaxRuntime.
+func WithMaxRuntime(d time.Duration) Option {
+	return func(h *Handler) {
+		h.maxRuntime = d
+	}
+}
+
+// WithDefaultDuration sets the duration of streams whose client does not
+// request one. The default is options.DefaultDuration.
+func WithDefaultDuration(d time.Duration) Option {
+	return func(h *Handler) {
+		h.defaultDuration = d
+	}
+}
+
+// WithDownsampling makes the handler archive only one every n measurements,
+// plus the first, the last and those with the lowest and highest RTT, to
+// keep the archives of long tests small. Values less than 2 disable
+// downsampling.
+func WithDownsampling(n int) Option {
+	return func(h *Handler) {
+		h.downsampling = n
+	}
+}
+
+// WithCaptureDir makes the handler record the sequence of WebSocket messages
+// of every test to a JSON file named after the connection's UUID in dir. The
+// recordings can be replayed with cmd/msak-replay. This is meant for
+// debugging and should not be enabled on production servers.
+func WithCaptureDir(dir string) Option {
+	return func(h *Handler) {
+		h.captureDir = dir
+	}
+}
+
+// WithFinalFlushTimeout sets how long the final measurement of a stream may
+// take to be sent once the stream is over, even if the stream's deadline has
+// expired. The default is spec.FinalFlushTimeout.
+func WithFinalFlushTimeout(d time.Duration) Option {
+	return func(h *Handler) {
+		h.finalFlushTimeout = d
+	}
+}
+
+// WithSocketBuffers sets the size of the send and receive buffers (SO_SNDBUF
+// and SO_RCVBUF) of throughput1 connections. A zero value keeps the kernel's
+// default, including buffer autotuning.
+func WithSocketBuffers(sndbuf, rcvbuf int) Option {
+	return func(h *Handler) {
+		h.sndbuf = sndbuf
+		h.rcvbuf = rcvbuf
+	}
+}
+
+// WithNotSentLowat sets TCP_NOTSENT_LOWAT, in bytes, on download connections.
+// A zero value leaves it unset.
+func WithNotSentLowat(bytes int) Option {
+	return func(h *Handler) {
+		h.notSentLowat = bytes
+	}
+}
+
+// WithQdisc sets the server's default queueing discipline, as returned by
+// netx.DefaultQdisc. The root qdisc of the serving interface is recorded in
+// every result, so that results can be segmented by pacing capability: the
+// default one is recorded instead if it cannot be read.
+func WithQdisc(qdisc string) Option {
+	return func(h *Handler) {
+		h.qdisc = qdisc
+	}
+}
+
+// WithAdvertisedServer sets the host name or IP address the server is
+// publicly reachable at. It is recorded in every result next to the socket's
+// local address, which may not be the public one on multi-homed machines.
+func WithAdvertisedServer(host string) Option {
+	return func(h *Handler) {
+		h.advertisedServer = host
+	}
+}
+
+// WithHostStats enables sampling the drop and error counters of the network
+// interface serving each stream, and of its root qdisc, at the start and at
+// the end of the stream. The difference is recorded in the result's
+// HostStats.
+func WithHostStats(enabled bool) Option {
+	return func(h *Handler) {
+		h.hostStats = enabled
+	}
+}
+
+// WithMemoryBudget sets the maximum memory, in bytes, committed to WebSocket
+// read and write buffers across active connections. Upgrades that would
+// exceed the budget are rejected with a 503 Service Unavailable status. A
+// value of zero disables the limit.
+func WithMemoryBudget(bytes int64) Option {
+	return func(h *Handler) {
+		h.memoryBudget = bytes
+	}
+}
+
+// WithTokenMachine sets the machine name access tokens are verified
+// against, so it can be recorded in the archived AccessToken.
+func WithTokenMachine(machine string) Option {
+	return func(h *Handler) {
+		h.tokenMachine = machine
+	}
+}
+
+// TokenExpiryPolicy is what a Handler does with streams whose duration
+// exceeds the remaining validity of their access token.
+type TokenExpiryPolicy string
+
+const (
+	// TokenExpiryClamp shortens such streams so that they end when the
+	// token expires. It is the default.
+	TokenExpiryClamp TokenExpiryPolicy = "clamp"
+	// TokenExpiryReject rejects such streams with a 401 Unauthorized status,
+	// so that the client can retry with a fresh token.
+	TokenExpiryReject TokenExpiryPolicy = "reject"
+	// TokenExpiryIgnore lets such streams outlive their token.
+	TokenExpiryIgnore TokenExpiryPolicy = "ignore"
+)
+
+// WithTokenExpiryPolicy sets what the handler does with streams whose
+// duration exceeds the remaining validity of their access token. Streams
+// whose token has already expired are always rejected, unless the policy is
+// TokenExpiryIgnore.
+func WithTokenExpiryPolicy(p TokenExpiryPolicy) Option {
+	return func(h *Handler) {
+		h.tokenExpiryPolicy = p
+	}
+}
+
+// WithQuota enforces the daily quotas of store on requests with a verified
+// access token, keyed by the token's subject. Requests from a subject that
+// exhausted its quotas are rejected with a 429 Too Many Requests status and a
+// JSON body describing the exceeded quota. The caller is responsible for
+// running store.Run, so that usage is persisted and old entries expire.
+func WithQuota(store *quota.Store) Option {
+	return func(h *Handler) {
+		h.quota = store
+	}
+}
+
+// WithMetadataPolicy sets the policy for the client metadata accepted in the
+// querystring. The default is options.DefaultMetadataPolicy.
+func WithMetadataPolicy(p options.MetadataPolicy) Option {
+	return func(h *Handler) {
+		h.metadataPolicy = p
+	}
+}
+
+// WithAllowedOrigins sets the origins allowed to upgrade, as accepted by
+// throughput1.OriginAllowed. Requests with an Origin header matching none of
+// them are rejected with a 403 Forbidden status. Requests without an Origin
+// header are always allowed. By default, every origin is allowed.
+func WithAllowedOrigins(origins ...string) Option {
+	return func(h *Handler) {
+		h.allowedOrigins = origins
+	}
+}
+
+// WithMaxConcurrentTests sets the maximum number of concurrent tests, i.e.
+// throughput1 connections, served by the handler. Requests beyond this limit
+// are rejected with a 503 Service Unavailable status. A value of zero disables
+// the limit.
+func WithMaxConcurrentTests(n int) Option {
+	return func(h *Handler) {
+		h.maxConcurrentTests = int64(n)
+	}
+}
+
+// WithAllowCompression sets whether clients are allowed to negotiate
+// permessage-deflate WebSocket compression. Compression is refused by default,
+// since it makes throughput measurements hard to interpret.
+func WithAllowCompression(allow bool) Option {
+	return func(h *Handler) {
+		h.allowCompression = allow
+	}
+}
+
+// WithGenerateMID enables or disables generating a measurement ID on the
+// server side for requests that do not include one. The generated measurement
+// ID is returned to the client in the handshake response's X-Measurement-ID
+// header. Since the server cannot tell which connections belong to the same
+// measurement, clients must provide it for the other streams of the
+// measurement, which are then archived as server-generated too. This should
+// only be enabled when access tokens are not required.
+func WithGenerateMID(enabled bool) Option {
+	return func(h *Handler) {
+		h.generateMID = enabled
+	}
+}
+
+// WithAllowedCC sets the congestion control algorithms clients can request.
+// Requests for other algorithms are rejected. By default, only reno, cubic
+// and bbr are allowed.
+func WithAllowedCC(algorithms ...string) Option {
+	return func(h *Handler) {
+		h.allowedCC = make(map[string]struct{}, len(algorithms))
+		for _, cc := range algorithms {
+			h.allowedCC[cc] = struct{}{}
+		}
+	}
+}
+
+// NewListener wraps a TCP listener so that the accepted connections expose
+// the information needed by the Handler. The http.Server serving a Handler
+// must use a listener returned by this function.
+func NewListener(l *net.TCPListener) net.Listener {
+	return netx.NewListener(l)
+}
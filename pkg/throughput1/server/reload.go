@@ -0,0 +1,41 @@
+package server
+
+import (
+	"github.com/m-lab/msak/pkg/options"
+)
+
+// Reloadable is the part of a Handler's configuration that can be changed
+// with Reload while it is serving tests.
+type Reloadable struct {
+	// AllowedOrigins are the origins allowed to upgrade, as set by
+	// WithAllowedOrigins. If empty, every origin is allowed.
+	AllowedOrigins []string
+	// AllowedCC are the congestion control algorithms clients can request,
+	// as set by WithAllowedCC. If empty, the default algorithms are allowed.
+	AllowedCC []string
+	// MetadataPolicy is the policy for the client metadata accepted, as set
+	// by WithMetadataPolicy.
+	MetadataPolicy options.MetadataPolicy
+}
+
+// Reload replaces the handler's Reloadable configuration. Tests started
+// afterwards use the new configuration, while running tests are unaffected.
+func (h *Handler) Reload(r Reloadable) {
+	algorithms := r.AllowedCC
+	if len(algorithms) == 0 {
+		algorithms = defaultCCAlgorithms
+	}
+	h.reloadMu.Lock()
+	defer h.reloadMu.Unlock()
+	WithAllowedOrigins(r.AllowedOrigins...)(h)
+	WithAllowedCC(algorithms...)(h)
+	WithMetadataPolicy(r.MetadataPolicy)(h)
+}
+
+// policy returns the allowed origins, the allowed congestion control
+// algorithms and the metadata policy to apply to a new test.
+func (h *Handler) policy() ([]string, map[string]struct{}, options.MetadataPolicy) {
+	h.reloadMu.RLock()
+	defer h.reloadMu.RUnlock()
+	return h.allowedOrigins, h.allowedCC, h.metadataPolicy
+}
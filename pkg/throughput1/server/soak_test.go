@@ -0,0 +1,150 @@
+//go:build soak
+// +build soak
+
+package server_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/m-lab/msak/pkg/throughput1"
+	"github.com/m-lab/msak/pkg/throughput1/model"
+	"github.com/m-lab/msak/pkg/throughput1/server"
+	"github.com/m-lab/msak/pkg/throughput1/spec"
+)
+
+const (
+	// soakTests is the number of tests run by TestSoak.
+	soakTests = 300
+	// soakConcurrency is the number of tests running at the same time.
+	soakConcurrency = 20
+	// soakSlack is the number of goroutines/file descriptors above the
+	// baseline tolerated at the end of the soak test.
+	soakSlack = 5
+)
+
+// openFDs returns the number of open file descriptors for this process, or
+// -1 if it cannot be determined on this platform.
+func openFDs() int {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(fds)
+}
+
+// waitForBaseline polls f until it returns a value <= baseline+soakSlack or
+// the timeout expires. It returns the last value returned by f.
+func waitForBaseline(f func() int, baseline int, timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	v := f()
+	for v > baseline+soakSlack && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+		v = f()
+	}
+	return v
+}
+
+// runSoakClient runs a single short throughput1 test with the given mid
+// against the server.
+func runSoakClient(t *testing.T, serverURL, mid string, kind spec.SubtestKind) {
+	u, err := url.Parse(serverURL)
+	rtx.Must(err, "cannot get server URL")
+	u.Scheme = "ws"
+	u.Path = spec.DownloadPath
+	if kind == spec.SubtestUpload {
+		u.Path = spec.UploadPath
+	}
+	q := u.Query()
+	q.Add("mid", mid)
+	q.Add("streams", "1")
+	q.Add("duration", "100")
+	u.RawQuery = q.Encode()
+
+	headers := http.Header{}
+	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+	conn, _, err := setupTestWSDialer(u).Dial(u.String(), headers)
+	if err != nil {
+		t.Errorf("websocket dial failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	proto := throughput1.New(conn)
+	timeout, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	var senderCh, receiverCh <-chan model.WireMeasurement
+	var errCh <-chan error
+	if kind == spec.SubtestDownload {
+		senderCh, receiverCh, errCh = proto.ReceiverLoop(timeout)
+	} else {
+		senderCh, receiverCh, errCh = proto.SenderLoop(timeout)
+	}
+	drain(t, timeout, senderCh, receiverCh, errCh)
+}
+
+// TestSoak runs many short tests against an in-process server and checks that
+// goroutines and file descriptors return to their baseline afterwards.
+//
+// Run with: go test -tags soak ./pkg/throughput1/server/
+func TestSoak(t *testing.T) {
+	tempDir := t.TempDir()
+	h := server.New(server.WithDataDir(tempDir))
+	mux := http.NewServeMux()
+	mux.HandleFunc(spec.DownloadPath, h.Download)
+	mux.HandleFunc(spec.UploadPath, h.Upload)
+	srv := setupTestServer(tempDir, mux)
+	srv.Start()
+	defer srv.Close()
+
+	baselineGoroutines := runtime.NumGoroutine()
+	baselineFDs := openFDs()
+
+	sem := make(chan struct{}, soakConcurrency)
+	wg := sync.WaitGroup{}
+	for i := 0; i < soakTests; i++ {
+		kind := spec.SubtestDownload
+		if i%2 == 1 {
+			kind = spec.SubtestUpload
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			runSoakClient(t, srv.URL, fmt.Sprintf("soak-mid-%d", i), kind)
+		}(i)
+	}
+	wg.Wait()
+
+	files, err := os.ReadDir(tempDir)
+	rtx.Must(err, "cannot read output folder")
+	if len(files) == 0 {
+		t.Errorf("no results written")
+	}
+
+	if n := waitForBaseline(runtime.NumGoroutine, baselineGoroutines,
+		10*time.Second); n > baselineGoroutines+soakSlack {
+		buf := make([]byte, 1<<20)
+		buf = buf[:runtime.Stack(buf, true)]
+		t.Errorf("goroutine leak: %d at start, %d at end\n%s",
+			baselineGoroutines, n, buf)
+	}
+	if baselineFDs != -1 {
+		if n := waitForBaseline(openFDs, baselineFDs,
+			10*time.Second); n > baselineFDs+soakSlack {
+			t.Errorf("file descriptor leak: %d at start, %d at end",
+				baselineFDs, n)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"time"
+
+	"github.com/m-lab/msak/pkg/throughput1/model"
+)
+
+// streamGroup tracks the streams belonging to the same mid.
+type streamGroup struct {
+	// active is the number of connections for this mid, including those
+	// that have not started transmitting data yet.
+	active int
+	// running is the number of streams currently transmitting data.
+	running int
+	// streams is the number of streams that started transmitting data.
+	streams int
+	// requested is the number of streams declared by the first connection
+	// for this mid.
+	requested int
+	// joined is the number of connections accepted for this mid so far.
+	joined int
+	// created is when the first connection for this mid was accepted.
+	created time.Time
+	// generated is true if the server generated this mid.
+	generated bool
+
+	firstStart, lastStart time.Time
+	firstEnd, lastEnd     time.Time
+}
+
+// acquireStream registers a new active stream for the given mid, whose client
+// declared the given number of streams. It returns the index of this stream,
+// i.e. the number of streams accepted for this mid before it, the time the
+// first stream for this mid was accepted, and false if the declared number of
+// streams or the maximum number of streams for this mid has been reached.
+func (h *Handler) acquireStream(mid string, streams int) (int, time.Time, bool) {
+	h.streamGroupsMu.Lock()
+	defer h.streamGroupsMu.Unlock()
+	g, ok := h.streamGroups[mid]
+	if !ok {
+		g = &streamGroup{requested: streams, created: time.Now()}
+		h.streamGroups[mid] = g
+	}
+	limit := g.requested
+	if streams < limit {
+		limit = streams
+	}
+	if h.maxStreamsPerMID > 0 && h.maxStreamsPerMID < limit {
+		limit = h.maxStreamsPerMID
+	}
+	if g.active >= limit {
+		return g.joined, g.created, false
+	}
+	g.active++
+	index := g.joined
+	g.joined++
+	return index, g.created, true
+}
+
+// markGeneratedMID records that the server generated the given mid, which
+// must have an active stream.
+func (h *Handler) markGeneratedMID(mid string) {
+	h.streamGroupsMu.Lock()
+	defer h.streamGroupsMu.Unlock()
+	if g, ok := h.streamGroups[mid]; ok {
+		g.generated = true
+	}
+}
+
+// isGeneratedMID returns true if the server generated the given mid for a
+// measurement that still has active streams.
+func (h *Handler) isGeneratedMID(mid string) bool {
+	h.streamGroupsMu.Lock()
+	defer h.streamGroupsMu.Unlock()
+	g, ok := h.streamGroups[mid]
+	return ok && g.generated
+}
+
+// releaseStream unregisters an active stream for the given mid.
+func (h *Handler) releaseStream(mid string) {
+	h.streamGroupsMu.Lock()
+	defer h.streamGroupsMu.Unlock()
+	g, ok := h.streamGroups[mid]
+	if !ok {
+		return
+	}
+	g.active--
+	if g.active <= 0 {
+		delete(h.streamGroups, mid)
+	}
+}
+
+// streamStarted records that a stream for the given mid started transmitting
+// data at the provided time.
+func (h *Handler) streamStarted(mid string, t time.Time) {
+	h.streamGroupsMu.Lock()
+	defer h.streamGroupsMu.Unlock()
+	g, ok := h.streamGroups[mid]
+	if !ok {
+		return
+	}
+	if g.streams == 0 {
+		g.firstStart = t
+	}
+	g.lastStart = t
+	g.streams++
+	g.running++
+}
+
+// streamEnded records that a stream for the given mid ended at the provided
+// time and returns the skew between the streams of this mid observed so far.
+// It returns nil if the stream never started transmitting data.
+func (h *Handler) streamEnded(mid string, t time.Time) *model.StreamSkew {
+	h.streamGroupsMu.Lock()
+	defer h.streamGroupsMu.Unlock()
+	g, ok := h.streamGroups[mid]
+	if !ok || g.running == 0 {
+		return nil
+	}
+	if g.firstEnd.IsZero() {
+		g.firstEnd = t
+	}
+	g.lastEnd = t
+	g.running--
+	return &model.StreamSkew{
+		Streams:     g.streams,
+		StartSpread: g.lastStart.Sub(g.firstStart).Microseconds(),
+		EndSpread:   g.lastEnd.Sub(g.firstEnd).Microseconds(),
+		Complete:    g.running == 0,
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHandler_streamSkew(t *testing.T) {
+	h := New(WithDataDir(t.TempDir()), WithMaxStreamsPerMID(2))
+
+	if _, _, ok := h.acquireStream("mid", 4); !ok {
+		t.Fatalf("first stream rejected")
+	}
+	if idx, _, ok := h.acquireStream("mid", 4); !ok || idx != 1 {
+		t.Fatalf("second stream rejected or wrong index %d", idx)
+	}
+	if _, _, ok := h.acquireStream("mid", 4); ok {
+		t.Fatalf("third stream accepted, max is 2")
+	}
+
+	start := time.Now()
+	h.streamStarted("mid", start)
+	h.streamStarted("mid", start.Add(100*time.Millisecond))
+
+	skew := h.streamEnded("mid", start.Add(5*time.Second))
+	if skew == nil || skew.Complete || skew.Streams != 2 ||
+		skew.StartSpread != 100000 || skew.EndSpread != 0 {
+		t.Errorf("invalid skew for first stream end: %+v", skew)
+	}
+	skew = h.streamEnded("mid", start.Add(5200*time.Millisecond))
+	if skew == nil || !skew.Complete || skew.EndSpread != 200000 {
+		t.Errorf("invalid skew for last stream end: %+v", skew)
+	}
+
+	h.releaseStream("mid")
+	h.releaseStream("mid")
+	if len(h.streamGroups) != 0 {
+		t.Errorf("stream group not removed after release")
+	}
+	if skew := h.streamEnded("mid", time.Now()); skew != nil {
+		t.Errorf("expected nil skew for unknown mid, got %+v", skew)
+	}
+}
+
+func TestHandler_acquireStreamDeclared(t *testing.T) {
+	h := New(WithDataDir(t.TempDir()))
+
+	// The first connection declares two streams.
+	if _, _, ok := h.acquireStream("mid", 2); !ok {
+		t.Fatalf("first stream rejected")
+	}
+	// A later connection cannot raise the declared count.
+	if _, _, ok := h.acquireStream("mid", 8); !ok {
+		t.Fatalf("second stream rejected")
+	}
+	if _, _, ok := h.acquireStream("mid", 8); ok {
+		t.Fatalf("third stream accepted, declared streams is 2")
+	}
+	h.releaseStream("mid")
+	h.releaseStream("mid")
+
+	// A connection declaring fewer streams than already active is rejected.
+	if _, _, ok := h.acquireStream("other", 3); !ok {
+		t.Fatalf("first stream rejected")
+	}
+	if _, _, ok := h.acquireStream("other", 1); ok {
+		t.Fatalf("second stream accepted, it declared a single stream")
+	}
+}
+
+func TestHandler_acquireStreamIndex(t *testing.T) {
+	h := New(WithDataDir(t.TempDir()))
+
+	idx0, start0, ok := h.acquireStream("mid", 2)
+	if !ok || idx0 != 0 || start0.IsZero() {
+		t.Fatalf("invalid first stream: %d, %v, %v", idx0, start0, ok)
+	}
+	idx1, start1, ok := h.acquireStream("mid", 2)
+	if !ok || idx1 != 1 || !start1.Equal(start0) {
+		t.Fatalf("invalid second stream: %d, %v, %v", idx1, start1, ok)
+	}
+	// Indexes are not reused when a stream is released.
+	h.releaseStream("mid")
+	idx2, start2, ok := h.acquireStream("mid", 2)
+	if !ok || idx2 != 2 || !start2.Equal(start0) {
+		t.Fatalf("invalid third stream: %d, %v, %v", idx2, start2, ok)
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"time"
+
+	"github.com/m-lab/msak/pkg/throughput1/model"
+	"github.com/m-lab/msak/pkg/throughput1/spec"
+)
+
+// byteCounterSlack is the tolerance used when comparing byte counters that
+// are not read atomically with respect to each other (e.g. application-level
+// counters vs network-level counters). Up to a full message can be
+// transferred between the two reads.
+const byteCounterSlack = spec.MaxScaledMessageSize
+
+// validateResult runs sanity checks on an archival result and returns the
+// list of failed checks (see the model.Validation* constants). truncated
+// indicates that the test did not terminate normally.
+func validateResult(result *model.Throughput1Result, duration time.Duration,
+	byteLimit int, truncated bool) []string {
+	flags := []string{}
+	if len(result.ServerMeasurements) == 0 {
+		flags = append(flags, model.ValidationNoMeasurements)
+	}
+	if result.EndTime.Before(result.StartTime) ||
+		hasNegativeElapsedTime(result.ServerMeasurements) ||
+		hasNegativeElapsedTime(result.ClientMeasurements) {
+		flags = append(flags, model.ValidationNegativeElapsedTime)
+	}
+	if hasInconsistentByteCounters(result.ServerMeasurements) {
+		flags = append(flags, model.ValidationInconsistentByteCounters)
+	}
+	// Tests with a byte limit can legitimately terminate early.
+	if truncated || (byteLimit == 0 &&
+		result.EndTime.Sub(result.StartTime) < duration/2) {
+		flags = append(flags, model.ValidationTruncated)
+	}
+	if result.HostStats != nil && result.HostStats.Drops() > 0 {
+		flags = append(flags, model.ValidationHostDrops)
+	}
+	if len(flags) == 0 {
+		return nil
+	}
+	return flags
+}
+
+func hasNegativeElapsedTime(measurements []model.Measurement) bool {
+	for _, m := range measurements {
+		if m.ElapsedTime < 0 || m.ElapsedSinceTestStart < 0 || m.ElapsedSinceAccept < 0 ||
+			(m.TCPInfo != nil && m.TCPInfo.ElapsedTime < 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasInconsistentByteCounters returns true if the byte counters in the
+// provided measurements are decreasing over time or inconsistent with each
+// other or with TCPInfo.
+func hasInconsistentByteCounters(measurements []model.Measurement) bool {
+	var prev model.Measurement
+	for _, m := range measurements {
+		// Counters must not decrease.
+		if m.Application.BytesSent < prev.Application.BytesSent ||
+			m.Application.BytesReceived < prev.Application.BytesReceived ||
+			m.Network.BytesSent < prev.Network.BytesSent ||
+			m.Network.BytesReceived < prev.Network.BytesReceived {
+			return true
+		}
+		// Application-level payload cannot exceed network-level bytes.
+		if m.Application.BytesSent > m.Network.BytesSent+byteCounterSlack ||
+			m.Application.BytesReceived > m.Network.BytesReceived+byteCounterSlack {
+			return true
+		}
+		// Bytes read from the socket cannot exceed bytes received by the
+		// kernel.
+		if m.TCPInfo != nil && m.TCPInfo.BytesReceived != 0 &&
+			m.Network.BytesReceived > m.TCPInfo.BytesReceived+byteCounterSlack {
+			return true
+		}
+		prev = m
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/m-lab/msak/pkg/throughput1/model"
+)
+
+func Test_validateResult(t *testing.T) {
+	start := time.Now()
+	valid := []model.Measurement{
+		{
+			ElapsedTime: 100,
+			Application: model.ByteCounters{BytesSent: 100},
+			Network:     model.ByteCounters{BytesSent: 200},
+		},
+		{
+			ElapsedTime: 200,
+			Application: model.ByteCounters{BytesSent: 1000},
+			Network:     model.ByteCounters{BytesSent: 1200},
+		},
+	}
+	tests := []struct {
+		name      string
+		result    model.Throughput1Result
+		byteLimit int
+		truncated bool
+		want      []string
+	}{
+		{
+			name: "valid",
+			result: model.Throughput1Result{
+				StartTime:          start,
+				EndTime:            start.Add(5 * time.Second),
+				ServerMeasurements: valid,
+			},
+		},
+		{
+			name: "no-measurements-truncated",
+			result: model.Throughput1Result{
+				StartTime: start,
+				EndTime:   start.Add(time.Second),
+			},
+			want: []string{model.ValidationNoMeasurements,
+				model.ValidationTruncated},
+		},
+		{
+			name: "byte-limit-early-end",
+			result: model.Throughput1Result{
+				StartTime:          start,
+				EndTime:            start.Add(time.Second),
+				ServerMeasurements: valid,
+			},
+			byteLimit: 1000,
+		},
+		{
+			name: "terminated-with-error",
+			result: model.Throughput1Result{
+				StartTime:          start,
+				EndTime:            start.Add(5 * time.Second),
+				ServerMeasurements: valid,
+			},
+			truncated: true,
+			want:      []string{model.ValidationTruncated},
+		},
+		{
+			name: "host-drops",
+			result: model.Throughput1Result{
+				StartTime:          start,
+				EndTime:            start.Add(5 * time.Second),
+				ServerMeasurements: valid,
+				HostStats:          &model.HostStats{Interface: "eth0", QdiscDrops: 1},
+			},
+			want: []string{model.ValidationHostDrops},
+		},
+		{
+			name: "host-stats-without-drops",
+			result: model.Throughput1Result{
+				StartTime:          start,
+				EndTime:            start.Add(5 * time.Second),
+				ServerMeasurements: valid,
+				HostStats:          &model.HostStats{Interface: "eth0", QdiscBacklog: 1500},
+			},
+		},
+		{
+			name: "negative-elapsed-time",
+			result: model.Throughput1Result{
+				StartTime: start,
+				EndTime:   start.Add(5 * time.Second),
+				ServerMeasurements: []model.Measurement{
+					{ElapsedTime: -1},
+				},
+			},
+			want: []string{model.ValidationNegativeElapsedTime},
+		},
+		{
+			name: "decreasing-counters",
+			result: model.Throughput1Result{
+				StartTime: start,
+				EndTime:   start.Add(5 * time.Second),
+				ServerMeasurements: []model.Measurement{
+					valid[1], valid[0],
+				},
+			},
+			want: []string{model.ValidationInconsistentByteCounters},
+		},
+		{
+			name: "application-exceeds-network",
+			result: model.Throughput1Result{
+				StartTime: start,
+				EndTime:   start.Add(5 * time.Second),
+				ServerMeasurements: []model.Measurement{
+					{
+						Application: model.ByteCounters{BytesReceived: 1 << 30},
+						Network:     model.ByteCounters{BytesReceived: 100},
+					},
+				},
+			},
+			want: []string{model.ValidationInconsistentByteCounters},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := validateResult(&tt.result, 5*time.Second, tt.byteLimit,
+				tt.truncated)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("validateResult() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -31,17 +31,131 @@ const (
 	DownloadPath = "/throughput/v1/download"
 	// UploadPath selects the upload subtest.
 	UploadPath = "/throughput/v1/upload"
+	// MonitorPath streams the measurements of an ongoing test as
+	// server-sent events.
+	MonitorPath = "/throughput/v1/monitor"
+
+	// MaxMeasurementMessageRate is the maximum number of Measurement
+	// messages per second parsed by the receiver on each connection. Excess
+	// messages are dropped.
+	MaxMeasurementMessageRate = 20
 
 	// MaxRuntime is the maximum runtime of a subtest.
 	MaxRuntime = 15 * time.Second
 
+	// FinalFlushTimeout is how long the sender may take to write the final
+	// Measurement message once the test is over, even if the deadline for
+	// the whole test has already expired.
+	FinalFlushTimeout = 500 * time.Millisecond
+
+	// PingInterval is the interval between WebSocket ping frames sent by the
+	// server to sample the application-level RTT during a test.
+	PingInterval = 100 * time.Millisecond
+
+	// IdleTimeout is how long the server waits without receiving anything
+	// from the client, including pongs, before considering it dead and
+	// terminating the test.
+	IdleTimeout = 3 * time.Second
+
+	// MaxStreams is the maximum number of streams a client can request for
+	// a single measurement via the "streams" parameter.
+	MaxStreams = 16
+
+	// MaxStreamDelay is the maximum time the server waits before starting to
+	// transmit data on a stream, when the client requests staggered stream
+	// starts via the "delay" parameter.
+	MaxStreamDelay = 5 * time.Second
+
 	// SecWebSocketProtocol is the value of the Sec-WebSocket-Protocol header.
 	SecWebSocketProtocol = "net.measurementlab.throughput.v1"
 
+	// SecWebSocketProtocolCBOR is the value of the Sec-WebSocket-Protocol
+	// header for the throughput1 variant where Measurement messages are CBOR
+	// encoded and sent as binary messages prefixed by CBORMeasurementPrefix.
+	// Binary messages carrying random payload MUST NOT start with this prefix.
+	SecWebSocketProtocolCBOR = "net.measurementlab.throughput.v1+cbor"
+
+	// CBORMeasurementPrefix is the CBOR self-describe tag (55799), used to
+	// tell CBOR-encoded Measurement messages apart from binary payload.
+	CBORMeasurementPrefix = "\xd9\xd9\xf7"
+
+	// CloseCodeAborted is the WebSocket close code sent by a client to abort
+	// a test before its end. It is in the range reserved for applications.
+	CloseCodeAborted = 4000
+
+	// ControlMessagePrefix is the prefix of text messages carrying a JSON
+	// ControlMessage instead of a Measurement. Control messages are always
+	// sent as text messages, regardless of the negotiated subprotocol.
+	ControlMessagePrefix = "control:"
+
+	// MeasurementIDHeader is the name of the HTTP header carrying the
+	// measurement ID. Clients can use it to provide the measurement ID when
+	// they cannot modify the querystring. When the server generates a
+	// measurement ID on behalf of the client, it is returned in this header
+	// of the handshake response.
+	MeasurementIDHeader = "X-Measurement-ID"
+
+	// StreamDelayHeader is the name of the HTTP header the server includes in
+	// the handshake response when it staggers the start of the stream
+	// according to the "delay" parameter. Its value is how long the server
+	// waits before transmitting data on the stream, in milliseconds. Clients
+	// must only delay connecting their streams if this header is missing.
+	StreamDelayHeader = "X-Stream-Delay"
+
 	// ByteLimitParameterName is the name of the parameter that clients can use
 	// to terminate throughput1 download tests once the test has transferred
 	// the specified number of bytes.
 	ByteLimitParameterName = "bytes"
+
+	// MeasureIntervalParameterName is the name of the parameter that clients
+	// can use to request a different average interval (in milliseconds)
+	// between measurements sent by the server.
+	MeasureIntervalParameterName = "measure_interval_ms"
+
+	// CounterflowParameterName is the name of the parameter that clients can
+	// set to "false" to stop the server from sending Measurement messages
+	// during upload tests, except for the final one. This avoids perturbing
+	// uploads on extremely asymmetric links.
+	CounterflowParameterName = "counterflow"
+
+	// TargetRateParameterName is the name of the parameter that clients can
+	// use to request the sender to pace binary messages at the specified rate
+	// (in bits per second) instead of saturating the link.
+	TargetRateParameterName = "target_rate"
+
+	// PacingInterval is the amount of time covered by a single binary message
+	// when a target rate is set. The message size is scaled accordingly.
+	PacingInterval = 10 * time.Millisecond
+
+	// MaxTargetRate is the maximum target rate (in bits per second) a client
+	// can request via the "target_rate" parameter.
+	MaxTargetRate = 1e12
+
+	// MinRequestedMeasureInterval is the lowest average measurement interval
+	// a client can request.
+	MinRequestedMeasureInterval = 100 * time.Millisecond
+
+	// MaxRequestedMeasureInterval is the highest average measurement interval
+	// a client can request.
+	MaxRequestedMeasureInterval = 5 * time.Second
+
+	// SecWebSocketProtocolNDT7 is the value of the Sec-WebSocket-Protocol
+	// header for the ndt7 protocol, which the server can serve on
+	// NDT7DownloadPath and NDT7UploadPath for compatibility with existing
+	// ndt7 clients. Measurement messages use the ndt7 format.
+	SecWebSocketProtocolNDT7 = "net.measurementlab.ndt.v7"
+
+	// NDT7DownloadPath and NDT7UploadPath select the ndt7 subtests.
+	NDT7DownloadPath = "/ndt/v7/download"
+	NDT7UploadPath   = "/ndt/v7/upload"
+
+	// NDT7Duration is the duration of ndt7 subtests, which clients cannot
+	// choose.
+	NDT7Duration = 10 * time.Second
+
+	// NDT7Datatype is the archival datatype of the results of ndt7
+	// subtests, kept apart from the throughput1 results.
+	NDT7Datatype = "ndt7shim"
 )
 
 // SubtestKind indicates the subtest kind
@@ -1,5 +1,120 @@
 package version
 
+import (
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+// modulePath is the path of the msak module, used to find its version when
+// msak is built as a dependency of another module.
+const modulePath = "github.com/m-lab/msak"
+
+// unspecified is the value of the fields that cannot be determined.
+const unspecified = "unspecified"
+
 // Version is the version of msak. This is meant to be overridden at compile
-// time using `-ldflags "-X var=value`
-var Version = "unspecified"
+// time using `-ldflags "-X var=value`. If it is not, the module version from
+// the binary's build information is used, when available.
+var Version = unspecified
+
+// GitCommit is the full hash of the Git commit msak was built from. Like
+// Version, it can be set at compile time. If it is not, the VCS revision
+// stamped by the Go toolchain is used.
+var GitCommit = ""
+
+// BuildDate is the time msak was built, in RFC 3339 format. Like Version, it
+// can be set at compile time. If it is not, the time of the VCS commit is
+// used.
+var BuildDate = ""
+
+// Info describes the running build of msak.
+type Info struct {
+	// Version is the symbolic version, e.g. a Git tag or a module version.
+	Version string
+	// GitCommit is the full hash of the Git commit. GitShortCommit is its
+	// first seven characters.
+	GitCommit      string `json:",omitempty"`
+	GitShortCommit string `json:",omitempty"`
+	// Modified is true if the working tree had uncommitted changes.
+	Modified bool `json:",omitempty"`
+	// BuildDate is the build time, or the commit time if it is not known.
+	BuildDate string `json:",omitempty"`
+	// GoVersion is the version of the Go toolchain used for the build.
+	GoVersion string
+}
+
+var (
+	info     Info
+	infoOnce sync.Once
+)
+
+// Get returns the Info of the running binary. It is computed once, from the
+// variables set at compile time and from debug.ReadBuildInfo.
+func Get() Info {
+	infoOnce.Do(func() {
+		bi, _ := debug.ReadBuildInfo()
+		info = newInfo(bi)
+	})
+	return info
+}
+
+// newInfo returns the Info described by the package variables, completed
+// with bi if not nil.
+func newInfo(bi *debug.BuildInfo) Info {
+	i := Info{
+		Version:   Version,
+		GitCommit: GitCommit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+	}
+	if bi != nil {
+		if i.Version == unspecified {
+			i.Version = moduleVersion(bi)
+		}
+		// The VCS settings describe the main module, which is only msak when
+		// it is not imported as a library.
+		if bi.Main.Path == modulePath {
+			for _, s := range bi.Settings {
+				switch s.Key {
+				case "vcs.revision":
+					if i.GitCommit == "" {
+						i.GitCommit = s.Value
+					}
+				case "vcs.time":
+					if i.BuildDate == "" {
+						i.BuildDate = s.Value
+					}
+				case "vcs.modified":
+					i.Modified = s.Value == "true"
+				}
+			}
+		}
+		if bi.GoVersion != "" {
+			i.GoVersion = bi.GoVersion
+		}
+	}
+	i.GitShortCommit = i.GitCommit
+	if len(i.GitShortCommit) > 7 {
+		i.GitShortCommit = i.GitShortCommit[:7]
+	}
+	return i
+}
+
+// moduleVersion returns the version of the msak module in bi, whether it is
+// the main module or a dependency.
+func moduleVersion(bi *debug.BuildInfo) string {
+	if bi.Main.Path == modulePath && bi.Main.Version != "" &&
+		bi.Main.Version != "(devel)" {
+		return bi.Main.Version
+	}
+	for _, dep := range bi.Deps {
+		if dep.Path == modulePath {
+			if dep.Replace != nil && dep.Replace.Version != "" {
+				return dep.Replace.Version
+			}
+			return dep.Version
+		}
+	}
+	return unspecified
+}
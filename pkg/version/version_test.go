@@ -0,0 +1,92 @@
+package version
+
+import (
+	"runtime/debug"
+	"testing"
+)
+
+func Test_newInfo(t *testing.T) {
+	bi := &debug.BuildInfo{
+		GoVersion: "go1.20.4",
+		Main:      debug.Module{Path: modulePath, Version: "v0.4.0"},
+		Settings: []debug.BuildSetting{
+			{Key: "vcs.revision", Value: "c8a8cea0eecaa29b4db1da2e6d87ed341a8f05b2"},
+			{Key: "vcs.time", Value: "2023-06-01T12:00:00Z"},
+			{Key: "vcs.modified", Value: "true"},
+		},
+	}
+	want := Info{
+		Version:        "v0.4.0",
+		GitCommit:      "c8a8cea0eecaa29b4db1da2e6d87ed341a8f05b2",
+		GitShortCommit: "c8a8cea",
+		Modified:       true,
+		BuildDate:      "2023-06-01T12:00:00Z",
+		GoVersion:      "go1.20.4",
+	}
+	if got := newInfo(bi); got != want {
+		t.Errorf("newInfo() = %+v, want %+v", got, want)
+	}
+
+	// When msak is a dependency, the VCS settings describe another module.
+	dep := &debug.BuildInfo{
+		GoVersion: "go1.20.4",
+		Main:      debug.Module{Path: "example.com/app", Version: "v1.0.0"},
+		Deps:      []*debug.Module{{Path: modulePath, Version: "v0.3.1"}},
+		Settings:  bi.Settings,
+	}
+	want = Info{
+		Version:   "v0.3.1",
+		GoVersion: "go1.20.4",
+	}
+	if got := newInfo(dep); got != want {
+		t.Errorf("newInfo() = %+v, want %+v", got, want)
+	}
+
+	// Variables set at compile time take precedence.
+	oldVersion, oldCommit, oldDate := Version, GitCommit, BuildDate
+	defer func() { Version, GitCommit, BuildDate = oldVersion, oldCommit, oldDate }()
+	Version, GitCommit, BuildDate = "v0.5.0", "0123456789", "2023-07-01T00:00:00Z"
+	got := newInfo(bi)
+	if got.Version != Version || got.GitCommit != GitCommit ||
+		got.GitShortCommit != "0123456" || got.BuildDate != BuildDate {
+		t.Errorf("newInfo() = %+v, want compile time values", got)
+	}
+}
+
+func Test_moduleVersion(t *testing.T) {
+	tests := []struct {
+		name string
+		bi   *debug.BuildInfo
+		want string
+	}{
+		{
+			name: "main-devel",
+			bi:   &debug.BuildInfo{Main: debug.Module{Path: modulePath, Version: "(devel)"}},
+			want: unspecified,
+		},
+		{
+			name: "dependency",
+			bi: &debug.BuildInfo{
+				Main: debug.Module{Path: "example.com/app", Version: "v1.0.0"},
+				Deps: []*debug.Module{{Path: modulePath, Version: "v0.3.1"}},
+			},
+			want: "v0.3.1",
+		},
+		{
+			name: "replaced-dependency",
+			bi: &debug.BuildInfo{
+				Main: debug.Module{Path: "example.com/app"},
+				Deps: []*debug.Module{{Path: modulePath, Version: "v0.3.1",
+					Replace: &debug.Module{Path: "example.com/fork", Version: "v0.3.2"}}},
+			},
+			want: "v0.3.2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := moduleVersion(tt.bi); got != tt.want {
+				t.Errorf("moduleVersion() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}